@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// predefinedACLs lists the predefined object ACLs of the JSON API that objects can be
+// uploaded with, in the spelling GCS expects.
+var predefinedACLs = []string{"authenticatedRead", "bucketOwnerFullControl", "bucketOwnerRead", "private", "projectPrivate", "publicRead"}
+
+// parsePredefinedACL normalizes a predefined ACL name, in any case and with or without
+// dashes (bucket-owner-full-control), and checks that it exists.
+func parsePredefinedACL(acl string) (string, error) {
+	name := strings.ReplaceAll(strings.TrimSpace(acl), "-", "")
+	for _, a := range predefinedACLs {
+		if strings.EqualFold(name, a) {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("unknown predefined ACL %q (expected one of %s)", acl, strings.Join(predefinedACLs, ", "))
+}
+
+// aclFor returns the predefined ACL a file is uploaded with, given its path relative to
+// the source folder: the first matching --acl-rule, or else --predefined-acl. Empty leaves
+// the object with the bucket's default object ACL.
+func aclFor(rel string) string {
+	if acl, ok := cfg.ACLRules.lookup(rel); ok {
+		return acl
+	}
+	return cfg.PredefinedACL
+}
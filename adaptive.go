@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// With --adaptive-concurrency, the number of upload workers allowed to run at once is tuned
+// additive-increase/multiplicative-decrease style: it grows by one while files are waiting
+// and uploads go through, is halved as soon as transient errors (429, 5xx, network) show up,
+// and steps back if growing made the throughput drop. --concurrency is the upper limit.
+
+// Activity of the uploads since the last adjustment, counted by the upload paths.
+var (
+	uploadedBytes   atomic.Int64 // Bytes of the files uploaded
+	transientErrors atomic.Int64 // Attempts that failed with an error that is retried
+)
+
+// adaptConcurrency lowers the limit of the upload pool p to a start value and then adjusts it
+// in the background every interval, from the throughput and errors seen during the interval.
+func adaptConcurrency(p *workerPool, interval time.Duration) {
+	limit := min(2, cfg.Concurrency)
+	p.setLimit(limit)
+	go adjustConcurrency(p, interval, limit)
+}
+
+func adjustConcurrency(p *workerPool, interval time.Duration, limit int) {
+	var lastRate float64 // Bytes per second during the previous interval
+	grew := false
+	for range time.Tick(interval) {
+		bytes := uploadedBytes.Swap(0)
+		errs := transientErrors.Swap(0)
+		rate := float64(bytes) / interval.Seconds()
+
+		next := limit
+		reason := ""
+		switch {
+		case limit > cfg.Concurrency:
+			next, reason = cfg.Concurrency, "concurrency lowered"
+		case errs > 0 && limit > 1:
+			next, reason = max(1, limit/2), "transient errors"
+		case grew && bytes > 0 && rate < lastRate*0.9:
+			next, reason = limit-1, "throughput dropped"
+		case errs == 0 && p.depth() > 0 && limit < cfg.Concurrency:
+			next, reason = limit+1, "files waiting"
+		}
+		if next != limit {
+			slog.Info("Adjusted upload concurrency", "workers", next, "previous", limit, "reason", reason,
+				"throughput", formatByteSize(int64(rate))+"/s", "transient_errors", errs)
+			p.setLimit(next)
+		}
+		grew = next > limit
+		limit, lastRate = next, rate
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/user"
+	"sync"
+)
+
+// Spotlight attribute with the application that created a document, where macOS records it.
+const xattrCreator = "com.apple.metadata:kMDItemCreator"
+
+// Object metadata keys attribution (--capture-attribution) is stored under.
+const (
+	metaUploadedBy   = "uploaded-by"    // User running the uploader
+	metaUploadedFrom = "uploaded-from"  // Host name of the machine
+	metaFileOwner    = "file-owner"     // Owner of the local file
+	metaCreatedByApp = "created-by-app" // Application that created the file, if macOS recorded it
+)
+
+// uploaderUser is the name of the user running the uploader, looked up once.
+var uploaderUser = sync.OnceValue(func() string {
+	u, err := user.Current()
+	if err != nil {
+		slog.Error("Error looking up the current user for attribution", "error", err)
+		return ""
+	}
+	return u.Username
+})
+
+// userNames caches user names by user ID for file-owner.
+var userNames sync.Map
+
+// userName returns the name of the user with the given ID, or the ID if it has none.
+func userName(uid string) string {
+	if name, ok := userNames.Load(uid); ok {
+		return name.(string)
+	}
+	name := uid
+	if u, err := user.LookupId(uid); err == nil {
+		name = u.Username
+	}
+	userNames.Store(uid, name)
+	return name
+}
+
+// fileAttribution returns object metadata attributing the upload of filePath: who ran the
+// uploader on which machine, who owns the file and, on macOS, which application created
+// it. File system events don't name the process behind a change, so the creator is only
+// known where the application recorded it in the file's Spotlight attributes.
+func fileAttribution(filePath string) map[string]string {
+	meta := make(map[string]string)
+	if name := uploaderUser(); name != "" {
+		meta[metaUploadedBy] = name
+	}
+	if hostName != "" {
+		meta[metaUploadedFrom] = hostName
+	}
+	if info, err := os.Stat(filePath); err == nil {
+		if uid, ok := fileOwner(info); ok {
+			meta[metaFileOwner] = userName(uid)
+		}
+	}
+	if app, err := fileCreator(filePath); err != nil {
+		slog.Error("Error reading creator attribute", "file", filePath, "attribute", xattrCreator, "error", err)
+	} else if app != "" {
+		meta[metaCreatedByApp] = app
+	}
+	return meta
+}
+
+// fileCreator returns the application that created filePath, or "" if macOS recorded none.
+func fileCreator(filePath string) (string, error) {
+	data, err := readXattr(filePath, xattrCreator)
+	if err != nil || data == nil {
+		return "", err
+	}
+	if names, err := decodePlistStrings(data); err == nil && len(names) > 0 {
+		return names[0], nil
+	}
+	return "", nil
+}
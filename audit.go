@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Audit events recorded in the state directory.
+const (
+	auditUploaded  = "uploaded"  // File uploaded, local copy handled per --on-success
+	auditExisted   = "existed"   // Object already existed, local copy handled per --on-success
+	auditCopied    = "copied"    // Content existed under another name and was copied server-side (--dedupe=copy)
+	auditDuplicate = "duplicate" // Content existed under another name, nothing uploaded (--dedupe=skip)
+
+	// A different object existed under the file's name (--on-conflict)
+	auditOverwritten = "overwritten" // File uploaded over it, local copy handled per --on-success
+	auditQuarantined = "quarantined" // Nothing uploaded, the file was moved to --quarantine-dir
+	auditSkipped     = "skipped"     // Nothing uploaded, the file was left in place
+
+	auditGaveUp  = "gave-up" // Failed --quarantine-after times in a row, moved to --quarantine-dir
+	auditBundled = "bundled" // Uploaded in the tar archive Object (--bundle-below), local copy handled per --on-success
+)
+
+// auditRecord is one line of the audit history.
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	File     string    `json:"file"`
+	Bucket   string    `json:"bucket"`
+	Object   string    `json:"object"`
+	Pipeline string    `json:"pipeline"`
+	Size     int64     `json:"size"`
+	Local    string    `json:"local,omitempty"` // --on-success action applied to the local file
+
+	// The object under the file's name, where known, for --verify-only
+	Generation int64             `json:"generation,omitempty"`
+	CRC32C     string            `json:"crc32c,omitempty"`  // Hex, as logged
+	Digests    map[string]string `json:"digests,omitempty"` // --digest digests in the object's metadata, by algorithm
+}
+
+// withObject returns rec with the generation and checksum of object, which may be nil.
+func (rec auditRecord) withObject(object *storage.ObjectAttrs) auditRecord {
+	if object != nil {
+		rec.Generation = object.Generation
+		rec.CRC32C = fmt.Sprintf("%08x", object.CRC32C)
+		rec.Digests = objectDigests(object)
+	}
+	return rec
+}
+
+// recordAudit appends rec to the audit history. Failures are logged but never abort an upload.
+func recordAudit(rec auditRecord) {
+	countTelemetryEvent(rec.Event)
+	if appState == nil {
+		return
+	}
+	rec.Time = time.Now().UTC()
+	if err := appState.appendJSONLine(stateAuditFile, rec); err != nil {
+		slog.Error("Error recording audit entry", "file", rec.File, "error", err)
+	}
+}
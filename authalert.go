@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// authAlertAfter is how many storage clients in a row must fail to authenticate before
+// authentication counts as broken. A single failure is usually an expired access token,
+// which rebuilding the client fixes; a rebuilt client failing as well means the underlying
+// credentials no longer work.
+const authAlertAfter = 2
+
+// authAlertEvents are the "event" values of the alert webhook payload.
+const (
+	authAlertBroken   = "auth_broken"
+	authAlertRestored = "auth_restored"
+)
+
+// authAlert is the JSON payload POSTed to --alert-webhook.
+type authAlert struct {
+	Event       string    `json:"event"`
+	Host        string    `json:"host"`
+	Credentials string    `json:"credentials"`
+	Strategy    string    `json:"strategy"`
+	Code        string    `json:"code,omitempty"` // errCodeAuth while broken
+	Error       string    `json:"error,omitempty"`
+	Hint        string    `json:"hint,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// authRemediation returns what the user can do about cause, given the credentials in use.
+func authRemediation(creds resolvedCredentials, cause error) string {
+	var retrieveErr *oauth2.RetrieveError
+	revoked := errors.As(cause, &retrieveErr) && (retrieveErr.ErrorCode == "invalid_grant" || retrieveErr.ErrorCode == "invalid_rapt")
+	switch creds.Strategy {
+	case authKeychainKey:
+		return fmt.Sprintf("The service account key stored in %s (account '%s') was rejected; it may have been deleted, disabled or its account removed. Create a new key and store it with --set-sa-key-path.", keystore.Name(), creds.KeychainAccount)
+	case authUser:
+		return fmt.Sprintf("The user credentials stored with login (profile '%s') were rejected; the refresh token may have been revoked, or expired after a password change or because the OAuth client's consent screen is in testing mode. Run 'gcs-folder-uploader login' again, and check that the user still has access to the bucket.", creds.KeychainAccount)
+	case authExternal:
+		return fmt.Sprintf("Exchanging the token of the workload identity federation config '%s' failed. Check that its credential_source still provides a valid subject token (OIDC, SAML, AWS or Azure), that the pool provider's attribute condition accepts it, and that the federated principal still has access to the bucket or to the service account it impersonates.", creds.ExternalAccount)
+	case authImpersonation:
+		if revoked {
+			return fmt.Sprintf("The credentials used to impersonate %s have expired or were revoked. Run 'gcloud auth application-default login' again (or sign in again to your workforce identity pool).", creds.ImpersonateSA)
+		}
+		return fmt.Sprintf("Impersonating %s failed. Check that the service account still exists and that the account running the uploader still has roles/iam.serviceAccountTokenCreator on it.", creds.ImpersonateSA)
+	default:
+		if revoked {
+			return "Application Default Credentials have expired or were revoked. Run 'gcloud auth application-default login' again, or sign in again to your workforce identity pool ('gcloud auth login --login-config=...')."
+		}
+		return "Application Default Credentials were rejected. Check GOOGLE_APPLICATION_CREDENTIALS and 'gcloud auth application-default print-access-token', or store a service account key with --set-sa-key-path."
+	}
+}
+
+// alertAuthBroken reports that authentication with a credential profile stopped working: in
+// the log, as a notification and to --alert-webhook, so the cause isn't buried in the upload
+// errors that follow.
+func alertAuthBroken(profile string, cause error) {
+	creds, err := credentialsFor(profile)
+	if err != nil {
+		// The profile can't even be resolved, e.g. its keystore item is gone
+		creds.Strategy = authKeychainKey
+		creds.KeychainAccount = cfg.Credentials[profile].KeychainAccount
+	}
+	hint := authRemediation(creds, cause)
+	slog.Error("Authentication to Google Cloud is broken", "credentials", profileName(profile), "strategy", creds.Strategy, "error_code", errCodeAuth, "error", cause, "hint", hint)
+	notifyCode(notifyAlert, errCodeAuth, msgAuthBroken, "credentials", profileName(profile))
+	postAuthAlert(authAlert{Event: authAlertBroken, Credentials: profileName(profile), Strategy: creds.Strategy, Code: errCodeAuth, Error: cause.Error(), Hint: hint})
+}
+
+// alertAuthRestored reports that authentication works again after alertAuthBroken.
+func alertAuthRestored(profile string) {
+	slog.Info("Authentication to Google Cloud works again", "credentials", profileName(profile))
+	notify(notifyAlert, msgAuthRestored, "credentials", profileName(profile))
+	creds, _ := credentialsFor(profile)
+	postAuthAlert(authAlert{Event: authAlertRestored, Credentials: profileName(profile), Strategy: creds.Strategy})
+}
+
+// postAuthAlert POSTs alert to --alert-webhook, if set, in the background.
+func postAuthAlert(alert authAlert) {
+	if cfg.AlertWebhook == "" {
+		return
+	}
+	alert.Host, _ = os.Hostname()
+	alert.Time = time.Now().UTC()
+	body, err := json.Marshal(alert)
+	if err != nil {
+		slog.Error("Error encoding alert", "event", alert.Event, "error", err)
+		return
+	}
+	go func() {
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Post(cfg.AlertWebhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			slog.Error("Error sending alert to the webhook", "event", alert.Event, "error", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			slog.Error("Error sending alert to the webhook", "event", alert.Event, "status", resp.Status)
+		}
+	}()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// backlogSummary counts the files found in the source folders at startup.
+type backlogSummary struct {
+	Files int
+	Bytes int64
+}
+
+func (b *backlogSummary) add(size int64) {
+	b.Files++
+	b.Bytes += size
+}
+
+// estimate returns how long uploading the backlog takes at --backlog-throughput.
+func (b backlogSummary) estimate() time.Duration {
+	return time.Duration(float64(b.Bytes) / float64(cfg.BacklogThroughput) * float64(time.Second))
+}
+
+// confirmBacklog logs a summary of the startup backlog and, when it reaches --confirm-backlog
+// files, asks for confirmation before anything is uploaded, as a guard against pointing the
+// uploader at the wrong folder. Without a terminal to ask on, it exits unless yes (--yes)
+// is set.
+func confirmBacklog(backlog backlogSummary, yes bool) {
+	if backlog.Files == 0 {
+		return
+	}
+	slog.Info("Startup backlog", "files", backlog.Files, "bytes", backlog.Bytes, "size", formatByteSize(backlog.Bytes),
+		"estimated_duration", backlog.estimate().Round(time.Second), "on_success", cfg.OnSuccess)
+	if cfg.Observe || cfg.ConfirmBacklog == 0 || backlog.Files < cfg.ConfirmBacklog || yes {
+		return
+	}
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		fatalUnconfirmed(backlog)
+	}
+	var folders []string
+	for _, src := range sources {
+		folders = append(folders, src.Path)
+	}
+	fmt.Printf("About to upload %d files (%s, about %s) from %s and %s. Continue? [y/N] ",
+		backlog.Files, formatByteSize(backlog.Bytes), backlog.estimate().Round(time.Second), strings.Join(folders, ", "), onSuccessAction())
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Println()
+		fatalUnconfirmed(backlog) // E.g. /dev/null, which looks like a terminal
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		slog.Info("Startup backlog confirmed")
+	default:
+		fatal("Startup backlog not confirmed, exiting")
+	}
+}
+
+// fatalUnconfirmed exits because the backlog needs a confirmation that can't be asked for.
+func fatalUnconfirmed(backlog backlogSummary) {
+	fatal("The startup backlog needs confirmation; check the source folders and start again with --yes",
+		"files", backlog.Files, "confirm_backlog", cfg.ConfirmBacklog)
+}
+
+// onSuccessAction describes what --on-success does with the uploaded files.
+func onSuccessAction() string {
+	switch cfg.OnSuccess {
+	case onSuccessMove:
+		return "move the uploaded files to " + cfg.ArchiveDir
+	case onSuccessKeep:
+		return "keep the uploaded files in place"
+	default:
+		return "DELETE the uploaded files"
+	}
+}
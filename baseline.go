@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// sourceBaseline lists the files a source folder held when the uploader first ran on it
+// with --new-files-only. They are never uploaded, even once they change.
+type sourceBaseline struct {
+	Recorded time.Time `json:"recorded"`
+	Files    []string  `json:"files"`
+}
+
+// fileBaseline is the in-memory copy of the baseline file, keyed by source folder. It is
+// only changed at startup, before any file is looked at.
+type fileBaseline struct {
+	dir     *stateDir
+	sources map[string]sourceBaseline
+	files   map[string]bool // The files of every baseline
+}
+
+// baseline is the file baseline of the state directory, loaded at startup.
+var baseline *fileBaseline
+
+// loadBaseline reads the baseline file of dir.
+func loadBaseline(dir *stateDir) (*fileBaseline, error) {
+	b := &fileBaseline{dir: dir, sources: make(map[string]sourceBaseline), files: make(map[string]bool)}
+	if err := dir.readJSON(stateBaselineFile, &b.sources); err != nil {
+		return nil, err
+	}
+	for _, sb := range b.sources {
+		for _, filePath := range sb.Files {
+			b.files[filePath] = true
+		}
+	}
+	return b, nil
+}
+
+// record takes the baseline of the sources that have none yet: every file in the folder,
+// at any depth and whatever the filters say, so the historical content stays untouched
+// when they change. Observe mode keeps it in memory only.
+func (b *fileBaseline) record(sources []*watchSource) error {
+	added := false
+	for _, src := range sources {
+		if sb, ok := b.sources[src.Path]; ok {
+			slog.Info("Only uploading files that are not in the baseline of the source folder", "path", src.Path,
+				"baseline_files", len(sb.Files), "recorded", sb.Recorded.Format(time.RFC3339))
+			continue
+		}
+		sb := sourceBaseline{Recorded: time.Now().UTC(), Files: []string{}}
+		err := filepath.WalkDir(src.Path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				slog.Error("Error accessing path while taking the baseline", "path", p, "error", err)
+				return nil
+			}
+			if !d.IsDir() {
+				sb.Files = append(sb.Files, p)
+				b.files[p] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Strings(sb.Files)
+		b.sources[src.Path] = sb
+		added = true
+		slog.Info("Recorded the files present in the source folder, only new files are uploaded", "path", src.Path, "baseline_files", len(sb.Files))
+	}
+	if !added || cfg.Observe {
+		return nil
+	}
+	return b.dir.writeJSON(stateBaselineFile, b.sources)
+}
+
+// contains reports whether filePath was present when its source's baseline was taken.
+func (b *fileBaseline) contains(filePath string) bool {
+	return b.files[filePath]
+}
@@ -0,0 +1,77 @@
+//go:build darwin && cgo
+
+package main
+
+/*
+#cgo LDFLAGS: -framework CoreFoundation
+#include <CoreFoundation/CoreFoundation.h>
+#include <stdlib.h>
+#include <string.h>
+
+static CFDataRef bookmarkCreate(const char *path) {
+	CFURLRef url = CFURLCreateFromFileSystemRepresentation(NULL, (const UInt8 *)path, strlen(path), true);
+	if (url == NULL) {
+		return NULL;
+	}
+	CFDataRef data = CFURLCreateBookmarkData(NULL, url, kCFURLBookmarkCreationWithSecurityScope, NULL, NULL, NULL);
+	CFRelease(url);
+	return data;
+}
+
+static CFURLRef bookmarkResolve(const UInt8 *bytes, CFIndex length, Boolean *stale) {
+	CFDataRef data = CFDataCreate(NULL, bytes, length);
+	if (data == NULL) {
+		return NULL;
+	}
+	CFURLRef url = CFURLCreateByResolvingBookmarkData(NULL, data, kCFURLBookmarkResolutionWithSecurityScope, NULL, NULL, stale, NULL);
+	CFRelease(data);
+	return url;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// createBookmark returns a security-scoped bookmark of path, which the process must be
+// able to access right now.
+func createBookmark(path string) ([]byte, error) {
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	data := C.bookmarkCreate(cpath)
+	if data == 0 {
+		return nil, errors.New("could not create a security-scoped bookmark")
+	}
+	defer C.CFRelease(C.CFTypeRef(data))
+	return C.GoBytes(unsafe.Pointer(C.CFDataGetBytePtr(data)), C.int(C.CFDataGetLength(data))), nil
+}
+
+// resolveBookmark resolves a security-scoped bookmark and starts accessing the folder it
+// points to. It returns the folder's current path, whether the bookmark should be created
+// again (stale) and a function that ends the access.
+func resolveBookmark(bookmark []byte) (path string, stale bool, release func(), err error) {
+	if len(bookmark) == 0 {
+		return "", false, nil, errors.New("empty bookmark")
+	}
+	var cstale C.Boolean
+	url := C.bookmarkResolve((*C.UInt8)(unsafe.Pointer(&bookmark[0])), C.CFIndex(len(bookmark)), &cstale)
+	if url == 0 {
+		return "", false, nil, errors.New("could not resolve the bookmark")
+	}
+	if C.CFURLStartAccessingSecurityScopedResource(url) == 0 {
+		C.CFRelease(C.CFTypeRef(url))
+		return "", false, nil, errors.New("access to the bookmarked folder was denied")
+	}
+	release = func() {
+		C.CFURLStopAccessingSecurityScopedResource(url)
+		C.CFRelease(C.CFTypeRef(url))
+	}
+	buf := make([]byte, 1024) // PATH_MAX on macOS
+	if C.CFURLGetFileSystemRepresentation(url, C.Boolean(1), (*C.UInt8)(unsafe.Pointer(&buf[0])), C.CFIndex(len(buf))) == 0 {
+		release()
+		return "", false, nil, errors.New("could not get the path of the bookmarked folder")
+	}
+	return C.GoString((*C.char)(unsafe.Pointer(&buf[0]))), cstale != 0, release, nil
+}
@@ -0,0 +1,17 @@
+//go:build !darwin || !cgo
+
+package main
+
+import "errors"
+
+var errBookmarksUnsupported = errors.New("security-scoped bookmarks are only supported on macOS")
+
+// createBookmark returns a security-scoped bookmark of path. Only macOS has them.
+func createBookmark(path string) ([]byte, error) {
+	return nil, errBookmarksUnsupported
+}
+
+// resolveBookmark resolves a security-scoped bookmark. Only macOS has them.
+func resolveBookmark(bookmark []byte) (path string, stale bool, release func(), err error) {
+	return "", false, nil, errBookmarksUnsupported
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"runtime"
+)
+
+// isSandboxed reports whether the process runs inside the macOS App Sandbox, where folders
+// outside the app's container can only be read through an access the user granted.
+func isSandboxed() bool {
+	return runtime.GOOS == "darwin" && os.Getenv("APP_SANDBOX_CONTAINER_ID") != ""
+}
+
+// accessSourceBookmarks opens the source folders through the security-scoped bookmarks kept
+// in the state directory, so access granted once (by picking the folder in the app) survives
+// restarts without Full Disk Access. A source without a bookmark, or with a stale one, gets a
+// new bookmark while it is accessible. The returned function ends the access.
+func accessSourceBookmarks(dir *stateDir, sources []*watchSource) func() {
+	bookmarks := make(map[string][]byte)
+	if err := dir.readJSON(stateBookmarksFile, &bookmarks); err != nil {
+		slog.Error("Error reading source folder bookmarks", "error", err)
+	}
+	var releases []func()
+	changed := false
+	for _, src := range sources {
+		if bookmark, ok := bookmarks[src.Path]; ok {
+			path, stale, release, err := resolveBookmark(bookmark)
+			if err != nil {
+				slog.Error("Error resolving the bookmark of a source", "path", src.Path, "error", err)
+			} else {
+				releases = append(releases, release)
+				if path != src.Path {
+					slog.Warn("The bookmark of a source points elsewhere now; update the source to follow it", "path", src.Path, "bookmark_path", path)
+				}
+				if !stale {
+					continue
+				}
+			}
+		}
+		bookmark, err := createBookmark(src.Path)
+		if err != nil {
+			slog.Error("Error creating a bookmark for a source (grant the app access to the folder first)", "path", src.Path, "error", err)
+			continue
+		}
+		bookmarks[src.Path] = bookmark
+		changed = true
+		slog.Debug("Saved a security-scoped bookmark of a source", "path", src.Path)
+	}
+	if changed && !dir.readOnly {
+		if err := dir.writeJSON(stateBookmarksFile, bookmarks); err != nil {
+			slog.Error("Error saving source folder bookmarks", "error", err)
+		}
+	}
+	return func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+}
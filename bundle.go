@@ -0,0 +1,324 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Names inside a bundle and of its objects (--bundle-below).
+const (
+	bundleFolder       = "bundles"       // Below the source's destination prefix
+	bundleFilesDir     = "files"         // Folder of the files in the archive, by their path relative to the source
+	bundleManifestName = "manifest.json" // The manifest in the archive
+	bundleManifestExt  = ".manifest.json"
+)
+
+// fileBundle collects small files of one source until they are uploaded together as one
+// tar archive.
+type fileBundle struct {
+	id    string
+	src   *watchSource
+	files []bundledFile
+	paths map[string]bool
+	size  int64
+	timer *time.Timer // Closes the bundle after --bundle-interval
+}
+
+// bundledFile is a file of a bundle, with the object it would have been uploaded to alone.
+type bundledFile struct {
+	path   string
+	target uploadTarget
+	info   os.FileInfo // As written to the archive
+}
+
+// bundleManifest lists the files of a bundle. It is the last entry of the archive and,
+// with --bundle-manifest, an object of its own next to it.
+type bundleManifest struct {
+	Bundle  string                `json:"bundle"`
+	Created time.Time             `json:"created"`
+	Host    string                `json:"host"`
+	Source  string                `json:"source"`
+	Files   []bundleManifestEntry `json:"files"`
+}
+
+// bundleManifestEntry is one file of a bundleManifest.
+type bundleManifestEntry struct {
+	Path    string    `json:"path"`   // In the archive
+	Object  string    `json:"object"` // The object the file would have been uploaded to alone
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	CRC32C  string    `json:"crc32c"` // Hex, as logged
+}
+
+// bundles holds the open bundle of each source.
+var bundles = struct {
+	mu   sync.Mutex
+	open map[*watchSource]*fileBundle
+}{open: make(map[*watchSource]*fileBundle)}
+
+// bundleFile adds filePath from src to the open bundle of src instead of uploading it, if
+// it is smaller than --bundle-below, and reports whether it did. A bundle is queued for
+// upload once its files add up to --bundle-size, or --bundle-interval after its first file.
+func bundleFile(src *watchSource, filePath string, target uploadTarget) bool {
+	if cfg.BundleBelow == 0 {
+		return false
+	}
+	info, err := os.Stat(filePath)
+	if err != nil || info.Size() >= int64(cfg.BundleBelow) {
+		return false
+	}
+	bundles.mu.Lock()
+	defer bundles.mu.Unlock()
+	b := bundles.open[src]
+	if b == nil {
+		b = &fileBundle{id: uuid.NewString(), src: src, paths: make(map[string]bool)}
+		b.timer = time.AfterFunc(cfg.BundleInterval, func() { closeBundle(b) })
+		bundles.open[src] = b
+	}
+	if b.paths[filePath] {
+		return true // Changed again while waiting; the archive gets its latest content
+	}
+	b.paths[filePath] = true
+	b.files = append(b.files, bundledFile{path: filePath, target: target})
+	b.size += info.Size()
+	slog.Debug("Added file to bundle", "file", filePath, "bundle", b.id, "files", len(b.files), "bytes", b.size)
+	if b.size >= int64(cfg.BundleSize) {
+		b.timer.Stop()
+		delete(bundles.open, src)
+		uploads.submitBundle(b)
+	}
+	return true
+}
+
+// closeBundle queues b for upload, unless it was queued already.
+func closeBundle(b *fileBundle) {
+	bundles.mu.Lock()
+	defer bundles.mu.Unlock()
+	if bundles.open[b.src] != b {
+		return
+	}
+	delete(bundles.open, b.src)
+	uploads.submitBundle(b)
+}
+
+// flushBundles queues every open bundle for upload, as the last step of --once or of a stop.
+func flushBundles() {
+	bundles.mu.Lock()
+	defer bundles.mu.Unlock()
+	for src, b := range bundles.open {
+		b.timer.Stop()
+		delete(bundles.open, src)
+		uploads.submitBundle(b)
+	}
+}
+
+// processBundle writes the files of b into a tar archive, uploads it, and its manifest with
+// --bundle-manifest, and applies --on-success to the files once the archive has been
+// verified. If anything fails, the files stay in place and are bundled again by a later run.
+func processBundle(b *fileBundle) {
+	target := bundleTarget(b)
+	logger := slog.With("bundle", b.id, "bucket", target.Bucket, "object", target.Object)
+	archive, manifest, err := writeBundle(b, target.Object)
+	for _, f := range []*os.File{archive, manifest} {
+		if f != nil {
+			defer os.Remove(f.Name())
+			defer f.Close()
+		}
+	}
+	if err != nil {
+		reportFailure(logger, target.Object, "Error writing bundle, leaving its files in place", err, "files", len(b.files))
+		return
+	}
+	if len(b.files) == 0 {
+		return // Every file was gone
+	}
+	var size int64
+	for _, bf := range b.files {
+		size += bf.info.Size()
+	}
+	logger = logger.With("files", len(b.files), "bytes", size)
+
+	start := time.Now()
+	if cfg.BundleManifest {
+		manifestTarget := target
+		manifestTarget.Object += bundleManifestExt
+		manifestTarget.ContentType = "application/json"
+		if err := uploadBundleObject(manifestTarget, manifest); err != nil {
+			reportFailure(logger, target.Object, "Error uploading bundle manifest, leaving its files in place", err)
+			return
+		}
+	}
+	if err := uploadBundleObject(target, archive); err != nil {
+		if reportFailure(logger, target.Object, "Error uploading bundle, leaving its files in place", err, durationMS(start)) {
+			notifyCode(notifyFailure, errorCode(err), msgBundleFailed, "count", len(b.files), "bucket", target.Bucket, "error", err)
+		}
+		return
+	}
+	health.uploaded()
+	uploadedBytes.Add(size)
+	logger.Info("Uploaded bundle", durationMS(start))
+	notify(notifySuccess, msgBundleUploaded, "count", len(b.files), "bucket", target.Bucket, "object", target.Object)
+
+	// Only now that the archive is safely in GCS are its files touched
+	for _, bf := range b.files {
+		done, err := finishLocalFile(b.src, bf.path, bf.info, bf.target)
+		if err != nil {
+			reportFailure(logger, bf.path, "Error handling bundled file after upload", err, "on_success", cfg.OnSuccess)
+			continue
+		}
+		recordAudit(auditRecord{Event: auditBundled, File: bf.path, Bucket: target.Bucket, Object: target.Object, Pipeline: target.Pipeline, Size: bf.info.Size(), Local: cfg.OnSuccess})
+		logger.Debug("Bundled file handled", "file", bf.path, "local", done)
+	}
+	logger.Info("Local files of bundle handled", "on_success", cfg.OnSuccess)
+}
+
+// bundleTarget returns the destination of the archive of b: a uniquely named object in the
+// bundles folder below the destination prefix of its source.
+func bundleTarget(b *fileBundle) uploadTarget {
+	name := fmt.Sprintf("%s-%s-%s.tar", time.Now().UTC().Format("20060102T150405Z"), hostName, b.id[:8])
+	contentType := "application/x-tar"
+	if cfg.BundleCompress {
+		name += ".gz"
+		contentType = gzipContentType
+	}
+	return uploadTarget{Pipeline: pipelineStable, Credentials: b.src.Credentials, Bucket: b.src.Bucket,
+		Object: path.Join(b.src.Prefix, bundleFolder, name), Time: time.Now(), TimeFrom: timeFromMtime,
+		ContentType: contentType, ListPrefix: listingPrefix(b.src.Prefix), PredefinedACL: cfg.PredefinedACL}
+}
+
+// writeBundle writes the files of b and their manifest into a temporary tar archive, gzipped
+// with --bundle-compress, and returns it together with the manifest, in temporary files the
+// caller removes. Files that are gone are left out of b; b.files ends up with the files
+// in the archive.
+func writeBundle(b *fileBundle, object string) (archive, manifestFile *os.File, err error) {
+	archive, err = os.CreateTemp("", "gcs-uploader-bundle-*.tar")
+	if err != nil {
+		return nil, nil, err
+	}
+	var w io.Writer = archive
+	var zw *gzip.Writer
+	if cfg.BundleCompress {
+		zw = gzip.NewWriter(archive)
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	manifest := bundleManifest{Bundle: object, Created: time.Now().UTC(), Host: hostName, Source: b.src.Path, Files: []bundleManifestEntry{}}
+	var written []bundledFile
+	for _, bf := range b.files {
+		entry, info, err := addToBundle(tw, b.src, bf.path)
+		if os.IsNotExist(err) {
+			slog.Debug("Bundled file no longer exists, leaving it out", "file", bf.path)
+			continue
+		} else if err != nil {
+			return archive, nil, fmt.Errorf("adding '%s': %w", bf.path, err)
+		}
+		entry.Object = bf.target.Object
+		manifest.Files = append(manifest.Files, entry)
+		bf.info = info
+		written = append(written, bf)
+	}
+	b.files = written
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return archive, nil, err
+	}
+	hdr := &tar.Header{Name: bundleManifestName, Mode: 0o644, Size: int64(len(data)), ModTime: manifest.Created, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return archive, nil, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return archive, nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return archive, nil, err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return archive, nil, err
+		}
+	}
+	if !cfg.BundleManifest {
+		return archive, nil, nil
+	}
+	manifestFile, err = os.CreateTemp("", "gcs-uploader-bundle-*"+bundleManifestExt)
+	if err != nil {
+		return archive, nil, err
+	}
+	_, err = manifestFile.Write(data)
+	return archive, manifestFile, err
+}
+
+// addToBundle writes the file filePath from src into tw and returns its manifest entry and
+// the file info it was written with.
+func addToBundle(tw *tar.Writer, src *watchSource, filePath string) (bundleManifestEntry, os.FileInfo, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return bundleManifestEntry{}, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return bundleManifestEntry{}, nil, err
+	}
+	name := path.Join(bundleFilesDir, src.relativePath(filePath))
+	hdr := &tar.Header{Name: name, Mode: int64(info.Mode().Perm()), Size: info.Size(), ModTime: info.ModTime(), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return bundleManifestEntry{}, nil, err
+	}
+	crc := crc32.New(crc32cTable)
+	// Exactly the size in the header, even if the file grew since
+	if _, err := io.CopyN(io.MultiWriter(tw, crc), f, info.Size()); err != nil {
+		return bundleManifestEntry{}, nil, err
+	}
+	entry := bundleManifestEntry{Path: name, Size: info.Size(), ModTime: info.ModTime().UTC(), CRC32C: fmt.Sprintf("%08x", crc.Sum32())}
+	return entry, info, nil
+}
+
+// bundleEntry returns the content of the file rel, relative to its source, in the bundle
+// archive object read from r, for undo.
+func bundleEntry(r io.Reader, object, rel string) (io.Reader, error) {
+	if strings.HasSuffix(object, ".gz") {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	}
+	name := path.Join(bundleFilesDir, rel)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no file %s in the bundle", name)
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Name == name {
+			return tr, nil
+		}
+	}
+}
+
+// uploadBundleObject uploads the temporary file f, an archive or a manifest, to target.
+func uploadBundleObject(target uploadTarget, f *os.File) error {
+	return withRetries(fmt.Sprintf("uploading bundle %s", target.Object), func() error {
+		return withUploadTimeout(rootCtx, func(ctx context.Context) error {
+			_, _, err := uploadFile(ctx, f, target)
+			return err
+		})
+	})
+}
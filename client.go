@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+
+	"cloud.google.com/go/auth"
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// clientManager owns the storage clients shared by all uploads, one per credential profile.
+// A client is created on first use and only rebuilt (re-running the authentication strategy)
+// after it was invalidated because its credentials stopped working. The manager also tracks
+// whether authentication works at all, to alert once when it breaks instead of with every
+// failing upload.
+type clientManager struct {
+	mu       sync.Mutex
+	profiles map[string]*profileClient
+}
+
+// profileClient is the client of one credential profile and its authentication health.
+type profileClient struct {
+	client       *storage.Client
+	authFailures int  // Clients in a row that failed to authenticate
+	authBroken   bool // alertAuthBroken has been sent and authentication hasn't worked since
+}
+
+// clients is the process-wide storage client manager.
+var clients = &clientManager{profiles: make(map[string]*profileClient)}
+
+// profile returns the entry of the named credential profile. It must be called with m.mu held.
+func (m *clientManager) profile(name string) *profileClient {
+	pc, ok := m.profiles[name]
+	if !ok {
+		pc = &profileClient{}
+		m.profiles[name] = pc
+	}
+	return pc
+}
+
+// get returns the shared client of the credential profile, creating it if there is none yet.
+func (m *clientManager) get(profile string) (*storage.Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pc := m.profile(profile)
+	if pc.client != nil {
+		return pc.client, nil
+	}
+	client, err := newStorageClient(profile)
+	if err != nil {
+		if pc.authFailed() {
+			go alertAuthBroken(profile, err)
+		}
+		return nil, err
+	}
+	pc.client = client
+	return client, nil
+}
+
+// report records the result of a request made with client. An authentication error drops
+// client if it is still the shared one of its profile, so the next get re-authenticates;
+// uploads still using the old client finish with it, it is not closed to avoid cutting them
+// off. A success means authentication works.
+func (m *clientManager) report(client *storage.Client, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var profile string
+	var pc *profileClient
+	for name, p := range m.profiles {
+		if p.client == client {
+			profile, pc = name, p
+			break
+		}
+	}
+	if pc == nil {
+		return // Another upload already reported this client
+	}
+	if !isAuthError(err) {
+		if err == nil && pc.authFailures > 0 {
+			pc.authFailures = 0
+			if pc.authBroken {
+				pc.authBroken = false
+				go alertAuthRestored(profile)
+			}
+		}
+		return
+	}
+	slog.Warn("Discarding the Google Cloud Storage client after an authentication failure; the next upload re-authenticates", "credentials", profileName(profile), "error", err)
+	pc.client = nil
+	if cfg.CacheTokens {
+		forgetCachedToken(profile)
+	}
+	if pc.authFailed() {
+		go alertAuthBroken(profile, err)
+	}
+}
+
+// authFailed counts a client that failed to authenticate and reports whether authentication
+// has just become broken. It must be called with the manager's mu held.
+func (pc *profileClient) authFailed() bool {
+	pc.authFailures++
+	if pc.authFailures < authAlertAfter || pc.authBroken {
+		return false
+	}
+	pc.authBroken = true
+	return true
+}
+
+// brokenProfiles returns the credential profiles whose authentication is broken (see authFailed).
+func (m *clientManager) brokenProfiles() map[string]bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	broken := make(map[string]bool)
+	for name, pc := range m.profiles {
+		if pc.authBroken {
+			broken[name] = true
+		}
+	}
+	return broken
+}
+
+// close releases the shared clients at shutdown.
+func (m *clientManager) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, pc := range m.profiles {
+		if pc.client != nil {
+			pc.client.Close()
+			pc.client = nil
+		}
+	}
+}
+
+// newStorageClient builds a storage client using the authentication strategy of a credential
+// profile (see credentialsFor): a service account key or user credentials from the keystore,
+// workload identity federation, impersonation, or Application Default Credentials.
+func newStorageClient(profile string) (*storage.Client, error) {
+	// The client outlives any single upload, so its token sources get a background context
+	ctx := context.Background()
+
+	if host := emulatorHost(); host != "" {
+		// The client library connects to the emulator, without credentials, by itself
+		return storage.NewClient(ctx)
+	}
+
+	var clientOptions []option.ClientOption
+
+	// Checked for every client, since a key may have been stored while the uploader runs
+	if cfg.ForbidSAKeys {
+		if err := checkKeyless(profile); err != nil {
+			return nil, err
+		}
+	}
+
+	creds, err := credentialsFor(profile)
+	if err != nil {
+		return nil, err
+	}
+	logger := slog.With("credentials", profileName(profile))
+	switch creds.Strategy {
+	case authKeychainKey:
+		logger.Info("Authenticating with service account key from the keystore", "keystore", keystore.Name(), "keychain_account", creds.KeychainAccount)
+		clientOptions = append(clientOptions, option.WithCredentialsJSON(creds.Key))
+	case authUser:
+		logger.Info("Authenticating with user credentials from the keystore", "keystore", keystore.Name(), "profile", creds.KeychainAccount)
+		clientOptions = append(clientOptions, option.WithCredentialsJSON(creds.Key))
+	case authExternal:
+		logger.Info("Authenticating with workload identity federation", "config", creds.ExternalAccount)
+		data, err := os.ReadFile(creds.ExternalAccount)
+		if err != nil {
+			return nil, fmt.Errorf("reading external account config: %w", err)
+		}
+		federated, err := google.CredentialsFromJSON(ctx, data, storage.ScopeFullControl)
+		if err != nil {
+			return nil, fmt.Errorf("loading external account config '%s': %w", creds.ExternalAccount, err)
+		}
+		ts := federated.TokenSource
+		if cfg.CacheTokens {
+			ts = withTokenCache(ts, tokenCacheAccount(profile, creds))
+		}
+		clientOptions = append(clientOptions, option.WithTokenSource(ts))
+	case authImpersonation:
+		logger.Info("Authenticating by impersonating a service account", "service_account", creds.ImpersonateSA)
+		impersonationScopes := []string{
+			"https://www.googleapis.com/auth/devstorage.read_write",
+		}
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: creds.ImpersonateSA,
+			Scopes:          impersonationScopes,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if cfg.CacheTokens {
+			ts = withTokenCache(ts, tokenCacheAccount(profile, creds))
+		}
+		clientOptions = append(clientOptions, option.WithTokenSource(ts))
+	default:
+		if profile == "" {
+			logger.Warn("No service account key found in the keystore and no impersonation SA provided. Using Application Default Credentials (may not be sufficient for GCS access).", "keystore", keystore.Name())
+		} else {
+			logger.Info("Authenticating with Application Default Credentials")
+		}
+		if cfg.CacheTokens {
+			if ts := cacheableADCTokenSource(ctx); ts != nil {
+				clientOptions = append(clientOptions, option.WithTokenSource(withTokenCache(ts, tokenCacheAccount(profile, creds))))
+			}
+		}
+	}
+
+	if creds.Project != "" {
+		clientOptions = append(clientOptions, option.WithQuotaProject(creds.Project))
+	}
+	if cfg.GCSEndpoint != "" {
+		clientOptions = append(clientOptions, option.WithEndpoint(cfg.GCSEndpoint))
+	}
+
+	return storage.NewClient(ctx, clientOptions...)
+}
+
+// emulatorHost returns the address of the GCS emulator (e.g. fake-gcs-server) set in
+// STORAGE_EMULATOR_HOST, or "" to use Cloud Storage.
+func emulatorHost() string {
+	return os.Getenv("STORAGE_EMULATOR_HOST")
+}
+
+// isAuthError reports whether err means the client's credentials no longer work
+// (token refresh failed, or the API rejected the credentials).
+func isAuthError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return true
+	}
+	var authErr *auth.Error
+	if errors.As(err, &authErr) {
+		return true
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusUnauthorized {
+		return true
+	}
+	return false
+}
+
+// checkKeyless returns an error if the credential profile would authenticate with a service
+// account key, for --forbid-sa-keys.
+func checkKeyless(profile string) error {
+	key, where := longLivedKey(profile)
+	if key == nil {
+		return nil
+	}
+	return fmt.Errorf("service account keys are forbidden (--forbid-sa-keys), but credentials '%s' use key %s of %s in %s; remove it and use impersonation, workload identity federation or user credentials", profileName(profile), key.PrivateKeyID, key.ClientEmail, where)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// nameCollision is a destination object that more than one local file maps to, or that
+// already exists in the bucket with other content than the one local file mapping to it.
+type nameCollision struct {
+	dest  string   // gs://bucket/object
+	files []string // The local files, sorted
+	size  int64    // Size of the existing object, or -1 for a collision between local files
+}
+
+func (c nameCollision) key() string {
+	return c.dest + "\x00" + strings.Join(c.files, "\x00")
+}
+
+// collisionWarned holds the collisions already reported, so each is only reported once
+// while it lasts.
+var collisionWarned = struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}{keys: make(map[string]bool)}
+
+// collisionFile is a local file with the object it is uploaded to under the current
+// naming rules.
+type collisionFile struct {
+	path   string
+	size   int64
+	target uploadTarget
+}
+
+// checkNameCollisions maps every file in sources to its destination object, as an upload
+// would, and reports the objects that more than one file maps to, and those that already
+// exist in the bucket with a different size, before the uploads run into --on-conflict.
+func checkNameCollisions(sources []*watchSource) {
+	start := time.Now()
+	byDest := make(map[string][]collisionFile)
+	for _, src := range sources {
+		err := forEachFile(src.Path, func(filePath string) {
+			if src.skipReason(filePath) != "" {
+				return
+			}
+			info, err := os.Stat(filePath)
+			if err != nil {
+				return
+			}
+			if cfg.BundleBelow > 0 && info.Size() < int64(cfg.BundleBelow) {
+				return // Uploaded in a bundle, under a name of its own
+			}
+			if cfg.PartSets && partFileRegexp.MatchString(filepath.Base(filePath)) {
+				return // Composed into one object with the other parts
+			}
+			target := resolveTarget(src, filePath, info)
+			dest := fmt.Sprintf("gs://%s/%s", target.Bucket, target.Object)
+			byDest[dest] = append(byDest[dest], collisionFile{path: filePath, size: info.Size(), target: target})
+		})
+		if err != nil {
+			slog.Error("Error checking source folder for name collisions", "path", src.Path, "error", err)
+		}
+	}
+
+	var collisions []nameCollision
+	for dest, files := range byDest {
+		if len(files) < 2 {
+			continue
+		}
+		c := nameCollision{dest: dest, size: -1}
+		for _, f := range files {
+			c.files = append(c.files, f.path)
+		}
+		slices.Sort(c.files)
+		collisions = append(collisions, c)
+	}
+	collisions = append(collisions, existingCollisions(byDest)...)
+	slices.SortFunc(collisions, func(a, b nameCollision) int { return strings.Compare(a.dest, b.dest) })
+	slog.Debug("Checked destination names for collisions", "objects", len(byDest), "collisions", len(collisions), durationMS(start))
+	reportCollisions(collisions)
+}
+
+// existingCollisions lists the destination prefixes of the files of byDest that map to an
+// object of their own and returns the objects that exist with a different size than the
+// file. Compressed files (--gzip) are left out, as their size in GCS is another.
+func existingCollisions(byDest map[string][]collisionFile) []nameCollision {
+	type listing struct{ credentials, bucket, prefix string }
+	wanted := make(map[listing]map[string]collisionFile) // Object names by listing
+	for _, files := range byDest {
+		f := files[0]
+		if len(files) > 1 || f.target.Gzip {
+			continue
+		}
+		l := listing{f.target.Credentials, f.target.Bucket, f.target.ListPrefix}
+		if wanted[l] == nil {
+			wanted[l] = make(map[string]collisionFile)
+		}
+		wanted[l][f.target.Object] = f
+	}
+	var collisions []nameCollision
+	for l, objects := range wanted {
+		err := func() (err error) {
+			client, err := clients.get(l.credentials)
+			if err != nil {
+				return fmt.Errorf("creating Google Cloud Storage client: %w", err)
+			}
+			defer func() { clients.report(client, err) }()
+			ctx, cancel := context.WithTimeout(rootCtx, 5*time.Minute)
+			defer cancel()
+			query := &storage.Query{Prefix: l.prefix}
+			if err := query.SetAttrSelection([]string{"Name", "Size"}); err != nil {
+				return err
+			}
+			it := client.Bucket(l.bucket).Objects(ctx, query)
+			for {
+				attrs, err := it.Next()
+				if err == iterator.Done {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				if f, ok := objects[attrs.Name]; ok && attrs.Size != f.size {
+					collisions = append(collisions, nameCollision{dest: fmt.Sprintf("gs://%s/%s", l.bucket, attrs.Name), files: []string{f.path}, size: attrs.Size})
+				}
+			}
+		}()
+		if err != nil {
+			slog.Error("Error listing destination for name collisions", "bucket", l.bucket, "prefix", l.prefix, "error", err)
+		}
+	}
+	return collisions
+}
+
+// reportCollisions logs the collisions not reported before and sends one alert for them.
+func reportCollisions(collisions []nameCollision) {
+	collisionWarned.mu.Lock()
+	defer collisionWarned.mu.Unlock()
+	seen := make(map[string]bool, len(collisions))
+	var fresh []nameCollision
+	for _, c := range collisions {
+		seen[c.key()] = true
+		if collisionWarned.keys[c.key()] {
+			continue
+		}
+		collisionWarned.keys[c.key()] = true
+		fresh = append(fresh, c)
+		if c.size < 0 {
+			slog.Warn("Several local files would be uploaded to the same object", "object", c.dest, "files", c.files, "on_conflict", cfg.OnConflict)
+		} else {
+			slog.Warn("Local file would be uploaded to an object that exists with other content", "object", c.dest, "file", c.files[0], "object_bytes", c.size, "on_conflict", cfg.OnConflict)
+		}
+	}
+	// Resolved collisions are reported again if they come back
+	for key := range collisionWarned.keys {
+		if !seen[key] {
+			delete(collisionWarned.keys, key)
+		}
+	}
+	switch len(fresh) {
+	case 0:
+	case 1:
+		c := fresh[0]
+		if c.size < 0 {
+			notify(notifyAlert, msgNameCollision, "object", c.dest, "files", strings.Join(c.files, ", "), "on_conflict", cfg.OnConflict)
+		} else {
+			notify(notifyAlert, msgObjectCollision, "file", c.files[0], "object", c.dest, "on_conflict", cfg.OnConflict)
+		}
+	default:
+		notify(notifyAlert, msgNameCollisions, "count", len(fresh), "object", fresh[0].dest, "on_conflict", cfg.OnConflict)
+	}
+}
+
+// watchNameCollisions runs checkNameCollisions every --collision-check.
+func watchNameCollisions(sources []*watchSource) {
+	checkNameCollisions(sources)
+	for range time.Tick(cfg.CollisionCheck) {
+		checkNameCollisions(sources)
+	}
+}
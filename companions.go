@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// companionFlag maps a glob of file names to the comma-separated name patterns of their
+// companion files, such as the .xmp sidecar of a raw photo. In a pattern, {stem} is the
+// file's name without extension and {name} its full name. Companions are never uploaded;
+// they are deleted or archived (--on-success) together with the file they belong to. As a
+// flag it is repeatable and takes GLOB=PATTERNS; config files use a plain mapping.
+type companionFlag map[string]string
+
+func (f *companionFlag) String() string {
+	var parts []string
+	for glob, patterns := range *f {
+		parts = append(parts, glob+"="+patterns)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+func (f *companionFlag) Set(value string) error {
+	glob, patterns, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected GLOB=PATTERNS, got '%s'", value)
+	}
+	if *f == nil {
+		*f = make(companionFlag)
+	}
+	(*f)[glob] = patterns
+	return nil
+}
+
+// companionPlaceholders replaces {stem} and {name} in a companion pattern.
+func companionPlaceholders(pattern, stem, name string) string {
+	return strings.NewReplacer("{stem}", stem, "{name}", name).Replace(pattern)
+}
+
+// globEscaper escapes the characters of a file name that are special in a glob.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`)
+
+// validateCompanions checks the globs and patterns of --companion. Both match file names in
+// one folder, so they can't contain a slash.
+func validateCompanions(c *Config) error {
+	for glob, patterns := range c.Companions {
+		if strings.Contains(glob, "/") || validateGlob(glob) != nil {
+			return fmt.Errorf("companion: invalid file name glob '%s'", glob)
+		}
+		for _, p := range strings.Split(patterns, ",") {
+			if p == "" || strings.Contains(p, "/") || validateGlob(companionPlaceholders(p, "*", "*")) != nil {
+				return fmt.Errorf("companion %s: invalid pattern '%s'", glob, p)
+			}
+		}
+	}
+	return nil
+}
+
+// isCompanion reports whether filePath has the name of a companion file, which is not
+// uploaded by itself.
+func isCompanion(filePath string) bool {
+	name := filepath.Base(filePath)
+	for _, patterns := range cfg.Companions {
+		for _, p := range strings.Split(patterns, ",") {
+			if matchGlob(companionPlaceholders(p, "*", "*"), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// companionsOf returns the companion files next to filePath.
+func companionsOf(filePath string) []string {
+	dir, name := filepath.Split(filePath)
+	var globs []string
+	for glob, patterns := range cfg.Companions {
+		if !matchGlob(glob, name) {
+			continue
+		}
+		stem := strings.TrimSuffix(name, filepath.Ext(name))
+		for _, p := range strings.Split(patterns, ",") {
+			globs = append(globs, companionPlaceholders(p, globEscaper.Replace(stem), globEscaper.Replace(name)))
+		}
+	}
+	if len(globs) == 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var companions []string
+	for _, e := range entries {
+		if !e.Type().IsRegular() || e.Name() == name {
+			continue
+		}
+		for _, g := range globs {
+			if matchGlob(g, e.Name()) {
+				companions = append(companions, filepath.Join(dir, e.Name()))
+				break
+			}
+		}
+	}
+	return companions
+}
+
+// finishCompanions deletes the companion files of filePath, or moves them to the archive
+// next to it, after filePath itself was. A companion that can't be removed is logged and
+// left in place; it doesn't fail the upload.
+func finishCompanions(src *watchSource, filePath string) {
+	for _, companion := range companionsOf(filePath) {
+		logger := slog.With("file", filePath, "companion", companion)
+		if p := protectedBy(companion); p != "" {
+			logger.Warn("Companion file is under a protected path, leaving it in place", "protected", p)
+			continue
+		}
+		if cfg.OnSuccess == onSuccessMove {
+			dest, err := archiveFile(companion, filepath.Join(cfg.ArchiveDir, filepath.FromSlash(src.relativePath(companion))))
+			if err != nil {
+				logger.Warn("Error archiving companion file", "error", err)
+				continue
+			}
+			logger.Info("Moved companion file", "archive", dest)
+			continue
+		}
+		if err := os.Remove(companion); err != nil {
+			logger.Warn("Error deleting companion file", "error", err)
+			continue
+		}
+		logger.Info("Deleted companion file")
+	}
+}
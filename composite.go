@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/uuid"
+)
+
+// compositePartMarker is part of the names of the temporary part objects, so parts left
+// behind by a crash can be recognized (and removed with a lifecycle rule).
+const compositePartMarker = ".gcs-uploader-part-"
+
+// uploadComposite uploads f as up to --composite-parts temporary objects in parallel,
+// composes them into dest and deletes the parts (parallel composite upload). It returns
+// the attributes of the composed object together with the checksums of the file.
+//
+// Composite objects carry a CRC32C but no MD5, so only the CRC32C is verified.
+func uploadComposite(ctx context.Context, client *storage.Client, dest *storage.ObjectHandle, f *os.File, size int64, attrs storage.ObjectAttrs) (*storage.ObjectAttrs, *checksums, error) {
+	// The parts are read independently, so the whole file is checksummed up front
+	sums, err := fileChecksums(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading file: %w", err)
+	}
+
+	partSize := (size + int64(cfg.CompositeParts) - 1) / int64(cfg.CompositeParts)
+	bucket := client.Bucket(dest.BucketName())
+	id := uuid.NewString()
+	var parts []*storage.ObjectHandle
+	for offset := int64(0); offset < size; offset += partSize {
+		parts = append(parts, bucket.Object(fmt.Sprintf("%s%s%s-%02d", attrs.Name, compositePartMarker, id, len(parts))))
+	}
+	defer func() { deleteParts(parts) }()
+
+	slog.Debug("Uploading file as parallel parts", "file", f.Name(), "parts", len(parts), "part_bytes", partSize)
+	errs := make([]error, len(parts))
+	var wg sync.WaitGroup
+	for i, part := range parts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			offset := int64(i) * partSize
+			errs[i] = uploadPart(ctx, part, io.NewSectionReader(f, offset, min(partSize, size-offset)))
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, nil, fmt.Errorf("uploading part %d of %d: %w", i+1, len(parts), err)
+		}
+	}
+
+	composer := dest.ComposerFrom(parts...)
+	composer.ObjectAttrs = attrs
+	composer.Metadata = withDigests(attrs.Metadata, sums)
+	// GCS rejects the compose if the result doesn't match the local file
+	composer.CRC32C = sums.crc32c.Sum32()
+	composer.SendCRC32C = true
+	composed, err := composer.Run(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("composing %d parts: %w", len(parts), err)
+	}
+	return composed, sums, nil
+}
+
+// uploadPart writes one part of a parallel composite upload.
+func uploadPart(ctx context.Context, part *storage.ObjectHandle, r io.Reader) error {
+	wc := encrypted(part).Retryer(storage.WithPolicy(storage.RetryAlways)).NewWriter(ctx)
+	wc.KMSKeyName = cfg.KMSKey
+	wc.ChunkSize = int(cfg.ChunkSize)
+	wc.ChunkRetryDeadline = cfg.ChunkRetryDeadline
+	// Parts only live for a moment; a colder bucket default would bill them a minimum storage duration
+	wc.StorageClass = "STANDARD"
+	if _, err := io.Copy(wc, r); err != nil {
+		if cerr := wc.Close(); cerr != nil {
+			slog.Error("Error closing writer after failed upload", "object", part.ObjectName(), "error", cerr)
+		}
+		return err
+	}
+	return wc.Close()
+}
+
+// deleteParts deletes the temporary part objects of a composite upload.
+func deleteParts(parts []*storage.ObjectHandle) {
+	for _, part := range parts {
+		if err := part.Delete(context.Background()); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			slog.Error("Error deleting temporary part", "bucket", part.BucketName(), "object", part.ObjectName(), "error", err)
+		}
+	}
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the uploader. It is filled from an optional
+// config file (--config) and then from command-line flags, which take precedence.
+// The `flag` tag names the command-line flag that overrides each field.
+type Config struct {
+	Source              sourceListFlag    `yaml:"source" toml:"source" flag:"source"`
+	Sources             []SourceConfig    `yaml:"sources" toml:"sources"`
+	Preset              string            `yaml:"preset" toml:"preset" flag:"preset"`
+	Bucket              string            `yaml:"bucket" toml:"bucket" flag:"bucket"`
+	Project             string            `yaml:"project" toml:"project" flag:"project"`
+	ImpersonateSA       string            `yaml:"impersonate_sa" toml:"impersonate_sa" flag:"impersonate-sa"`
+	KeyProfile          string            `yaml:"profile" toml:"profile" flag:"profile"`
+	ExternalAccount     string            `yaml:"external_account" toml:"external_account" flag:"external-account"`
+	Credentials         credentialsConfig `yaml:"credentials" toml:"credentials"`
+	CacheTokens         bool              `yaml:"cache_tokens" toml:"cache_tokens" flag:"cache-tokens"`
+	ForbidSAKeys        bool              `yaml:"forbid_sa_keys" toml:"forbid_sa_keys" flag:"forbid-sa-keys"`
+	Preflight           bool              `yaml:"preflight" toml:"preflight" flag:"preflight"`
+	AlertWebhook        string            `yaml:"alert_webhook" toml:"alert_webhook" flag:"alert-webhook"`
+	Notify              notifyFlag        `yaml:"notify" toml:"notify" flag:"notify"`
+	SlackWebhook        string            `yaml:"slack_webhook" toml:"slack_webhook" flag:"slack-webhook"`
+	SMTPServer          string            `yaml:"smtp_server" toml:"smtp_server" flag:"smtp-server"`
+	SMTPFrom            string            `yaml:"smtp_from" toml:"smtp_from" flag:"smtp-from"`
+	SMTPTo              stringSliceFlag   `yaml:"smtp_to" toml:"smtp_to" flag:"smtp-to"`
+	SMTPUsername        string            `yaml:"smtp_username" toml:"smtp_username" flag:"smtp-username"`
+	NotifyCommand       string            `yaml:"notify_command" toml:"notify_command" flag:"notify-command"`
+	MessageCatalog      string            `yaml:"message_catalog" toml:"message_catalog" flag:"message-catalog"`
+	HealthAddr          string            `yaml:"health_addr" toml:"health_addr" flag:"health-addr"`
+	Telemetry           string            `yaml:"telemetry" toml:"telemetry" flag:"telemetry"`
+	TelemetryURL        string            `yaml:"telemetry_url" toml:"telemetry_url" flag:"telemetry-url"`
+	TelemetryInterval   time.Duration     `yaml:"telemetry_interval" toml:"telemetry_interval" flag:"telemetry-interval"`
+	GCSEndpoint         string            `yaml:"gcs_endpoint" toml:"gcs_endpoint" flag:"gcs-endpoint"`
+	Proxy               string            `yaml:"proxy" toml:"proxy" flag:"proxy"`
+	KeyMaxAgeDays       int               `yaml:"key_max_age_days" toml:"key_max_age_days" flag:"key-max-age-days"`
+	StateDir            string            `yaml:"state_dir" toml:"state_dir" flag:"state-dir"`
+	Dedupe              string            `yaml:"dedupe" toml:"dedupe" flag:"dedupe"`
+	DestIndex           bool              `yaml:"dest_index" toml:"dest_index" flag:"dest-index"`
+	DestIndexRefresh    time.Duration     `yaml:"dest_index_refresh" toml:"dest_index_refresh" flag:"dest-index-refresh"`
+	ReconnectInterval   time.Duration     `yaml:"reconnect_interval" toml:"reconnect_interval" flag:"reconnect-interval"`
+	ShutdownTimeout     time.Duration     `yaml:"shutdown_timeout" toml:"shutdown_timeout" flag:"shutdown-timeout"`
+	OnSuccess           string            `yaml:"on_success" toml:"on_success" flag:"on-success"`
+	ArchiveDir          string            `yaml:"archive_dir" toml:"archive_dir" flag:"archive-dir"`
+	OnConflict          string            `yaml:"on_conflict" toml:"on_conflict" flag:"on-conflict"`
+	QuarantineDir       string            `yaml:"quarantine_dir" toml:"quarantine_dir" flag:"quarantine-dir"`
+	ConflictRename      string            `yaml:"conflict_rename" toml:"conflict_rename" flag:"conflict-rename"`
+	CollisionCheck      time.Duration     `yaml:"collision_check" toml:"collision_check" flag:"collision-check"`
+	QuarantineAfter     int               `yaml:"quarantine_after" toml:"quarantine_after" flag:"quarantine-after"`
+	HoldDir             string            `yaml:"hold_dir" toml:"hold_dir" flag:"hold-dir"`
+	HoldMaxAge          time.Duration     `yaml:"hold_max_age" toml:"hold_max_age" flag:"hold-max-age"`
+	ExcludeFromIndexing bool              `yaml:"exclude_from_indexing" toml:"exclude_from_indexing" flag:"exclude-from-indexing"`
+	NewFilesOnly        bool              `yaml:"new_files_only" toml:"new_files_only" flag:"new-files-only"`
+	UndoWindow          time.Duration     `yaml:"undo_window" toml:"undo_window" flag:"undo-window"`
+	Recursive           bool              `yaml:"recursive" toml:"recursive" flag:"recursive"`
+	PreservePath        bool              `yaml:"preserve_path" toml:"preserve_path" flag:"preserve-path"`
+	UseEXIF             bool              `yaml:"use_exif" toml:"use_exif" flag:"use-exif"`
+	ObjectPrefix        string            `yaml:"object_prefix" toml:"object_prefix" flag:"object-prefix"`
+	HostPrefix          bool              `yaml:"host_prefix" toml:"host_prefix" flag:"host-prefix"`
+	DatePrefix          string            `yaml:"date_prefix" toml:"date_prefix" flag:"date-prefix"`
+	FilenameTimePattern string            `yaml:"filename_time_pattern" toml:"filename_time_pattern" flag:"filename-time-pattern"`
+	FilenameTimeLayout  string            `yaml:"filename_time_layout" toml:"filename_time_layout" flag:"filename-time-layout"`
+	Verbose             bool              `yaml:"verbose" toml:"verbose" flag:"verbose"`
+	LogFormat           string            `yaml:"log_format" toml:"log_format" flag:"log-format"`
+	LogLevel            string            `yaml:"log_level" toml:"log_level" flag:"log-level"`
+	ConfirmBacklog      int               `yaml:"confirm_backlog" toml:"confirm_backlog" flag:"confirm-backlog"`
+	BacklogThroughput   byteSize          `yaml:"backlog_throughput" toml:"backlog_throughput" flag:"backlog-throughput"`
+	Observe             bool              `yaml:"observe" toml:"observe" flag:"observe"`
+	VerifyOnly          bool              `yaml:"verify_only" toml:"verify_only" flag:"verify-only"`
+	VerifyInterval      time.Duration     `yaml:"verify_interval" toml:"verify_interval" flag:"verify-interval"`
+	Once                bool              `yaml:"once" toml:"once" flag:"once"`
+	PollInterval        time.Duration     `yaml:"poll_interval" toml:"poll_interval" flag:"poll-interval"`
+	PollOnly            bool              `yaml:"poll_only" toml:"poll_only" flag:"poll-only"`
+	RunAs               string            `yaml:"run_as" toml:"run_as" flag:"run-as"`
+	AllowRoot           bool              `yaml:"allow_root" toml:"allow_root" flag:"allow-root"`
+	AllowDangerous      bool              `yaml:"i_know_what_i_am_doing" toml:"i_know_what_i_am_doing" flag:"i-know-what-i-am-doing"`
+	ProtectedPaths      stringSliceFlag   `yaml:"protected_paths" toml:"protected_paths" flag:"protect"`
+	MaxDeletionRate     int               `yaml:"max_deletions_per_minute" toml:"max_deletions_per_minute" flag:"max-deletions-per-minute"`
+	Hardened            bool              `yaml:"hardened" toml:"hardened" flag:"hardened"`
+	ContentType         string            `yaml:"content_type" toml:"content_type" flag:"content-type"`
+	CacheControl        string            `yaml:"cache_control" toml:"cache_control" flag:"cache-control"`
+	ContentDisposition  string            `yaml:"content_disposition" toml:"content_disposition" flag:"content-disposition"`
+	ContentLanguage     string            `yaml:"content_language" toml:"content_language" flag:"content-language"`
+	Metadata            metadataFlag      `yaml:"metadata" toml:"metadata" flag:"metadata"`
+	ContentTypeRules    patternRulesFlag  `yaml:"content_types" toml:"content_types" flag:"content-type-rule"`
+	GzipEncoding        bool              `yaml:"gzip_encoding" toml:"gzip_encoding" flag:"gzip-encoding"`
+	Gzip                bool              `yaml:"gzip" toml:"gzip" flag:"gzip"`
+	GzipPatterns        stringSliceFlag   `yaml:"gzip_patterns" toml:"gzip_patterns" flag:"gzip-pattern"`
+	GzipObjects         bool              `yaml:"gzip_objects" toml:"gzip_objects" flag:"gzip-objects"`
+	SniffSchema         bool              `yaml:"sniff_schema" toml:"sniff_schema" flag:"sniff-schema"`
+	TTLRules            patternRulesFlag  `yaml:"ttl_rules" toml:"ttl_rules" flag:"ttl-rule"`
+	StorageClass        string            `yaml:"storage_class" toml:"storage_class" flag:"storage-class"`
+	StorageClassRules   patternRulesFlag  `yaml:"storage_classes" toml:"storage_classes" flag:"storage-class-rule"`
+	StorageClassBySize  sizeRulesFlag     `yaml:"storage_class_by_size" toml:"storage_class_by_size" flag:"storage-class-by-size"`
+	Digests             stringSliceFlag   `yaml:"digests" toml:"digests" flag:"digest"`
+	PredefinedACL       string            `yaml:"predefined_acl" toml:"predefined_acl" flag:"predefined-acl"`
+	ACLRules            patternRulesFlag  `yaml:"acls" toml:"acls" flag:"acl-rule"`
+	KMSKey              string            `yaml:"kms_key" toml:"kms_key" flag:"kms-key"`
+	CSEKKeyFile         string            `yaml:"csek_key_file" toml:"csek_key_file" flag:"csek-key-file"`
+	Previews            bool              `yaml:"previews" toml:"previews" flag:"previews"`
+	PreviewPrefix       string            `yaml:"preview_prefix" toml:"preview_prefix" flag:"preview-prefix"`
+	CaptureProvenance   bool              `yaml:"capture_provenance" toml:"capture_provenance" flag:"capture-provenance"`
+	CaptureAttribution  bool              `yaml:"capture_attribution" toml:"capture_attribution" flag:"capture-attribution"`
+	Concurrency         int               `yaml:"concurrency" toml:"concurrency" flag:"concurrency"`
+	AdaptiveConcurrency bool              `yaml:"adaptive_concurrency" toml:"adaptive_concurrency" flag:"adaptive-concurrency"`
+	HashWorkers         int               `yaml:"hash_workers" toml:"hash_workers" flag:"hash-workers"`
+	MaxRetries          int               `yaml:"max_retries" toml:"max_retries" flag:"max-retries"`
+	RetryBaseDelay      time.Duration     `yaml:"retry_base_delay" toml:"retry_base_delay" flag:"retry-base-delay"`
+	RetryPolicies       retryPolicyFlag   `yaml:"retry_policy" toml:"retry_policy" flag:"retry-policy"`
+	ErrorSummary        time.Duration     `yaml:"error_summary_interval" toml:"error_summary_interval" flag:"error-summary-interval"`
+	ChunkSize           byteSize          `yaml:"chunk_size" toml:"chunk_size" flag:"chunk-size"`
+	IOMode              string            `yaml:"io_mode" toml:"io_mode" flag:"io-mode"`
+	ChunkRetryDeadline  time.Duration     `yaml:"chunk_retry_deadline" toml:"chunk_retry_deadline" flag:"chunk-retry-deadline"`
+	UploadTimeout       time.Duration     `yaml:"upload_timeout" toml:"upload_timeout" flag:"upload-timeout"`
+	ProgressThreshold   byteSize          `yaml:"progress_threshold" toml:"progress_threshold" flag:"progress-threshold"`
+	ProgressInterval    time.Duration     `yaml:"progress_interval" toml:"progress_interval" flag:"progress-interval"`
+	CompositeThreshold  byteSize          `yaml:"parallel_composite_threshold" toml:"parallel_composite_threshold" flag:"parallel-composite-threshold"`
+	CompositeParts      int               `yaml:"composite_parts" toml:"composite_parts" flag:"composite-parts"`
+	PartSets            bool              `yaml:"part_sets" toml:"part_sets" flag:"part-sets"`
+	PartSetSettle       time.Duration     `yaml:"part_set_settle" toml:"part_set_settle" flag:"part-set-settle"`
+	BundleBelow         byteSize          `yaml:"bundle_below" toml:"bundle_below" flag:"bundle-below"`
+	BundleInterval      time.Duration     `yaml:"bundle_interval" toml:"bundle_interval" flag:"bundle-interval"`
+	BundleSize          byteSize          `yaml:"bundle_size" toml:"bundle_size" flag:"bundle-size"`
+	BundleCompress      bool              `yaml:"bundle_compress" toml:"bundle_compress" flag:"bundle-compress"`
+	BundleManifest      bool              `yaml:"bundle_manifest" toml:"bundle_manifest" flag:"bundle-manifest"`
+	MaxInflightBytes    byteSize          `yaml:"max_inflight_bytes" toml:"max_inflight_bytes" flag:"max-inflight-bytes"`
+	SourceWeights       sourceWeightsFlag `yaml:"source_weights" toml:"source_weights" flag:"source-weight"`
+	Debounce            time.Duration     `yaml:"debounce" toml:"debounce" flag:"debounce"`
+	StabilityCheck      string            `yaml:"stability_check" toml:"stability_check" flag:"stability-check"`
+	StabilityDuration   time.Duration     `yaml:"stability_duration" toml:"stability_duration" flag:"stability-duration"`
+	StabilityInterval   time.Duration     `yaml:"stability_interval" toml:"stability_interval" flag:"stability-interval"`
+	MinFileAge          time.Duration     `yaml:"min_file_age" toml:"min_file_age" flag:"min-file-age"`
+	MinSize             byteSize          `yaml:"min_size" toml:"min_size" flag:"min-size"`
+	MaxSize             byteSize          `yaml:"max_size" toml:"max_size" flag:"max-size"`
+	Producers           stringSliceFlag   `yaml:"producers" toml:"producers" flag:"producer"`
+	WatchSubpaths       stringSliceFlag   `yaml:"watch_subpaths" toml:"watch_subpaths" flag:"watch-subpath"`
+	Include             stringSliceFlag   `yaml:"include" toml:"include" flag:"include"`
+	Exclude             stringSliceFlag   `yaml:"exclude" toml:"exclude" flag:"exclude"`
+	Companions          companionFlag     `yaml:"companions" toml:"companions" flag:"companion"`
+	MaterializeTimeout  time.Duration     `yaml:"materialize_timeout" toml:"materialize_timeout" flag:"materialize-timeout"`
+	CloudPlaceholders   string            `yaml:"cloud_placeholders" toml:"cloud_placeholders" flag:"cloud-placeholders"`
+	CanaryPercent       int               `yaml:"canary_percent" toml:"canary_percent" flag:"canary-percent"`
+	CanaryBucket        string            `yaml:"canary_bucket" toml:"canary_bucket" flag:"canary-bucket"`
+	CanaryPrefix        string            `yaml:"canary_prefix" toml:"canary_prefix" flag:"canary-prefix"`
+}
+
+// registerFlags defines the command-line flag for every Config field on fs, bound to c.
+func registerFlags(fs *flag.FlagSet, c *Config) {
+	fs.Var(&c.Source, "source", "Path to the folder to monitor for files (e.g., /path/to/your/files). Repeatable; use PATH=gs://BUCKET/PREFIX to give a folder its own destination.")
+	fs.StringVar(&c.Preset, "preset", "", "Optional: Apply a bundle of settings for a common use case ('logs': ship rotated log files by host and date). Settings given explicitly take precedence.")
+	fs.StringVar(&c.Bucket, "bucket", "", "Name of the Google Cloud Storage bucket (e.g., my-unique-bucket)")
+	fs.StringVar(&c.Project, "project", "", "Optional: Your Google Cloud Project ID. If not provided, it will be inferred from credentials.")
+	fs.StringVar(&c.ImpersonateSA, "impersonate-sa", "", "Optional: Email of the service account to impersonate (e.g., file-uploader-sa@your-project-id.iam.gserviceaccount.com). Only used if no SA key is found in the keystore.")
+	fs.StringVar(&c.KeyProfile, "profile", keychainSAKeyAccount, "Keystore profile of the service account key the top-level settings use, and that --set-sa-key-path and --delete-sa-key store and remove (see --list-profiles).")
+	fs.StringVar(&c.ExternalAccount, "external-account", "", "Optional: Path to a workload identity federation config (type external_account, from 'gcloud iam workload-identity-pools create-cred-config'), whose OIDC, SAML, AWS or Azure token is exchanged for Google credentials without a service account key.")
+	fs.BoolVar(&c.CacheTokens, "cache-tokens", false, "Keep impersonated and federated access tokens in the keystore (Keychain, Secret Service or Credential Manager) until they expire, so restarts reuse them instead of requesting new ones.")
+	fs.BoolVar(&c.ForbidSAKeys, "forbid-sa-keys", false, "Refuse to run with a service account JSON key (in the keystore or as Application Default Credentials); only keyless authentication is accepted: impersonation, workload identity federation, user or attached service account credentials.")
+	fs.BoolVar(&c.Preflight, "preflight", true, "Check at startup that each destination bucket exists and that its credentials authenticate and may create objects, and exit with an error if not. Disable with --preflight=false.")
+	fs.IntVar(&c.KeyMaxAgeDays, "key-max-age-days", 90, "Warn (log and notification) when the service account key in use, from the keystore or GOOGLE_APPLICATION_CREDENTIALS, is older than this many days. 0 disables the check.")
+	fs.StringVar(&c.AlertWebhook, "alert-webhook", "", "Optional: URL that receives a JSON POST when authentication to Google Cloud breaks (and when it works again), with hints on how to fix it.")
+	fs.Var(&c.Notify, "notify", "Optional, repeatable: Notification sink and the events it receives, as SINK or SINK=EVENTS (e.g., 'slack=failure,alert'). Sinks: desktop, slack, email, command; events: success, exists, failure, observed, alert or all. Defaults to desktop=all on macOS.")
+	fs.StringVar(&c.SlackWebhook, "slack-webhook", "", "Slack incoming webhook URL for --notify slack.")
+	fs.StringVar(&c.SMTPServer, "smtp-server", "", "SMTP server (HOST:PORT) for --notify email. The password, if needed, is read from GCS_UPLOADER_SMTP_PASSWORD.")
+	fs.StringVar(&c.SMTPFrom, "smtp-from", "", "Sender address of --notify email.")
+	fs.Var(&c.SMTPTo, "smtp-to", "Repeatable: Recipient address of --notify email.")
+	fs.StringVar(&c.SMTPUsername, "smtp-username", "", "Optional: User name to authenticate to --smtp-server with.")
+	fs.StringVar(&c.NotifyCommand, "notify-command", "", "Program --notify command runs for every notification, with GCS_UPLOADER_EVENT, GCS_UPLOADER_TITLE, GCS_UPLOADER_MESSAGE, GCS_UPLOADER_MESSAGE_ID and GCS_UPLOADER_PARAMS set.")
+	fs.StringVar(&c.MessageCatalog, "message-catalog", "", "Optional: YAML file with translated or reworded notifications, mapping message IDs to a title and text (print the English ones with the messages subcommand).")
+	fs.StringVar(&c.GCSEndpoint, "gcs-endpoint", "", "Optional: Cloud Storage JSON API endpoint to use instead of storage.googleapis.com (e.g., a Private Service Connect endpoint https://storage-myendpoint.p.googleapis.com/storage/v1/). For an emulator without authentication, set STORAGE_EMULATOR_HOST instead.")
+	fs.StringVar(&c.Proxy, "proxy", "", "Optional: HTTP(S) or SOCKS5 proxy URL for all requests (e.g., http://user@proxy.example.com:3128), instead of HTTPS_PROXY. Hosts in NO_PROXY are still reached directly. The proxy password can be in the URL or in GCS_UPLOADER_PROXY_PASSWORD.")
+	fs.StringVar(&c.HealthAddr, "health-addr", "", "Optional: Address (e.g., 127.0.0.1:8080) to serve /healthz and /readyz on, reporting the watchers, the last upload, credentials and GCS reachability.")
+	fs.StringVar(&c.Telemetry, "telemetry", telemetryOff, "Send anonymous usage statistics (version, OS, the names of the settings used, counts of uploaded files and of errors by code) to help prioritize development: 'off' or 'on'. 'telemetry show' prints exactly what is sent.")
+	fs.StringVar(&c.TelemetryURL, "telemetry-url", "", "Optional: URL that --telemetry on posts its reports to, instead of the endpoint built in.")
+	fs.DurationVar(&c.TelemetryInterval, "telemetry-interval", 24*time.Hour, "How often --telemetry on sends a report.")
+	fs.StringVar(&c.StateDir, "state-dir", "", "Optional: Directory for persistent state. Defaults to ~/Library/Application Support/gcs-uploader on macOS or the XDG data directory elsewhere.")
+	fs.StringVar(&c.Dedupe, "dedupe", dedupeOff, "Look for a file's content under the destination prefix before uploading it: 'off', 'copy' (create the object as a server-side copy of the identical one) or 'skip' (don't create it).")
+	fs.BoolVar(&c.DestIndex, "dest-index", false, "Keep a local index of the objects under each destination prefix and answer existence and --dedupe checks from it.")
+	fs.DurationVar(&c.DestIndexRefresh, "dest-index-refresh", 10*time.Minute, "How often --dest-index lists a destination prefix again.")
+	fs.DurationVar(&c.ReconnectInterval, "reconnect-interval", 30*time.Second, "While uploads are queued because GCS is unreachable, how often to check whether it is reachable again.")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "On SIGINT or SIGTERM, how long to wait for the uploads in progress to finish before exiting. Queued files are left for the next start. 0 exits right away.")
+	fs.StringVar(&c.OnSuccess, "on-success", onSuccessDelete, "What to do with a local file once it is in GCS: 'delete' it, 'move' it to --archive-dir, or 'keep' it in place (recorded in the state directory so it isn't uploaded again).")
+	fs.StringVar(&c.ArchiveDir, "archive-dir", "", "Folder that --on-success=move moves uploaded files to, keeping their path relative to the source folder. Must not be inside a source folder.")
+	fs.StringVar(&c.OnConflict, "on-conflict", conflictFail, "What to do with a file whose object already exists with different content: 'fail' (report it and leave the file), 'skip' (leave the file without an error), 'rename' (upload it under a free name, see --conflict-rename), 'overwrite' the object, 'version' (overwrite only if the bucket keeps old versions), or 'quarantine' (move the file to --quarantine-dir).")
+	fs.StringVar(&c.ConflictRename, "conflict-rename", conflictRenameNumbered, "How --on-conflict=rename names the object: 'numbered' (name (1).ext) or 'timestamp' (name-20060102T150405Z.ext).")
+	fs.DurationVar(&c.CollisionCheck, "collision-check", 0, "How often (e.g., 1h) to map every local file to its object under the current naming rules and alert on objects that several files map to, or that exist in the bucket with a different size, before the uploads run into --on-conflict. 0 disables the check.")
+	fs.StringVar(&c.QuarantineDir, "quarantine-dir", "", "Folder that --on-conflict=quarantine and --quarantine-after move files to, keeping their path relative to the source folder. Must not be inside a source folder.")
+	fs.IntVar(&c.QuarantineAfter, "quarantine-after", 0, "Move a file that failed to upload this many times in a row to --quarantine-dir, with a <name>.error.json describing the failure. 0 leaves failing files in place.")
+	fs.StringVar(&c.HoldDir, "hold-dir", "hold", "Folder below each source folder whose files are never uploaded until they are moved out of it, for staging files that aren't ready. Empty disables it.")
+	fs.DurationVar(&c.HoldMaxAge, "hold-max-age", 24*time.Hour, "Warn (log and notification) about files that have been in --hold-dir, unmodified, for longer than this. 0 disables the warning.")
+	fs.BoolVar(&c.ExcludeFromIndexing, "exclude-from-indexing", false, "macOS only: Keep Spotlight from indexing the source folders and exclude them from Time Machine backups, which only waste resources on files that are uploaded and deleted.")
+	fs.BoolVar(&c.NewFilesOnly, "new-files-only", false, "Never upload the files the source folders held when the uploader first ran with this flag, even when they change; only files that appear later are uploaded. The list is kept in the state directory.")
+	fs.DurationVar(&c.UndoWindow, "undo-window", 24*time.Hour, "How far back the undo subcommand looks for uploaded and removed files to restore.")
+	fs.BoolVar(&c.Recursive, "recursive", false, "Watch subdirectories of --source as well, including ones created while running.")
+	fs.BoolVar(&c.PreservePath, "preserve-path", false, "Name objects after the file's path relative to --source (e.g., sub/dir/file.txt) instead of its base name.")
+	fs.BoolVar(&c.UseEXIF, "use-exif", false, "For photos (JPEG, TIFF and camera raw files), take the file time from the EXIF capture date and record the camera model in the object's metadata.")
+	fs.StringVar(&c.ObjectPrefix, "object-prefix", "", "Optional: Object name prefix template, e.g. 'ingest/{date}/{hostname}'. Variables: {date} {year} {month} {day} {hour} {hostname} {uuid} {source} {reldir} {camera}, and {relpath} {name} {ext}, which make it the whole object name.")
+	fs.BoolVar(&c.HostPrefix, "host-prefix", false, "Prefix object names with this machine's host name (after the source prefix, before --date-prefix).")
+	fs.StringVar(&c.DatePrefix, "date-prefix", "", "Optional: Partition objects by the file's date, using this Go time layout as a prefix (e.g., 2006/01/02). The date comes from the file name (see --filename-time-pattern) or its modification time.")
+	fs.StringVar(&c.FilenameTimePattern, "filename-time-pattern", "", "Optional: Regular expression extracting a timestamp from file names (e.g., '_(\\d{8}_\\d{6})' for IMG_20240131_123456.jpg); its first capture group is parsed with --filename-time-layout. Sets the object's customTime.")
+	fs.StringVar(&c.FilenameTimeLayout, "filename-time-layout", "", "Optional: Go time layout of the timestamp matched by --filename-time-pattern (e.g., 20060102_150405), in local time.")
+	fs.BoolVar(&c.Verbose, "verbose", false, "Enable verbose logging, including periodic scan messages. Same as --log-level=debug.")
+	fs.StringVar(&c.LogFormat, "log-format", logFormatText, "Log format: 'text' (key=value lines) or 'json' (one JSON object per line, for log pipelines).")
+	fs.StringVar(&c.LogLevel, "log-level", "info", "Minimum level of logged messages: debug, info, warn or error.")
+	fs.IntVar(&c.ConfirmBacklog, "confirm-backlog", 0, "Ask for confirmation (or require --yes when not run from a terminal) before uploading a startup backlog of this many files or more. 0 never asks.")
+	c.BacklogThroughput = 10 << 20
+	fs.Var(&c.BacklogThroughput, "backlog-throughput", "Upload speed per second assumed to estimate how long the startup backlog takes (e.g., 10MiB, 50MB).")
+	fs.BoolVar(&c.Observe, "observe", false, "Read-only observer mode: log and notify about files that would be uploaded, but never upload or delete anything.")
+	fs.BoolVar(&c.VerifyOnly, "verify-only", false, "Integrity monitor mode: upload nothing, but check that the objects in the audit history still exist with the recorded size and checksum every --verify-interval, and alert on drift.")
+	fs.DurationVar(&c.VerifyInterval, "verify-interval", 24*time.Hour, "How often --verify-only checks the audited objects.")
+	fs.BoolVar(&c.Once, "once", false, "Upload the files already in the source folders and exit instead of watching them; the exit code is non-zero if any upload failed.")
+	fs.DurationVar(&c.PollInterval, "poll-interval", 0, "Also scan the source folders for new and changed files this often, for network file systems (NFS, SMB) where file system events are unreliable. 0 disables polling.")
+	fs.BoolVar(&c.PollOnly, "poll-only", false, "Only poll the source folders (see --poll-interval) instead of watching them for file system events.")
+	fs.StringVar(&c.RunAs, "run-as", "", "When started as root, switch to this user once the control socket is set up.")
+	fs.BoolVar(&c.AllowRoot, "allow-root", false, "Run as root even on source folders other users can write to.")
+	fs.BoolVar(&c.AllowDangerous, "i-know-what-i-am-doing", false, "Allow watching /, the home folder, /Users and other broad roots or system folders, whose files would all be uploaded and deleted.")
+	fs.Var(&c.ProtectedPaths, "protect", "Optional, repeatable: Absolute path of a file or folder that is never uploaded, deleted or moved, even inside a source folder.")
+	fs.IntVar(&c.MaxDeletionRate, "max-deletions-per-minute", 0, "Pause deleting or moving local files (uploads continue) when more than this many are removed within a minute, until confirmed with the resume-deletions subcommand. 0 disables the limit.")
+	fs.BoolVar(&c.Hardened, "hardened", false, "Least-privilege mode for tight SELinux/AppArmor profiles: never run external commands and require an absolute state directory.")
+	fs.StringVar(&c.ContentType, "content-type", "", "Optional: Content-Type set on every uploaded object (e.g., text/plain) not matched by a --content-type-rule. By default it is derived from the file extension or content.")
+	fs.StringVar(&c.CacheControl, "cache-control", "", "Optional: Cache-Control set on uploaded objects (e.g., 'public, max-age=3600'). May use the --object-prefix variables.")
+	fs.StringVar(&c.ContentDisposition, "content-disposition", "", "Optional: Content-Disposition set on uploaded objects (e.g., 'attachment; filename=\"{name}\"'). May use the --object-prefix variables.")
+	fs.StringVar(&c.ContentLanguage, "content-language", "", "Optional: Content-Language set on uploaded objects (e.g., en).")
+	fs.Var(&c.Metadata, "metadata", "Optional, repeatable: Custom metadata (x-goog-meta-*) set on uploaded objects, as KEY=VALUE (e.g., 'source-host={hostname}', 'original-mtime={mtime}'). Values may use the --object-prefix variables.")
+	fs.Var(&c.ContentTypeRules, "content-type-rule", "Optional, repeatable: Content-Type for files matching a pattern, as PATTERN=TYPE (e.g., '*.ndjson=application/x-ndjson'). Patterns work like --include; the first matching rule wins.")
+	fs.BoolVar(&c.GzipEncoding, "gzip-encoding", false, "Upload .gz files with 'Content-Encoding: gzip', so GCS serves them decompressed to clients that don't accept gzip.")
+	fs.BoolVar(&c.Gzip, "gzip", false, "Compress files with gzip while uploading them and set 'Content-Encoding: gzip', so GCS stores the compressed bytes and serves them decompressed to clients that don't accept gzip.")
+	fs.Var(&c.GzipPatterns, "gzip-pattern", "Optional, repeatable: Only compress files matching this glob (e.g., '*.log') or 're:' regular expression with --gzip. Defaults to every file but .gz files.")
+	fs.BoolVar(&c.GzipObjects, "gzip-objects", false, "With --gzip, upload compressed files as <name>.gz objects of type application/gzip instead of setting Content-Encoding.")
+	fs.BoolVar(&c.SniffSchema, "sniff-schema", false, "For CSV, TSV and Parquet files, record the column count, header and row count (estimated for large CSV files) in the object's metadata.")
+	fs.Var(&c.TTLRules, "ttl-rule", "Optional, repeatable: Prefix objects of files matching a pattern with 'ttl-<N>d/', as PATTERN=DAYS (e.g., '*.tmp.csv=30d'), for bucket lifecycle rules to delete them after N days (see --apply-lifecycle).")
+	fs.StringVar(&c.StorageClass, "storage-class", "", "Optional: Storage class of uploaded objects (STANDARD, NEARLINE, COLDLINE or ARCHIVE). Defaults to the bucket's default class.")
+	fs.Var(&c.StorageClassRules, "storage-class-rule", "Optional, repeatable: Storage class for files matching a pattern, as PATTERN=CLASS (e.g., '*.bak=ARCHIVE'). Takes precedence over --storage-class-by-size and --storage-class.")
+	fs.StringVar(&c.PredefinedACL, "predefined-acl", "", "Optional: Predefined ACL of uploaded objects (authenticatedRead, bucketOwnerFullControl, bucketOwnerRead, private, projectPrivate or publicRead), for buckets without uniform bucket-level access. Defaults to the bucket's default object ACL.")
+	fs.Var(&c.ACLRules, "acl-rule", "Optional, repeatable: Predefined ACL for files matching a pattern, as PATTERN=ACL (e.g., 'public/**=publicRead'). Takes precedence over --predefined-acl.")
+	fs.Var(&c.Digests, "digest", "Optional, repeatable: Also compute this digest of each file while uploading it and store it, hex-encoded, in the object metadata under its name: sha256, sha512 or blake3. The audit log records it too.")
+	fs.StringVar(&c.KMSKey, "kms-key", "", "Optional: Cloud KMS key to encrypt uploaded objects with (customer-managed encryption key), as projects/P/locations/L/keyRings/R/cryptoKeys/K. The GCS service agent of the project needs permission to use it. Defaults to the bucket's default encryption.")
+	fs.StringVar(&c.CSEKKeyFile, "csek-key-file", "", "Optional: File holding a customer-supplied AES-256 key (32 bytes, raw or base64) to encrypt uploaded objects with. GCS doesn't store the key: without it the objects can't be read, so keep it safe.")
+	fs.Var(&c.StorageClassBySize, "storage-class-by-size", "Optional, repeatable: Upload files of at least SIZE with a storage class, as SIZE=CLASS (e.g., 1GB=NEARLINE). The largest matching size wins.")
+	fs.BoolVar(&c.Previews, "previews", false, "Generate a JPEG preview of every uploaded image or video with ffmpeg (if installed) and upload it under --preview-prefix.")
+	fs.StringVar(&c.PreviewPrefix, "preview-prefix", "previews", "Object name prefix for previews; the preview of 'a/b.mp4' is '<prefix>/a/b.mp4.jpg' in the same bucket.")
+	fs.BoolVar(&c.CaptureProvenance, "capture-provenance", false, "Store where a file was downloaded from (macOS where-from and quarantine attributes) in the object's metadata.")
+	fs.BoolVar(&c.CaptureAttribution, "capture-attribution", false, "Record who uploaded a file (user and host name), who owns it and, on macOS, the application that created it in the object's metadata.")
+	fs.IntVar(&c.Concurrency, "concurrency", 4, "Number of files uploaded in parallel.")
+	fs.BoolVar(&c.AdaptiveConcurrency, "adaptive-concurrency", false, "Tune the number of parallel uploads to the throughput and transient errors seen, up to --concurrency: start low, add a worker while files are waiting and halve them on errors.")
+	fs.IntVar(&c.HashWorkers, "hash-workers", 0, "Number of workers that wait for files to be stable and hash them before handing them to the upload workers, so disk and network are each kept busy. 0 hashes files while they are uploaded.")
+	fs.IntVar(&c.MaxRetries, "max-retries", 5, "How many times an upload that failed with a transient error (429, 5xx, network) is retried before giving up on the file until its next event.")
+	fs.DurationVar(&c.RetryBaseDelay, "retry-base-delay", 1*time.Second, "Delay before the first retry of a failed upload; it doubles (with jitter) for every further retry.")
+	fs.DurationVar(&c.ErrorSummary, "error-summary-interval", 10*time.Minute, "Log and notify a file failing again with the same error code only as one 'Still failing' summary per interval, with the number of repeats. 0 logs every failure.")
+	fs.Var(&c.RetryPolicies, "retry-policy", "Optional, repeatable: Retry policy of an error class as CODE=POLICY, where POLICY is 'never', 'forever' or a number of retries, optionally followed by ',cooldown=DURATION' (e.g., PERMISSION=never, NETWORK=forever, QUOTA=3,cooldown=5m). Other classes follow --max-retries.")
+	c.ChunkSize = 16 << 20
+	fs.Var(&c.ChunkSize, "chunk-size", "Size of the chunks of resumable uploads (e.g., 8MiB, 64MiB); a failed chunk is retried instead of the whole file. Larger chunks are faster and use more memory per upload. 0 uploads every file in a single request.")
+	fs.StringVar(&c.IOMode, "io-mode", ioBuffered, "How files are read for uploading and hashing: 'buffered' (small reads through the page cache), 'large' (large sequential reads), 'dontneed' (large reads that drop what was read from the page cache) or 'direct' (O_DIRECT, bypassing the page cache). dontneed and direct are only supported on Linux.")
+	fs.DurationVar(&c.ChunkRetryDeadline, "chunk-retry-deadline", 32*time.Second, "How long a failed chunk of a resumable upload is retried before the upload fails.")
+	fs.DurationVar(&c.UploadTimeout, "upload-timeout", 0, "Give up an upload attempt that hasn't finished after this long (e.g., 30m), e.g. on a stalled connection, and retry it like a network error. 0 lets uploads run as long as they take.")
+	c.ProgressThreshold = 256 << 20
+	fs.Var(&c.ProgressThreshold, "progress-threshold", "Log the progress of uploads of files of at least this size (e.g., 1GB) and serve it on the /metrics endpoint of --health-addr. 0 disables progress reporting.")
+	fs.DurationVar(&c.ProgressInterval, "progress-interval", 30*time.Second, "How often the progress of an upload of at least --progress-threshold is logged.")
+	fs.Var(&c.CompositeThreshold, "parallel-composite-threshold", "Upload files of at least this size (e.g., 150MB) as parts in parallel and compose them in GCS. 0 disables parallel composite uploads.")
+	fs.IntVar(&c.CompositeParts, "composite-parts", 8, "Number of parts of a parallel composite upload (2-32).")
+	fs.BoolVar(&c.PartSets, "part-sets", false, "Upload files split by their producer into NAME.part0001, NAME.part0002, ... as one object NAME, composed in GCS once all parts are there.")
+	fs.DurationVar(&c.PartSetSettle, "part-set-settle", time.Minute, "How long no part of a --part-sets set must change before the set counts as complete.")
+	fs.Var(&c.BundleBelow, "bundle-below", "Collect files smaller than this size (e.g., 1MiB) into tar archives uploaded as one object below 'bundles/' of the destination prefix, instead of uploading them one by one. 0 disables bundling.")
+	fs.DurationVar(&c.BundleInterval, "bundle-interval", time.Minute, "How long a --bundle-below bundle collects files, from its first file, before it is uploaded.")
+	c.BundleSize = 64 << 20
+	fs.Var(&c.BundleSize, "bundle-size", "Upload a --bundle-below bundle as soon as its files add up to this size, before --bundle-interval is over.")
+	fs.BoolVar(&c.BundleCompress, "bundle-compress", false, "Compress --bundle-below bundles with gzip (.tar.gz).")
+	fs.BoolVar(&c.BundleManifest, "bundle-manifest", false, "Also upload the manifest of each --bundle-below bundle, listing its files, as <bundle>.manifest.json next to it.")
+	fs.Var(&c.MaxInflightBytes, "max-inflight-bytes", "Optional: Maximum total size of files uploaded concurrently (e.g., 2GB, 512MiB). 0 means unlimited.")
+	fs.Var(&c.SourceWeights, "source-weight", "Optional, repeatable: Relative share of the workers, and of the --max-inflight-bytes budget if set, for a source folder while several have files waiting, as PATH=WEIGHT (e.g., /data/telemetry=4). Unlisted sources weigh 1.")
+	fs.DurationVar(&c.Debounce, "debounce", 3*time.Second, "How long a file must go without new events before it is processed.")
+	fs.StringVar(&c.StabilityCheck, "stability-check", stabilitySize, "How to tell that a file is no longer being written, as a comma-separated list of checks that must all pass: 'size' (its size stays the same) and 'handles' (no other process has it open for writing).")
+	fs.DurationVar(&c.StabilityDuration, "stability-duration", 500*time.Millisecond, "How long the --stability-check checks must pass in a row before a file is uploaded.")
+	fs.DurationVar(&c.StabilityInterval, "stability-interval", 100*time.Millisecond, "How often the --stability-check checks are run while waiting for a file to be stable.")
+	fs.DurationVar(&c.MinFileAge, "min-file-age", 0, "Only upload files last modified at least this long ago (e.g., 10m); younger files are uploaded once they are old enough. For slow writers the stability check doesn't catch.")
+	fs.Var(&c.MinSize, "min-size", "Skip files smaller than this size (e.g., 1 to skip empty files). 0 uploads files of any size.")
+	fs.Var(&c.MaxSize, "max-size", "Skip files larger than this size (e.g., 10GB). 0 sets no limit.")
+	fs.Var(&c.Producers, "producer", "Optional, repeatable, macOS only: Only upload files created by this application (e.g., 'Final Cut Pro'), as recorded in the file's Spotlight attributes. Files without a recorded creator are skipped.")
+	fs.Var(&c.WatchSubpaths, "watch-subpath", "Optional, repeatable: Only upload files whose path relative to --source matches this glob (e.g., '**/outbox/**'). '**' matches any number of directories.")
+	fs.Var(&c.Include, "include", "Optional, repeatable: Only upload files matching this glob (e.g., '*.csv'), or regular expression if prefixed with 're:'. Globs without a slash match the file name at any depth.")
+	fs.Var(&c.Exclude, "exclude", "Optional, repeatable: Never upload files matching this glob (e.g., '*.part', '.DS_Store') or 're:' regular expression. Takes precedence over --include.")
+	fs.Var(&c.Companions, "companion", "Optional, repeatable: Companion files as GLOB=PATTERNS (e.g., '*.raw={stem}.xmp,{name}.xmp'): files next to an uploaded file matching GLOB whose names match a pattern are not uploaded, but deleted or archived with it.")
+	fs.DurationVar(&c.MaterializeTimeout, "materialize-timeout", 30*time.Minute, "How long to wait for a cloud placeholder file (Google Drive / iCloud, macOS only) to be downloaded before skipping it.")
+	fs.StringVar(&c.CloudPlaceholders, "cloud-placeholders", placeholderWait, "What to do with cloud placeholder files (iCloud Drive evicted files, Google Drive online-only files; macOS only): 'wait' for the sync client, 'download' to request the content first, or 'skip' them with a warning.")
+	fs.IntVar(&c.CanaryPercent, "canary-percent", 0, "Optional: Percentage (0-100) of files routed through the canary pipeline (--canary-bucket/--canary-prefix). The choice is stable per file path.")
+	fs.StringVar(&c.CanaryBucket, "canary-bucket", "", "Optional: Bucket used by the canary pipeline. Defaults to --bucket.")
+	fs.StringVar(&c.CanaryPrefix, "canary-prefix", "", "Optional: Object name prefix used by the canary pipeline (e.g., canary/).")
+}
+
+// loadConfigFile decodes a YAML (.yaml, .yml) or TOML (.toml) file on top of base.
+// Keys absent from the file keep the value they have in base; unknown keys are an error.
+func loadConfigFile(configPath string, base Config) (Config, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return base, err
+	}
+	c := base
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+			return base, err
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), &c)
+		if err != nil {
+			return base, err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return base, fmt.Errorf("unknown keys: %v", undecoded)
+		}
+	default:
+		return base, fmt.Errorf("unsupported config file extension %q (expected .yaml, .yml or .toml)", filepath.Ext(configPath))
+	}
+	return c, nil
+}
+
+// overrideWith copies into c every field of file whose flag was not set explicitly on the command line.
+// Fields without a flag can only be set from the file and are always copied.
+func (c *Config) overrideWith(file Config, setFlags map[string]bool) {
+	dst := reflect.ValueOf(c).Elem()
+	src := reflect.ValueOf(file)
+	for i := 0; i < dst.NumField(); i++ {
+		name := dst.Type().Field(i).Tag.Get("flag")
+		if name != "" && setFlags[name] {
+			continue
+		}
+		dst.Field(i).Set(src.Field(i))
+	}
+}
+
+// validate checks that the configuration is complete and consistent.
+func (c *Config) validate() error {
+	sources, err := c.sourceConfigs()
+	if err != nil {
+		return err
+	}
+	if err := validateSources(sources); err != nil {
+		return err
+	}
+	if err := validateOnSuccess(c, sources); err != nil {
+		return err
+	}
+	if err := validateOnConflict(c, sources); err != nil {
+		return err
+	}
+	if c.CollisionCheck < 0 {
+		return errors.New("collision-check must not be negative")
+	}
+	if err := validateStabilityChecks(c); err != nil {
+		return err
+	}
+	if err := validateDigests(c); err != nil {
+		return err
+	}
+	if err := validateEncryption(c); err != nil {
+		return err
+	}
+	if err := validateTelemetry(c); err != nil {
+		return err
+	}
+	if err := validateIOMode(c); err != nil {
+		return err
+	}
+	if err := validateProducers(c); err != nil {
+		return err
+	}
+	if err := validateExcludeFromIndexing(c); err != nil {
+		return err
+	}
+	if err := validateHold(c); err != nil {
+		return err
+	}
+	if err := validateCredentials(c, sources); err != nil {
+		return err
+	}
+	if err := validateProtected(c, sources); err != nil {
+		return err
+	}
+	for _, sc := range sources {
+		info, err := os.Stat(sc.Path)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("source folder '%s' does not exist. Please create it or update --source parameter", sc.Path)
+		} else if err != nil {
+			return fmt.Errorf("checking source folder '%s': %v", sc.Path, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("source '%s' is not a folder", sc.Path)
+		}
+	}
+	if c.Concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1, got %d", c.Concurrency)
+	}
+	if c.HashWorkers < 0 {
+		return fmt.Errorf("hash-workers must not be negative, got %d", c.HashWorkers)
+	}
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("max-retries must not be negative, got %d", c.MaxRetries)
+	}
+	if c.KeyMaxAgeDays < 0 {
+		return fmt.Errorf("key-max-age-days must not be negative, got %d", c.KeyMaxAgeDays)
+	}
+	if c.DestIndexRefresh <= 0 {
+		return errors.New("dest-index-refresh must be positive")
+	}
+	if c.PollInterval < 0 {
+		return errors.New("poll-interval must not be negative")
+	}
+	if c.PollOnly && c.PollInterval == 0 {
+		return errors.New("poll-only needs a poll-interval")
+	}
+	if c.ReconnectInterval <= 0 {
+		return errors.New("reconnect-interval must be positive")
+	}
+	if c.ShutdownTimeout < 0 {
+		return errors.New("shutdown-timeout must not be negative")
+	}
+	if c.VerifyInterval <= 0 {
+		return errors.New("verify-interval must be positive")
+	}
+	if c.VerifyOnly && c.Observe {
+		return errors.New("verify-only and observe can't be combined")
+	}
+	if c.MinFileAge < 0 {
+		return errors.New("min-file-age must not be negative")
+	}
+	if c.MinSize < 0 || c.MaxSize < 0 {
+		return errors.New("min-size and max-size must not be negative")
+	}
+	if c.MaxSize > 0 && c.MinSize > c.MaxSize {
+		return errors.New("min-size must not be larger than max-size")
+	}
+	if c.ErrorSummary < 0 {
+		return errors.New("error-summary-interval must not be negative")
+	}
+	if c.RetryBaseDelay <= 0 {
+		return errors.New("retry-base-delay must be positive")
+	}
+	if c.ChunkSize < 0 {
+		return errors.New("chunk-size must not be negative")
+	}
+	if c.ProgressInterval <= 0 {
+		return errors.New("progress-interval must be positive")
+	}
+	if c.ChunkRetryDeadline <= 0 {
+		return errors.New("chunk-retry-deadline must be positive")
+	}
+	if c.UploadTimeout < 0 {
+		return errors.New("upload-timeout must not be negative")
+	}
+	if c.CompositeThreshold < 0 {
+		return errors.New("parallel-composite-threshold must not be negative")
+	}
+	if c.PartSetSettle <= 0 {
+		return errors.New("part-set-settle must be positive")
+	}
+	if c.BundleBelow < 0 {
+		return errors.New("bundle-below must not be negative")
+	}
+	if c.BundleBelow > 0 && c.BundleInterval <= 0 {
+		return errors.New("bundle-interval must be positive")
+	}
+	if c.BundleBelow > 0 && c.BundleSize <= 0 {
+		return errors.New("bundle-size must be positive")
+	}
+	if (c.BundleCompress || c.BundleManifest) && c.BundleBelow == 0 {
+		return errors.New("bundle-compress and bundle-manifest require --bundle-below")
+	}
+	if c.CompositeParts < 2 || c.CompositeParts > 32 {
+		return fmt.Errorf("composite-parts must be between 2 and 32, got %d", c.CompositeParts)
+	}
+	if c.MaxInflightBytes < 0 {
+		return errors.New("max-inflight-bytes must not be negative")
+	}
+	if c.MaterializeTimeout <= 0 {
+		return errors.New("materialize-timeout must be positive")
+	}
+	if c.Previews && strings.Trim(c.PreviewPrefix, "/") == "" {
+		return errors.New("preview-prefix must not be empty, or previews would mix with the uploaded objects")
+	}
+	if c.AlertWebhook != "" {
+		if u, err := url.Parse(c.AlertWebhook); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("alert-webhook must be an http(s) URL, got '%s'", c.AlertWebhook)
+		}
+	}
+	if c.ConfirmBacklog < 0 {
+		return errors.New("confirm-backlog must not be negative")
+	}
+	if c.KeyProfile == "" {
+		return errors.New("profile must not be empty")
+	}
+	if c.UndoWindow <= 0 {
+		return errors.New("undo-window must be positive")
+	}
+	if c.MaxDeletionRate < 0 {
+		return errors.New("max-deletions-per-minute must not be negative")
+	}
+	if c.BacklogThroughput <= 0 {
+		return errors.New("backlog-throughput must be positive")
+	}
+	if c.GCSEndpoint != "" {
+		if u, err := url.Parse(c.GCSEndpoint); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("gcs-endpoint must be an http(s) URL, got '%s'", c.GCSEndpoint)
+		}
+	}
+	if c.Proxy != "" {
+		if _, err := parseProxyURL(c.Proxy); err != nil {
+			return err
+		}
+	}
+	if c.HealthAddr != "" {
+		if _, _, err := net.SplitHostPort(c.HealthAddr); err != nil {
+			return fmt.Errorf("health-addr must be HOST:PORT, got '%s'", c.HealthAddr)
+		}
+	}
+	if err := validateMessageCatalog(c); err != nil {
+		return err
+	}
+	if err := validateNotify(c); err != nil {
+		return err
+	}
+	if err := validateCompanions(c); err != nil {
+		return err
+	}
+	if err := validateRetryPolicies(c); err != nil {
+		return err
+	}
+	if err := validateLogging(c); err != nil {
+		return err
+	}
+	if err := validateHardened(c); err != nil {
+		return err
+	}
+	if err := validateDedupe(c.Dedupe); err != nil {
+		return err
+	}
+	if err := validatePlaceholderPolicy(c.CloudPlaceholders); err != nil {
+		return err
+	}
+	if c.CanaryPercent < 0 || c.CanaryPercent > 100 {
+		return fmt.Errorf("canary-percent must be between 0 and 100, got %d", c.CanaryPercent)
+	}
+	if c.CanaryPercent > 0 && c.CanaryBucket == "" && c.CanaryPrefix == "" {
+		return errors.New("canary-percent needs a canary-bucket or canary-prefix that differs from the stable pipeline")
+	}
+	if _, err := compileFilenameTimePattern(c.FilenameTimePattern); err != nil {
+		return fmt.Errorf("invalid filename-time-pattern %q: %v", c.FilenameTimePattern, err)
+	}
+	if (c.FilenameTimePattern == "") != (c.FilenameTimeLayout == "") {
+		return errors.New("filename-time-pattern and filename-time-layout must be used together")
+	}
+	if c.StorageClass != "" {
+		if c.StorageClass, err = parseStorageClass(c.StorageClass); err != nil {
+			return err
+		}
+	}
+	for i, rule := range c.StorageClassRules {
+		if c.StorageClassRules[i].value, err = parseStorageClass(rule.value); err != nil {
+			return fmt.Errorf("storage-class-rule %s: %v", rule.filter.pattern, err)
+		}
+	}
+	if c.PredefinedACL != "" {
+		if c.PredefinedACL, err = parsePredefinedACL(c.PredefinedACL); err != nil {
+			return err
+		}
+	}
+	for i, rule := range c.ACLRules {
+		if c.ACLRules[i].value, err = parsePredefinedACL(rule.value); err != nil {
+			return fmt.Errorf("acl-rule %s: %v", rule.filter.pattern, err)
+		}
+	}
+	for _, rule := range c.TTLRules {
+		if _, err := parseTTLDays(rule.value); err != nil {
+			return fmt.Errorf("ttl-rule %s: %v", rule.filter.pattern, err)
+		}
+	}
+	templates := map[string]string{
+		"object-prefix":       c.ObjectPrefix,
+		"cache-control":       c.CacheControl,
+		"content-disposition": c.ContentDisposition,
+		"content-language":    c.ContentLanguage,
+	}
+	for key, value := range c.Metadata {
+		if key == "" || strings.ContainsAny(key, " =:") {
+			return fmt.Errorf("invalid metadata key %q", key)
+		}
+		templates["metadata "+key] = value
+	}
+	for name, tmpl := range templates {
+		if err := validateTemplate(tmpl); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", name, tmpl, err)
+		}
+		if strings.Contains(tmpl, "{camera}") && !c.UseEXIF {
+			return fmt.Errorf("invalid %s %q: {camera} needs --use-exif", name, tmpl)
+		}
+	}
+	if _, err := compilePathFilters(c.Include); err != nil {
+		return fmt.Errorf("include: %v", err)
+	}
+	if _, err := compilePathFilters(c.Exclude); err != nil {
+		return fmt.Errorf("exclude: %v", err)
+	}
+	if _, err := compilePathFilters(c.GzipPatterns); err != nil {
+		return fmt.Errorf("gzip-pattern: %v", err)
+	}
+	if (len(c.GzipPatterns) > 0 || c.GzipObjects) && !c.Gzip {
+		return errors.New("gzip-pattern and gzip-objects need --gzip")
+	}
+	for _, pattern := range c.WatchSubpaths {
+		if err := validateGlob(pattern); err != nil {
+			return fmt.Errorf("invalid watch-subpath pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
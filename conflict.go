@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// What happens to a file whose object already exists with different content (--on-conflict).
+// The file is never deleted in that case: the object name is taken by other data.
+const (
+	conflictFail       = "fail"       // Report an error and leave the file in place
+	conflictSkip       = "skip"       // Upload nothing and leave the file in place, without an error
+	conflictRename     = "rename"     // Upload it under a free name ("report (1).pdf")
+	conflictOverwrite  = "overwrite"  // Replace the object, unless it changed since it was compared
+	conflictVersion    = "version"    // Overwrite, keeping the old object as a noncurrent version
+	conflictQuarantine = "quarantine" // Move the file below --quarantine-dir without uploading it
+)
+
+// How --on-conflict=rename names the renamed object (--conflict-rename).
+const (
+	conflictRenameNumbered  = "numbered"  // "report (1).pdf", "report (2).pdf", ...
+	conflictRenameTimestamp = "timestamp" // "report-20250102T150405Z.pdf", then numbered
+)
+
+// maxConflictRenames is how many numbered suffixes --on-conflict=rename tries.
+const maxConflictRenames = 100
+
+// conflictError is returned when the object of a file already exists with different content.
+type conflictError struct {
+	generation int64 // Of the existing object
+	mismatch   error // Which checksum differs
+}
+
+func (e *conflictError) Error() string {
+	return fmt.Sprintf("object already exists with different content (%v)", e.mismatch)
+}
+
+// validateOnConflict checks the --on-conflict, --quarantine-after and --quarantine-dir
+// settings against the sources.
+func validateOnConflict(c *Config, sources []SourceConfig) error {
+	if c.ConflictRename != conflictRenameNumbered && c.ConflictRename != conflictRenameTimestamp {
+		return fmt.Errorf("conflict-rename must be %q or %q, got %q", conflictRenameNumbered, conflictRenameTimestamp, c.ConflictRename)
+	}
+	switch c.OnConflict {
+	case conflictFail, conflictSkip, conflictRename, conflictOverwrite, conflictVersion:
+	case conflictQuarantine:
+		if c.QuarantineDir == "" {
+			return errors.New("on-conflict=quarantine needs a quarantine-dir")
+		}
+	default:
+		return fmt.Errorf("on-conflict must be %q, %q, %q, %q, %q or %q, got %q", conflictFail, conflictSkip, conflictRename, conflictOverwrite, conflictVersion, conflictQuarantine, c.OnConflict)
+	}
+	if c.QuarantineAfter < 0 {
+		return errors.New("quarantine-after must not be negative")
+	}
+	if c.QuarantineAfter > 0 && c.QuarantineDir == "" {
+		return errors.New("quarantine-after needs a quarantine-dir")
+	}
+	if c.QuarantineDir == "" {
+		return nil
+	}
+	quarantine := filepath.Clean(c.QuarantineDir)
+	for _, sc := range sources {
+		// A quarantine inside a watched folder would have its files picked up again
+		if isWithin(quarantine, sc.Path) {
+			return fmt.Errorf("quarantine-dir '%s' must not be inside source '%s'", c.QuarantineDir, sc.Path)
+		}
+	}
+	return nil
+}
+
+// resolveConflict applies --on-conflict (other than fail) to filePath from src after
+// uploading f to target found a different object there. It returns the outcome as an audit
+// event, the target the file ended up at and, like uploadFile, the attributes of its object.
+func resolveConflict(ctx context.Context, src *watchSource, f *os.File, filePath string, target uploadTarget, conflict *conflictError) (string, uploadTarget, *storage.ObjectAttrs, error) {
+	logger := slog.With("file", filePath, "bucket", target.Bucket, "object", target.Object, "on_conflict", cfg.OnConflict)
+	upload := func(target uploadTarget) (outcome string, object *storage.ObjectAttrs, err error) {
+		err = withRetries(fmt.Sprintf("uploading %s", filePath), func() error {
+			return withUploadTimeout(ctx, func(ctx context.Context) (err error) {
+				outcome, object, err = uploadFile(ctx, f, target)
+				return err
+			})
+		})
+		return outcome, object, err
+	}
+
+	switch cfg.OnConflict {
+	case conflictSkip:
+		logger.Warn("Object exists with different content, leaving the file in place", "error", conflict)
+		return auditSkipped, target, nil, nil
+	case conflictQuarantine:
+		dest, err := archiveFile(filePath, filepath.Join(cfg.QuarantineDir, filepath.FromSlash(src.relativePath(filePath))))
+		if err != nil {
+			return "", target, nil, fmt.Errorf("moving to quarantine after %v: %w", conflict, err)
+		}
+		logger.Warn("Object exists with different content, moved the file to quarantine", "quarantine", dest, "error", conflict)
+		return auditQuarantined, target, nil, nil
+	case conflictOverwrite, conflictVersion:
+		if cfg.OnConflict == conflictVersion {
+			versioned, err := bucketVersioned(ctx, target)
+			if err != nil {
+				return "", target, nil, fmt.Errorf("%w, and checking bucket versioning failed: %v", conflict, err)
+			}
+			if !versioned {
+				return "", target, nil, fmt.Errorf("%w, and bucket versioning is off, so it would be lost", conflict)
+			}
+		}
+		logger.Warn("Object exists with different content, overwriting it", "error", conflict)
+		target.Replace = conflict.generation
+		outcome, object, err := upload(target)
+		if outcome == auditUploaded {
+			outcome = auditOverwritten
+		}
+		return outcome, target, object, err
+	default:
+		stamp := ""
+		if cfg.ConflictRename == conflictRenameTimestamp {
+			stamp = time.Now().UTC().Format("20060102T150405Z")
+		}
+		for n := 1; n <= maxConflictRenames; n++ {
+			renamed := target
+			renamed.Object = renamedObject(target.Object, stamp, n)
+			outcome, object, err := upload(renamed)
+			if errors.As(err, new(*conflictError)) {
+				continue
+			}
+			if err == nil {
+				logger.Warn("Object exists with different content, uploaded the file under another name", "renamed", renamed.Object, "error", conflict)
+			}
+			return outcome, renamed, object, err
+		}
+		return "", target, nil, fmt.Errorf("%v, and so do the first %d renamed objects", conflict, maxConflictRenames)
+	}
+}
+
+// renamedObject returns the n-th name --on-conflict=rename tries for object: "name (n).ext",
+// or with a timestamp "name-stamp.ext" first and "name-stamp (n-1).ext" after that.
+func renamedObject(object, stamp string, n int) string {
+	ext := path.Ext(object)
+	stem := strings.TrimSuffix(object, ext)
+	if stamp != "" {
+		stem += "-" + stamp
+		n--
+	}
+	if n == 0 {
+		return stem + ext
+	}
+	return fmt.Sprintf("%s (%d)%s", stem, n, ext)
+}
+
+// bucketVersioned reports whether the bucket of target keeps noncurrent object versions.
+func bucketVersioned(ctx context.Context, target uploadTarget) (bool, error) {
+	client, err := clients.get(target.Credentials)
+	if err != nil {
+		return false, err
+	}
+	attrs, err := client.Bucket(target.Bucket).Attrs(ctx)
+	if err != nil {
+		return false, err
+	}
+	return attrs.VersioningEnabled, nil
+}
+
+// conflictMessage returns the notification message, with its parameters, of what
+// --on-conflict did with filePath, whose object conflicted with an existing one; target is
+// where it was uploaded to in the end.
+func conflictMessage(filePath, object string, target uploadTarget, outcome string) (string, []any) {
+	args := []any{"file", filePath, "bucket", target.Bucket, "object", object, "on_conflict", cfg.OnConflict}
+	switch outcome {
+	case auditQuarantined:
+		return msgConflictQuarantined, append(args, "quarantine", cfg.QuarantineDir)
+	case auditSkipped:
+		return msgConflictSkipped, args
+	case auditOverwritten:
+		return msgUploadedOverwritten, args
+	}
+	return msgUploadedRenamed, []any{"file", filePath, "bucket", target.Bucket, "object", target.Object, "conflict", object, "on_conflict", cfg.OnConflict}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// contentTypeFor picks the Content-Type of filePath: the first matching --content-type-rule,
+// then --content-type, then the type registered for its extension, and finally the type
+// sniffed from its first 512 bytes.
+func contentTypeFor(src *watchSource, filePath string) string {
+	if ct, ok := cfg.ContentTypeRules.lookup(src.relativePath(filePath)); ok {
+		return ct
+	}
+	if cfg.ContentType != "" {
+		return cfg.ContentType
+	}
+
+	name := filePath
+	gzipped := gzipEncoded(filePath)
+	if gzipped {
+		// Served decompressed, so the type is that of the content: "app.log.gz" is a .log
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+		return ct
+	}
+	if gzipped {
+		return "application/octet-stream" // Sniffing would only see compressed bytes
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := f.Read(buf)
+	if n == 0 {
+		return ""
+	}
+	return http.DetectContentType(buf[:n])
+}
+
+// gzipEncoded reports whether filePath is uploaded with Content-Encoding: gzip (--gzip-encoding).
+func gzipEncoded(filePath string) bool {
+	return cfg.GzipEncoding && strings.EqualFold(filepath.Ext(filePath), ".gz")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Requests accepted on the control socket.
+const (
+	controlStop    = "stop"    // Drain the uploads and exit
+	controlRestart = "restart" // Drain the uploads and start again with the same arguments
+
+	controlResumeDeletions = "resume-deletions" // Lift the --max-deletions-per-minute pause
+)
+
+// controlServer listens on the control socket of the state directory for the requests
+// sent by the `stop`, `restart` and `resume-deletions` subcommands. A request is answered
+// right away; for stop and restart the connection then stays open until the process exits
+// or restarts, which tells the subcommand that the uploader is done.
+type controlServer struct {
+	listener net.Listener
+	requests chan string
+}
+
+// listenControl opens the control socket of dir. It fails if another uploader is
+// already listening on it.
+func listenControl(dir *stateDir) (*controlServer, error) {
+	path := dir.file(stateControlSocket)
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another uploader is already listening on '%s'", path)
+	}
+	// A socket left behind by a process that didn't exit cleanly
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	s := &controlServer{listener: listener, requests: make(chan string, 1)}
+	go s.serve()
+	return s, nil
+}
+
+// serve accepts connections until the listener is closed.
+func (s *controlServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle reads one request from conn and passes it on to main.
+func (s *controlServer) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return
+	}
+	request := strings.TrimSpace(line)
+	switch request {
+	case controlResumeDeletions:
+		fmt.Fprintf(conn, "ok %d\n", deletions.resume())
+		conn.Close()
+		return
+	case controlStop:
+	case controlRestart:
+		if cfg.Hardened {
+			// Restarting means executing the binary again
+			fmt.Fprintln(conn, "error: restart is disabled in hardened mode, use stop and let the service manager start the uploader")
+			conn.Close()
+			return
+		}
+	default:
+		fmt.Fprintf(conn, "error: unknown request %q\n", request)
+		conn.Close()
+		return
+	}
+	select {
+	case s.requests <- request:
+		slog.Info("Received request on the control socket", "request", request)
+		fmt.Fprintln(conn, "ok")
+		// conn is left open and closes with the process (sockets are close-on-exec)
+	default:
+		fmt.Fprintln(conn, "error: a stop or restart is already in progress")
+		conn.Close()
+	}
+}
+
+// close stops listening and removes the socket file.
+func (s *controlServer) close() {
+	s.listener.Close()
+}
+
+// runControlCommand implements the `stop`, `restart` and `resume-deletions` subcommands: it
+// sends the request to the uploader running with the given state directory and, for stop
+// and restart, waits until it is done.
+func runControlCommand(request string, args []string) error {
+	fs := flag.NewFlagSet(request, flag.ExitOnError)
+	dir := fs.String("state-dir", "", "State directory of the running uploader (defaults to the platform data directory).")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return fmt.Errorf("usage: %s [--state-dir DIR]", request)
+	}
+	if *dir == "" {
+		var err error
+		if *dir, err = defaultStateDir(); err != nil {
+			return fmt.Errorf("could not determine default state directory: %v", err)
+		}
+	}
+
+	conn, err := net.Dial("unix", filepath.Join(*dir, stateControlSocket))
+	if err != nil {
+		return fmt.Errorf("no running uploader found for state directory '%s': %v", *dir, err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, request); err != nil {
+		return fmt.Errorf("sending %s request: %v", request, err)
+	}
+	reader := bufio.NewReader(conn)
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("reading reply to %s request: %v", request, err)
+	}
+	if msg, isErr := strings.CutPrefix(strings.TrimSpace(reply), "error: "); isErr {
+		return errors.New(msg)
+	}
+	if request == controlResumeDeletions {
+		held := strings.TrimPrefix(strings.TrimSpace(reply), "ok ")
+		log.Printf("Deletions resumed, %s held files are being deleted or moved.", held)
+		return nil
+	}
+	log.Printf("Uploader is finishing its queued uploads before it %ss...", request)
+	io.Copy(io.Discard, reader) // Returns once the uploader has exited or restarted
+	if request == controlRestart {
+		log.Println("Uploader restarted.")
+	} else {
+		log.Println("Uploader stopped.")
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Authentication strategies of a credential profile.
+const (
+	authKeychainKey   = "keychain-key"  // Service account key stored in the keystore (Keychain, Secret Service, Credential Manager)
+	authImpersonation = "impersonation" // Impersonating a service account
+	authExternal      = "external"      // Workload identity federation config (external_account)
+	authUser          = "user"          // User credentials stored by `login`
+	authADC           = "adc"           // Application Default Credentials
+)
+
+// CredentialProfile is a named way to authenticate, defined in the `credentials` section of
+// the config file. A source selects one with its `credentials` key, so buckets of different
+// projects or organizations are each reached with their own identity and client.
+type CredentialProfile struct {
+	KeychainAccount string `yaml:"keychain_account" toml:"keychain_account"` // Keystore profile holding a service account key (see --profile)
+	ImpersonateSA   string `yaml:"impersonate_sa" toml:"impersonate_sa"`     // Service account to impersonate
+	ExternalAccount string `yaml:"external_account" toml:"external_account"` // Workload identity federation config file (see --external-account)
+	Login           string `yaml:"login" toml:"login"`                       // Keystore profile of user credentials stored with `login`
+	Project         string `yaml:"project" toml:"project"`                   // Quota project; defaults to --project
+}
+
+// credentialsConfig is the `credentials` section of the config file: credential profiles by name.
+type credentialsConfig map[string]CredentialProfile
+
+// resolvedCredentials is a credential profile ready to build a client from.
+type resolvedCredentials struct {
+	Strategy        string // authKeychainKey, authUser, authImpersonation, authExternal or authADC
+	Key             []byte // Service account key (authKeychainKey) or user credentials (authUser)
+	KeychainAccount string // Keystore profile of Key
+	ImpersonateSA   string
+	ExternalAccount string
+	Project         string
+}
+
+// credentialsFor resolves the named credential profile. The default profile "" follows the
+// top-level settings: the key of --profile in the keystore if there is one, else the user
+// credentials of `login --profile`, else --external-account, else --impersonate-sa, else
+// Application Default Credentials. A named profile uses exactly what it configures, with
+// Application Default Credentials when it configures neither a key, a login, federation
+// nor impersonation.
+func credentialsFor(profile string) (resolvedCredentials, error) {
+	if profile == "" {
+		creds := resolvedCredentials{Strategy: authADC, ImpersonateSA: cfg.ImpersonateSA, ExternalAccount: cfg.ExternalAccount, Project: cfg.Project}
+		if key, err := getServiceAccountKey(cfg.KeyProfile); err == nil && len(key) > 0 {
+			creds.Strategy, creds.Key, creds.KeychainAccount = authKeychainKey, key, cfg.KeyProfile
+		} else if user, err := getUserCredentials(cfg.KeyProfile); err == nil && len(user) > 0 {
+			creds.Strategy, creds.Key, creds.KeychainAccount = authUser, user, cfg.KeyProfile
+		} else if cfg.ExternalAccount != "" {
+			creds.Strategy = authExternal
+		} else if cfg.ImpersonateSA != "" {
+			creds.Strategy = authImpersonation
+		}
+		return creds, nil
+	}
+	p, ok := cfg.Credentials[profile]
+	if !ok {
+		return resolvedCredentials{}, fmt.Errorf("unknown credential profile '%s'", profile)
+	}
+	creds := resolvedCredentials{Strategy: authADC, ImpersonateSA: p.ImpersonateSA, ExternalAccount: p.ExternalAccount, Project: cmp.Or(p.Project, cfg.Project)}
+	switch {
+	case p.KeychainAccount != "":
+		key, err := getServiceAccountKey(p.KeychainAccount)
+		if err != nil {
+			return creds, err
+		}
+		creds.Strategy, creds.Key, creds.KeychainAccount = authKeychainKey, key, p.KeychainAccount
+	case p.Login != "":
+		user, err := getUserCredentials(p.Login)
+		if err != nil {
+			return creds, err
+		}
+		creds.Strategy, creds.Key, creds.KeychainAccount = authUser, user, p.Login
+	case p.ExternalAccount != "":
+		creds.Strategy = authExternal
+	case p.ImpersonateSA != "":
+		creds.Strategy = authImpersonation
+	}
+	return creds, nil
+}
+
+// profileName returns how a credential profile is called in logs.
+func profileName(profile string) string {
+	if profile == "" {
+		return "default"
+	}
+	return profile
+}
+
+// credentialProfilesInUse returns the credential profiles the sources select, sorted.
+func credentialProfilesInUse() []string {
+	seen := make(map[string]bool)
+	var profiles []string
+	for _, src := range sources {
+		if !seen[src.Credentials] {
+			seen[src.Credentials] = true
+			profiles = append(profiles, src.Credentials)
+		}
+	}
+	sort.Strings(profiles)
+	return profiles
+}
+
+// validateCredentials checks the credential profiles and the sources' references to them.
+func validateCredentials(c *Config, sources []SourceConfig) error {
+	for name, p := range c.Credentials {
+		if name == "" || name == "default" {
+			return fmt.Errorf("credential profile name '%s' is reserved for the top-level settings", name)
+		}
+		set := 0
+		for _, v := range []string{p.KeychainAccount, p.Login, p.ImpersonateSA, p.ExternalAccount} {
+			if v != "" {
+				set++
+			}
+		}
+		if set > 1 {
+			return fmt.Errorf("credential profile '%s' sets more than one of keychain_account, login, impersonate_sa and external_account", name)
+		}
+		if p.ExternalAccount != "" {
+			if err := checkExternalAccount(p.ExternalAccount, c.Hardened); err != nil {
+				return fmt.Errorf("credential profile '%s': %v", name, err)
+			}
+		}
+	}
+	if c.ExternalAccount != "" {
+		if c.ImpersonateSA != "" {
+			return errors.New("external-account and impersonate-sa can't be combined; set service_account_impersonation_url in the external account config instead")
+		}
+		if err := checkExternalAccount(c.ExternalAccount, c.Hardened); err != nil {
+			return err
+		}
+	}
+	for _, sc := range sources {
+		if _, ok := c.Credentials[sc.Credentials]; sc.Credentials != "" && !ok {
+			return fmt.Errorf("source '%s' uses unknown credential profile '%s'", sc.Path, sc.Credentials)
+		}
+	}
+	return nil
+}
+
+// externalAccountTypes are the credential configuration types of workload and workforce
+// identity federation.
+var externalAccountTypes = map[string]bool{
+	"external_account":                 true, // Workload identity federation (AWS, Azure, OIDC, SAML, X.509)
+	"external_account_authorized_user": true, // Workforce identity federation via gcloud
+}
+
+// checkExternalAccount checks that path is a workload identity federation configuration,
+// as written by 'gcloud iam workload-identity-pools create-cred-config'. Hardened mode
+// refuses configs that get their subject token by running a program.
+func checkExternalAccount(path string, hardened bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading external account config: %v", err)
+	}
+	var config struct {
+		Type             string `json:"type"`
+		CredentialSource struct {
+			Executable json.RawMessage `json:"executable"`
+		} `json:"credential_source"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("external account config '%s': %v", path, err)
+	}
+	if !externalAccountTypes[config.Type] {
+		return fmt.Errorf("'%s' is not an external account config (type '%s'); a service account key belongs in the keystore (--set-sa-key-path)", path, config.Type)
+	}
+	if hardened && config.CredentialSource.Executable != nil {
+		return fmt.Errorf("external account config '%s' runs an executable for its subject token, which hardened mode doesn't allow", path)
+	}
+	return nil
+}
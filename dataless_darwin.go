@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// sfDataless is SF_DATALESS from <sys/stat.h>: the file's content lives in the cloud
+// (File Provider / iCloud placeholder) and has not been materialized locally yet.
+const sfDataless = 0x40000000
+
+// isDataless reports whether filePath is a cloud placeholder whose content is not on disk.
+func isDataless(filePath string) (bool, error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(filePath, &st); err != nil {
+		return false, err
+	}
+	return st.Flags&sfDataless != 0, nil
+}
+
+// requestDownload asks iCloud Drive / File Provider to download filePath, as Finder's
+// "Download Now" does. It returns once the request is queued, not when the content arrives.
+func requestDownload(filePath string) error {
+	out, err := exec.Command("brctl", "download", filePath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("brctl download: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
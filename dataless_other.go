@@ -0,0 +1,15 @@
+//go:build !darwin
+
+package main
+
+import "errors"
+
+// isDataless reports whether filePath is a cloud placeholder. Only macOS has dataless files.
+func isDataless(filePath string) (bool, error) {
+	return false, nil
+}
+
+// requestDownload asks the sync client to download filePath. Only macOS supports this.
+func requestDownload(filePath string) error {
+	return errors.New("downloading cloud placeholders is only supported on macOS")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// What to do when a file's content already exists in the destination under another name (--dedupe).
+const (
+	dedupeOff  = "off"  // Always upload
+	dedupeCopy = "copy" // Create the object with a server-side copy of the existing one
+	dedupeSkip = "skip" // Don't create the object at all
+)
+
+// validateDedupe checks a --dedupe value.
+func validateDedupe(mode string) error {
+	switch mode {
+	case dedupeOff, dedupeCopy, dedupeSkip:
+		return nil
+	}
+	return fmt.Errorf("dedupe must be %q, %q or %q, got %q", dedupeOff, dedupeCopy, dedupeSkip, mode)
+}
+
+// findDuplicate lists the objects under prefix in bucket and returns one with the same size
+// and checksums as the local file, or nil if there is none.
+func findDuplicate(ctx context.Context, client *storage.Client, bucket, prefix string, size int64, sums *checksums) (*storage.ObjectAttrs, error) {
+	query := &storage.Query{Prefix: prefix}
+	if err := query.SetAttrSelection([]string{"Name", "Size", "CRC32C", "MD5"}); err != nil {
+		return nil, err
+	}
+	crc := sums.crc32c.Sum32()
+	md5sum := sums.md5.Sum(nil)
+	it := client.Bucket(bucket).Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if attrs.Size == size && attrs.CRC32C == crc && (len(attrs.MD5) == 0 || bytes.Equal(attrs.MD5, md5sum)) {
+			return attrs, nil
+		}
+	}
+}
+
+// dedupeFile checks whether the content of f already exists under the destination prefix
+// of target and, if so, applies --dedupe to it instead of uploading. It returns the outcome
+// (auditCopied or auditDuplicate), or "" if the file has to be uploaded.
+func dedupeFile(ctx context.Context, client *storage.Client, f *os.File, target uploadTarget) (string, error) {
+	sums, err := uploadChecksums(f, target)
+	if err != nil {
+		return "", fmt.Errorf("reading file: %w", err)
+	}
+	var dup *storage.ObjectAttrs
+	if idx := destIndexFor(target); idx != nil {
+		dup, err = idx.find(ctx, client, sums.size, sums)
+	} else {
+		dup, err = findDuplicate(ctx, client, target.Bucket, target.ListPrefix, sums.size, sums)
+	}
+	if err != nil {
+		return "", fmt.Errorf("listing gs://%s/%s for duplicates: %w", target.Bucket, target.ListPrefix, err)
+	}
+	if dup == nil {
+		return "", nil
+	}
+	if cfg.Dedupe == dedupeSkip {
+		slog.Info("Content already exists in GCS, not uploading it", "file", f.Name(), "bucket", target.Bucket, "duplicate", dup.Name)
+		return auditDuplicate, nil
+	}
+
+	bucket := client.Bucket(target.Bucket)
+	copier := encrypted(bucket.Object(target.Object)).If(storage.Conditions{DoesNotExist: true}).CopierFrom(encrypted(bucket.Object(dup.Name)))
+	copier.StorageClass = target.StorageClass
+	copier.DestinationKMSKeyName = cfg.KMSKey
+	copier.PredefinedACL = target.PredefinedACL
+	objectWrites.wait(target.Bucket, target.Object)
+	attrs, err := copier.Run(ctx)
+	if err != nil {
+		return "", fmt.Errorf("copying gs://%s/%s: %w", target.Bucket, dup.Name, err)
+	}
+	if err := sums.verify(attrs); err != nil {
+		return "", err
+	}
+	recordObject(target, attrs)
+	slog.Info("Content already exists in GCS, created the object as a server-side copy", "file", f.Name(), "bucket", target.Bucket, "object", target.Object, "duplicate", dup.Name)
+	return auditCopied, nil
+}
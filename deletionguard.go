@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// deletionGuard is the safety valve of --max-deletions-per-minute. When more local files
+// are deleted or moved within a minute than allowed, which suggests the uploader is working
+// through a tree it was never meant to see, removals pause: uploads go on, but the files
+// stay in place and are held until an operator confirms with `resume-deletions`. Held files
+// are recorded in the state directory, so they stay held across restarts.
+type deletionGuard struct {
+	mu     sync.Mutex
+	recent []time.Time // Removals within the last minute
+	paused bool
+	held   map[string]heldDeletion
+}
+
+// heldDeletion is a file whose --on-success removal waits for `resume-deletions`, as it
+// was uploaded.
+type heldDeletion struct {
+	File    string    `json:"file"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Bucket  string    `json:"bucket"`
+	Object  string    `json:"object"`
+}
+
+var deletions deletionGuard
+
+// load reads the files held by a previous run from dir. Deletions stay paused while there are any.
+func (g *deletionGuard) load(dir *stateDir) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.held = make(map[string]heldDeletion)
+	err := dir.readJSONLines(stateHeldFile, func(line []byte) error {
+		var h heldDeletion
+		if err := json.Unmarshal(line, &h); err != nil {
+			return err
+		}
+		g.held[h.File] = h
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) { // Not carried over by state import
+		return err
+	}
+	if len(g.held) > 0 {
+		g.paused = true
+		slog.Error("Deletions are paused: files of a previous run are held until confirmed with resume-deletions; uploads continue", "held_files", len(g.held))
+	}
+	if dir.readOnly {
+		return nil
+	}
+	return g.save(dir)
+}
+
+// save rewrites the held files of dir, which compacts it. It must be called with g.mu held.
+func (g *deletionGuard) save(dir *stateDir) error {
+	records := make([]any, 0, len(g.held))
+	for _, filePath := range slices.Sorted(maps.Keys(g.held)) {
+		records = append(records, g.held[filePath])
+	}
+	return dir.writeJSONLines(stateHeldFile, records)
+}
+
+// allow reports whether filePath may be removed now. If not, the file is held and,
+// when this trips the limit, the operator is alerted.
+func (g *deletionGuard) allow(filePath string, info os.FileInfo, target uploadTarget) bool {
+	if cfg.MaxDeletionRate == 0 {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for len(g.recent) > 0 && now.Sub(g.recent[0]) >= time.Minute {
+		g.recent = g.recent[1:]
+	}
+	if !g.paused && len(g.recent) < cfg.MaxDeletionRate {
+		g.recent = append(g.recent, now)
+		return true
+	}
+	h := heldDeletion{File: filePath, Size: info.Size(), ModTime: info.ModTime(), Bucket: target.Bucket, Object: target.Object}
+	if g.held == nil {
+		g.held = make(map[string]heldDeletion)
+	}
+	g.held[filePath] = h
+	if appState != nil {
+		if err := appState.appendJSONLine(stateHeldFile, h); err != nil {
+			slog.Error("Error recording held file in the state directory", "file", filePath, "error", err)
+		}
+	}
+	if !g.paused {
+		g.paused = true
+		slog.Error("Too many local files removed, pausing deletions until confirmed with resume-deletions; uploads continue",
+			"max_deletions_per_minute", cfg.MaxDeletionRate, "on_success", cfg.OnSuccess)
+		notify(notifyAlert, msgDeletionsPaused, "max", cfg.MaxDeletionRate)
+	}
+	return false
+}
+
+// holds reports whether filePath, as described by info, is uploaded and held for
+// `resume-deletions`, so it isn't uploaded again.
+func (g *deletionGuard) holds(filePath string, info os.FileInfo) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	h, ok := g.held[filePath]
+	return ok && h.Size == info.Size() && h.ModTime.Equal(info.ModTime())
+}
+
+// heldCount returns how many files wait for `resume-deletions`.
+func (g *deletionGuard) heldCount() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.held)
+}
+
+// resume lifts the pause and applies --on-success to the held files in the background;
+// files that changed since their upload are queued again instead. It returns the number of held files.
+func (g *deletionGuard) resume() int {
+	g.mu.Lock()
+	held := g.held
+	g.held, g.recent, g.paused = nil, nil, false
+	if appState != nil {
+		if err := g.save(appState); err != nil {
+			slog.Error("Error clearing held files in the state directory", "error", err)
+		}
+	}
+	g.mu.Unlock()
+	slog.Info("Deletions resumed", "held_files", len(held))
+	go func() {
+		for _, filePath := range slices.Sorted(maps.Keys(held)) {
+			h := held[filePath]
+			logger := slog.With("file", filePath)
+			src := sourceOf(sources, filePath)
+			info, err := os.Stat(filePath)
+			if src == nil || err != nil {
+				logger.Info("Held file is gone or no longer watched, leaving it")
+				continue
+			}
+			if info.Size() != h.Size || !info.ModTime().Equal(h.ModTime) {
+				logger.Info("Held file has changed since its upload, queuing it again")
+				processFileWrapper(src, filePath)
+				continue
+			}
+			done, err := applyOnSuccess(src, filePath, info, uploadTarget{Bucket: h.Bucket, Object: h.Object})
+			if err != nil {
+				logger.Error("Error handling held local file", "on_success", cfg.OnSuccess, "error_code", errorCode(err), "error", err)
+				continue
+			}
+			logger.Info("Held local file handled", "local", done)
+		}
+	}()
+	return len(held)
+}
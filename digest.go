@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"maps"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"lukechampine.com/blake3"
+)
+
+// digestAlgorithms are the digests --digest can add to the CRC32C and MD5 of GCS, by name.
+// The name is also the object metadata key of the hex digest.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// validateDigests checks the --digest algorithms.
+func validateDigests(c *Config) error {
+	for i, name := range c.Digests {
+		name = strings.ToLower(name)
+		if _, ok := digestAlgorithms[name]; !ok {
+			return fmt.Errorf("unknown digest %q; supported: %s", c.Digests[i], strings.Join(slices.Sorted(maps.Keys(digestAlgorithms)), ", "))
+		}
+		c.Digests[i] = name
+	}
+	return nil
+}
+
+// digestMetadata returns the --digest digests of the data written to c, as object metadata.
+func (c *checksums) digestMetadata() map[string]string {
+	if len(c.digests) == 0 {
+		return nil
+	}
+	metadata := make(map[string]string, len(c.digests))
+	for name, h := range c.digests {
+		metadata[name] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return metadata
+}
+
+// withDigests returns metadata with the --digest digests of sums added.
+func withDigests(metadata map[string]string, sums *checksums) map[string]string {
+	digests := sums.digestMetadata()
+	if len(digests) == 0 {
+		return metadata
+	}
+	merged := maps.Clone(metadata)
+	if merged == nil {
+		merged = make(map[string]string, len(digests))
+	}
+	maps.Copy(merged, digests)
+	return merged
+}
+
+// hasDigests reports whether the object of attrs carries the --digest digests of sums.
+func hasDigests(attrs *storage.ObjectAttrs, sums *checksums) bool {
+	for name, value := range sums.digestMetadata() {
+		if attrs.Metadata[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// recordDigests adds the --digest digests of sums to the metadata of obj, the object of
+// attrs that was just written: a streamed upload only knows them at its end. Only that
+// version of the object is updated.
+func recordDigests(ctx context.Context, obj *storage.ObjectHandle, attrs *storage.ObjectAttrs, sums *checksums) (*storage.ObjectAttrs, error) {
+	cond := storage.Conditions{GenerationMatch: attrs.Generation, MetagenerationMatch: attrs.Metageneration}
+	return obj.If(cond).Update(ctx, storage.ObjectAttrsToUpdate{Metadata: withDigests(attrs.Metadata, sums)})
+}
+
+// objectDigests returns the --digest digests recorded in the metadata of object.
+func objectDigests(object *storage.ObjectAttrs) map[string]string {
+	var digests map[string]string
+	for _, name := range cfg.Digests {
+		if value, ok := object.Metadata[name]; ok {
+			if digests == nil {
+				digests = make(map[string]string)
+			}
+			digests[name] = value
+		}
+	}
+	return digests
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+
+	"cloud.google.com/go/storage"
+)
+
+// kmsKeyPattern matches the resource name of a Cloud KMS key (--kms-key).
+var kmsKeyPattern = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+// csekKey is the customer-supplied AES-256 key of --csek-key-file, read at startup; nil
+// without one.
+var csekKey []byte
+
+// validateEncryption checks --kms-key and --csek-key-file. An object is encrypted with
+// either, never both.
+func validateEncryption(c *Config) error {
+	if c.KMSKey != "" && c.CSEKKeyFile != "" {
+		return errors.New("kms-key and csek-key-file can't be used together")
+	}
+	if c.KMSKey != "" && !kmsKeyPattern.MatchString(c.KMSKey) {
+		return fmt.Errorf("kms-key must be a key resource name (projects/P/locations/L/keyRings/R/cryptoKeys/K), got %q", c.KMSKey)
+	}
+	return nil
+}
+
+// loadCSEK reads the customer-supplied encryption key of --csek-key-file: 32 bytes, raw or
+// base64-encoded (as `openssl rand -base64 32` prints it).
+func loadCSEK(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("the file must hold a 256-bit AES key, as 32 bytes or base64-encoded")
+	}
+	return key, nil
+}
+
+// encrypted returns obj with the customer-supplied key of --csek-key-file, if there is
+// one. Every handle that writes or reads an object's content needs it, and so does one
+// that reads its checksums. Sources of a compose are the exception: they are decrypted with
+// the key of the destination.
+func encrypted(obj *storage.ObjectHandle) *storage.ObjectHandle {
+	if csekKey == nil {
+		return obj
+	}
+	return obj.Key(csekKey)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"net"
+	"net/http"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// Error codes classify failures for alerting: they appear as error_code in the logs, in
+// the failures of /healthz, in webhooks and notifications, and decide the exit code of
+// --once. They are stable; new ones may be added but existing ones never change meaning.
+const (
+	errCodeAuth          = "AUTH"            // Credentials don't work: fix or rotate them
+	errCodePermission    = "PERMISSION"      // Credentials work but lack access (IAM), or a local file isn't readable
+	errCodeNotFoundLocal = "NOT_FOUND_LOCAL" // The local file disappeared
+	errCodeNetwork       = "NETWORK"         // GCS unreachable, timeouts, server errors: usually transient
+	errCodeQuota         = "QUOTA"           // Rate limited or out of quota
+	errCodePrecondition  = "PRECONDITION"    // The object changed under a conditional request
+	errCodeCorrupt       = "CORRUPT"         // Checksums didn't match, the object was removed
+	errCodeUnknown       = "UNKNOWN"
+	errCodeConflict      = "CONFLICT" // A different object already exists under the file's name
+)
+
+// errorCodes lists the codes by priority, which decides the exit code when files failed
+// for different reasons; the exit code is 10 plus the index. Codes added later go last,
+// so the exit codes of the others stay the same.
+var errorCodes = []string{errCodeAuth, errCodePermission, errCodeNotFoundLocal, errCodeNetwork, errCodeQuota, errCodePrecondition, errCodeCorrupt, errCodeUnknown, errCodeConflict}
+
+// errorCode classifies err.
+func errorCode(err error) string {
+	var apiErr *googleapi.Error
+	switch {
+	case isAuthError(err):
+		return errCodeAuth
+	case errors.As(err, new(*conflictError)):
+		return errCodeConflict
+	case errors.Is(err, errChecksumMismatch):
+		return errCodeCorrupt
+	case errors.Is(err, fs.ErrNotExist):
+		return errCodeNotFoundLocal
+	case errors.Is(err, fs.ErrPermission):
+		return errCodePermission
+	case errors.As(err, &apiErr):
+		switch {
+		case apiErr.Code == http.StatusTooManyRequests || isQuotaReason(apiErr):
+			return errCodeQuota
+		case apiErr.Code == http.StatusForbidden:
+			return errCodePermission
+		case apiErr.Code == http.StatusPreconditionFailed:
+			return errCodePrecondition
+		case apiErr.Code >= 500:
+			return errCodeNetwork
+		}
+		return errCodeUnknown
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errUploadTimeout) || errors.Is(err, io.ErrUnexpectedEOF) || storage.ShouldRetry(err) {
+		return errCodeNetwork
+	}
+	return errCodeUnknown
+}
+
+// isQuotaReason reports whether a 403 is about quota or rate limits rather than access.
+func isQuotaReason(apiErr *googleapi.Error) bool {
+	for _, item := range apiErr.Errors {
+		switch item.Reason {
+		case "rateLimitExceeded", "userRateLimitExceeded", "quotaExceeded", "dailyLimitExceeded":
+			return true
+		}
+	}
+	return false
+}
+
+// failures counts failed files by error code.
+var failures = struct {
+	mu     sync.Mutex
+	byCode map[string]int64
+}{byCode: make(map[string]int64)}
+
+// countFailure counts a file that failed with the given error code.
+func countFailure(code string) {
+	failedFiles.Add(1)
+	failures.mu.Lock()
+	failures.byCode[code]++
+	failures.mu.Unlock()
+}
+
+// failureCounts returns a copy of the failed files by error code.
+func failureCounts() map[string]int64 {
+	failures.mu.Lock()
+	defer failures.mu.Unlock()
+	return maps.Clone(failures.byCode)
+}
+
+// failureExitCode returns the exit code of --once after failures: 10 plus the index in
+// errorCodes of the highest-priority code that occurred, e.g. 10 for AUTH.
+func failureExitCode() int {
+	counts := failureCounts()
+	for i, code := range errorCodes {
+		if counts[code] > 0 {
+			return 10 + i
+		}
+	}
+	return 1
+}
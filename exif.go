@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EXIF/TIFF tags read from photos.
+const (
+	tagModel              = 0x0110 // IFD0: camera model
+	tagExifIFD            = 0x8769 // IFD0: offset of the Exif sub-IFD
+	tagDateTimeOriginal   = 0x9003 // Exif IFD: capture time, "2006:01:02 15:04:05"
+	tagOffsetTimeOriginal = 0x9011 // Exif IFD: UTC offset of the capture time, "+01:00"
+)
+
+// exifExtensions lists the image formats whose EXIF data is read: JPEG, and TIFF-based
+// formats including the common camera raw files.
+var exifExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".tif": true, ".tiff": true,
+	".dng": true, ".cr2": true, ".nef": true, ".arw": true,
+}
+
+// exifMaxHeader bounds how much of a file is read looking for EXIF data.
+const exifMaxHeader = 256 << 10
+
+// exifInfo is the photo metadata used for naming and routing.
+type exifInfo struct {
+	CaptureTime time.Time // Zero if the photo doesn't record it
+	CameraModel string
+}
+
+// metaCameraModel is the object metadata key the camera model of a photo is stored under.
+const metaCameraModel = "camera-model"
+
+// photoInfo returns the EXIF data of filePath when --use-exif is set and the file is a photo
+// that has some. Unreadable EXIF data is logged and treated as absent.
+func photoInfo(filePath string) (exifInfo, bool) {
+	if !cfg.UseEXIF {
+		return exifInfo{}, false
+	}
+	info, ok, err := readEXIF(filePath)
+	if err != nil {
+		slog.Error("Error reading EXIF data", "file", filePath, "error", err)
+		return exifInfo{}, false
+	}
+	return info, ok
+}
+
+// readEXIF returns the capture time and camera model recorded in an image file.
+// ok is false for files that aren't images or carry no EXIF data.
+func readEXIF(filePath string) (info exifInfo, ok bool, err error) {
+	if !exifExtensions[strings.ToLower(filepath.Ext(filePath))] {
+		return info, false, nil
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return info, false, err
+	}
+	defer f.Close()
+	header, err := io.ReadAll(io.LimitReader(f, exifMaxHeader))
+	if err != nil {
+		return info, false, err
+	}
+
+	tiff := header
+	if bytes.HasPrefix(header, []byte{0xFF, 0xD8}) {
+		if tiff = jpegEXIF(header); tiff == nil {
+			return info, false, nil
+		}
+	}
+	info, err = parseTIFF(tiff)
+	if err != nil {
+		return info, false, err
+	}
+	return info, true, nil
+}
+
+// jpegEXIF returns the TIFF structure inside the APP1 "Exif" segment of a JPEG, or nil.
+func jpegEXIF(data []byte) []byte {
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		marker := data[pos+1]
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == 0xDA || length < 2 { // Start of scan: no more metadata segments
+			return nil
+		}
+		end := pos + 2 + length
+		if end > len(data) {
+			return nil
+		}
+		segment := data[pos+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		pos = end
+	}
+	return nil
+}
+
+// tiffReader reads IFD entries from a TIFF structure in its declared byte order.
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// parseTIFF extracts exifInfo from a TIFF structure (as embedded in JPEG EXIF or a raw file).
+func parseTIFF(data []byte) (exifInfo, error) {
+	var info exifInfo
+	if len(data) < 8 {
+		return info, errors.New("truncated TIFF header")
+	}
+	r := tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		r.order = binary.LittleEndian
+	case "MM":
+		r.order = binary.BigEndian
+	default:
+		return info, errors.New("invalid TIFF byte order")
+	}
+	if r.order.Uint16(data[2:]) != 42 {
+		return info, errors.New("invalid TIFF magic number")
+	}
+
+	ifd0, err := r.entries(r.order.Uint32(data[4:]))
+	if err != nil {
+		return info, err
+	}
+	info.CameraModel = r.ascii(ifd0[tagModel])
+	exifOffset, ok := ifd0[tagExifIFD]
+	if !ok {
+		return info, nil
+	}
+	exif, err := r.entries(r.order.Uint32(exifOffset[8:]))
+	if err != nil {
+		return info, err
+	}
+	if original := r.ascii(exif[tagDateTimeOriginal]); original != "" {
+		loc := time.Local
+		if offset := r.ascii(exif[tagOffsetTimeOriginal]); offset != "" {
+			if t, err := time.Parse("-07:00", offset); err == nil {
+				loc = t.Location()
+			}
+		}
+		t, err := time.ParseInLocation("2006:01:02 15:04:05", original, loc)
+		if err != nil {
+			return info, fmt.Errorf("invalid DateTimeOriginal %q", original)
+		}
+		info.CaptureTime = t
+	}
+	return info, nil
+}
+
+// entries returns the raw 12-byte entries of the IFD at offset, keyed by tag.
+func (r tiffReader) entries(offset uint32) (map[uint16][]byte, error) {
+	if uint64(offset)+2 > uint64(len(r.data)) {
+		return nil, errors.New("IFD offset out of range")
+	}
+	count := int(r.order.Uint16(r.data[offset:]))
+	start := int(offset) + 2
+	if start+count*12 > len(r.data) {
+		return nil, errors.New("IFD runs past the end of the EXIF data")
+	}
+	entries := make(map[uint16][]byte, count)
+	for i := 0; i < count; i++ {
+		entry := r.data[start+i*12 : start+(i+1)*12]
+		entries[r.order.Uint16(entry)] = entry
+	}
+	return entries, nil
+}
+
+// ascii returns the value of an ASCII (type 2) entry, or "" if it is missing or malformed.
+func (r tiffReader) ascii(entry []byte) string {
+	if entry == nil || r.order.Uint16(entry[2:]) != 2 {
+		return ""
+	}
+	count := r.order.Uint32(entry[4:])
+	value := entry[8:12]
+	if count > 4 {
+		offset := r.order.Uint32(entry[8:])
+		if uint64(offset)+uint64(count) > uint64(len(r.data)) {
+			return ""
+		}
+		value = r.data[offset : offset+count]
+	} else {
+		value = value[:count]
+	}
+	return strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+}
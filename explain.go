@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// explanation collects how one local file would be handled, as labeled lines.
+type explanation struct {
+	lines [][2]string
+}
+
+func (e *explanation) add(label, format string, args ...any) {
+	e.lines = append(e.lines, [2]string{label, fmt.Sprintf(format, args...)})
+}
+
+func (e *explanation) print(filePath string) {
+	fmt.Println(filePath)
+	for _, l := range e.lines {
+		fmt.Printf("  %-18s %s\n", l[0]+":", l[1])
+	}
+}
+
+// runExplain implements `explain [flags] PATH...`: it prints how each file would be handled
+// with the given flags, from the filters it passes to the object it ends up in, its
+// attributes and what happens to the local file afterwards, without uploading anything or
+// touching the bucket. The flags are those of the uploader, so a config file explains itself.
+func runExplain(paths []string) error {
+	if len(paths) == 0 {
+		return errors.New("usage: explain [flags] PATH... (files to explain)")
+	}
+	var failed int
+	for i, p := range paths {
+		if i > 0 {
+			fmt.Println()
+		}
+		filePath, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		var e explanation
+		if err := explainFile(&e, filePath); err != nil {
+			e.add("Error", "%v", err)
+			failed++
+		}
+		e.print(filePath)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be explained", failed)
+	}
+	return nil
+}
+
+// explainFile adds to e how filePath would be handled, following the checks of prepareFile
+// and uploadPrepared in order. A file that would not be uploaded ends with the reason.
+func explainFile(e *explanation, filePath string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return errors.New("is a folder; explain takes files")
+	}
+	src := sourceOf(sources, filePath)
+	if src == nil {
+		return errors.New("not in any source folder")
+	}
+	e.add("File", "%s, modified %s", formatByteSize(info.Size()), info.ModTime().Format(time.RFC3339))
+	e.add("Source", "%s (relative path %s)", src.Path, src.relativePath(filePath))
+
+	// Filters
+	if reason := src.skipReason(filePath); reason != "" {
+		e.add("Skipped", "%s", reason)
+		return nil
+	}
+	e.add("Filters", "%s", includedBy(src.relativePath(filePath)))
+	if cfg.OnSuccess == onSuccessKeep && ledger.contains(filePath, info) {
+		e.add("Skipped", "already uploaded and unchanged (--on-success keep)")
+		return nil
+	}
+	if ledger.restored(filePath, info) {
+		e.add("Skipped", "restored with undo and unchanged")
+		return nil
+	}
+	if cfg.PartSets && partFileRegexp.MatchString(filepath.Base(filePath)) {
+		e.add("Skipped", "part of a split file, composed with its other parts once the set is complete (--part-sets)")
+		return nil
+	}
+	if reason := sizeSkipReason(info.Size()); reason != "" {
+		e.add("Skipped", "%s", reason)
+		return nil
+	}
+	if reason := producerSkipReason(filePath); reason != "" {
+		e.add("Skipped", "%s", reason)
+		return nil
+	}
+	if wait := cfg.MinFileAge - time.Since(info.ModTime()); wait > 0 {
+		e.add("Waits", "modified too recently, uploaded in %s (--min-file-age %s)", wait.Round(time.Second), cfg.MinFileAge)
+	}
+
+	// Route and object name
+	target := resolveTarget(src, filePath, info)
+	target.StorageClass = storageClassFor(src.relativePath(filePath), info.Size())
+	if cfg.BundleBelow > 0 && info.Size() < int64(cfg.BundleBelow) {
+		e.add("Bundled", "smaller than --bundle-below %s: stored as files/%s in a tar archive under gs://%s/%s/",
+			formatByteSize(int64(cfg.BundleBelow)), src.relativePath(filePath), src.Bucket, path.Join(src.Prefix, bundleFolder))
+		explainLocalFile(e, src, filePath)
+		return nil
+	}
+	route := target.Pipeline
+	if target.Credentials != "" {
+		route += ", credentials " + target.Credentials
+	}
+	e.add("Pipeline", "%s", route)
+	e.add("Object", "gs://%s/%s", target.Bucket, target.Object)
+	e.add("File time", "%s (from %s)", target.Time.Format(time.RFC3339), target.TimeFrom)
+
+	// Object attributes, as the upload sets them
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	attrs := objectAttrs(f, target)
+	explainAttrs(e, attrs)
+	if len(cfg.Digests) > 0 {
+		e.add("Digests", "%s, computed while uploading", strings.Join(cfg.Digests, ", "))
+	}
+	switch {
+	case csekKey != nil:
+		e.add("Encryption", "customer-supplied key (--csek-key-file)")
+	case cfg.KMSKey != "":
+		e.add("Encryption", "%s", cfg.KMSKey)
+	}
+	if prefix := ttlPrefixFor(src.relativePath(filePath)); prefix != "" {
+		e.add("Expires", "by the bucket lifecycle rule for %s", prefix)
+	}
+
+	// Upload
+	switch {
+	case cfg.CompositeThreshold > 0 && info.Size() >= int64(cfg.CompositeThreshold) && !target.Gzip:
+		e.add("Upload", "parallel composite upload in %d parts", cfg.CompositeParts)
+	case target.Gzip:
+		e.add("Upload", "gzip-compressed while uploading")
+	default:
+		e.add("Upload", "single upload")
+	}
+	if cfg.Dedupe != dedupeOff {
+		e.add("Dedupe", "%s: identical content under gs://%s/%s is reused", cfg.Dedupe, target.Bucket, target.ListPrefix)
+	}
+	e.add("On conflict", "%s", cfg.OnConflict)
+	if cfg.Previews && previewExtensions[strings.ToLower(filepath.Ext(filePath))] {
+		e.add("Preview", "gs://%s/%s (needs ffmpeg)", target.Bucket, previewObject(target.Object))
+	}
+	if cfg.Observe {
+		e.add("Observe", "only logged with --observe; nothing is uploaded")
+		return nil
+	}
+	explainLocalFile(e, src, filePath)
+	return nil
+}
+
+// includedBy describes which --include pattern lets rel through.
+func includedBy(rel string) string {
+	if len(includeFilters) == 0 {
+		return "no include patterns, matches no exclude pattern"
+	}
+	for _, f := range includeFilters {
+		if f.match(rel) {
+			return fmt.Sprintf("matches include pattern %q and no exclude pattern", f.pattern)
+		}
+	}
+	return "matches no include pattern"
+}
+
+// explainAttrs adds the attributes an object is written with.
+func explainAttrs(e *explanation, attrs storage.ObjectAttrs) {
+	optional := []struct{ label, value string }{
+		{"Content-Type", attrs.ContentType},
+		{"Content-Encoding", attrs.ContentEncoding},
+		{"Cache-Control", attrs.CacheControl},
+		{"Disposition", attrs.ContentDisposition},
+		{"Language", attrs.ContentLanguage},
+	}
+	for _, a := range optional {
+		if a.value != "" {
+			e.add(a.label, "%s", a.value)
+		}
+	}
+	if attrs.StorageClass != "" {
+		e.add("Storage class", "%s", attrs.StorageClass)
+	} else {
+		e.add("Storage class", "bucket default")
+	}
+	if attrs.PredefinedACL != "" {
+		e.add("ACL", "%s", attrs.PredefinedACL)
+	} else {
+		e.add("ACL", "bucket default")
+	}
+	if !attrs.CustomTime.IsZero() {
+		e.add("Custom time", "%s", attrs.CustomTime.Format(time.RFC3339))
+	}
+	for _, key := range slices.Sorted(maps.Keys(attrs.Metadata)) {
+		e.add("Metadata", "%s=%s", key, attrs.Metadata[key])
+	}
+}
+
+// explainLocalFile adds what --on-success does with filePath once it is uploaded.
+func explainLocalFile(e *explanation, src *watchSource, filePath string) {
+	switch cfg.OnSuccess {
+	case onSuccessMove:
+		e.add("Afterwards", "moved to %s", filepath.Join(cfg.ArchiveDir, filepath.FromSlash(src.relativePath(filePath))))
+	case onSuccessKeep:
+		e.add("Afterwards", "kept, and recorded so it isn't uploaded again until it changes")
+	default:
+		e.add("Afterwards", "deleted")
+	}
+	if companions := companionsOf(filePath); len(companions) > 0 && cfg.OnSuccess != onSuccessKeep {
+		e.add("Companions", "%s, removed with it", strings.Join(companions, ", "))
+	}
+	if cfg.OnSuccess != onSuccessKeep && cfg.MaxDeletionRate > 0 {
+		e.add("Deletion limit", "held for resume-deletions beyond %d removals a minute", cfg.MaxDeletionRate)
+	}
+	if cfg.OnSuccess != onSuccessKeep {
+		e.add("Undo", "restorable with undo for %s", cfg.UndoWindow)
+	}
+}
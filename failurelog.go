@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// failureKey identifies a repeated failure: the same file failing with the same error code.
+type failureKey struct {
+	file string
+	code string
+}
+
+// repeatedFailure counts the failures of a key that were not logged.
+type repeatedFailure struct {
+	first      time.Time // When the key was last logged in full
+	suppressed int
+	lastErr    error
+}
+
+// failureLog deduplicates failure logs and notifications. The first failure of a file with
+// an error code is logged and notified as usual; repeats within --error-summary-interval
+// are only counted, and summarize reports them as one "still failing" line per interval,
+// so a stuck file that is retried all night doesn't flood the log.
+var failureLog = struct {
+	mu      sync.Mutex
+	repeats map[failureKey]*repeatedFailure
+}{repeats: make(map[failureKey]*repeatedFailure)}
+
+// reportFailure counts a failed file and logs msg with err and attrs, unless the file
+// already failed with the same error code since the last summary. It reports whether the
+// failure was logged, in which case the caller may notify about it as well.
+func reportFailure(logger *slog.Logger, filePath, msg string, err error, attrs ...any) bool {
+	code := errorCode(err)
+	countFailure(code)
+	if cfg.ErrorSummary > 0 {
+		failureLog.mu.Lock()
+		key := failureKey{file: filePath, code: code}
+		r, seen := failureLog.repeats[key]
+		if seen {
+			r.suppressed++
+			r.lastErr = err
+		} else {
+			failureLog.repeats[key] = &repeatedFailure{first: time.Now()}
+		}
+		failureLog.mu.Unlock()
+		if seen {
+			logger.Debug(msg, append(attrs, "error_code", code, "error", err, "repeated", true)...)
+			return false
+		}
+	}
+	logger.Error(msg, append(attrs, "error_code", code, "error", err)...)
+	return true
+}
+
+// summarizeFailures logs, and notifies about, the failures suppressed by reportFailure every
+// interval. A file that didn't fail again during an interval is forgotten, so its next
+// failure is logged in full.
+func summarizeFailures(interval time.Duration) {
+	for range time.Tick(interval) {
+		failureLog.mu.Lock()
+		due := make(map[failureKey]repeatedFailure)
+		for key, r := range failureLog.repeats {
+			if r.suppressed == 0 {
+				delete(failureLog.repeats, key)
+				continue
+			}
+			due[key] = *r
+			r.suppressed, r.lastErr = 0, nil
+		}
+		failureLog.mu.Unlock()
+
+		for key, r := range due {
+			slog.Warn("Still failing", "file", key.file, "error_code", key.code, "repeats", r.suppressed,
+				"since", r.first.Format(time.RFC3339), "error", r.lastErr)
+			notifyCode(notifyFailure, key.code, msgStillFailing, "file", key.file, "failures", r.suppressed, "code", key.code,
+				"since", r.first.Format(time.Kitchen), "error", r.lastErr)
+		}
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeGCS is an in-memory stand-in for the parts of the GCS JSON API the uploader uses:
+// multipart and resumable uploads, object metadata and its updates, listing, deletion,
+// compose, rewrite, downloads and permission tests, with generation and metageneration preconditions. The storage client talks to it through
+// STORAGE_EMULATOR_HOST. Every bucket exists and is unversioned.
+type fakeGCS struct {
+	mu         sync.Mutex
+	objects    map[string]*fakeObject // By bucket + "/" + name
+	uploads    map[string]*fakeUpload // Resumable uploads by ID
+	generation int64
+}
+
+// fakeObject is an object stored in fakeGCS.
+type fakeObject struct {
+	bucket, name string
+	data         []byte
+	generation   int64
+	metagen      int64          // Counts the metadata updates, from 1
+	composite    bool           // Composed objects have no MD5 hash, as in GCS
+	attrs        map[string]any // The metadata sent with the upload
+	updated      time.Time
+}
+
+// fakeUpload is a resumable upload in progress.
+type fakeUpload struct {
+	bucket, name string
+	attrs        map[string]any
+	query        url.Values // Preconditions of the upload
+	data         []byte
+}
+
+func newFakeGCS() *fakeGCS {
+	return &fakeGCS{objects: make(map[string]*fakeObject), uploads: make(map[string]*fakeUpload)}
+}
+
+// put stores an object, as a scenario does before the uploader starts.
+func (g *fakeGCS) put(bucket, name string, data []byte, attrs map[string]any) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.store(bucket, name, data, attrs, false)
+}
+
+// list returns a snapshot of the stored objects, sorted by bucket and name.
+func (g *fakeGCS) list() []fakeObject {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	objects := make([]fakeObject, 0, len(g.objects))
+	for _, o := range g.objects {
+		objects = append(objects, *o)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].bucket != objects[j].bucket {
+			return objects[i].bucket < objects[j].bucket
+		}
+		return objects[i].name < objects[j].name
+	})
+	return objects
+}
+
+var (
+	fakeUploadPath  = regexp.MustCompile(`^/upload/storage/v1/b/([^/]+)/o$`)
+	fakeComposePath = regexp.MustCompile(`^/storage/v1/b/([^/]+)/o/(.+)/compose$`)
+	fakeRewritePath = regexp.MustCompile(`^/storage/v1/b/([^/]+)/o/(.+)/(?:rewriteTo|copyTo)/b/([^/]+)/o/(.+)$`)
+	fakeObjectPath  = regexp.MustCompile(`^/(?:download/)?storage/v1/b/([^/]+)/o/(.+)$`)
+	fakeListPath    = regexp.MustCompile(`^/storage/v1/b/([^/]+)/o$`)
+	fakeBucketPath  = regexp.MustCompile(`^/storage/v1/b/([^/]+)$`)
+	fakeIAMPath     = regexp.MustCompile(`^/storage/v1/b/([^/]+)/iam/testPermissions$`)
+	fakeXMLPath     = regexp.MustCompile(`^/([^/]+)/(.+)$`)
+)
+
+func (g *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	path := r.URL.EscapedPath()
+	q := r.URL.Query()
+	if m := fakeUploadPath.FindStringSubmatch(path); m != nil {
+		switch {
+		case q.Get("upload_id") != "":
+			g.continueUpload(w, r, q.Get("upload_id"))
+		case r.Method == http.MethodPost && q.Get("uploadType") == "multipart":
+			g.multipartUpload(w, r, unescape(m[1]))
+		case r.Method == http.MethodPost && q.Get("uploadType") == "resumable":
+			g.startUpload(w, r, unescape(m[1]))
+		default:
+			fakeError(w, http.StatusNotImplemented, "unsupported upload")
+		}
+		return
+	}
+	if m := fakeComposePath.FindStringSubmatch(path); m != nil && r.Method == http.MethodPost {
+		g.compose(w, r, unescape(m[1]), unescape(m[2]))
+		return
+	}
+	if m := fakeRewritePath.FindStringSubmatch(path); m != nil && r.Method == http.MethodPost {
+		g.rewrite(w, r, unescape(m[1]), unescape(m[2]), unescape(m[3]), unescape(m[4]))
+		return
+	}
+	if m := fakeObjectPath.FindStringSubmatch(path); m != nil {
+		g.object(w, r, unescape(m[1]), unescape(m[2]))
+		return
+	}
+	if m := fakeListPath.FindStringSubmatch(path); m != nil && r.Method == http.MethodGet {
+		g.listObjects(w, unescape(m[1]), q.Get("prefix"), q.Get("delimiter"))
+		return
+	}
+	if m := fakeBucketPath.FindStringSubmatch(path); m != nil && r.Method == http.MethodGet {
+		fakeJSON(w, map[string]any{"kind": "storage#bucket", "name": unescape(m[1]), "versioning": map[string]any{"enabled": false}})
+		return
+	}
+	if fakeIAMPath.MatchString(path) && r.Method == http.MethodGet {
+		// Every permission is granted
+		fakeJSON(w, map[string]any{"kind": "storage#testIamPermissionsResponse", "permissions": q["permissions"]})
+		return
+	}
+	if m := fakeXMLPath.FindStringSubmatch(path); m != nil && r.Method == http.MethodGet {
+		// Reads of the storage client go through the XML API
+		q.Set("alt", "media")
+		r.URL.RawQuery = q.Encode()
+		g.object(w, r, unescape(m[1]), unescape(m[2]))
+		return
+	}
+	fakeError(w, http.StatusNotImplemented, fmt.Sprintf("unsupported request %s %s", r.Method, path))
+}
+
+// multipartUpload handles an upload of the metadata and the data in one request.
+func (g *fakeGCS) multipartUpload(w http.ResponseWriter, r *http.Request, bucket string) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	var attrs map[string]any
+	var data []byte
+	for i := 0; i < 2; i++ {
+		part, err := mr.NextPart()
+		if err == nil {
+			data, err = io.ReadAll(part)
+		}
+		if err != nil {
+			fakeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if i == 0 {
+			if err := json.Unmarshal(data, &attrs); err != nil {
+				fakeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+	}
+	g.create(w, r.URL.Query(), bucket, objectName(attrs, r.URL.Query()), data, attrs, false)
+}
+
+// startUpload starts a resumable upload and returns its session URI.
+func (g *fakeGCS) startUpload(w http.ResponseWriter, r *http.Request, bucket string) {
+	var attrs map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&attrs); err != nil && err != io.EOF {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	g.generation++
+	id := strconv.FormatInt(g.generation, 10)
+	g.uploads[id] = &fakeUpload{bucket: bucket, name: objectName(attrs, r.URL.Query()), attrs: attrs, query: r.URL.Query()}
+	w.Header().Set("Location", fmt.Sprintf("http://%s%s?uploadType=resumable&upload_id=%s", r.Host, r.URL.Path, id))
+	w.WriteHeader(http.StatusOK)
+}
+
+// continueUpload takes a chunk of a resumable upload, or a status query, completing the
+// upload with the last chunk.
+func (g *fakeGCS) continueUpload(w http.ResponseWriter, r *http.Request, id string) {
+	up, ok := g.uploads[id]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "no such upload")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Content-Range is "bytes FIRST-LAST/TOTAL", with "*" for an unknown total or no data
+	rng, total, _ := strings.Cut(strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes "), "/")
+	if first, _, ok := strings.Cut(rng, "-"); ok {
+		offset, err := strconv.Atoi(first)
+		if err != nil || offset > len(up.data) {
+			fakeError(w, http.StatusBadRequest, "invalid Content-Range")
+			return
+		}
+		up.data = append(up.data[:offset], data...)
+	}
+	if total == "*" || total != strconv.Itoa(len(up.data)) {
+		if len(up.data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(up.data)-1))
+		}
+		w.Header().Set("Content-Length", "0")
+		if r.Header.Get("X-GUploader-No-308") == "yes" {
+			// The client asks for the "resume incomplete" status in a header instead
+			w.Header().Set("X-Http-Status-Code-Override", "308")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusPermanentRedirect)
+		return
+	}
+	delete(g.uploads, id)
+	g.create(w, up.query, up.bucket, up.name, up.data, up.attrs, false)
+}
+
+// compose concatenates the source objects into a new object.
+func (g *fakeGCS) compose(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	var req struct {
+		Destination   map[string]any `json:"destination"`
+		SourceObjects []struct {
+			Name string `json:"name"`
+		} `json:"sourceObjects"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var data []byte
+	for _, src := range req.SourceObjects {
+		o, ok := g.objects[bucket+"/"+src.Name]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "no such source object: "+src.Name)
+			return
+		}
+		data = append(data, o.data...)
+	}
+	if want, ok := req.Destination["crc32c"].(string); ok && want != fakeCRC32C(data) {
+		fakeError(w, http.StatusBadRequest, "provided CRC32C doesn't match the composed object")
+		return
+	}
+	g.create(w, r.URL.Query(), bucket, name, data, req.Destination, true)
+}
+
+// rewrite copies an object, in a single call.
+func (g *fakeGCS) rewrite(w http.ResponseWriter, r *http.Request, srcBucket, srcName, bucket, name string) {
+	src, ok := g.objects[srcBucket+"/"+srcName]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "no such object")
+		return
+	}
+	var attrs map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&attrs); err != nil && err != io.EOF {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(attrs) == 0 {
+		attrs = maps.Clone(src.attrs)
+	}
+	if !g.preconditionsMet(r.URL.Query(), bucket, name) {
+		fakeError(w, http.StatusPreconditionFailed, "precondition failed")
+		return
+	}
+	o := g.store(bucket, name, src.data, attrs, src.composite)
+	size := strconv.Itoa(len(o.data))
+	fakeJSON(w, map[string]any{"kind": "storage#rewriteResponse", "done": true, "totalBytesRewritten": size, "objectSize": size, "resource": o.resource()})
+}
+
+// object reads, downloads or deletes an object.
+func (g *fakeGCS) object(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	o, ok := g.objects[bucket+"/"+name]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "no such object")
+		return
+	}
+	q := r.URL.Query()
+	if gen := q.Get("generation"); gen != "" && gen != strconv.FormatInt(o.generation, 10) {
+		// Buckets of the fake keep no noncurrent versions
+		fakeError(w, http.StatusNotFound, "no such object generation")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if q.Get("alt") != "media" {
+			fakeJSON(w, o.resource())
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Goog-Generation", strconv.FormatInt(o.generation, 10))
+		w.Header().Set("X-Goog-Hash", "crc32c="+fakeCRC32C(o.data))
+		w.Write(o.data)
+	case http.MethodPatch:
+		if !g.preconditionsMet(q, bucket, name) || (q.Has("ifMetagenerationMatch") && q.Get("ifMetagenerationMatch") != strconv.FormatInt(o.metagen, 10)) {
+			fakeError(w, http.StatusPreconditionFailed, "precondition failed")
+			return
+		}
+		var update map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			fakeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		o.patch(update)
+		fakeJSON(w, o.resource())
+	case http.MethodDelete:
+		if !g.preconditionsMet(q, bucket, name) {
+			fakeError(w, http.StatusPreconditionFailed, "precondition failed")
+			return
+		}
+		delete(g.objects, bucket+"/"+name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeError(w, http.StatusNotImplemented, "unsupported object request")
+	}
+}
+
+// listObjects lists the objects of bucket under prefix, in a single page.
+func (g *fakeGCS) listObjects(w http.ResponseWriter, bucket, prefix, delimiter string) {
+	items := []map[string]any{}
+	prefixes := []string{}
+	seen := make(map[string]bool)
+	for _, o := range g.sorted(bucket) {
+		rest, ok := strings.CutPrefix(o.name, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			if p := prefix + rest[:i+len(delimiter)]; !seen[p] {
+				seen[p] = true
+				prefixes = append(prefixes, p)
+			}
+			continue
+		}
+		items = append(items, o.resource())
+	}
+	fakeJSON(w, map[string]any{"kind": "storage#objects", "items": items, "prefixes": prefixes})
+}
+
+// sorted returns the objects of bucket by name.
+func (g *fakeGCS) sorted(bucket string) []*fakeObject {
+	var objects []*fakeObject
+	for _, o := range g.objects {
+		if o.bucket == bucket {
+			objects = append(objects, o)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].name < objects[j].name })
+	return objects
+}
+
+// create stores a new object if the preconditions of q are met, and writes its resource.
+func (g *fakeGCS) create(w http.ResponseWriter, q url.Values, bucket, name string, data []byte, attrs map[string]any, composite bool) {
+	if name == "" {
+		fakeError(w, http.StatusBadRequest, "object name missing")
+		return
+	}
+	if !g.preconditionsMet(q, bucket, name) {
+		fakeError(w, http.StatusPreconditionFailed, "precondition failed")
+		return
+	}
+	if want, ok := attrs["crc32c"].(string); ok && want != fakeCRC32C(data) {
+		fakeError(w, http.StatusBadRequest, "provided CRC32C doesn't match the uploaded data")
+		return
+	}
+	fakeJSON(w, g.store(bucket, name, data, attrs, composite).resource())
+}
+
+// preconditionsMet checks ifGenerationMatch, where 0 means the object must not exist.
+func (g *fakeGCS) preconditionsMet(q url.Values, bucket, name string) bool {
+	match := q.Get("ifGenerationMatch")
+	if match == "" {
+		return true
+	}
+	var current int64
+	if o, ok := g.objects[bucket+"/"+name]; ok {
+		current = o.generation
+	}
+	return match == strconv.FormatInt(current, 10)
+}
+
+// store writes an object with a new generation. The caller holds g.mu.
+func (g *fakeGCS) store(bucket, name string, data []byte, attrs map[string]any, composite bool) *fakeObject {
+	g.generation++
+	o := &fakeObject{bucket: bucket, name: name, data: bytes.Clone(data), generation: g.generation, metagen: 1, composite: composite, attrs: attrs, updated: time.Now().UTC()}
+	g.objects[bucket+"/"+name] = o
+	return o
+}
+
+// patch applies a metadata update to o, as GCS patches do: custom metadata is merged key by
+// key, with null removing a key, and other fields are replaced.
+func (o *fakeObject) patch(update map[string]any) {
+	attrs := maps.Clone(o.attrs)
+	if attrs == nil {
+		attrs = make(map[string]any)
+	}
+	for key, value := range update {
+		if key != "metadata" {
+			attrs[key] = value
+			continue
+		}
+		metadata := make(map[string]any)
+		if old, ok := attrs["metadata"].(map[string]any); ok {
+			maps.Copy(metadata, old)
+		}
+		if changes, ok := value.(map[string]any); ok {
+			for k, v := range changes {
+				if v == nil {
+					delete(metadata, k)
+				} else {
+					metadata[k] = v
+				}
+			}
+		}
+		attrs["metadata"] = metadata
+	}
+	o.attrs = attrs
+	o.metagen++
+	o.updated = time.Now().UTC()
+}
+
+// resource returns the JSON API representation of o.
+func (o *fakeObject) resource() map[string]any {
+	res := make(map[string]any)
+	for key, value := range o.attrs {
+		switch key {
+		case "contentType", "contentEncoding", "contentDisposition", "contentLanguage", "cacheControl", "metadata", "storageClass", "customTime":
+			res[key] = value
+		}
+	}
+	updated := o.updated.Format(time.RFC3339Nano)
+	maps.Copy(res, map[string]any{
+		"kind":           "storage#object",
+		"bucket":         o.bucket,
+		"name":           o.name,
+		"size":           strconv.Itoa(len(o.data)),
+		"generation":     strconv.FormatInt(o.generation, 10),
+		"metageneration": strconv.FormatInt(o.metagen, 10),
+		"crc32c":         fakeCRC32C(o.data),
+		"timeCreated":    updated,
+		"updated":        updated,
+	})
+	if !o.composite {
+		sum := md5.Sum(o.data)
+		res["md5Hash"] = base64.StdEncoding.EncodeToString(sum[:])
+	}
+	if _, ok := res["storageClass"]; !ok {
+		res["storageClass"] = "STANDARD"
+	}
+	return res
+}
+
+// fakeCRC32C returns the CRC32C of data as GCS encodes it: base64 of the big-endian value.
+func fakeCRC32C(data []byte) string {
+	return base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))))
+}
+
+// objectName returns the name of an uploaded object, from its metadata or the query.
+func objectName(attrs map[string]any, q url.Values) string {
+	if name, ok := attrs["name"].(string); ok && name != "" {
+		return name
+	}
+	return q.Get("name")
+}
+
+func unescape(s string) string {
+	if u, err := url.PathUnescape(s); err == nil {
+		return u
+	}
+	return s
+}
+
+func fakeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func fakeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"code": code, "message": message}})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// pathFilter is one --include or --exclude pattern: a glob, or a regular expression when
+// written as "re:<expression>". Globs without a slash match the file's base name at any
+// depth (like *.part or .DS_Store); others, and regular expressions, match the path
+// relative to the source folder.
+type pathFilter struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// Compiled --include and --exclude patterns, set at startup.
+var includeFilters, excludeFilters []pathFilter
+
+// compilePathFilters parses --include/--exclude patterns.
+func compilePathFilters(patterns []string) ([]pathFilter, error) {
+	var filters []pathFilter
+	for _, pattern := range patterns {
+		f := pathFilter{pattern: pattern}
+		if expr, ok := strings.CutPrefix(pattern, "re:"); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+			}
+			f.re = re
+		} else if err := validateGlob(pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// match reports whether the filter matches rel, a path relative to the source folder.
+func (f pathFilter) match(rel string) bool {
+	if f.re != nil {
+		return f.re.MatchString(rel)
+	}
+	if !strings.Contains(f.pattern, "/") {
+		return matchGlob(f.pattern, path.Base(rel))
+	}
+	return matchGlob(f.pattern, rel)
+}
+
+// matchGlob reports whether name matches pattern. Both use forward slashes.
+// In addition to the path.Match syntax, a "**" segment matches zero or more path segments.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// validateGlob reports a malformed segment in a matchGlob pattern.
+func validateGlob(pattern string) error {
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment == "**" {
+			continue
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Try to match the rest of the pattern at every possible depth
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// sizeSkipReason returns why a file of size bytes is not uploaded by --min-size and
+// --max-size, or "" if it is eligible.
+func sizeSkipReason(size int64) string {
+	if size < int64(cfg.MinSize) {
+		return fmt.Sprintf("smaller than min-size (%s)", formatByteSize(int64(cfg.MinSize)))
+	}
+	if cfg.MaxSize > 0 && size > int64(cfg.MaxSize) {
+		return fmt.Sprintf("larger than max-size (%s)", formatByteSize(int64(cfg.MaxSize)))
+	}
+	return ""
+}
+
+// producerSkipReason returns why filePath is not uploaded by --producer, or "" if it was
+// created by one of the listed applications. File system events don't name the process that
+// wrote a file, so the application is the creator macOS keeps in the file's Spotlight
+// attributes; files without one are skipped. A copy made by the Finder keeps the creator of
+// the original.
+func producerSkipReason(filePath string) string {
+	if len(cfg.Producers) == 0 {
+		return ""
+	}
+	app, err := fileCreator(filePath)
+	if err != nil {
+		return fmt.Sprintf("creating application unknown: %v", err)
+	}
+	if app == "" {
+		return "no creating application recorded, see --producer"
+	}
+	for _, producer := range cfg.Producers {
+		if strings.EqualFold(app, producer) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("created by %q, not a --producer", app)
+}
+
+// validateProducers checks --producer, which needs the creator attribute of macOS.
+func validateProducers(c *Config) error {
+	if len(c.Producers) > 0 && runtime.GOOS != "darwin" {
+		return errors.New("producer is only supported on macOS")
+	}
+	return nil
+}
+
+// inWatchedSubpath reports whether filePath falls under one of the --watch-subpath patterns.
+// When no patterns are configured every path under the source folder is eligible.
+func (s *watchSource) inWatchedSubpath(filePath string) bool {
+	if len(cfg.WatchSubpaths) == 0 {
+		return true
+	}
+	rel := s.relativePath(filePath)
+	for _, pattern := range cfg.WatchSubpaths {
+		if matchGlob(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipReason returns why filePath is not uploaded by the filters (--protect, --hold-dir,
+// --exclude-from-indexing, --new-files-only, --watch-subpath, --include, --exclude, --companion), or "" if it is eligible.
+func (s *watchSource) skipReason(filePath string) string {
+	if p := protectedBy(filePath); p != "" {
+		return fmt.Sprintf("protected path %q", p)
+	}
+	if s.isHeld(filePath) {
+		return "in the hold folder"
+	}
+	if filepath.Base(filePath) == spotlightMarker {
+		return "Spotlight exclusion marker"
+	}
+	if cfg.NewFilesOnly && baseline.contains(filePath) {
+		return "present before --new-files-only took effect"
+	}
+	if !s.inWatchedSubpath(filePath) {
+		return "not under a watched subpath"
+	}
+	rel := s.relativePath(filePath)
+	for _, f := range excludeFilters {
+		if f.match(rel) {
+			return fmt.Sprintf("matches exclude pattern %q", f.pattern)
+		}
+	}
+	if isCompanion(filePath) {
+		return "companion file, removed with the file it belongs to"
+	}
+	if len(includeFilters) == 0 {
+		return ""
+	}
+	for _, f := range includeFilters {
+		if f.match(rel) {
+			return ""
+		}
+	}
+	return "matches no include pattern"
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stringSliceFlag is a flag.Value that collects every occurrence of a repeatable flag.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// byteSize is a size in bytes that parses suffixes such as "512MB" or "20GiB",
+// both as a flag.Value and from config files.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	n, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(n)
+	return nil
+}
+
+func (b *byteSize) UnmarshalText(text []byte) error {
+	return b.Set(string(text))
+}
+
+// sourceWeightsFlag maps a cleaned source path to its weight. As a flag it is
+// repeatable and takes PATH=WEIGHT; config files use a plain mapping.
+type sourceWeightsFlag map[string]int
+
+func (w *sourceWeightsFlag) String() string {
+	var parts []string
+	for p, n := range *w {
+		parts = append(parts, fmt.Sprintf("%s=%d", p, n))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (w *sourceWeightsFlag) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("%q is not in PATH=WEIGHT form", value)
+	}
+	n, err := strconv.Atoi(value[i+1:])
+	if err != nil || n <= 0 {
+		return fmt.Errorf("weight in %q must be a positive integer", value)
+	}
+	if *w == nil {
+		*w = make(sourceWeightsFlag)
+	}
+	(*w)[filepath.Clean(value[:i])] = n
+	return nil
+}
+
+// patternRule assigns value to the files matching a pattern (see pathFilter).
+type patternRule struct {
+	filter pathFilter
+	value  string
+}
+
+// patternRulesFlag is an ordered list of pattern rules; the first matching rule wins.
+// As a flag it is repeatable and takes PATTERN=VALUE (split at the first '=');
+// config files use a mapping, applied in file order (YAML) or sorted by pattern (TOML).
+type patternRulesFlag []patternRule
+
+func (r *patternRulesFlag) String() string {
+	var parts []string
+	for _, rule := range *r {
+		parts = append(parts, rule.filter.pattern+"="+rule.value)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r *patternRulesFlag) Set(value string) error {
+	pattern, v, ok := strings.Cut(value, "=")
+	if !ok || pattern == "" || v == "" {
+		return fmt.Errorf("%q is not in PATTERN=VALUE form", value)
+	}
+	return r.add(pattern, v)
+}
+
+func (r *patternRulesFlag) add(pattern, value string) error {
+	filters, err := compilePathFilters([]string{pattern})
+	if err != nil {
+		return err
+	}
+	*r = append(*r, patternRule{filter: filters[0], value: value})
+	return nil
+}
+
+func (r *patternRulesFlag) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: expected a mapping of pattern: value", node.Line)
+	}
+	*r = nil
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if err := r.add(node.Content[i].Value, node.Content[i+1].Value); err != nil {
+			return fmt.Errorf("line %d: %v", node.Content[i].Line, err)
+		}
+	}
+	return nil
+}
+
+func (r *patternRulesFlag) UnmarshalTOML(data any) error {
+	m, ok := data.(map[string]any)
+	if !ok {
+		return fmt.Errorf("expected a table of pattern = value, got %T", data)
+	}
+	patterns := make([]string, 0, len(m))
+	for pattern := range m {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	*r = nil
+	for _, pattern := range patterns {
+		value, ok := m[pattern].(string)
+		if !ok {
+			return fmt.Errorf("value for %q must be a string, got %T", pattern, m[pattern])
+		}
+		if err := r.add(pattern, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup returns the value of the first rule matching rel, a path relative to the source folder.
+func (r patternRulesFlag) lookup(rel string) (string, bool) {
+	for _, rule := range r {
+		if rule.filter.match(rel) {
+			return rule.value, true
+		}
+	}
+	return "", false
+}
+
+// metadataFlag holds custom object metadata. As a flag it is repeatable and takes
+// KEY=VALUE; config files use a plain mapping.
+type metadataFlag map[string]string
+
+func (m *metadataFlag) String() string {
+	var parts []string
+	for k, v := range *m {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (m *metadataFlag) Set(value string) error {
+	key, v, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("%q is not in KEY=VALUE form", value)
+	}
+	if *m == nil {
+		*m = make(metadataFlag)
+	}
+	(*m)[key] = v
+	return nil
+}
+
+var byteSizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"KB":  1000,
+	"MB":  1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"TB":  1000 * 1000 * 1000 * 1000,
+	"KIB": 1 << 10,
+	"MIB": 1 << 20,
+	"GIB": 1 << 30,
+	"TIB": 1 << 40,
+}
+
+// parseByteSize parses a plain byte count or a number followed by a decimal (KB, MB, ...) or binary (KiB, MiB, ...) unit.
+func parseByteSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	i := strings.IndexFunc(value, func(r rune) bool { return !unicode.IsDigit(r) && r != '.' })
+	if i == -1 {
+		i = len(value)
+	}
+	number, unit := value[:i], strings.ToUpper(strings.TrimSpace(value[i:]))
+	multiplier, ok := byteSizeUnits[unit]
+	if !ok || number == "" {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 1048576, 512MB or 2GiB)", value)
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %v", value, err)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// formatByteSize renders a byte count in a human-readable binary unit (e.g. "1.5 GiB").
+func formatByteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
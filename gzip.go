@@ -0,0 +1,69 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// gzipContentType is the Content-Type of the .gz objects of --gzip-objects.
+const gzipContentType = "application/gzip"
+
+// gzipFilters are the compiled --gzip-pattern patterns, set at startup.
+var gzipFilters []pathFilter
+
+// compressesFile reports whether filePath from src is compressed while it is uploaded
+// (--gzip): it matches a --gzip-pattern, if there are any, and isn't a .gz file already.
+func compressesFile(src *watchSource, filePath string) bool {
+	if !cfg.Gzip || strings.EqualFold(filepath.Ext(filePath), ".gz") {
+		return false
+	}
+	if len(gzipFilters) == 0 {
+		return true
+	}
+	rel := src.relativePath(filePath)
+	for _, f := range gzipFilters {
+		if f.match(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressedReader returns the gzip compression of r, produced as it is read. Closing it
+// stops the compression. The output only depends on the data, so compressing a file again
+// gives the same bytes, and checksums, as its upload.
+func compressedReader(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// uploadChecksums reads f from the start and returns the checksums of the data uploaded
+// for target: the file itself, or its compression with --gzip.
+func uploadChecksums(f *os.File, target uploadTarget) (*checksums, error) {
+	if !target.Gzip {
+		return fileChecksums(f)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r, done := fileReader(f)
+	defer done()
+	zr := compressedReader(r)
+	defer zr.Close()
+	sums := newChecksums()
+	if _, err := io.Copy(sums, zr); err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// hardenedEndpoint is a host the uploader may connect to.
+type hardenedEndpoint struct {
+	Host    string
+	Purpose string
+}
+
+// hardenedEndpoints lists every host the uploader connects to. Keep it in sync with the
+// features allowed by --hardened, as security teams derive network policies from it.
+var hardenedEndpoints = []hardenedEndpoint{
+	{"storage.googleapis.com:443", "Cloud Storage JSON API: uploads, listings, lifecycle rules"},
+	{"oauth2.googleapis.com:443", "OAuth2 token exchange for service account keys and user credentials"},
+	{"iamcredentials.googleapis.com:443", "Access tokens for --impersonate-sa"},
+	{"www.googleapis.com:443", "Public certificates of service account keys, for --key-max-age-days"},
+	{"sts.googleapis.com:443", "Token exchange for workload identity federation credentials"},
+	{"metadata.google.internal:80", "Credentials of the attached service account on Google Cloud (169.254.169.254)"},
+}
+
+// validateHardened checks that --hardened isn't combined with a feature that runs an external
+// command: with --hardened the process never executes anything, so a SELinux or AppArmor
+// profile can deny exec outright. The state directory must be an absolute path, so the
+// profile can name the one place the uploader writes its state.
+func validateHardened(c *Config) error {
+	if !c.Hardened {
+		return nil
+	}
+	if c.Previews {
+		return errors.New("previews run ffmpeg, which hardened mode doesn't allow")
+	}
+	if c.CloudPlaceholders == placeholderDownload {
+		return fmt.Errorf("cloud-placeholders=%s runs brctl, which hardened mode doesn't allow", placeholderDownload)
+	}
+	if c.ExcludeFromIndexing {
+		return errors.New("exclude-from-indexing runs tmutil, which hardened mode doesn't allow")
+	}
+	for _, sink := range []string{sinkDesktop, sinkCommand} {
+		if _, ok := c.Notify[sink]; ok {
+			return fmt.Errorf("%s notifications run external commands, which hardened mode doesn't allow", sink)
+		}
+	}
+	if openHandlesCommand != "" && slices.Contains(strings.Split(c.StabilityCheck, ","), stabilityHandles) {
+		return fmt.Errorf("stability-check=%s runs %s on this platform, which hardened mode doesn't allow", stabilityHandles, openHandlesCommand)
+	}
+	if runtime.GOOS == "linux" {
+		usesKeystore := c.CacheTokens
+		for _, p := range c.Credentials {
+			usesKeystore = usesKeystore || p.KeychainAccount != "" || p.Login != ""
+		}
+		if usesKeystore {
+			return errors.New("the Secret Service is reached through secret-tool, which hardened mode doesn't allow (cache-tokens, keychain_account, login)")
+		}
+	}
+	if c.StateDir != "" && !filepath.IsAbs(c.StateDir) {
+		return fmt.Errorf("hardened mode needs an absolute state-dir, got '%s'", c.StateDir)
+	}
+	return nil
+}
+
+// logHardened describes the constraints of --hardened at startup.
+func logHardened() {
+	slog.Info("Hardened mode: no external commands are run (no desktop notifications, previews, cloud downloads or in-place restarts)")
+	slog.Info("Hardened mode: state is only written below the state directory", "path", cfg.StateDir)
+	for _, e := range hardenedEndpoints {
+		slog.Info("Hardened mode: outbound endpoint", "endpoint", e.Host, "purpose", e.Purpose)
+	}
+	if cfg.GCSEndpoint != "" {
+		slog.Info("Hardened mode: outbound endpoint", "endpoint", cfg.GCSEndpoint, "purpose", "--gcs-endpoint")
+	}
+	if cfg.Proxy != "" {
+		slog.Info("Hardened mode: outbound endpoint", "endpoint", redactProxy(cfg.Proxy), "purpose", "--proxy (all requests)")
+	}
+	if cfg.AlertWebhook != "" {
+		slog.Info("Hardened mode: outbound endpoint", "endpoint", cfg.AlertWebhook, "purpose", "--alert-webhook")
+	}
+	if _, ok := cfg.Notify[sinkSlack]; ok {
+		slog.Info("Hardened mode: outbound endpoint", "endpoint", cfg.SlackWebhook, "purpose", "--notify slack")
+	}
+	if _, ok := cfg.Notify[sinkEmail]; ok {
+		slog.Info("Hardened mode: outbound endpoint", "endpoint", cfg.SMTPServer, "purpose", "--notify email")
+	}
+	if cfg.Telemetry == telemetryOn {
+		slog.Info("Hardened mode: outbound endpoint", "endpoint", telemetryURL(cfg), "purpose", "--telemetry on")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateHardened(t *testing.T) {
+	stateDir, err := filepath.Abs("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		wantErr bool
+	}{
+		{"defaults", func(c *Config) {}, false},
+		{"previews", func(c *Config) { c.Previews = true }, true},
+		{"cloud downloads", func(c *Config) { c.CloudPlaceholders = placeholderDownload }, true},
+		{"exclude from indexing", func(c *Config) { c.ExcludeFromIndexing = true }, true},
+		{"desktop notifications", func(c *Config) { c.Notify = notifyFlag{sinkDesktop: "all"} }, true},
+		{"command notifications", func(c *Config) { c.Notify = notifyFlag{sinkCommand: "all"} }, true},
+		{"slack notifications", func(c *Config) { c.Notify = notifyFlag{sinkSlack: "all"} }, false},
+		{"relative state-dir", func(c *Config) { c.StateDir = "state" }, true},
+		// lsof on macOS; /proc on Linux and a sharing check on Windows run nothing
+		{"handles", func(c *Config) { c.StabilityCheck = stabilityHandles }, openHandlesCommand != ""},
+		{"size and handles", func(c *Config) { c.StabilityCheck = stabilitySize + "," + stabilityHandles }, openHandlesCommand != ""},
+		{"size", func(c *Config) { c.StabilityCheck = stabilitySize }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Hardened: true, StateDir: stateDir, StabilityCheck: stabilitySize}
+			tt.change(c)
+			err := validateHardened(c)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateHardened() = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
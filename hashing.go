@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"time"
+)
+
+// hashedFile holds the checksums of a file hashed ahead of its upload by the hashing pool
+// (--hash-workers), with the size and modification time the file had then. The upload
+// worker hashes the file again while uploading it if either changed since.
+type hashedFile struct {
+	sums    *checksums
+	size    int64
+	modTime time.Time
+}
+
+// hashJob is the work of the hashing pool: it prepares the file of job (checks, stability,
+// destination) and reads it once to compute its checksums, then queues it for the upload
+// pool. Hashing and waiting for stability are bound by the disk and the CPU, uploading by the
+// network, so each pool can be sized for its own bottleneck. A file that can't be hashed is
+// queued without checksums; its upload worker then runs into the error and reports it.
+func hashJob(job uploadJob) {
+	target, ok := prepareFile(job.src, job.filePath)
+	if !ok {
+		return
+	}
+	if hashed, err := hashFile(job.filePath, target); err != nil {
+		slog.Debug("Error hashing file, leaving it to the upload worker", "file", job.filePath, "error", err)
+	} else {
+		target.Hashed = hashed
+	}
+	job.prepared = &target
+	uploads.enqueue(job)
+}
+
+// hashFile reads filePath and returns the checksums of its upload to target.
+func hashFile(filePath string, target uploadTarget) (*hashedFile, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sums, err := uploadChecksums(f, target)
+	if err != nil {
+		return nil, err
+	}
+	return &hashedFile{sums: sums, size: info.Size(), modTime: info.ModTime()}, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// healthState tracks what the health endpoints report that isn't kept elsewhere: how each
+// source is watched and when the last upload succeeded.
+type healthState struct {
+	mu         sync.Mutex
+	watching   map[*watchSource]bool // fsnotify watcher running
+	polling    map[*watchSource]bool // Polling loop running
+	watchErr   map[*watchSource]string
+	lastUpload time.Time
+}
+
+// health is the process-wide health state.
+var health = &healthState{
+	watching: make(map[*watchSource]bool),
+	polling:  make(map[*watchSource]bool),
+	watchErr: make(map[*watchSource]string),
+}
+
+// setWatching records whether the fsnotify watcher of src is running.
+func (h *healthState) setWatching(src *watchSource, running bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.watching[src] = running
+}
+
+// setPolling records whether src is polled.
+func (h *healthState) setPolling(src *watchSource, running bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.polling[src] = running
+}
+
+// watchError records the last error reported by the watcher of src.
+func (h *healthState) watchError(src *watchSource, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.watchErr[src] = err.Error()
+}
+
+// uploaded records a successful upload.
+func (h *healthState) uploaded() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastUpload = time.Now()
+}
+
+// sourceHealth is the status of one source folder in a health report.
+type sourceHealth struct {
+	Path      string `json:"path"`
+	Watching  bool   `json:"watching"`
+	Polling   bool   `json:"polling"`
+	Reachable bool   `json:"reachable"` // The folder can be read
+	Error     string `json:"error,omitempty"`
+}
+
+// credentialHealth is the status of one credential profile in a health report.
+type credentialHealth struct {
+	Name  string `json:"name"`
+	Valid bool   `json:"valid"`
+}
+
+// healthReport is the JSON body of /healthz and /readyz.
+type healthReport struct {
+	Status       string             `json:"status"` // "ok" or "unavailable"
+	Sources      []sourceHealth     `json:"sources"`
+	LastUpload   *time.Time         `json:"last_upload,omitempty"`
+	Credentials  []credentialHealth `json:"credentials,omitempty"` // Not checked in observer mode
+	GCSReachable bool               `json:"gcs_reachable"`
+	QueuedFiles  int                `json:"queued_files"`
+	HeldFiles    int                `json:"held_deletions"`     // Waiting for resume-deletions
+	Failures     map[string]int64   `json:"failures,omitempty"` // Failed files by error code
+}
+
+// report collects the current health. live is false when a source folder is no longer
+// watched or polled, or can't be read: the uploader is wedged and only a restart helps.
+// ready is false as well when credentials are broken or GCS is unreachable, conditions
+// the uploader recovers from by itself.
+func (h *healthState) report() (r healthReport, live, ready bool) {
+	h.mu.Lock()
+	for _, src := range sources {
+		r.Sources = append(r.Sources, sourceHealth{Path: src.Path, Watching: h.watching[src], Polling: h.polling[src], Error: h.watchErr[src]})
+	}
+	if !h.lastUpload.IsZero() {
+		last := h.lastUpload
+		r.LastUpload = &last
+	}
+	h.mu.Unlock()
+
+	// Stat outside the lock, a hung network mount must not block the watchers
+	live = true
+	for i := range r.Sources {
+		s := &r.Sources[i]
+		if _, err := os.Stat(s.Path); err != nil {
+			s.Error = err.Error()
+		} else {
+			s.Reachable = true
+		}
+		live = live && s.Reachable && (s.Watching || s.Polling)
+	}
+
+	ready = live
+	if !cfg.Observe {
+		broken := clients.brokenProfiles()
+		for _, profile := range credentialProfilesInUse() {
+			valid := !broken[profile]
+			r.Credentials = append(r.Credentials, credentialHealth{Name: profileName(profile), Valid: valid})
+			ready = ready && valid
+		}
+	}
+	r.GCSReachable = !retryQueue.offline()
+	r.QueuedFiles = retryQueue.len()
+	r.HeldFiles = deletions.heldCount()
+	r.Failures = failureCounts()
+	ready = ready && r.GCSReachable
+	return r, live, ready
+}
+
+// serveHealth answers /healthz (liveness) and /readyz (readiness) on listener until the process
+// exits. Both return the full report; the status code is 200 when the check passes and 503
+// when it doesn't.
+func serveHealth(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		report, live, _ := health.report()
+		writeHealth(w, report, live)
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		report, _, ready := health.report()
+		writeHealth(w, report, ready)
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeProgressMetrics(w)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	if err := server.Serve(listener); err != nil {
+		slog.Error("Health endpoint stopped", "error", err)
+	}
+}
+
+// writeHealth writes report with the status code for ok.
+func writeHealth(w http.ResponseWriter, report healthReport, ok bool) {
+	code := http.StatusOK
+	report.Status = "ok"
+	if !ok {
+		code = http.StatusServiceUnavailable
+		report.Status = "unavailable"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files in the hold folder of a source (--hold-dir) are never uploaded: it is the place to
+// stage files inside the watched tree that are not ready yet. Moving a file out of it
+// uploads the file as usual. Files held longer than --hold-max-age are reported.
+
+// validateHold checks --hold-dir and --hold-max-age.
+func validateHold(c *Config) error {
+	if c.HoldMaxAge < 0 {
+		return errors.New("hold-max-age must not be negative")
+	}
+	if c.HoldDir == "" {
+		return nil
+	}
+	dir := filepath.ToSlash(filepath.Clean(c.HoldDir))
+	if filepath.IsAbs(c.HoldDir) || dir == "." || dir == ".." || strings.HasPrefix(dir, "../") {
+		return fmt.Errorf("hold-dir must be a folder relative to the source folder, got '%s'", c.HoldDir)
+	}
+	return nil
+}
+
+// holdPath returns the hold folder of the source, or "" without --hold-dir.
+func (s *watchSource) holdPath() string {
+	if cfg.HoldDir == "" {
+		return ""
+	}
+	return filepath.Join(s.Path, filepath.Clean(cfg.HoldDir))
+}
+
+// isHeld reports whether filePath is in the hold folder of the source.
+func (s *watchSource) isHeld(filePath string) bool {
+	hold := s.holdPath()
+	filePath = filepath.Clean(filePath)
+	return hold != "" && filePath != hold && isWithin(filePath, hold)
+}
+
+// holdWarned remembers the files reported as held too long, with the modification time
+// they had then, so each is reported once until it changes.
+var holdWarned = struct {
+	mu    sync.Mutex
+	files map[string]time.Time
+}{files: make(map[string]time.Time)}
+
+// checkHold reports the files that have been in the hold folders of sources, unmodified,
+// for longer than --hold-max-age.
+func checkHold(sources []*watchSource) {
+	if cfg.HoldDir == "" || cfg.HoldMaxAge == 0 {
+		return
+	}
+	holdWarned.mu.Lock()
+	defer holdWarned.mu.Unlock()
+	seen := make(map[string]bool)
+	var overdue []string
+	for _, src := range sources {
+		hold := src.holdPath()
+		// Walked whatever --recursive says: held files are waiting to be moved, not watched
+		err := filepath.WalkDir(hold, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			seen[p] = true
+			age := time.Since(info.ModTime())
+			if age < cfg.HoldMaxAge || holdWarned.files[p].Equal(info.ModTime()) {
+				return nil
+			}
+			holdWarned.files[p] = info.ModTime()
+			overdue = append(overdue, p)
+			slog.Warn("File has been on hold for too long, move it out of the hold folder to upload it",
+				"file", p, "hold", hold, "age", age.Round(time.Minute), "max_age", cfg.HoldMaxAge)
+			return nil
+		})
+		if err != nil {
+			slog.Error("Error checking hold folder", "path", hold, "error", err)
+		}
+	}
+	for p := range holdWarned.files {
+		if !seen[p] {
+			delete(holdWarned.files, p)
+		}
+	}
+	switch len(overdue) {
+	case 0:
+	case 1:
+		notify(notifyAlert, msgFileOnHold, "file", overdue[0], "max_age", cfg.HoldMaxAge)
+	default:
+		notify(notifyAlert, msgFilesOnHold, "count", len(overdue), "max_age", cfg.HoldMaxAge, "file", overdue[0])
+	}
+}
+
+// watchHold runs checkHold every HoldCheckInterval.
+func watchHold(sources []*watchSource) {
+	checkHold(sources)
+	for range time.Tick(HoldCheckInterval) {
+		checkHold(sources)
+	}
+}
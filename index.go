@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// indexEntry is what the destination index knows about one object.
+type indexEntry struct {
+	Generation int64
+	Size       int64
+	CRC32C     uint32
+	MD5        []byte
+}
+
+// attrs returns the entry in the form checksums.verify expects.
+func (e indexEntry) attrs(bucket, name string) *storage.ObjectAttrs {
+	return &storage.ObjectAttrs{Bucket: bucket, Name: name, Generation: e.Generation, Size: e.Size, CRC32C: e.CRC32C, MD5: e.MD5}
+}
+
+// destIndex caches the objects below one destination prefix (--dest-index), so that
+// existence and --dedupe checks are answered locally instead of with an API call per file.
+// The prefix is listed on first use and listed again every --dest-index-refresh, merging
+// the result into the cache; objects the uploader creates itself are added as it goes.
+type destIndex struct {
+	mu        sync.Mutex
+	bucket    string
+	prefix    string
+	objects   map[string]indexEntry
+	refreshed time.Time
+}
+
+// destIndexes holds one destIndex per bucket and prefix.
+var destIndexes = struct {
+	sync.Mutex
+	m map[string]*destIndex
+}{m: make(map[string]*destIndex)}
+
+// destIndexFor returns the index covering the destination of target, or nil if
+// --dest-index is off.
+func destIndexFor(target uploadTarget) *destIndex {
+	if !cfg.DestIndex {
+		return nil
+	}
+	key := target.Bucket + "/" + target.ListPrefix
+	destIndexes.Lock()
+	defer destIndexes.Unlock()
+	idx, ok := destIndexes.m[key]
+	if !ok {
+		idx = &destIndex{bucket: target.Bucket, prefix: target.ListPrefix, objects: make(map[string]indexEntry)}
+		destIndexes.m[key] = idx
+	}
+	return idx
+}
+
+// refresh lists the prefix again if the cache is older than --dest-index-refresh.
+// It must be called with idx.mu held, so concurrent lookups wait for one listing.
+func (idx *destIndex) refresh(ctx context.Context, client *storage.Client) error {
+	if !idx.refreshed.IsZero() && time.Since(idx.refreshed) < cfg.DestIndexRefresh {
+		return nil
+	}
+	start := time.Now()
+	query := &storage.Query{Prefix: idx.prefix}
+	if err := query.SetAttrSelection([]string{"Name", "Generation", "Size", "CRC32C", "MD5"}); err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(idx.objects))
+	it := client.Bucket(idx.bucket).Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return fmt.Errorf("listing gs://%s/%s: %w", idx.bucket, idx.prefix, err)
+		}
+		seen[attrs.Name] = true
+		idx.objects[attrs.Name] = indexEntry{Generation: attrs.Generation, Size: attrs.Size, CRC32C: attrs.CRC32C, MD5: attrs.MD5}
+	}
+	// Objects removed from the bucket since the last listing
+	for name := range idx.objects {
+		if !seen[name] {
+			delete(idx.objects, name)
+		}
+	}
+	idx.refreshed = time.Now()
+	slog.Debug("Indexed destination prefix", "bucket", idx.bucket, "prefix", idx.prefix, "objects", len(idx.objects), durationMS(start))
+	return nil
+}
+
+// stat returns the cached attributes of the named object, or nil if the index has no such object.
+func (idx *destIndex) stat(ctx context.Context, client *storage.Client, name string) (*storage.ObjectAttrs, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if err := idx.refresh(ctx, client); err != nil {
+		return nil, err
+	}
+	entry, ok := idx.objects[name]
+	if !ok {
+		return nil, nil
+	}
+	return entry.attrs(idx.bucket, name), nil
+}
+
+// find returns a cached object with the given size and checksums, or nil if there is none.
+func (idx *destIndex) find(ctx context.Context, client *storage.Client, size int64, sums *checksums) (*storage.ObjectAttrs, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if err := idx.refresh(ctx, client); err != nil {
+		return nil, err
+	}
+	crc := sums.crc32c.Sum32()
+	md5sum := sums.md5.Sum(nil)
+	for name, entry := range idx.objects {
+		if entry.Size == size && entry.CRC32C == crc && (len(entry.MD5) == 0 || bytes.Equal(entry.MD5, md5sum)) {
+			return entry.attrs(idx.bucket, name), nil
+		}
+	}
+	return nil, nil
+}
+
+// put records an object the uploader created.
+func (idx *destIndex) put(attrs *storage.ObjectAttrs) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.objects[attrs.Name] = indexEntry{Generation: attrs.Generation, Size: attrs.Size, CRC32C: attrs.CRC32C, MD5: attrs.MD5}
+}
+
+// remove drops an object the uploader deleted.
+func (idx *destIndex) remove(name string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	delete(idx.objects, name)
+}
+
+// statObject returns the attributes of the object target names, or nil if it doesn't exist.
+// With --dest-index they come from the cached index of the destination prefix; a stale
+// "doesn't exist" is caught by the DoesNotExist precondition of the upload that follows.
+func statObject(ctx context.Context, client *storage.Client, target uploadTarget) (*storage.ObjectAttrs, error) {
+	if idx := destIndexFor(target); idx != nil && strings.HasPrefix(target.Object, idx.prefix) {
+		return idx.stat(ctx, client, target.Object)
+	}
+	attrs, err := encrypted(client.Bucket(target.Bucket).Object(target.Object)).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil
+	}
+	return attrs, err
+}
+
+// recordObject adds an object the uploader created to the index of target's destination, if any.
+func recordObject(target uploadTarget, attrs *storage.ObjectAttrs) {
+	if idx := destIndexFor(target); idx != nil && attrs != nil {
+		idx.put(attrs)
+	}
+}
+
+// isPreconditionFailed reports whether err is GCS rejecting a write because of its conditions,
+// e.g. DoesNotExist on an object that does exist.
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"runtime"
+)
+
+// spotlightMarker is the file that keeps Spotlight from indexing the folder it is in
+// (--exclude-from-indexing). It is never uploaded.
+const spotlightMarker = ".metadata_never_index"
+
+// validateExcludeFromIndexing checks --exclude-from-indexing, which only macOS has.
+func validateExcludeFromIndexing(c *Config) error {
+	if c.ExcludeFromIndexing && runtime.GOOS != "darwin" {
+		return errors.New("exclude-from-indexing is only supported on macOS")
+	}
+	return nil
+}
+
+// excludeFromIndexing keeps Spotlight and Time Machine out of the source folders: indexing
+// and backing up a folder whose files are deleted as soon as they are uploaded only costs
+// disk and CPU time, and the indexer races with the deletion. Failures are logged; the
+// uploader works either way.
+func excludeFromIndexing(sources []*watchSource) {
+	for _, src := range sources {
+		logger := slog.With("path", src.Path)
+		spotlightErr := excludeFromSpotlight(src.Path)
+		if spotlightErr != nil {
+			logger.Warn("Error excluding source folder from Spotlight", "error", spotlightErr)
+		}
+		timeMachineErr := excludeFromTimeMachine(src.Path)
+		if timeMachineErr != nil {
+			logger.Warn("Error excluding source folder from Time Machine", "error", timeMachineErr)
+		}
+		if spotlightErr == nil && timeMachineErr == nil {
+			logger.Info("Source folder is excluded from Spotlight and Time Machine")
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// excludeFromSpotlight creates the Spotlight marker file in dir, unless it is there.
+func excludeFromSpotlight(dir string) error {
+	f, err := os.OpenFile(filepath.Join(dir, spotlightMarker), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// excludeFromTimeMachine adds dir to the Time Machine exclusions with tmutil. The exclusion
+// is sticky: it is stored with the folder, follows it when it is moved, and needs no admin
+// rights.
+func excludeFromTimeMachine(dir string) error {
+	out, err := exec.Command("tmutil", "addexclusion", dir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tmutil addexclusion: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
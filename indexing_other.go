@@ -0,0 +1,15 @@
+//go:build !darwin
+
+package main
+
+import "errors"
+
+// excludeFromSpotlight is never called: only macOS has Spotlight (see validateExcludeFromIndexing).
+func excludeFromSpotlight(dir string) error {
+	return errors.ErrUnsupported
+}
+
+// excludeFromTimeMachine is never called: only macOS has Time Machine.
+func excludeFromTimeMachine(dir string) error {
+	return errors.ErrUnsupported
+}
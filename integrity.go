@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Ways an object can drift from its audit record (--verify-only).
+const (
+	driftMissing  = "missing"  // The object is gone
+	driftSize     = "size"     // The object has another size
+	driftChecksum = "checksum" // The object has another CRC32C
+)
+
+// auditedObjects returns the latest audit record of every object the uploader left in GCS
+// under a file's name, sorted by bucket and object.
+func auditedObjects() ([]auditRecord, error) {
+	f, err := os.Open(appState.file(stateAuditFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	latest := make(map[string]auditRecord)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("reading audit history: %v", err)
+		}
+		switch rec.Event {
+		case auditUploaded, auditExisted, auditCopied, auditOverwritten:
+			latest[rec.Bucket+"/"+rec.Object] = rec
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading audit history: %v", err)
+	}
+	records := make([]auditRecord, 0, len(latest))
+	for _, rec := range latest {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Bucket != records[j].Bucket {
+			return records[i].Bucket < records[j].Bucket
+		}
+		return records[i].Object < records[j].Object
+	})
+	return records, nil
+}
+
+// objectDrift compares the object of rec with what was recorded when it was uploaded. It
+// returns how the object drifted, or "" if it still matches. The checksum is compared for
+// records that have one; older records only have the size.
+func objectDrift(ctx context.Context, client *storage.Client, rec auditRecord) (string, error) {
+	attrs, err := encrypted(client.Bucket(rec.Bucket).Object(rec.Object)).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return driftMissing, nil
+	} else if err != nil {
+		return "", err
+	}
+	if attrs.Size != rec.Size {
+		return driftSize, nil
+	}
+	if rec.CRC32C != "" && fmt.Sprintf("%08x", attrs.CRC32C) != rec.CRC32C {
+		return driftChecksum, nil
+	}
+	if rec.Generation != 0 && attrs.Generation != rec.Generation {
+		slog.Debug("Object was rewritten with the same content", "bucket", rec.Bucket, "object", rec.Object, "generation", attrs.Generation, "recorded_generation", rec.Generation)
+	}
+	return "", nil
+}
+
+// verifyPass checks every audited object once. Drifted objects are logged every pass, but
+// alerted only when they are first found; known holds the drifts found before and is
+// updated. It returns the number of drifted objects.
+func verifyPass(sources []*watchSource, known map[string]string) int {
+	records, err := auditedObjects()
+	if err != nil {
+		slog.Error("Error reading the audit history", "error", err)
+		return 0
+	}
+	ctx := context.Background()
+	start := time.Now()
+	var checked, failed int
+	var drifted []string
+	current := make(map[string]string)
+	for _, rec := range records {
+		logger := slog.With("bucket", rec.Bucket, "object", rec.Object, "file", rec.File)
+		profile := ""
+		if src := sourceOf(sources, rec.File); src != nil {
+			profile = src.Credentials
+		}
+		client, err := clients.get(profile)
+		if err != nil {
+			logger.Error("Error creating Google Cloud Storage client", "credentials", profileName(profile), "error", err)
+			failed++
+			continue
+		}
+		drift, err := objectDrift(ctx, client, rec)
+		clients.report(client, err)
+		if err != nil {
+			logger.Error("Error verifying object", "error_code", errorCode(err), "error", err)
+			failed++
+			continue
+		}
+		checked++
+		if drift == "" {
+			continue
+		}
+		key := rec.Bucket + "/" + rec.Object
+		current[key] = drift
+		logger.Error("Object no longer matches the audit history", "drift", drift, "size", rec.Size, "crc32c", rec.CRC32C,
+			"uploaded", rec.Time.Format(time.RFC3339))
+		if known[key] != drift {
+			drifted = append(drifted, fmt.Sprintf("gs://%s (%s)", key, drift))
+		}
+	}
+	clear(known)
+	for key, drift := range current {
+		known[key] = drift
+	}
+	slog.Info("Verified audited objects", "objects", len(records), "checked", checked, "drifted", len(current), "errors", failed,
+		"duration", time.Since(start).Round(time.Second))
+
+	switch len(drifted) {
+	case 0:
+	case 1:
+		notify(notifyAlert, msgObjectDrifted, "object", drifted[0])
+	default:
+		notify(notifyAlert, msgObjectsDrifted, "count", len(drifted), "object", drifted[0])
+	}
+	return len(current)
+}
+
+// runVerifyOnly implements --verify-only: it uploads nothing and instead checks the objects
+// recorded in the audit history every --verify-interval until it is stopped, or once with
+// --once, when it exits with status 1 if any object drifted.
+func runVerifyOnly(sources []*watchSource) {
+	slog.Info("Verifying audited objects, nothing is uploaded", "interval", cfg.VerifyInterval)
+	known := make(map[string]string)
+	if cfg.Once {
+		if verifyPass(sources, known) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(cfg.VerifyInterval)
+	defer ticker.Stop()
+	for {
+		verifyPass(sources, known)
+		select {
+		case <-sigChan:
+			slog.Info("Received shutdown signal. Exiting gracefully...")
+			return
+		case <-ticker.C:
+		}
+	}
+}
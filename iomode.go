@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"unsafe"
+)
+
+// How files are read for uploading and hashing (--io-mode).
+const (
+	ioBuffered = "buffered" // Small reads through the page cache, as by io.Copy
+	ioLarge    = "large"    // Large aligned reads through the page cache, read ahead sequentially
+	ioDontNeed = "dontneed" // Large reads, dropping the pages read from the page cache (Linux)
+	ioDirect   = "direct"   // Large reads bypassing the page cache with O_DIRECT (Linux)
+)
+
+// ioBlockSize is the size of the reads of every --io-mode but buffered. It is a multiple of
+// the logical block size of any disk, as O_DIRECT requires.
+const ioBlockSize = 4 << 20
+
+// ioAlignment is the alignment of the read buffer in memory, for O_DIRECT.
+const ioAlignment = 4096
+
+// validateIOMode checks --io-mode.
+func validateIOMode(c *Config) error {
+	switch c.IOMode {
+	case ioBuffered, ioLarge:
+		return nil
+	case ioDontNeed, ioDirect:
+		if err := pageCacheControlSupported(); err != nil {
+			return fmt.Errorf("io-mode=%s: %v", c.IOMode, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("io-mode must be '%s', '%s', '%s' or '%s', got '%s'", ioBuffered, ioLarge, ioDontNeed, ioDirect, c.IOMode)
+}
+
+// fileReader returns the reader a whole read of f, from its current offset, goes through
+// under --io-mode, and a function to call once the read is done. Huge sequential uploads
+// read with dontneed or direct don't evict the page cache of the application producing
+// the files.
+func fileReader(f *os.File) (io.Reader, func()) {
+	if cfg.IOMode == ioBuffered {
+		return f, func() {}
+	}
+	r := &blockReader{f: f, buf: alignedBuffer(ioBlockSize)}
+	if offset, err := f.Seek(0, io.SeekCurrent); err == nil {
+		r.off = offset
+	}
+	switch cfg.IOMode {
+	case ioLarge:
+		adviseSequential(f)
+	case ioDontNeed:
+		adviseSequential(f)
+		r.dontNeed = true
+	case ioDirect:
+		direct, err := openDirect(f.Name())
+		if err != nil {
+			// e.g. tmpfs doesn't support O_DIRECT: drop the pages read instead
+			slog.Debug("Error opening file for direct I/O, reading it through the page cache", "file", f.Name(), "error", err)
+			r.dontNeed = true
+			break
+		}
+		if _, err := direct.Seek(r.off, io.SeekStart); err != nil || r.off%ioAlignment != 0 {
+			direct.Close()
+			r.dontNeed = true
+			break
+		}
+		r.f = direct
+		return r, func() { direct.Close() }
+	}
+	return r, func() {}
+}
+
+// blockReader reads a file in blocks of ioBlockSize into an aligned buffer.
+type blockReader struct {
+	f        *os.File
+	buf      []byte
+	pos, end int   // Unread part of buf
+	off      int64 // File offset of the next block
+	eof      bool
+	dontNeed bool // Drop the blocks read from the page cache
+}
+
+func (r *blockReader) Read(p []byte) (int, error) {
+	if r.pos == r.end {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf[r.pos:r.end])
+	r.pos += n
+	return n, nil
+}
+
+// fill reads the next block. A short block is the last one: with O_DIRECT, reading on from
+// the unaligned offset after it would fail rather than return io.EOF.
+func (r *blockReader) fill() error {
+	if r.eof {
+		return io.EOF
+	}
+	n, err := r.f.Read(r.buf)
+	if err != nil {
+		return err // io.EOF at the end of a file that is a multiple of ioBlockSize
+	}
+	r.eof = n < len(r.buf)
+	if r.dontNeed {
+		dropPageCache(r.f, r.off, n)
+	}
+	r.pos, r.end = 0, n
+	r.off += int64(n)
+	return nil
+}
+
+// alignedBuffer returns a buffer of size bytes starting at a multiple of ioAlignment.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+ioAlignment)
+	shift := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % ioAlignment); rem != 0 {
+		shift = ioAlignment - rem
+	}
+	return buf[shift : shift+size : shift+size]
+}
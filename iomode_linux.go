@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// pageCacheControlSupported reports why the page cache can't be bypassed, if it can't.
+func pageCacheControlSupported() error {
+	return nil
+}
+
+// adviseSequential tells the kernel f is read sequentially, to read ahead further.
+func adviseSequential(f *os.File) {
+	if err := unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_SEQUENTIAL); err != nil {
+		slog.Debug("Error advising sequential reads", "file", f.Name(), "error", err)
+	}
+}
+
+// dropPageCache drops the n bytes of f read at off from the page cache.
+func dropPageCache(f *os.File, off int64, n int) {
+	if err := unix.Fadvise(int(f.Fd()), off, int64(n), unix.FADV_DONTNEED); err != nil {
+		slog.Debug("Error dropping read pages from the page cache", "file", f.Name(), "error", err)
+	}
+}
+
+// openDirect opens filePath for reading with O_DIRECT.
+func openDirect(filePath string) (*os.File, error) {
+	return os.OpenFile(filePath, os.O_RDONLY|unix.O_DIRECT, 0)
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// pageCacheControlSupported reports why the page cache can't be bypassed, if it can't.
+func pageCacheControlSupported() error {
+	return errors.New("only supported on Linux")
+}
+
+// adviseSequential does nothing: only Linux takes read advice here.
+func adviseSequential(f *os.File) {}
+
+// dropPageCache is never called: --io-mode=dontneed is only supported on Linux.
+func dropPageCache(f *os.File, off int64, n int) {}
+
+// openDirect fails: --io-mode=direct is only supported on Linux.
+func openDirect(filePath string) (*os.File, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Journal states of a file between being picked up by a worker and its local copy being handled.
+// A file leaves the journal once --on-success has been applied to it.
+const (
+	journalQueued    = "queued"    // Waiting for a worker when the uploader was stopped
+	journalPending   = "pending"   // Picked up, waiting for the in-flight budget
+	journalUploading = "uploading" // Upload in progress
+	journalUploaded  = "uploaded"  // Object confirmed in GCS, --on-success not applied yet
+	journalFailed    = "failed"    // Upload gave up; tried again at the next start
+)
+
+// journalEntry is the journal record of one local file.
+type journalEntry struct {
+	State   string    `json:"state"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Bucket  string    `json:"bucket"`
+	Object  string    `json:"object"`
+	Error   string    `json:"error,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// journalRecord is one line of the journal file: the new entry of File, or its removal
+// once the file is done.
+type journalRecord struct {
+	File  string        `json:"file"`
+	Entry *journalEntry `json:"entry,omitempty"`
+}
+
+// journalCompactRecords is the number of records from which the journal file is compacted
+// while running, once they outnumber the entries it holds several times over.
+const journalCompactRecords = 10000
+
+// uploadJournal is the in-memory copy of the journal file, keyed by local file path.
+// Every change is appended to the file right away, so a crash at any point leaves a record
+// of the files whose upload or local handling was interrupted; reconcileJournal finishes
+// them. The file is compacted to the current entries at startup.
+type uploadJournal struct {
+	mu      sync.Mutex
+	dir     *stateDir
+	entries map[string]journalEntry
+	records int // Records in the journal file
+}
+
+// journal is the upload journal of the state directory, loaded at startup.
+var journal *uploadJournal
+
+// loadJournal replays the journal file of dir and compacts it.
+func loadJournal(dir *stateDir) (*uploadJournal, error) {
+	j := &uploadJournal{dir: dir, entries: make(map[string]journalEntry)}
+	err := dir.readJSONLines(stateJournalFile, func(line []byte) error {
+		var rec journalRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return err
+		}
+		if rec.Entry == nil {
+			delete(j.entries, rec.File)
+		} else {
+			j.entries[rec.File] = *rec.Entry
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dir.readOnly {
+		return j, nil
+	}
+	if err := j.compact(); err != nil {
+		return nil, fmt.Errorf("compacting: %v", err)
+	}
+	return j, nil
+}
+
+// compact rewrites the journal file with one record per entry. It must be called with j.mu
+// held, or before j is shared.
+func (j *uploadJournal) compact() error {
+	paths := slices.Sorted(maps.Keys(j.entries))
+	records := make([]any, 0, len(paths))
+	for _, filePath := range paths {
+		e := j.entries[filePath]
+		records = append(records, journalRecord{File: filePath, Entry: &e})
+	}
+	if err := j.dir.writeJSONLines(stateJournalFile, records); err != nil {
+		return err
+	}
+	j.records = len(records)
+	return nil
+}
+
+// appendRecords appends recs to the journal file in a single write, compacting it instead
+// if it has grown long. It must be called with j.mu held.
+func (j *uploadJournal) appendRecords(recs ...journalRecord) error {
+	if j.records+len(recs) >= journalCompactRecords && j.records+len(recs) > 4*len(j.entries) {
+		return j.compact() // The entries already include recs
+	}
+	records := make([]any, len(recs))
+	for i, rec := range recs {
+		records[i] = rec
+	}
+	if err := j.dir.appendJSONLines(stateJournalFile, records); err != nil {
+		return err
+	}
+	j.records += len(recs)
+	return nil
+}
+
+// update changes the entry of filePath with fn and persists the change. Failures are
+// logged but never abort an upload: the journal only adds safety on top of the checks
+// made for every file.
+func (j *uploadJournal) update(filePath string, fn func(e *journalEntry)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e := j.entries[filePath]
+	fn(&e)
+	e.Updated = time.Now().UTC()
+	j.entries[filePath] = e
+	if err := j.appendRecords(journalRecord{File: filePath, Entry: &e}); err != nil {
+		slog.Error("Error recording file in the upload journal", "file", filePath, "state", e.State, "error", err)
+	}
+}
+
+// pending records that filePath, as described by info, is about to be uploaded to target.
+func (j *uploadJournal) pending(filePath string, info os.FileInfo, target uploadTarget) {
+	j.update(filePath, func(e *journalEntry) {
+		*e = journalEntry{State: journalPending, Size: info.Size(), ModTime: info.ModTime(), Bucket: target.Bucket, Object: target.Object}
+	})
+}
+
+// queued records that the files, as described by their infos, were still waiting for a
+// worker when the uploader was stopped, in a single write.
+func (j *uploadJournal) queued(files map[string]os.FileInfo) {
+	if len(files) == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now().UTC()
+	recs := make([]journalRecord, 0, len(files))
+	for _, filePath := range slices.Sorted(maps.Keys(files)) {
+		info := files[filePath]
+		e := journalEntry{State: journalQueued, Size: info.Size(), ModTime: info.ModTime(), Updated: now}
+		j.entries[filePath] = e
+		recs = append(recs, journalRecord{File: filePath, Entry: &e})
+	}
+	if err := j.appendRecords(recs...); err != nil {
+		slog.Error("Error recording waiting files in the upload journal", "files", len(files), "error", err)
+	}
+}
+
+// setState moves filePath to state, recording failure (if any) as the reason.
+func (j *uploadJournal) setState(filePath, state string, failure error) {
+	j.update(filePath, func(e *journalEntry) {
+		e.State = state
+		e.Error = ""
+		if failure != nil {
+			e.Error = failure.Error()
+		}
+	})
+}
+
+// done removes filePath from the journal once its local copy has been handled.
+func (j *uploadJournal) done(filePath string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.entries[filePath]; !ok {
+		return
+	}
+	delete(j.entries, filePath)
+	if err := j.appendRecords(journalRecord{File: filePath}); err != nil {
+		slog.Error("Error removing file from the upload journal", "file", filePath, "error", err)
+	}
+}
+
+// snapshot returns a copy of the journal entries.
+func (j *uploadJournal) snapshot() map[string]journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries := make(map[string]journalEntry, len(j.entries))
+	for filePath, e := range j.entries {
+		entries[filePath] = e
+	}
+	return entries
+}
+
+// reconcileJournal settles the files a previous run left in the journal. It runs before
+// the initial scan, so the scan only sees files that still need an upload:
+//   - uploaded files whose object is confirmed in GCS get --on-success applied without
+//     being uploaded again;
+//   - files that are gone, or changed since, are dropped (a changed file is a new upload);
+//   - interrupted or failed uploads are left to the initial scan, which checks the bucket
+//     before uploading anything.
+//
+// A local file is never deleted unless its object has been found with the same content.
+func reconcileJournal(sources []*watchSource) {
+	entries := journal.snapshot()
+	if len(entries) == 0 {
+		return
+	}
+	slog.Info("Reconciling files left in the upload journal by a previous run", "files", len(entries))
+	paths := make([]string, 0, len(entries))
+	for filePath := range entries {
+		paths = append(paths, filePath)
+	}
+	sort.Strings(paths)
+	for _, filePath := range paths {
+		reconcileJournalEntry(sources, filePath, entries[filePath])
+	}
+}
+
+func reconcileJournalEntry(sources []*watchSource, filePath string, e journalEntry) {
+	logger := slog.With("file", filePath, "state", e.State)
+	// Observe mode leaves the state directory as it is
+	drop := func() {
+		if !cfg.Observe {
+			journal.done(filePath)
+		}
+	}
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		logger.Debug("Journal: file no longer exists, dropping it")
+		drop()
+		return
+	} else if err != nil {
+		logger.Error("Journal: error getting file info", "error", err)
+		return
+	}
+	src := sourceOf(sources, filePath)
+	if src == nil || src.skipReason(filePath) != "" || info.Size() != e.Size || !info.ModTime().Equal(e.ModTime) {
+		logger.Info("Journal: file is no longer watched or has changed since the previous run, dropping it")
+		drop()
+		return
+	}
+	if e.State == journalQueued {
+		logger.Info("Journal: file was still queued when the previous run stopped; the initial scan picks it up")
+		return
+	}
+	if e.State != journalUploaded {
+		logger.Info("Journal: upload was interrupted in the previous run; the initial scan picks it up again")
+		return
+	}
+	logger = logger.With("bucket", e.Bucket, "object", e.Object)
+	if cfg.Observe {
+		logger.Info("[OBSERVE] Would confirm the object and then handle the local file", "on_success", cfg.OnSuccess)
+		return
+	}
+
+	target := uploadTarget{Credentials: src.Credentials, Bucket: e.Bucket, Object: e.Object, Gzip: compressesFile(src, filePath)}
+	if err := withRetries(fmt.Sprintf("confirming gs://%s/%s", e.Bucket, e.Object), func() error {
+		return confirmUploaded(rootCtx, filePath, target)
+	}); err != nil {
+		// Leave the file to the initial scan, which uploads it again if the object is missing
+		logger.Error("Journal: could not confirm the object", "error_code", errorCode(err), "error", err)
+		journal.done(filePath)
+		return
+	}
+	done, err := finishLocalFile(src, filePath, info, target)
+	if err != nil {
+		logger.Error("Journal: error handling local file", "on_success", cfg.OnSuccess, "error_code", errorCode(err), "error", err)
+		return
+	}
+	logger.Info("Journal: local file handled (upload confirmed in the previous run)", "local", done)
+	journal.done(filePath)
+}
+
+// confirmUploaded checks that the object of target exists with the content of filePath.
+func confirmUploaded(ctx context.Context, filePath string, target uploadTarget) (err error) {
+	client, err := clients.get(target.Credentials)
+	if err != nil {
+		return fmt.Errorf("creating Google Cloud Storage client: %w", err)
+	}
+	defer func() { clients.report(client, err) }()
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	existing, err := encrypted(client.Bucket(target.Bucket).Object(target.Object)).Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = matchExisting(f, target, existing)
+	return err
+}
+
+// migrateJournalLog converts the journal file of schema 3, a JSON object of the entries,
+// to the journal log of schema 4.
+func migrateJournalLog(dir string) error {
+	s := &stateDir{path: dir}
+	entries := make(map[string]journalEntry)
+	if err := s.readJSON(stateJournalFileV3, &entries); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	j := &uploadJournal{dir: s, entries: entries}
+	if err := j.compact(); err != nil {
+		return err
+	}
+	if err := os.Remove(s.file(stateJournalFileV3)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// sourceOf returns the source watching filePath, or nil if none does.
+func sourceOf(sources []*watchSource, filePath string) *watchSource {
+	for _, src := range sources {
+		if isWithin(filePath, src.Path) {
+			return src
+		}
+	}
+	return nil
+}
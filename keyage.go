@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// KeyAgeCheckInterval is how often a long-running uploader checks the age of its service account key again.
+const KeyAgeCheckInterval = 24 * time.Hour
+
+// serviceAccountKey is the part of a service account JSON key the age check reads.
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	PrivateKeyID string `json:"private_key_id"`
+	ClientEmail  string `json:"client_email"`
+	CertURL      string `json:"client_x509_cert_url"`
+}
+
+// longLivedKey returns the service account key a credential profile authenticates with, if
+// any, and where it is stored: the keystore, or the Application Default Credentials file
+// (which is also what impersonation starts from).
+func longLivedKey(profile string) (*serviceAccountKey, string) {
+	creds, err := credentialsFor(profile)
+	if err != nil {
+		return nil, ""
+	}
+	if creds.Strategy == authKeychainKey {
+		if key := parseServiceAccountKey(creds.Key); key != nil {
+			return key, fmt.Sprintf("%s (account '%s')", keystore.Name(), creds.KeychainAccount)
+		}
+		return nil, ""
+	}
+	if creds.Strategy == authExternal || creds.Strategy == authUser {
+		return nil, "" // Neither uses a service account key
+	}
+	path := adcFile()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, ""
+	}
+	if key := parseServiceAccountKey(data); key != nil {
+		return key, path
+	}
+	return nil, ""
+}
+
+// parseServiceAccountKey returns the service account key in a credentials file, or nil if it
+// holds other credentials. The source credentials of an impersonated_service_account file,
+// as written by 'gcloud auth application-default login --impersonate-service-account', count too.
+func parseServiceAccountKey(data []byte) *serviceAccountKey {
+	var creds struct {
+		serviceAccountKey
+		Source *serviceAccountKey `json:"source_credentials"`
+	}
+	if json.Unmarshal(data, &creds) != nil {
+		return nil
+	}
+	key := &creds.serviceAccountKey
+	if key.Type == "impersonated_service_account" && creds.Source != nil {
+		key = creds.Source
+	}
+	if key.Type != "service_account" || key.PrivateKeyID == "" {
+		return nil
+	}
+	return key
+}
+
+// adcFile returns the file Application Default Credentials are read from: the one
+// GOOGLE_APPLICATION_CREDENTIALS names, or the well-known file gcloud writes.
+func adcFile() string {
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		return path
+	}
+	dir := os.Getenv("CLOUDSDK_CONFIG")
+	if dir == "" {
+		if runtime.GOOS == "windows" {
+			dir = filepath.Join(os.Getenv("APPDATA"), "gcloud")
+		} else if home, err := os.UserHomeDir(); err == nil {
+			dir = filepath.Join(home, ".config", "gcloud")
+		}
+	}
+	return filepath.Join(dir, "application_default_credentials.json")
+}
+
+// keyCreated returns when key was created. A service account key file carries no date, but
+// Google publishes the certificate of every key of a service account, and a certificate is
+// valid from the moment its key was created.
+func keyCreated(ctx context.Context, key *serviceAccountKey) (time.Time, error) {
+	certURL := key.CertURL
+	if certURL == "" {
+		certURL = "https://www.googleapis.com/robot/v1/metadata/x509/" + url.PathEscape(key.ClientEmail)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, certURL, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("fetching the certificates of %s: %s", key.ClientEmail, resp.Status)
+	}
+	var certs map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&certs); err != nil {
+		return time.Time{}, fmt.Errorf("decoding the certificates of %s: %v", key.ClientEmail, err)
+	}
+	block, _ := pem.Decode([]byte(certs[key.PrivateKeyID]))
+	if block == nil {
+		return time.Time{}, errors.New("the key is not among the active keys of its service account (it may have been deleted)")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotBefore, nil
+}
+
+// checkKeyAge warns (log and notification) when a service account key in use is older
+// than --key-max-age-days, so long-lived keys get rotated on schedule.
+func checkKeyAge() {
+	if cfg.KeyMaxAgeDays <= 0 {
+		return
+	}
+	checked := make(map[string]bool) // Profiles may share a key, e.g. the ADC file
+	for _, profile := range credentialProfilesInUse() {
+		key, where := longLivedKey(profile)
+		if key == nil || checked[key.PrivateKeyID] {
+			continue
+		}
+		checked[key.PrivateKeyID] = true
+		checkServiceAccountKeyAge(key, where)
+	}
+}
+
+// checkServiceAccountKeyAge warns if key, stored in where, is older than --key-max-age-days.
+func checkServiceAccountKeyAge(key *serviceAccountKey, where string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	created, err := keyCreated(ctx, key)
+	if err != nil {
+		slog.Warn("Could not determine the age of the service account key", "key_id", key.PrivateKeyID, "from", where, "error", err)
+		return
+	}
+	days := int(time.Since(created).Hours() / 24)
+	if days < cfg.KeyMaxAgeDays {
+		slog.Debug("Service account key age", "key_id", key.PrivateKeyID, "service_account", key.ClientEmail, "from", where, "age_days", days, "created", created.Format(time.DateOnly))
+		return
+	}
+	slog.Warn("Service account key is older than the rotation limit. Create a new key, store it and delete the old one.",
+		"key_id", key.PrivateKeyID, "service_account", key.ClientEmail, "from", where, "age_days", days, "created", created.Format(time.DateOnly), "max_age_days", cfg.KeyMaxAgeDays)
+	notify(notifyAlert, msgKeyRotationDue, "account", key.ClientEmail, "days", days)
+}
+
+// watchKeyAge runs checkKeyAge now and every KeyAgeCheckInterval for the lifetime of the process.
+func watchKeyAge() {
+	for ; ; time.Sleep(KeyAgeCheckInterval) {
+		checkKeyAge()
+	}
+}
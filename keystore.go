@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Keystore is the platform's secure storage for secrets: the Keychain on macOS, the Secret
+// Service (GNOME Keyring, KWallet) on Linux and the Credential Manager on Windows. Items
+// are addressed by service and account, like Keychain items.
+type Keystore interface {
+	// Name describes the store in messages, e.g. "the Keychain".
+	Name() string
+	// Get returns the secret of an item, or errNotInKeystore if there is none.
+	Get(service, account string) ([]byte, error)
+	// Set creates or replaces an item. Items stay on this machine and are only readable by
+	// the user who stored them.
+	Set(service, account string, data []byte) error
+	// Delete removes an item; removing one that doesn't exist is not an error.
+	Delete(service, account string) error
+	// List returns the accounts of the items of a service.
+	List(service string) ([]string, error)
+}
+
+// errNotInKeystore is returned by Keystore.Get for a missing item.
+var errNotInKeystore = errors.New("item not found")
+
+// keystore is the secure storage of the platform (see newKeystore in keystore_*.go).
+var keystore Keystore = newKeystore()
+
+// storeServiceAccountKey stores the service account KEY JSON (as bytes) in the keystore
+// under the given account of the uploader's keystore service.
+func storeServiceAccountKey(account string, keyJSON []byte) error {
+	return keystore.Set(keychainSAKeyService, account, keyJSON)
+}
+
+// getServiceAccountKey retrieves the service account KEY JSON (as bytes) stored in the
+// keystore under the given account.
+func getServiceAccountKey(account string) ([]byte, error) {
+	key, err := keystore.Get(keychainSAKeyService, account)
+	if errors.Is(err, errNotInKeystore) {
+		return nil, fmt.Errorf("service account key not found in %s for service '%s', account '%s'", keystore.Name(), keychainSAKeyService, account)
+	}
+	return key, err
+}
+
+// deleteServiceAccountKey removes the service account key stored under account, which must exist.
+func deleteServiceAccountKey(account string) error {
+	if _, err := getServiceAccountKey(account); err != nil {
+		return err
+	}
+	return keystore.Delete(keychainSAKeyService, account)
+}
+
+// listServiceAccountKeys returns the accounts service account keys are stored under, sorted.
+func listServiceAccountKeys() ([]string, error) {
+	accounts, err := keystore.List(keychainSAKeyService)
+	sort.Strings(accounts)
+	return accounts, err
+}
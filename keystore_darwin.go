@@ -0,0 +1,64 @@
+package main
+
+import "github.com/keybase/go-keychain"
+
+// keychainStore keeps secrets in the macOS Keychain.
+type keychainStore struct{}
+
+func newKeystore() Keystore {
+	return keychainStore{}
+}
+
+func (keychainStore) Name() string {
+	return "the Keychain"
+}
+
+func (keychainStore) Get(service, account string) ([]byte, error) {
+	query := keychain.NewItem()
+	query.SetSecClass(keychain.SecClassGenericPassword)
+	query.SetService(service)
+	query.SetAccount(account)
+	query.SetMatchLimit(keychain.MatchLimitOne)
+	query.SetReturnData(true)
+
+	results, err := keychain.QueryItem(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, errNotInKeystore
+	}
+	return results[0].Data, nil
+}
+
+func (keychainStore) Set(service, account string, data []byte) error {
+	// Prepare the item with new data
+	newItem := keychain.NewGenericPassword(service, account, "", data, "")
+	newItem.SetSynchronizable(keychain.SynchronizableNo)
+	newItem.SetAccessible(keychain.AccessibleWhenUnlocked)
+
+	err := keychain.AddItem(newItem) // Try adding first
+	if err == keychain.ErrorDuplicateItem {
+		// If it's a duplicate, prepare a query for the existing item
+		queryItem := keychain.NewItem()
+		queryItem.SetSecClass(keychain.SecClassGenericPassword)
+		queryItem.SetService(service)
+		queryItem.SetAccount(account)
+
+		// Update the existing item with the data from newItem
+		err = keychain.UpdateItem(queryItem, newItem)
+	}
+	return err
+}
+
+func (keychainStore) List(service string) ([]string, error) {
+	return keychain.GetAccountsForService(service)
+}
+
+func (keychainStore) Delete(service, account string) error {
+	err := keychain.DeleteGenericPasswordItem(service, account)
+	if err == keychain.ErrorItemNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// secretServiceStore keeps secrets in the freedesktop Secret Service (GNOME Keyring,
+// KWallet, KeePassXC) through libsecret's secret-tool, which needs a D-Bus session and an
+// unlocked collection. Items carry the attributes service and account.
+type secretServiceStore struct{}
+
+func newKeystore() Keystore {
+	return secretServiceStore{}
+}
+
+func (secretServiceStore) Name() string {
+	return "the Secret Service"
+}
+
+// run runs secret-tool with args and stdin, returning its output. secret-tool exits with 1
+// without a message when no item matches, which counts as success with no output.
+func (secretServiceStore) run(stdin []byte, args ...string) ([]byte, error) {
+	if cfg != nil && cfg.Hardened {
+		return nil, errors.New("the Secret Service is reached through secret-tool, which hardened mode doesn't allow")
+	}
+	cmd := exec.Command("secret-tool", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && len(out) == 0 && stderr.Len() == 0 {
+		return nil, nil
+	}
+	if msg := bytes.TrimSpace(stderr.Bytes()); err != nil && len(msg) > 0 {
+		return nil, fmt.Errorf("secret-tool %s: %v: %s", args[0], err, msg)
+	} else if err != nil {
+		return nil, fmt.Errorf("secret-tool %s: %v", args[0], err)
+	}
+	return out, nil
+}
+
+func (s secretServiceStore) Get(service, account string) ([]byte, error) {
+	out, err := s.run(nil, "lookup", "service", service, "account", account)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, errNotInKeystore
+	}
+	return out, nil
+}
+
+func (s secretServiceStore) Set(service, account string, data []byte) error {
+	_, err := s.run(data, "store", "--label=gcs-folder-uploader "+service+" ("+account+")", "service", service, "account", account)
+	return err
+}
+
+// List parses the attributes secret-tool search prints for each item, e.g.
+// "attribute.account = default".
+func (s secretServiceStore) List(service string) ([]string, error) {
+	out, err := s.run(nil, "search", "--all", "service", service)
+	if err != nil {
+		return nil, err
+	}
+	var accounts []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if account, ok := strings.CutPrefix(line, "attribute.account = "); ok {
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts, nil
+}
+
+func (s secretServiceStore) Delete(service, account string) error {
+	_, err := s.run(nil, "clear", "service", service, "account", account)
+	return err
+}
@@ -0,0 +1,34 @@
+//go:build !darwin && !linux && !windows
+
+package main
+
+import "errors"
+
+var errKeystoreUnsupported = errors.New("no secure storage is supported on this platform")
+
+// unsupportedStore is the keystore of platforms without a supported secure storage.
+type unsupportedStore struct{}
+
+func newKeystore() Keystore {
+	return unsupportedStore{}
+}
+
+func (unsupportedStore) Name() string {
+	return "the keystore"
+}
+
+func (unsupportedStore) Get(service, account string) ([]byte, error) {
+	return nil, errKeystoreUnsupported
+}
+
+func (unsupportedStore) Set(service, account string, data []byte) error {
+	return errKeystoreUnsupported
+}
+
+func (unsupportedStore) List(service string) ([]string, error) {
+	return nil, errKeystoreUnsupported
+}
+
+func (unsupportedStore) Delete(service, account string) error {
+	return errKeystoreUnsupported
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Credential Manager API (wincred.h).
+var (
+	advapi32           = syscall.NewLazyDLL("advapi32.dll")
+	procCredReadW      = advapi32.NewProc("CredReadW")
+	procCredWriteW     = advapi32.NewProc("CredWriteW")
+	procCredDeleteW    = advapi32.NewProc("CredDeleteW")
+	procCredEnumerateW = advapi32.NewProc("CredEnumerateW")
+	procCredFree       = advapi32.NewProc("CredFree")
+)
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2    // Kept across logons, never roamed to other machines
+	credMaxBlobSize         = 2560 // CRED_MAX_CREDENTIAL_BLOB_SIZE
+	errorNotFound           = syscall.Errno(1168)
+)
+
+// credential is CREDENTIALW.
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// credentialManagerStore keeps secrets as generic credentials in the Windows Credential
+// Manager, which encrypts them for the user with DPAPI. A credential holds at most 2560
+// bytes, a little more than a service account key, so secrets are stored compressed.
+type credentialManagerStore struct{}
+
+func newKeystore() Keystore {
+	return credentialManagerStore{}
+}
+
+func (credentialManagerStore) Name() string {
+	return "the Windows Credential Manager"
+}
+
+// target names the credential of an item, e.g. "gcp-file-sync-sa-key/default".
+func (credentialManagerStore) target(service, account string) (*uint16, error) {
+	return syscall.UTF16PtrFromString(service + "/" + account)
+}
+
+func (s credentialManagerStore) Get(service, account string) ([]byte, error) {
+	target, err := s.target(service, account)
+	if err != nil {
+		return nil, err
+	}
+	var cred *credential
+	if r, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred))); r == 0 {
+		if errors.Is(err, errorNotFound) {
+			return nil, errNotInKeystore
+		}
+		return nil, fmt.Errorf("reading credential: %v", err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	blob := bytes.Clone(unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize))
+	return io.ReadAll(flate.NewReader(bytes.NewReader(blob)))
+}
+
+func (s credentialManagerStore) Set(service, account string, data []byte) error {
+	target, err := s.target(service, account)
+	if err != nil {
+		return err
+	}
+	var blob bytes.Buffer
+	w, _ := flate.NewWriter(&blob, flate.BestCompression)
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if blob.Len() > credMaxBlobSize {
+		return fmt.Errorf("secret is too large for the Credential Manager (%d bytes compressed, at most %d)", blob.Len(), credMaxBlobSize)
+	}
+	userName, _ := syscall.UTF16PtrFromString(account)
+	cred := credential{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		CredentialBlobSize: uint32(blob.Len()),
+		CredentialBlob:     &blob.Bytes()[0],
+		Persist:            credPersistLocalMachine,
+		UserName:           userName,
+	}
+	if r, _, err := procCredWriteW.Call(uintptr(unsafe.Pointer(&cred)), 0); r == 0 {
+		return fmt.Errorf("writing credential: %v", err)
+	}
+	return nil
+}
+
+// List enumerates the credentials whose target starts with the service, e.g.
+// "gcp-file-sync-sa-key/*".
+func (credentialManagerStore) List(service string) ([]string, error) {
+	prefix := service + "/"
+	filter, err := syscall.UTF16PtrFromString(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	var count uint32
+	var creds **credential
+	if r, _, err := procCredEnumerateW.Call(uintptr(unsafe.Pointer(filter)), 0, uintptr(unsafe.Pointer(&count)), uintptr(unsafe.Pointer(&creds))); r == 0 {
+		if errors.Is(err, errorNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("enumerating credentials: %v", err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(creds)))
+	var accounts []string
+	for _, cred := range unsafe.Slice(creds, count) {
+		target := utf16PtrToString(cred.TargetName)
+		if account, ok := strings.CutPrefix(target, prefix); ok {
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts, nil
+}
+
+// utf16PtrToString converts a NUL-terminated UTF-16 string to a Go string.
+func utf16PtrToString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	n := 0
+	for *(*uint16)(unsafe.Add(unsafe.Pointer(p), n*2)) != 0 {
+		n++
+	}
+	return syscall.UTF16ToString(unsafe.Slice(p, n))
+}
+
+func (s credentialManagerStore) Delete(service, account string) error {
+	target, err := s.target(service, account)
+	if err != nil {
+		return err
+	}
+	if r, _, err := procCredDeleteW.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0); r == 0 && !errors.Is(err, errorNotFound) {
+		return fmt.Errorf("deleting credential: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ledgerCompactRecords is the number of records from which the ledger file is compacted
+// while running, once most of them are stale.
+const ledgerCompactRecords = 10000
+
+// ledgerEntry records an uploaded file that was left in place (--on-success=keep) or
+// brought back with `undo`.
+type ledgerEntry struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Bucket   string    `json:"bucket"`
+	Object   string    `json:"object"`
+	Uploaded time.Time `json:"uploaded"`
+	Restored bool      `json:"restored,omitempty"` // Restored by `undo`, skipped whatever --on-success says
+}
+
+// ledgerRecord is one line of the ledger file.
+type ledgerRecord struct {
+	File  string      `json:"file"`
+	Entry ledgerEntry `json:"entry"`
+}
+
+// uploadLedger is the in-memory copy of the ledger file, keyed by local file path.
+// A file is only considered uploaded while its size and modification time are unchanged.
+// New entries are appended to the file; it is compacted at startup, without the entries of
+// files that are gone.
+type uploadLedger struct {
+	mu      sync.Mutex
+	dir     *stateDir
+	entries map[string]ledgerEntry
+	records int // Records in the ledger file
+}
+
+// ledger is the uploaded-file ledger of the state directory, loaded at startup.
+var ledger *uploadLedger
+
+// loadLedger replays the ledger file of dir, drops the entries of files that no longer
+// exist and compacts the file.
+func loadLedger(dir *stateDir) (*uploadLedger, error) {
+	l := &uploadLedger{dir: dir, entries: make(map[string]ledgerEntry)}
+	err := dir.readJSONLines(stateLedgerFile, func(line []byte) error {
+		var rec ledgerRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return err
+		}
+		l.entries[rec.File] = rec.Entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	pruned := 0
+	for filePath := range l.entries {
+		if ledgerFileGone(filePath) {
+			delete(l.entries, filePath)
+			pruned++
+		}
+	}
+	if dir.readOnly {
+		return l, nil
+	}
+	if err := l.compact(); err != nil {
+		return nil, fmt.Errorf("compacting: %v", err)
+	}
+	if pruned > 0 {
+		slog.Info("Dropped files that no longer exist from the upload ledger", "files", pruned, "entries", len(l.entries))
+	}
+	return l, nil
+}
+
+// ledgerFileGone reports whether filePath no longer exists while its folder does, so the
+// entries of a network share that isn't mounted yet survive.
+func ledgerFileGone(filePath string) bool {
+	if _, err := os.Lstat(filePath); !errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	_, err := os.Stat(filepath.Dir(filePath))
+	return err == nil
+}
+
+// compact rewrites the ledger file with one record per entry. It must be called with l.mu
+// held, or before l is shared.
+func (l *uploadLedger) compact() error {
+	paths := slices.Sorted(maps.Keys(l.entries))
+	records := make([]any, 0, len(paths))
+	for _, filePath := range paths {
+		records = append(records, ledgerRecord{File: filePath, Entry: l.entries[filePath]})
+	}
+	if err := l.dir.writeJSONLines(stateLedgerFile, records); err != nil {
+		return err
+	}
+	l.records = len(records)
+	return nil
+}
+
+// contains reports whether filePath was uploaded as it is now.
+func (l *uploadLedger) contains(filePath string, info os.FileInfo) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[filePath]
+	return ok && e.Size == info.Size() && e.ModTime.Equal(info.ModTime())
+}
+
+// restored reports whether filePath was restored by `undo` and is unchanged since.
+func (l *uploadLedger) restored(filePath string, info os.FileInfo) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[filePath]
+	return ok && e.Restored && e.Size == info.Size() && e.ModTime.Equal(info.ModTime())
+}
+
+// record adds filePath to the ledger and persists it.
+func (l *uploadLedger) record(filePath string, info os.FileInfo, target uploadTarget) error {
+	return l.add(filePath, ledgerEntry{Size: info.Size(), ModTime: info.ModTime(), Bucket: target.Bucket, Object: target.Object})
+}
+
+// recordRestored adds filePath, just restored by `undo`, to the ledger and persists it.
+func (l *uploadLedger) recordRestored(filePath string, info os.FileInfo, target uploadTarget) error {
+	return l.add(filePath, ledgerEntry{Size: info.Size(), ModTime: info.ModTime(), Bucket: target.Bucket, Object: target.Object, Restored: true})
+}
+
+func (l *uploadLedger) add(filePath string, e ledgerEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.Uploaded = time.Now().UTC()
+	l.entries[filePath] = e
+	// Files recorded again after a change leave stale records behind
+	if l.records >= ledgerCompactRecords && l.records > 2*len(l.entries) {
+		return l.compact()
+	}
+	if err := l.dir.appendJSONLine(stateLedgerFile, ledgerRecord{File: filePath, Entry: e}); err != nil {
+		return err
+	}
+	l.records++
+	return nil
+}
+
+// migrateLedgerLog converts the ledger file of schema 4, a JSON object of the entries, to
+// the ledger log of schema 5.
+func migrateLedgerLog(dir string) error {
+	s := &stateDir{path: dir}
+	entries := make(map[string]ledgerEntry)
+	if err := s.readJSON(stateLedgerFileV4, &entries); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	l := &uploadLedger{dir: s, entries: entries}
+	if err := l.compact(); err != nil {
+		return err
+	}
+	if err := os.Remove(s.file(stateLedgerFileV4)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// ttlPrefixRegexp matches the object name prefix of a TTL rule, e.g. "ttl-30d/".
+var ttlPrefixRegexp = regexp.MustCompile(`^ttl-([0-9]+)d/$`)
+
+// parseTTLDays parses the value of a --ttl-rule, a number of days such as "30d" or "30".
+func parseTTLDays(value string) (int, error) {
+	days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+	if err != nil || days < 1 {
+		return 0, fmt.Errorf("invalid TTL %q (expected a number of days, e.g. 30d)", value)
+	}
+	return days, nil
+}
+
+// ttlPrefix returns the object name prefix bucket lifecycle rules recognize for a TTL.
+func ttlPrefix(days int) string {
+	return fmt.Sprintf("ttl-%dd/", days)
+}
+
+// ttlPrefixFor returns the TTL prefix for a file relative to its source folder, or "".
+func ttlPrefixFor(rel string) string {
+	value, ok := cfg.TTLRules.lookup(rel)
+	if !ok {
+		return ""
+	}
+	days, _ := parseTTLDays(value) // Validated at startup
+	return ttlPrefix(days)
+}
+
+// ttlDays returns the distinct TTLs of the configured --ttl-rule values, sorted.
+func ttlDays() []int {
+	seen := make(map[int]bool)
+	var days []int
+	for _, rule := range cfg.TTLRules {
+		d, _ := parseTTLDays(rule.value)
+		if !seen[d] {
+			seen[d] = true
+			days = append(days, d)
+		}
+	}
+	sort.Ints(days)
+	return days
+}
+
+// lifecycleBucket is a bucket objects may be uploaded to, with the credential profile used to reach it.
+type lifecycleBucket struct {
+	Name        string
+	Credentials string
+}
+
+// lifecycleBuckets returns every bucket objects may be uploaded to. A bucket shared by
+// several sources is managed with the credentials of the first; the canary bucket with
+// those of the first source.
+func lifecycleBuckets() ([]lifecycleBucket, error) {
+	configs, err := cfg.sourceConfigs()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var buckets []lifecycleBucket
+	add := func(b, credentials string) {
+		if b != "" && !seen[b] {
+			seen[b] = true
+			buckets = append(buckets, lifecycleBucket{Name: b, Credentials: credentials})
+		}
+	}
+	for _, sc := range configs {
+		add(sc.Bucket, sc.Credentials)
+	}
+	if cfg.CanaryPercent > 0 && len(configs) > 0 {
+		add(cfg.CanaryBucket, configs[0].Credentials)
+	}
+	return buckets, nil
+}
+
+// applyLifecycleRules installs a Delete rule on every upload bucket for each configured TTL,
+// matching objects under its ttl-<N>d/ prefix. Earlier TTL rules created this way are replaced;
+// all other lifecycle rules of the bucket are kept.
+func applyLifecycleRules(ctx context.Context) error {
+	buckets, err := lifecycleBuckets()
+	if err != nil {
+		return err
+	}
+	clients := make(map[string]*storage.Client)
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+	for _, b := range buckets {
+		client, ok := clients[b.Credentials]
+		if !ok {
+			client, err = newStorageClient(b.Credentials)
+			if err != nil {
+				return fmt.Errorf("creating Google Cloud Storage client (credentials %s): %v", profileName(b.Credentials), err)
+			}
+			clients[b.Credentials] = client
+		}
+		bucket := b.Name
+		attrs, err := client.Bucket(bucket).Attrs(ctx)
+		if err != nil {
+			return fmt.Errorf("reading bucket %s: %v", bucket, err)
+		}
+		var rules []storage.LifecycleRule
+		for _, rule := range attrs.Lifecycle.Rules {
+			if !isTTLRule(rule) {
+				rules = append(rules, rule)
+			}
+		}
+		for _, days := range ttlDays() {
+			rules = append(rules, storage.LifecycleRule{
+				Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+				Condition: storage.LifecycleCondition{AgeInDays: int64(days), MatchesPrefix: []string{ttlPrefix(days)}},
+			})
+			slog.Info("Lifecycle rule", "bucket", bucket, "prefix", ttlPrefix(days), "age_days", days)
+		}
+		update := storage.BucketAttrsToUpdate{Lifecycle: &storage.Lifecycle{Rules: rules}}
+		if _, err := client.Bucket(bucket).If(storage.BucketConditions{MetagenerationMatch: attrs.MetaGeneration}).Update(ctx, update); err != nil {
+			return fmt.Errorf("updating lifecycle rules of bucket %s: %v", bucket, err)
+		}
+	}
+	return nil
+}
+
+// isTTLRule reports whether rule is a Delete rule created by applyLifecycleRules.
+func isTTLRule(rule storage.LifecycleRule) bool {
+	return rule.Action.Type == storage.DeleteAction &&
+		len(rule.Condition.MatchesPrefix) == 1 && ttlPrefixRegexp.MatchString(rule.Condition.MatchesPrefix[0])
+}
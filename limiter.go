@@ -0,0 +1,122 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+// byteBudgetMaxSkips is how many jobs may be taken ahead of one that doesn't fit into the
+// byte budget before it reserves the budget for itself.
+const byteBudgetMaxSkips = 32
+
+// byteBudgetLookahead is how many jobs of a source's queue are checked for one that fits.
+const byteBudgetLookahead = 64
+
+// byteBudget caps the total size of files being uploaded at the same time. It is the
+// admission check of the upload pool: a job is only taken from the queues once its bytes
+// fit (see workerPool.pick), so a large file waiting for room holds neither a worker nor
+// an open file, and the smaller files queued behind it keep flowing. A file bigger than
+// the whole budget is admitted alone once nothing else is in flight. So that a stream of
+// small files can't starve it, a job passed over byteBudgetMaxSkips times reserves the
+// budget: nothing else is admitted until it fits.
+//
+// When several sources compete for the budget, each one is limited to a share
+// proportional to its weight, so a bulk folder cannot starve a latency-sensitive one.
+// A source may use more than its share while no other source has files waiting.
+//
+// The budget is guarded by the mutex of its pool.
+type byteBudget struct {
+	limit    int64
+	inflight int64
+
+	weights    map[string]int
+	inflightBy map[string]int64
+}
+
+// budgetAdmission is the part of the budget held by a job while it is processed.
+type budgetAdmission struct {
+	source string
+	n      int64
+}
+
+// newByteBudget returns a budget of limit bytes, which must be positive.
+// weights maps a source to its relative share; sources not listed weigh 1.
+func newByteBudget(limit int64, weights map[string]int) *byteBudget {
+	cleaned := make(map[string]int, len(weights))
+	for source, w := range weights {
+		cleaned[filepath.Clean(source)] = w
+	}
+	return &byteBudget{
+		limit:      limit,
+		weights:    cleaned,
+		inflightBy: make(map[string]int64),
+	}
+}
+
+// clamp returns the amount of budget a file of size n actually reserves.
+func (b *byteBudget) clamp(n int64) int64 {
+	if n > b.limit {
+		return b.limit
+	}
+	return n
+}
+
+func (b *byteBudget) weight(source string) int {
+	if w, ok := b.weights[source]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+// share returns the part of the budget source is entitled to among the active sources:
+// those uploading and those with files queued.
+func (b *byteBudget) share(source string, queued map[string]bool) int64 {
+	active := make(map[string]bool, len(queued))
+	for s := range queued {
+		active[s] = true
+	}
+	for s, n := range b.inflightBy {
+		if n > 0 {
+			active[s] = true
+		}
+	}
+	active[source] = true
+	total := 0
+	for s := range active {
+		total += b.weight(s)
+	}
+	return b.limit * int64(b.weight(source)) / int64(total)
+}
+
+// fits reports whether a job of n bytes from source can be admitted while the sources of
+// queued have files waiting.
+func (b *byteBudget) fits(source string, n int64, queued map[string]bool) bool {
+	n = b.clamp(n)
+	if b.inflight+n > b.limit {
+		return false
+	}
+	othersWaiting := false
+	for s := range queued {
+		if s != source {
+			othersWaiting = true
+			break
+		}
+	}
+	if b.inflightBy[source] == 0 || !othersWaiting {
+		return true
+	}
+	return b.inflightBy[source]+n <= b.share(source, queued)
+}
+
+// admit reserves n bytes for source, which fits says there is room for.
+func (b *byteBudget) admit(source string, n int64) *budgetAdmission {
+	a := &budgetAdmission{source: source, n: b.clamp(n)}
+	b.inflight += a.n
+	b.inflightBy[a.source] += a.n
+	return a
+}
+
+// release returns the bytes of a to the budget.
+func (b *byteBudget) release(a *budgetAdmission) {
+	b.inflight -= a.n
+	b.inflightBy[a.source] -= a.n
+}
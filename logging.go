@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Log formats for --log-format.
+const (
+	logFormatText = "text" // key=value lines
+	logFormatJSON = "json" // One JSON object per line, for log pipelines
+)
+
+// validateLogging checks --log-format and --log-level.
+func validateLogging(c *Config) error {
+	switch c.LogFormat {
+	case logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("log-format must be '%s' or '%s', got '%s'", logFormatText, logFormatJSON, c.LogFormat)
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseLogLevel parses a --log-level value: debug, info, warn or error.
+func parseLogLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return 0, fmt.Errorf("log-level must be debug, info, warn or error, got '%s'", value)
+	}
+	return level, nil
+}
+
+// setupLogging makes the logger configured by --log-format and --log-level the default one.
+// --verbose lowers the level to debug. Messages still written with the standard log
+// package go through the same handler, at info level.
+func setupLogging(c *Config) {
+	level, _ := parseLogLevel(c.LogLevel) // Checked by validate
+	if c.Verbose {
+		level = min(level, slog.LevelDebug)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if c.LogFormat == logFormatJSON {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// fatal logs msg at error level and exits with status 1, like log.Fatal.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// durationMS returns the time elapsed since start as a duration_ms log attribute.
+func durationMS(start time.Time) slog.Attr {
+	return slog.Int64("duration_ms", time.Since(start).Milliseconds())
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// keychainUserService is the keystore service user credentials from `login` are stored
+// under, one item per --profile.
+const keychainUserService = "gcp-file-sync-user-credentials"
+
+// loginTimeout is how long `login` waits for the user to sign in in the browser.
+const loginTimeout = 5 * time.Minute
+
+// userCredentials are stored by `login` in the format of gcloud's Application Default
+// Credentials file, which the client libraries read as they are.
+type userCredentials struct {
+	Type         string `json:"type"` // Always "authorized_user"
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+	Account      string `json:"account,omitempty"` // Email address of the signed-in user
+}
+
+// getUserCredentials returns the user credentials JSON stored by `login` under account.
+func getUserCredentials(account string) ([]byte, error) {
+	data, err := keystore.Get(keychainUserService, account)
+	if errors.Is(err, errNotInKeystore) {
+		return nil, fmt.Errorf("no user credentials found in %s for profile '%s'; run 'gcs-folder-uploader login --profile %s'", keystore.Name(), account, account)
+	}
+	return data, err
+}
+
+// runLoginCommand implements `login`: the three-legged OAuth flow of an installed app. It
+// opens the Google sign-in page in the browser, receives the authorization code on a
+// loopback address and stores the refresh token in the keystore, so uploads run with the
+// signed-in user's access to the bucket.
+func runLoginCommand(args []string) error {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	secretsPath := fs.String("client-secrets", "", "OAuth client JSON of a Desktop app client, downloaded from the Google Cloud console (APIs & Services > Credentials).")
+	profile := fs.String("profile", keychainSAKeyAccount, "Keystore profile to store the user credentials under.")
+	noBrowser := fs.Bool("no-browser", false, "Print the sign-in URL instead of opening a browser.")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *secretsPath == "" || *profile == "" {
+		return errors.New("usage: login --client-secrets FILE [--profile NAME] [--no-browser]")
+	}
+	secrets, err := os.ReadFile(*secretsPath)
+	if err != nil {
+		return fmt.Errorf("reading OAuth client: %v", err)
+	}
+	conf, err := google.ConfigFromJSON(secrets, storage.ScopeFullControl, "openid", "email")
+	if err != nil {
+		return fmt.Errorf("OAuth client '%s': %v", *secretsPath, err)
+	}
+
+	// The authorization code comes back to a loopback address on a free port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	conf.RedirectURL = fmt.Sprintf("http://%s/", listener.Addr())
+
+	state := randomToken()
+	verifier := oauth2.GenerateVerifier()
+	authURL := conf.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce, oauth2.S256ChallengeOption(verifier))
+
+	codes := make(chan string, 1)
+	errs := make(chan error, 1)
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case q.Get("state") != state:
+			http.Error(w, "Unexpected sign-in response.", http.StatusBadRequest)
+			return
+		case q.Get("error") != "":
+			fmt.Fprintln(w, "Sign-in failed, see the terminal.")
+			errs <- fmt.Errorf("sign-in failed: %s", q.Get("error"))
+		default:
+			fmt.Fprintln(w, "Signed in to gcs-folder-uploader. You can close this window.")
+			codes <- q.Get("code")
+		}
+	}))
+
+	log.Printf("Sign in to Google Cloud in your browser:\n\n  %s\n", authURL)
+	if !*noBrowser {
+		if err := openBrowser(authURL); err != nil {
+			log.Printf("Could not open a browser (%v); open the URL above yourself.", err)
+		}
+	}
+	var code string
+	select {
+	case code = <-codes:
+	case err := <-errs:
+		return err
+	case <-time.After(loginTimeout):
+		return fmt.Errorf("no sign-in within %s", loginTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	token, err := conf.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return fmt.Errorf("exchanging the authorization code: %v", err)
+	}
+	if token.RefreshToken == "" {
+		return errors.New("Google returned no refresh token; remove the app's access at https://myaccount.google.com/permissions and log in again")
+	}
+	creds := userCredentials{
+		Type:         "authorized_user",
+		ClientID:     conf.ClientID,
+		ClientSecret: conf.ClientSecret,
+		RefreshToken: token.RefreshToken,
+		Account:      idTokenEmail(token),
+	}
+	data, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	if err := keystore.Set(keychainUserService, *profile, data); err != nil {
+		return fmt.Errorf("storing user credentials in %s: %v", keystore.Name(), err)
+	}
+	log.Printf("Signed in as %s. Stored user credentials in %s for service '%s', profile '%s'.", cmp.Or(creds.Account, "an unknown account"), keystore.Name(), keychainUserService, *profile)
+	return nil
+}
+
+// runLogoutCommand implements `logout`: it removes the user credentials of a profile.
+func runLogoutCommand(args []string) error {
+	fs := flag.NewFlagSet("logout", flag.ExitOnError)
+	profile := fs.String("profile", keychainSAKeyAccount, "Keystore profile of the user credentials to remove.")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("usage: logout [--profile NAME]")
+	}
+	if _, err := getUserCredentials(*profile); err != nil {
+		return err
+	}
+	if err := keystore.Delete(keychainUserService, *profile); err != nil {
+		return fmt.Errorf("removing user credentials from %s: %v", keystore.Name(), err)
+	}
+	log.Printf("Removed user credentials of profile '%s' from %s. Revoke the app's access at https://myaccount.google.com/permissions if it is no longer needed.", *profile, keystore.Name())
+	return nil
+}
+
+// randomToken returns a random string for the OAuth state parameter.
+func randomToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// idTokenEmail returns the email claim of the ID token that came with token, or "". The
+// token comes straight from Google over TLS and is only used for display, so its
+// signature isn't checked.
+func idTokenEmail(token *oauth2.Token) string {
+	idToken, _ := token.Extra("id_token").(string)
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Email string `json:"email"`
+	}
+	json.Unmarshal(payload, &claims)
+	return claims.Email
+}
+
+// openBrowser opens url in the default browser.
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
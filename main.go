@@ -7,36 +7,46 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"maps"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
-	"path/filepath"
-	"runtime"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/fsnotify/fsnotify"
-	"github.com/keybase/go-keychain"
-	"google.golang.org/api/impersonate"
-	"google.golang.org/api/option"
 )
 
 // Configuration constants
 const (
-	DebounceDuration           = 3 * time.Second        // Increased debounce time for better stability
-	FileStabilityCheckInterval = 100 * time.Millisecond // How often to check file size
-	FileStabilityDuration      = 500 * time.Millisecond // How long file size must be stable
+	MaterializeCheckInterval  = 2 * time.Second  // How often to re-check a cloud placeholder
+	QueueDepthReportInterval  = 1 * time.Minute  // How often a non-empty upload queue is logged
+	RetryMaxDelay             = 5 * time.Minute  // Upper bound of the backoff between upload retries
+	ObjectWriteInterval       = 1 * time.Second  // Minimum time between two writes to the same object
+	DefaultPollInterval       = 30 * time.Second // Polling interval of a source fsnotify doesn't work for
+	PartSetCheckInterval      = 5 * time.Second  // How often pending part sets are checked for completeness
+	HoldCheckInterval         = 10 * time.Minute // How often hold folders are checked for files held too long
+	ConcurrencyAdjustInterval = 15 * time.Second // How often --adaptive-concurrency adjusts the upload workers
 )
 
-// Global variables for command-line parameters
+// Global variables
 var (
-	sourceFolder              string
-	bucketName                string
-	projectID                 string
-	impersonateServiceAccount string
-	isVerbose                 bool
+	// Effective configuration (config file merged with command-line flags)
+	cfg *Config
+
+	// Watched source folders, one watcher pipeline each
+	sources []*watchSource
+
+	// Persistent state (ledger, journal, queue, audit history), opened at startup
+	appState *stateDir
+
+	// Files that could not be uploaded (or handled after upload), reported by --once
+	failedFiles atomic.Int64
 
 	// Debouncing mechanism for file events
 	debounceMap   = make(map[string]*time.Timer)
@@ -47,27 +57,90 @@ var (
 	buildTime   = "unknown"
 	bundleIdent = "org.example.example"
 
-	// Keychain variables for storing/retrieving the service account KEY JSON
+	// Receives the reports of --telemetry on unless --telemetry-url names another; builds without one need --telemetry-url
+	telemetryEndpoint = ""
+
+	// Keystore service and default account of the service account KEY JSON (see Keystore)
 	keychainSAKeyService = "gcp-file-sync-sa-key"
-	keychainSAKeyAccount = "default" // Using "default" as a common identifier for the key
+	keychainSAKeyAccount = "default" // Keystore profile of the key unless --profile names another
 )
 
 func main() {
+	// Subcommands are dispatched before the regular flags are parsed
+	if len(os.Args) > 1 && (os.Args[1] == controlStop || os.Args[1] == controlRestart || os.Args[1] == controlResumeDeletions) {
+		log.SetOutput(os.Stdout)
+		if err := runControlCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "login" || os.Args[1] == "logout") {
+		log.SetOutput(os.Stdout)
+		run := runLoginCommand
+		if os.Args[1] == "logout" {
+			run = runLogoutCommand
+		}
+		if err := run(os.Args[2:]); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "messages" {
+		if err := printMessageCatalog(); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "state" {
+		log.SetOutput(os.Stdout)
+		if err := runStateCommand(os.Args[2:]); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "test" {
+		log.SetOutput(os.Stdout)
+		if err := runTestCommand(os.Args[2:]); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		os.Exit(0)
+	}
+
 	// 1. Define command-line flags
-	flag.StringVar(&sourceFolder, "source", "", "Path to the folder to monitor for files (e.g., /path/to/your/files)")
-	flag.StringVar(&bucketName, "bucket", "", "Name of the Google Cloud Storage bucket (e.g., my-unique-bucket)")
-	flag.StringVar(&projectID, "project", "", "Optional: Your Google Cloud Project ID. If not provided, it will be inferred from credentials.")
-	flag.StringVar(&impersonateServiceAccount, "impersonate-sa", "", "Optional: Email of the service account to impersonate (e.g., file-uploader-sa@your-project-id.iam.gserviceaccount.com). Only used if no SA key is found in Keychain.")
-	flag.BoolVar(&isVerbose, "verbose", false, "Enable verbose logging, including periodic scan messages.")
+	flagCfg := &Config{}
+	registerFlags(flag.CommandLine, flagCfg)
+	defaults := *flagCfg // Flag registration stores the defaults
+
+	configPath := flag.String("config", "", "Optional: Path to a YAML (.yaml/.yml) or TOML (.toml) config file. Command-line flags take precedence over its values.")
 
 	// Add a flag to show version information
 	versionFlag := flag.Bool("version", false, "Display version and build information")
 
-	// Flag to store the service account KEY file path in Keychain
-	setSAKeyPathFlag := flag.String("set-sa-key-path", "", "Path to a Google Cloud Service Account JSON key file to store in Apple Keychain.")
+	// Flag to store the service account KEY file path in the keystore
+	setSAKeyPathFlag := flag.String("set-sa-key-path", "", "Path to a Google Cloud Service Account JSON key file to store in the Keychain (macOS), Secret Service (Linux) or Credential Manager (Windows).")
+	listProfilesFlag := flag.Bool("list-profiles", false, "List the profiles of the service account keys stored in the keystore, then exit.")
+	deleteSAKeyFlag := flag.Bool("delete-sa-key", false, "Remove the service account key of --profile from the keystore, then exit.")
+
+	// Flag to install the bucket lifecycle rules matching --ttl-rule
+	applyLifecycleFlag := flag.Bool("apply-lifecycle", false, "Create the bucket lifecycle rules that delete objects under the --ttl-rule prefixes, then exit.")
+
+	// Flag to skip the confirmation of a large startup backlog (see --confirm-backlog)
+	yesFlag := flag.Bool("yes", false, "Start uploading a startup backlog of --confirm-backlog files or more without asking for confirmation.")
 
-	// 2. Parse the command-line flags
-	flag.Parse()
+	// 2. Parse the command-line flags; `undo`, `explain` and `telemetry show` take the same flags as the uploader
+	undoCommand := len(os.Args) > 1 && os.Args[1] == "undo"
+	explainCommand := len(os.Args) > 1 && os.Args[1] == "explain"
+	telemetryCommand := len(os.Args) > 1 && os.Args[1] == "telemetry"
+	if undoCommand || explainCommand {
+		flag.CommandLine.Parse(os.Args[2:])
+	} else if telemetryCommand {
+		if len(os.Args) < 3 || os.Args[2] != "show" {
+			log.Fatalf("Error: usage: telemetry show [flags]")
+		}
+		flag.CommandLine.Parse(os.Args[3:])
+	} else {
+		flag.Parse()
+	}
 
 	// Configure standard logger to write to os.Stdout for general messages.
 	// Fatal errors will still typically go to stderr before exiting.
@@ -83,141 +156,565 @@ func main() {
 
 	// Handle --set-sa-key-path flag
 	if *setSAKeyPathFlag != "" {
-		if runtime.GOOS != "darwin" {
-			log.Fatalf("Error: --set-sa-key-path is only supported on macOS.")
+		if flagCfg.ForbidSAKeys {
+			log.Fatalf("Error: --set-sa-key-path stores a service account key, which --forbid-sa-keys forbids.")
 		}
 		keyContent, err := os.ReadFile(*setSAKeyPathFlag)
 		if err != nil {
 			log.Fatalf("Error reading service account key file '%s': %v", *setSAKeyPathFlag, err)
 		}
-		log.Printf("Attempting to store service account key from '%s' in Keychain...", *setSAKeyPathFlag)
-		err = storeServiceAccountKeyInKeychain(keyContent)
+		log.Printf("Attempting to store service account key from '%s' in %s...", *setSAKeyPathFlag, keystore.Name())
+		err = storeServiceAccountKey(flagCfg.KeyProfile, keyContent)
 		if err != nil {
-			log.Fatalf("Error storing service account key in Keychain: %v", err)
+			log.Fatalf("Error storing service account key in %s: %v", keystore.Name(), err)
 		}
-		log.Printf("Successfully stored service account key in Keychain for service '%s', account '%s'.", keychainSAKeyService, keychainSAKeyAccount)
+		log.Printf("Successfully stored service account key in %s for service '%s', profile '%s'.", keystore.Name(), keychainSAKeyService, flagCfg.KeyProfile)
 		os.Exit(0)
 	}
 
-	// 3. Validate required parameters
-	if sourceFolder == "" {
-		log.Fatal("Error: --source parameter is required. Please specify the folder to monitor.")
+	// Handle --list-profiles and --delete-sa-key
+	if *listProfilesFlag {
+		profiles, err := listServiceAccountKeys()
+		if err != nil {
+			log.Fatalf("Error listing service account keys in %s: %v", keystore.Name(), err)
+		}
+		if len(profiles) == 0 {
+			log.Printf("No service account keys stored in %s.", keystore.Name())
+		}
+		for _, profile := range profiles {
+			fmt.Println(profile)
+		}
+		os.Exit(0)
 	}
-	if bucketName == "" {
-		log.Fatal("Error: --bucket parameter is required. Please specify the GCP bucket name.")
+	if *deleteSAKeyFlag {
+		if err := deleteServiceAccountKey(flagCfg.KeyProfile); err != nil {
+			log.Fatalf("Error removing service account key from %s: %v", keystore.Name(), err)
+		}
+		log.Printf("Removed service account key of profile '%s' from %s.", flagCfg.KeyProfile, keystore.Name())
+		os.Exit(0)
 	}
 
-	// Validate source folder existence
-	_, err := os.Stat(sourceFolder)
-	if os.IsNotExist(err) {
-		log.Fatalf("Error: Source folder '%s' does not exist. Please create it or update --source parameter.", sourceFolder)
-	} else if err != nil {
-		log.Fatalf("Error checking source folder '%s': %v", sourceFolder, err)
+	// 3. Merge the config file (if any) under the explicitly set flags, then validate
+	cfg = flagCfg
+	reloader := &configReloader{path: *configPath, cmdline: *flagCfg, defaults: defaults, setFlags: make(map[string]bool)}
+	if *configPath != "" {
+		fileCfg, err := loadConfigFile(*configPath, defaults)
+		if err != nil {
+			log.Fatalf("Error loading config file '%s': %v", *configPath, err)
+		}
+		flag.Visit(func(f *flag.Flag) { reloader.setFlags[f.Name] = true })
+		cfg.overrideWith(fileCfg, reloader.setFlags)
 	}
-
-	log.Printf("Starting file transfer monitor for folder: %s (Version: %s, Built: %s)", sourceFolder, version, buildTime)
-	log.Printf("Target GCP bucket: %s", bucketName)
-	if projectID != "" {
-		log.Printf("GCP Project ID: %s", projectID)
+	if err := cfg.applyPreset(defaults); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if telemetryCommand {
+		runTelemetryShow(cfg, defaults)
+		os.Exit(0)
+	}
+	reloader.started = *cfg
+	setupLogging(cfg)
+	setupProxy(cfg)
+	setupNotifiers(cfg)
+	if *configPath != "" {
+		slog.Info("Loaded configuration", "path", *configPath)
 	}
 
-	// --- Authentication Strategy Logging ---
-	keychainKeyContent, keychainErr := getServiceAccountKeyFromKeychain()
-	if runtime.GOOS == "darwin" && keychainErr == nil && len(keychainKeyContent) > 0 {
-		log.Println("Authentication strategy: Using Service Account Key from Apple Keychain.")
-	} else if impersonateServiceAccount != "" {
-		log.Printf("Authentication strategy: Impersonating Service Account: %s (Key not found in Keychain).", impersonateServiceAccount)
-	} else {
-		log.Println("WARNING: No service account key found in Keychain and no impersonation SA provided. Using Application Default Credentials (may not be sufficient for GCS access).")
+	if *applyLifecycleFlag {
+		if len(cfg.TTLRules) == 0 {
+			fatal("--apply-lifecycle needs at least one --ttl-rule")
+		}
+		if err := applyLifecycleRules(context.Background()); err != nil {
+			fatal("Error applying lifecycle rules", "error", err)
+		}
+		slog.Info("Lifecycle rules applied")
+		os.Exit(0)
 	}
 
-	if isVerbose {
-		log.Println("Verbose logging is ENABLED.")
+	var err error
+	filenameTimeRegexp, err = compileFilenameTimePattern(cfg.FilenameTimePattern)
+	if err != nil {
+		fatal("Invalid filename-time-pattern", "error", err)
+	}
+	if hostName, err = os.Hostname(); err != nil {
+		fatal("Error determining host name", "error", err)
+	}
+	if includeFilters, err = compilePathFilters(cfg.Include); err != nil {
+		fatal("Invalid include pattern", "error", err)
+	}
+	if excludeFilters, err = compilePathFilters(cfg.Exclude); err != nil {
+		fatal("Invalid exclude pattern", "error", err)
+	}
+	if gzipFilters, err = compilePathFilters(cfg.GzipPatterns); err != nil {
+		fatal("Invalid gzip pattern", "error", err)
+	}
+	if cfg.CSEKKeyFile != "" {
+		if csekKey, err = loadCSEK(cfg.CSEKKeyFile); err != nil {
+			fatal("Error reading customer-supplied encryption key", "path", cfg.CSEKKeyFile, "error", err)
+		}
+	}
+	if cfg.StateDir == "" {
+		cfg.StateDir, err = defaultStateDir()
+		if err != nil {
+			fatal("Error determining default state directory", "error", err)
+		}
+	}
+	// Only upload mode takes the lock: explain, --observe and --verify-only just read the
+	// state, so they can run next to the uploader that owns it
+	if explainCommand || cfg.Observe || cfg.VerifyOnly {
+		appState, err = openStateDirReadOnly(cfg.StateDir)
 	} else {
-		log.Println("Verbose logging is DISABLED. Only critical messages will be shown.")
+		appState, err = openStateDir(cfg.StateDir)
+	}
+	if err != nil {
+		fatal("Error opening state directory", "path", cfg.StateDir, "error", err)
+	}
+	ledger, err = loadLedger(appState)
+	if err != nil {
+		fatal("Error loading upload ledger", "error", err)
+	}
+	journal, err = loadJournal(appState)
+	if err != nil {
+		fatal("Error loading upload journal", "error", err)
+	}
+	retryQueue, err = loadOfflineQueue(appState)
+	if err != nil {
+		fatal("Error loading offline retry queue", "error", err)
+	}
+	baseline, err = loadBaseline(appState)
+	if err != nil {
+		fatal("Error loading file baseline", "error", err)
+	}
+	if err := deletions.load(appState); err != nil {
+		fatal("Error loading files held for resume-deletions", "error", err)
 	}
-	log.Printf("Debounce duration for file events: %s", DebounceDuration)
-	log.Printf("File stability check duration: %s", FileStabilityDuration)
 
-	// --- Initial Scan ---
-	log.Println("Performing initial scan of source folder for existing files...")
-	initialFiles, err := os.ReadDir(sourceFolder)
+	sourceConfigs, err := cfg.sourceConfigs()
 	if err != nil {
-		log.Printf("Error during initial scan: %v", err)
-	} else {
-		for _, file := range initialFiles {
-			if !file.IsDir() {
-				if isVerbose {
-					log.Printf("Found existing file during initial scan: %s", file.Name())
-				}
-				// Process existing files directly without debouncing, as they should be stable
-				// Note: These files will bypass the debouncer. If they are actively being written
-				// when the app starts, they might be uploaded prematurely.
-				go processSingleFile(filepath.Join(sourceFolder, file.Name()))
+		fatal("Invalid source configuration", "error", err)
+	}
+	for _, sc := range sourceConfigs {
+		sources = append(sources, &watchSource{SourceConfig: sc})
+	}
+
+	// --- Source folder access inside the macOS App Sandbox ---
+	if isSandboxed() {
+		defer accessSourceBookmarks(appState, sources)()
+	}
+
+	if undoCommand {
+		if err := runUndo(flag.Args()); err != nil {
+			fatal("Undo failed", "error", err)
+		}
+		return
+	}
+	if explainCommand {
+		if err := runExplain(flag.Args()); err != nil {
+			fatal("Explain failed", "error", err)
+		}
+		return
+	}
+
+	// --- Control socket for the stop and restart subcommands ---
+	// Bound before privileges are dropped, as its directory may only be writable by root.
+	// It belongs to the uploader holding the state lock, so --observe doesn't take it over.
+	var control *controlServer
+	var controlRequests chan string // Stays nil (never ready) without a control socket
+	if !cfg.Once && !appState.readOnly {
+		control, err = listenControl(appState)
+		if err != nil {
+			slog.Warn("Control socket unavailable, stop and restart won't reach this process", "error", err)
+		} else {
+			defer control.close()
+			controlRequests = control.requests
+		}
+	}
+
+	// --- Health endpoints ---
+	// Also bound before privileges are dropped, so a privileged port works with --run-as
+	var healthListener net.Listener
+	if cfg.HealthAddr != "" && !cfg.Once {
+		healthListener, err = net.Listen("tcp", cfg.HealthAddr)
+		if err != nil {
+			fatal("Error listening for health checks", "address", cfg.HealthAddr, "error", err)
+		}
+	}
+
+	// --- Privileges ---
+	if cfg.RunAs != "" {
+		if err := dropPrivileges(cfg.RunAs, appState); err != nil {
+			fatal("Error switching user", "user", cfg.RunAs, "error", err)
+		}
+		slog.Info("Running as another user", "user", cfg.RunAs)
+	} else if !cfg.AllowRoot {
+		if err := checkRootSources(sources); err != nil {
+			fatal("Refusing to run as root", "error", err)
+		}
+	}
+
+	slog.Info("Starting file transfer monitor", "version", version, "built", buildTime)
+	for _, src := range sources {
+		slog.Info("Source folder", "path", src.Path, "destination", src.destination())
+	}
+	if cfg.ExcludeFromIndexing && !cfg.Observe {
+		excludeFromIndexing(sources)
+	}
+	if cfg.Project != "" {
+		slog.Info("GCP project", "project", cfg.Project)
+	}
+	slog.Info("State directory", "path", appState.path)
+	if host := emulatorHost(); host != "" {
+		slog.Warn("Using a GCS emulator without authentication (STORAGE_EMULATOR_HOST)", "host", host)
+	} else if cfg.GCSEndpoint != "" {
+		slog.Info("Using a custom GCS endpoint", "endpoint", cfg.GCSEndpoint)
+	}
+	if n := retryQueue.len(); n > 0 {
+		slog.Info("Files are waiting in the offline retry queue; they are uploaded once GCS is reachable", "files", n)
+	}
+
+	// --- Authentication Strategy Logging ---
+	for _, profile := range credentialProfilesInUse() {
+		logger := slog.With("credentials", profileName(profile))
+		creds, err := credentialsFor(profile)
+		switch {
+		case err != nil:
+			logger.Error("Error resolving credentials", "error", err)
+		case creds.Strategy == authKeychainKey:
+			logger.Info("Authentication strategy: service account key from the keystore", "keystore", keystore.Name(), "keychain_account", creds.KeychainAccount)
+		case creds.Strategy == authUser:
+			logger.Info("Authentication strategy: user credentials from login", "keystore", keystore.Name(), "profile", creds.KeychainAccount)
+		case creds.Strategy == authExternal:
+			logger.Info("Authentication strategy: workload identity federation", "config", creds.ExternalAccount)
+		case creds.Strategy == authImpersonation:
+			logger.Info("Authentication strategy: impersonating a service account", "service_account", creds.ImpersonateSA)
+		case profile == "":
+			logger.Warn("No service account key found in the keystore and no impersonation SA provided. Using Application Default Credentials (may not be sufficient for GCS access).", "keystore", keystore.Name())
+		default:
+			logger.Info("Authentication strategy: Application Default Credentials")
+		}
+	}
+
+	if cfg.CacheTokens {
+		slog.Info("Impersonated and federated access tokens are cached until they expire", "keystore", keystore.Name())
+	}
+
+	if cfg.ForbidSAKeys {
+		for _, profile := range credentialProfilesInUse() {
+			if err := checkKeyless(profile); err != nil {
+				fatal("Refusing to authenticate with a service account key", "error", err)
 			}
 		}
+		slog.Info("Service account keys are forbidden: only keyless authentication is used")
 	}
-	log.Println("Initial scan complete.")
 
-	// --- fsnotify Watcher Setup ---
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Fatalf("Error creating file system watcher: %v", err)
+	slog.Info("Logging", "format", cfg.LogFormat, "level", cfg.LogLevel, "verbose", cfg.Verbose)
+	slog.Info("Upload concurrency", "workers", cfg.Concurrency, "hash_workers", cfg.HashWorkers, "adaptive", cfg.AdaptiveConcurrency)
+	slog.Info("Transient upload errors are retried", "max_retries", cfg.MaxRetries, "base_delay", cfg.RetryBaseDelay)
+	if len(cfg.RetryPolicies) > 0 {
+		slog.Info("Retry policies per error code", "retry_policy", cfg.RetryPolicies.String())
+	}
+	if cfg.MaxInflightBytes > 0 {
+		slog.Info("Max in-flight upload bytes", "bytes", int64(cfg.MaxInflightBytes), "size", formatByteSize(int64(cfg.MaxInflightBytes)))
+	}
+	if cfg.ChunkSize > 0 {
+		slog.Info("Resumable upload chunk size", "bytes", int64(cfg.ChunkSize), "size", formatByteSize(int64(cfg.ChunkSize)))
+	}
+	if cfg.IOMode != ioBuffered {
+		slog.Info("Files are read in large blocks", "io_mode", cfg.IOMode, "block_size", formatByteSize(ioBlockSize))
+	}
+	if cfg.CompositeThreshold > 0 {
+		slog.Info("Large files are uploaded as parallel parts and composed in GCS", "threshold", formatByteSize(int64(cfg.CompositeThreshold)), "parts", cfg.CompositeParts)
+	}
+	if cfg.Hardened {
+		logHardened()
+	}
+	if cfg.Observe {
+		slog.Info("OBSERVE mode is ENABLED: files are reported but never uploaded or deleted")
+	}
+	if cfg.CanaryPercent > 0 {
+		slog.Info("Canary rollout", "percent", cfg.CanaryPercent, "bucket", cfg.CanaryBucket, "prefix", cfg.CanaryPrefix)
+	}
+	switch cfg.OnSuccess {
+	case onSuccessMove:
+		slog.Info("Uploaded files are moved to the archive folder", "path", cfg.ArchiveDir)
+	case onSuccessKeep:
+		slog.Info("Uploaded files are kept in place and tracked in the upload ledger")
+	}
+	if cfg.OnConflict != conflictFail {
+		slog.Info("Files whose object exists with different content are handled by the conflict policy", "on_conflict", cfg.OnConflict, "quarantine", cfg.QuarantineDir)
+	}
+	if cfg.Previews {
+		if ffmpegPath, err = exec.LookPath("ffmpeg"); err != nil {
+			slog.Warn("--previews is set but ffmpeg was not found; no previews will be generated", "error", err)
+		} else {
+			slog.Info("Previews of images and videos are generated with ffmpeg", "ffmpeg", ffmpegPath, "prefix", cfg.PreviewPrefix)
+		}
+	}
+	if cfg.Recursive {
+		slog.Info("Recursive mode is ENABLED: subdirectories are watched too")
+	}
+	if cfg.PreservePath {
+		slog.Info("Object names preserve the path relative to the source folder")
+	}
+	if cfg.FilenameTimePattern != "" {
+		slog.Info("File times are parsed from file names and set as customTime", "pattern", cfg.FilenameTimePattern, "layout", cfg.FilenameTimeLayout)
+	}
+	if cfg.Preset != "" {
+		slog.Info("Using a preset", "preset", cfg.Preset)
 	}
-	defer watcher.Close()
+	if cfg.ObjectPrefix != "" {
+		slog.Info("Object names follow a template", "template", cfg.ObjectPrefix)
+	}
+	if cfg.HostPrefix {
+		slog.Info("Object names are prefixed with the host name", "host", hostName)
+	}
+	if len(cfg.TTLRules) > 0 {
+		slog.Info("TTL rules (apply the matching bucket lifecycle rules with --apply-lifecycle)", "rules", cfg.TTLRules.String())
+	}
+	if cfg.StorageClass != "" {
+		slog.Info("Default storage class", "storage_class", cfg.StorageClass)
+	}
+	if len(cfg.StorageClassRules) > 0 {
+		slog.Info("Storage classes by pattern", "rules", cfg.StorageClassRules.String())
+	}
+	if len(cfg.StorageClassBySize) > 0 {
+		slog.Info("Storage class tiers by file size", "tiers", cfg.StorageClassBySize.String())
+	}
+	if cfg.Dedupe != dedupeOff {
+		slog.Info("Files whose content already exists under the destination prefix are deduplicated", "dedupe", cfg.Dedupe)
+	}
+	if cfg.DestIndex {
+		slog.Info("Existence checks use a local index of each destination prefix", "refresh", cfg.DestIndexRefresh)
+	}
+	if cfg.UseEXIF {
+		slog.Info("Photo capture dates and camera models are read from EXIF data")
+	}
+	if cfg.DatePrefix != "" {
+		slog.Info("Objects are partitioned by file date", "layout", cfg.DatePrefix)
+	}
+	if len(cfg.WatchSubpaths) > 0 {
+		slog.Info("Only uploading files under watched subpaths", "subpaths", cfg.WatchSubpaths.String())
+	}
+	if len(cfg.Include) > 0 {
+		slog.Info("Only uploading files matching the include patterns", "include", cfg.Include.String())
+	}
+	if len(cfg.Exclude) > 0 {
+		slog.Info("Never uploading files matching the exclude patterns", "exclude", cfg.Exclude.String())
+	}
+	if cfg.Gzip {
+		slog.Info("Compressing files with gzip while uploading", "patterns", cfg.GzipPatterns.String(), "gz_objects", cfg.GzipObjects)
+	}
+	if len(cfg.ProtectedPaths) > 0 {
+		slog.Info("Never uploading, deleting or moving files under protected paths", "protected", cfg.ProtectedPaths.String())
+	}
+	if cfg.MaxDeletionRate > 0 && cfg.OnSuccess != onSuccessKeep {
+		slog.Info("Pausing deletions when too many local files are removed", "max_deletions_per_minute", cfg.MaxDeletionRate)
+	}
+	if cfg.AllowDangerous {
+		slog.Warn("Safety check for broad and system source folders is disabled (--i-know-what-i-am-doing)")
+	}
+	slog.Info("File event handling", "debounce", cfg.Debounce, "stability_check", cfg.StabilityDuration, "stability_interval", cfg.StabilityInterval, "checks", cfg.StabilityCheck)
 
-	// Add the source folder to the watcher
-	err = watcher.Add(sourceFolder)
-	if err != nil {
-		log.Fatalf("Error adding folder '%s' to watcher: %v", sourceFolder, err)
-	}
-	log.Printf("Monitoring folder '%s' for file system events...", sourceFolder)
-
-	// Goroutine to handle file system events
-	done := make(chan bool)
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				if isVerbose {
-					log.Printf("[DEBUG] Raw fsnotify event: %s on %s", event.Op.String(), event.Name) // Added debug log
-				}
-				// We care about creation, writes, and chmod (often indicates end of write)
-				// RENAME/REMOVE for tracking if file disappears before processing
-				if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Chmod) != 0 {
-					if isVerbose {
-						log.Printf("Detected event: %s on file: %s", event.Op.String(), event.Name)
-					}
-					// Use the wrapper to debounce and process the file
-					go processFileWrapper(event.Name)
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				log.Printf("Watcher error: %v", err)
+	// --- Shared GCS clients, one per credential profile ---
+	if !cfg.Observe {
+		for _, profile := range credentialProfilesInUse() {
+			if _, err := clients.get(profile); err != nil {
+				// Not fatal: uploads retry creating the client when they need it
+				slog.Error("Error creating Google Cloud Storage client", "credentials", profileName(profile), "error", err)
 			}
 		}
-	}()
+		defer clients.close()
+	}
+
+	// --- Preflight: fail now rather than on the first upload ---
+	if cfg.Preflight && !cfg.Observe {
+		if err := runPreflight(sources); err != nil {
+			fatal("Preflight check failed; fix the bucket or credentials, or start with --preflight=false", "error", err)
+		}
+	}
+
+	// --- Integrity monitor: check what was uploaded, upload nothing ---
+	if cfg.VerifyOnly {
+		runVerifyOnly(sources)
+		return
+	}
+
+	// --- Upload worker pool ---
+	var budget *byteBudget
+	if cfg.MaxInflightBytes > 0 {
+		budget = newByteBudget(int64(cfg.MaxInflightBytes), cfg.SourceWeights)
+	}
+	uploads = newWorkerPool("upload", cfg.Concurrency, cfg.SourceWeights, budget, processJob)
+	defer uploads.close()
+	go uploads.reportDepth(QueueDepthReportInterval)
+	if cfg.AdaptiveConcurrency {
+		adaptConcurrency(uploads, ConcurrencyAdjustInterval)
+	}
+	if cfg.HashWorkers > 0 {
+		hashers = newWorkerPool("hash", cfg.HashWorkers, cfg.SourceWeights, nil, hashJob)
+		defer hashers.close()
+		go hashers.reportDepth(QueueDepthReportInterval)
+	}
+	if cfg.ErrorSummary > 0 {
+		go summarizeFailures(cfg.ErrorSummary)
+	}
+	if cfg.PartSets && !cfg.Once {
+		go watchPartSets()
+	}
+	if cfg.Once {
+		checkHold(sources)
+	} else {
+		go watchHold(sources)
+	}
+	if cfg.CollisionCheck > 0 {
+		if cfg.Once {
+			checkNameCollisions(sources)
+		} else {
+			go watchNameCollisions(sources)
+		}
+	}
+
+	// --- Service account key rotation (an emulator takes no credentials) ---
+	switch {
+	case emulatorHost() != "":
+	case cfg.Once:
+		checkKeyAge()
+	default:
+		go watchKeyAge()
+	}
+
+	// --- Files present before --new-files-only took effect ---
+	if cfg.NewFilesOnly {
+		if err := baseline.record(sources); err != nil {
+			fatal("Error recording the files present in the source folders", "error", err)
+		}
+	}
+
+	// --- Files left over by a previous run ---
+	reconcileJournal(sources)
+	if cfg.Once && !cfg.Observe {
+		// A single run has nothing to wait for: try the queued files first, in order
+		if n := retryQueue.len(); n > 0 {
+			slog.Info("Retrying files from the offline retry queue", "files", n)
+			retryQueue.flush()
+		}
+	} else if !cfg.Observe {
+		go retryQueue.probe(cfg.ReconnectInterval)
+	}
+
+	// --- Initial Scan ---
+	existing := make([][]string, len(sources))
+	var backlog backlogSummary
+	for i, src := range sources {
+		existing[i] = listExisting(src, &backlog)
+	}
+	confirmBacklog(backlog, *yesFlag)
+	for i, src := range sources {
+		queueExisting(src, existing[i])
+	}
+
+	// --- One-shot mode: upload what is there, then exit ---
+	if cfg.Once {
+		drainPools()
+		if cfg.PartSets {
+			// The scan found the parts; the sets that are complete are uploaded now
+			submitPartSets(true)
+			uploads.drain()
+		}
+		// The bundles still collecting files are uploaded now
+		flushBundles()
+		uploads.drain()
+		if n := failedFiles.Load(); n > 0 {
+			slog.Error("Some files could not be uploaded", "files", n, "failures", failureCounts())
+			os.Exit(failureExitCode())
+		}
+		slog.Info("All files processed. Exiting.")
+		return
+	}
+
+	startTelemetry(defaults)
+
+	if healthListener != nil {
+		slog.Info("Serving health checks on /healthz and /readyz", "address", healthListener.Addr().String())
+		go serveHealth(healthListener)
+	}
+
+	// --- fsnotify Watcher Setup (one pipeline per source) ---
+	var watchers []*fsnotify.Watcher
+	for _, src := range sources {
+		if cfg.PollOnly {
+			startPolling(src, cfg.PollInterval)
+			continue
+		}
+		watcher, err := startWatcher(src)
+		if isWatchUnsupported(err) {
+			slog.Warn("File system events are not supported for this folder, polling it instead", "path", src.Path, "error", err)
+			startPolling(src, pollIntervalOrDefault())
+			continue
+		} else if err != nil {
+			fatal("Error adding folder to watcher", "path", src.Path, "error", err)
+		}
+		defer watcher.Close()
+		watchers = append(watchers, watcher)
+		// Polling as a supplement catches the events fsnotify misses on network file systems
+		if cfg.PollInterval > 0 {
+			startPolling(src, cfg.PollInterval)
+		}
+	}
 
 	// --- Graceful Shutdown ---
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-
-	log.Println("Received shutdown signal. Exiting gracefully...")
-	select {
-	case done <- true:
-	case <-time.After(1 * time.Second):
-		log.Println("Timeout waiting for event goroutine to acknowledge shutdown.")
+	var reloadChan chan os.Signal // Stays nil (never ready) without a config file
+	if *configPath != "" {
+		reloadChan = make(chan os.Signal, 1)
+		signal.Notify(reloadChan, syscall.SIGHUP)
+	}
+	for stopped := false; !stopped; {
+		select {
+		case <-sigChan:
+			stopped = true
+		case <-reloadChan:
+			reloader.reload()
+		case request := <-controlRequests:
+			// Take no new files, let the queued and in-flight ones finish
+			slog.Info("Finishing queued uploads before stopping", "request", request)
+			for _, watcher := range watchers {
+				watcher.Close()
+			}
+			stopPolling()
+			cancelPendingEvents()
+			drainPools()
+			flushBundles()
+			uploads.drain()
+			if request == controlRestart {
+				control.close()
+				slog.Info("Uploads finished. Restarting...")
+				if err := restartProcess(); err != nil {
+					fatal("Error restarting", "error", err)
+				}
+				return
+			}
+			slog.Info("Uploads finished. Exiting.")
+			return
+		}
 	}
+
+	slog.Info("Received shutdown signal. Exiting gracefully...", "timeout", cfg.ShutdownTimeout)
+	shutdown(watchers)
 }
 
 // processFileWrapper handles debouncing of file events before actual processing.
-func processFileWrapper(filePath string) {
+func processFileWrapper(src *watchSource, filePath string) {
+	processFileAfter(src, filePath, cfg.Debounce)
+}
+
+// processFileAfter queues filePath for processing once delay has passed without another
+// event for it.
+func processFileAfter(src *watchSource, filePath string, delay time.Duration) {
 	debounceMutex.Lock()
 	defer debounceMutex.Unlock()
 
@@ -225,12 +722,10 @@ func processFileWrapper(filePath string) {
 		timer.Stop() // Stop any previous pending timer for this file
 	}
 
-	timer := time.AfterFunc(DebounceDuration, func() {
-		// This block runs AFTER DebounceDuration has passed without new events for this file
-		if isVerbose {
-			log.Printf("Processing debounced file: %s", filePath)
-		}
-		processSingleFile(filePath)
+	timer := time.AfterFunc(delay, func() {
+		// This block runs AFTER delay has passed without new events for this file
+		slog.Debug("Processing debounced file", "file", filePath)
+		submitFile(src, filePath)
 
 		debounceMutex.Lock() // Acquire lock to modify map safely inside the goroutine
 		delete(debounceMap, filePath)
@@ -239,215 +734,538 @@ func processFileWrapper(filePath string) {
 	debounceMap[filePath] = timer // Store the new timer
 }
 
+// cancelPendingEvents drops the files still waiting out their debounce delay and returns
+// them. They have not been touched yet, so the initial scan of the next start picks them up.
+func cancelPendingEvents() []string {
+	debounceMutex.Lock()
+	defer debounceMutex.Unlock()
+	var files []string
+	for filePath, timer := range debounceMap {
+		timer.Stop()
+		delete(debounceMap, filePath)
+		files = append(files, filePath)
+	}
+	return files
+}
+
 // processSingleFile contains the core logic for uploading and deleting a single file.
-func processSingleFile(filePath string) {
+func processSingleFile(job uploadJob) {
+	target, ok := prepareFile(job.src, job.filePath)
+	if !ok {
+		return
+	}
+	// Admitted to the byte budget by its size when queued: a file that grew while it
+	// settled is queued again by its final size rather than overrun the budget
+	if a := job.admission; a != nil {
+		if info, err := os.Stat(job.filePath); err == nil && uploads.budget.clamp(info.Size()) > a.n {
+			slog.Debug("File grew while it settled, queuing it again for the in-flight byte budget", "file", job.filePath, "bytes", info.Size())
+			uploads.enqueue(uploadJob{src: job.src, filePath: job.filePath, prepared: &target})
+			return
+		}
+	}
+	uploadPrepared(job.src, job.filePath, target)
+}
+
+// prepareFile checks whether filePath from src is to be uploaded, waits for it to be
+// stable and resolves its destination. It reports false if the file is not uploaded.
+func prepareFile(src *watchSource, filePath string) (uploadTarget, bool) {
+	logger := slog.With("file", filePath)
+
 	// First, check if the file still exists and is not a directory
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			if isVerbose {
-				log.Printf("File %s no longer exists, skipping processing.", filePath)
-			}
-			return
+			logger.Debug("File no longer exists, skipping processing")
+			return uploadTarget{}, false
 		}
-		log.Printf("Error getting file info for %s: %v", filePath, err)
-		return
+		reportFailure(logger, filePath, "Error getting file info", err)
+		quarantineFailed(src, filePath, err)
+		return uploadTarget{}, false
 	}
 
 	if fileInfo.IsDir() {
-		if isVerbose {
-			log.Printf("Skipping directory: %s (detected by fsnotify event for a directory)", filePath)
+		logger.Debug("Skipping directory (detected by fsnotify event for a directory)")
+		return uploadTarget{}, false
+	}
+
+	// Files queued before a --protect path was added must not slip through
+	if p := protectedBy(filePath); p != "" {
+		logger.Warn("Skipping file under a protected path", "protected", p)
+		return uploadTarget{}, false
+	}
+
+	// With --on-success=keep, uploaded files stay where they are; don't upload them again
+	if cfg.OnSuccess == onSuccessKeep && ledger.contains(filePath, fileInfo) {
+		logger.Debug("File was already uploaded and is unchanged, skipping")
+		return uploadTarget{}, false
+	}
+	// Files brought back with `undo` stay until they are changed
+	if ledger.restored(filePath, fileInfo) {
+		logger.Debug("File was restored with undo and is unchanged, skipping")
+		return uploadTarget{}, false
+	}
+	// Uploaded files whose removal is held stay until resume-deletions
+	if deletions.holds(filePath, fileInfo) {
+		logger.Debug("File was uploaded and is held until deletions are resumed, skipping")
+		return uploadTarget{}, false
+	}
+
+	// Parts of a split file are uploaded together once the set is complete (--part-sets)
+	if cfg.PartSets && observePart(src, filePath) {
+		return uploadTarget{}, false
+	}
+
+	// Size, producer and age filters (--min-size, --max-size, --producer, --min-file-age)
+	if reason := sizeSkipReason(fileInfo.Size()); reason != "" {
+		logger.Info("Skipping file", "reason", reason, "bytes", fileInfo.Size())
+		return uploadTarget{}, false
+	}
+	if reason := producerSkipReason(filePath); reason != "" {
+		logger.Info("Skipping file", "reason", reason)
+		return uploadTarget{}, false
+	}
+	if wait := cfg.MinFileAge - time.Since(fileInfo.ModTime()); wait > 0 {
+		if cfg.Once {
+			logger.Info("Skipping file modified too recently", "min_file_age", cfg.MinFileAge)
+			return uploadTarget{}, false
 		}
-		return
+		logger.Debug("File was modified too recently, checking again later", "min_file_age", cfg.MinFileAge, "wait", wait)
+		processFileAfter(src, filePath, wait)
+		return uploadTarget{}, false
 	}
 
-	objectName := fileInfo.Name()
+	// Cloud-synced folders (Google Drive, iCloud) may hold placeholders whose content isn't local yet
+	if !prepareCloudFile(filePath) {
+		return uploadTarget{}, false
+	}
 
-	log.Printf("Attempting to upload file: %s", filePath)
+	logger.Info("Attempting to upload file")
 
 	// Wait for file stability before opening
-	if err := waitForFileStability(filePath, FileStabilityDuration, FileStabilityCheckInterval); err != nil {
-		log.Printf("Error waiting for file stability for %s: %v, skipping upload.", filePath, err)
+	if err := waitForFileStability(filePath, cfg.StabilityDuration, cfg.StabilityInterval); err != nil {
+		reportFailure(logger, filePath, "Error waiting for file stability, skipping upload", err)
+		quarantineFailed(src, filePath, err)
+		return uploadTarget{}, false
+	}
+
+	// Resolve the destination only now, as it may depend on the file's content (EXIF data)
+	target := resolveTarget(src, filePath, fileInfo)
+	logger = logger.With("bucket", target.Bucket, "object", target.Object)
+	if cfg.CanaryPercent > 0 {
+		logger.Info("Routing file through its pipeline", "pipeline", target.Pipeline)
+	}
+
+	// In observer mode, report what would happen and leave both the file and the bucket untouched
+	if cfg.Observe {
+		observeFile(src, filePath, target)
+		return uploadTarget{}, false
+	}
+	return target, true
+}
+
+// uploadPrepared uploads filePath from src to target, prepared by prepareFile, then handles
+// the local file per --on-success.
+func uploadPrepared(src *watchSource, filePath string, target uploadTarget) {
+	if bundleFile(src, filePath, target) {
 		return
 	}
+	objectName := target.Object
+	logger := slog.With("file", filePath, "bucket", target.Bucket, "object", objectName)
 
 	f, err := os.Open(filePath)
 	if err != nil {
-		log.Printf("Error opening file %s: %v", filePath, err)
+		reportFailure(logger, filePath, "Error opening file", err)
+		quarantineFailed(src, filePath, err)
 		return
 	}
 	// Defer closing the file until function exits
 	defer func() {
-		if err := f.Close(); err != nil {
-			log.Printf("Error closing file %s: %v", filePath, err)
+		if err := f.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+			logger.Error("Error closing file", "error", err)
 		}
 	}()
 
-	ctx := context.Background()
+	stableInfo, err := f.Stat()
+	if err != nil {
+		reportFailure(logger, filePath, "Error getting file info", err)
+		return
+	}
+	logger = logger.With("bytes", stableInfo.Size())
+	if h := target.Hashed; h != nil && (h.size != stableInfo.Size() || !h.modTime.Equal(stableInfo.ModTime())) {
+		logger.Debug("File changed since it was hashed, hashing it while uploading")
+		target.Hashed = nil
+	}
+	// While GCS is unreachable, new files wait behind the queued ones
+	if retryQueue.offline() {
+		retryQueue.add(filePath, target, nil)
+		countFailure(errCodeNetwork) // Counted as unreachable until the queue gets through
+		return
+	}
 
-	var clientOptions []option.ClientOption
+	journal.pending(filePath, stableInfo, target)
 
-	keychainKeyContent, keychainErr := getServiceAccountKeyFromKeychain()
-	if runtime.GOOS == "darwin" && keychainErr == nil && len(keychainKeyContent) > 0 {
-		log.Printf("Authenticating with Service Account Key from Keychain for %s", filePath)
-		clientOptions = append(clientOptions, option.WithCredentialsJSON(keychainKeyContent))
-	} else if impersonateServiceAccount != "" {
-		log.Printf("Authenticating by impersonating Service Account: %s for %s", impersonateServiceAccount, filePath)
-		impersonationScopes := []string{
-			"https://www.googleapis.com/auth/devstorage.read_write",
-		}
-		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
-			TargetPrincipal: impersonateServiceAccount,
-			Scopes:          impersonationScopes,
-		})
-		if err != nil {
-			log.Printf("Failed to create impersonated token source for %s: %v", filePath, err)
-			return
-		}
-		clientOptions = append(clientOptions, option.WithTokenSource(ts))
-	} else {
-		log.Printf("WARNING: No service account key found in Keychain and no impersonation SA provided for %s. Using Application Default Credentials (may not be sufficient for GCS access).", filePath)
-	}
+	// Storage class tiers go by the final size of the file
+	target.StorageClass = storageClassFor(src.relativePath(filePath), stableInfo.Size())
 
-	if projectID != "" {
-		clientOptions = append(clientOptions, option.WithQuotaProject(projectID))
-	}
+	ctx := rootCtx
 
-	client, err := storage.NewClient(ctx, clientOptions...)
-	if err != nil {
-		log.Printf("Error creating Google Cloud Storage client for %s: %v", filePath, err)
+	journal.setState(filePath, journalUploading, nil)
+	start := time.Now()
+	var outcome string
+	var object *storage.ObjectAttrs
+	err = withRetries(fmt.Sprintf("uploading %s", filePath), func() error {
+		return withUploadTimeout(ctx, func(ctx context.Context) (err error) {
+			outcome, object, err = uploadFile(ctx, f, target)
+			return err
+		})
+	})
+	if ctx.Err() != nil {
+		// Cut off by the shutdown timeout: the journal entry makes the next start check the bucket
+		logger.Warn("Upload stopped by shutdown, leaving the file for the next start", "error", err)
 		return
 	}
-	defer client.Close()
-
-	obj := client.Bucket(bucketName).Object(objectName)
-	// Attempt to get attributes to check for object existence
-	_, err = obj.Attrs(ctx)
-	if err == nil {
-		// Case 1: File already exists in GCS. Log, notify, delete local, then return.
-		log.Printf("File '%s' already exists in GCS bucket '%s'. Skipping upload, proceeding with local deletion.", objectName, bucketName)
-		sendNotification("File Existed", fmt.Sprintf("File '%s' already existed in GCS bucket '%s'. Local file deleted.", objectName, bucketName))
-		if err := os.Remove(filePath); err != nil {
-			log.Printf("Error deleting file %s (already on GCS) after checking existence: %v", filePath, err)
-		} else {
-			log.Printf("Successfully deleted local file: %s (after confirming GCS existence)", filePath)
+	var conflict *conflictError
+	conflicted := errors.As(err, &conflict) && cfg.OnConflict != conflictFail
+	if conflicted {
+		outcome, target, object, err = resolveConflict(ctx, src, f, filePath, target, conflict)
+		logger = slog.With("file", filePath, "bucket", target.Bucket, "object", target.Object, "bytes", stableInfo.Size())
+	}
+	if err != nil {
+		if reportFailure(logger, filePath, "Error uploading file, skipping upload", err, durationMS(start)) {
+			notifyCode(notifyFailure, errorCode(err), msgUploadFailed, "file", filePath, "bucket", target.Bucket, "error", err)
+		}
+		journal.setState(filePath, journalFailed, err)
+		if isUnreachable(err) {
+			retryQueue.add(filePath, target, err)
 		}
+		// Closed first, so it can be moved on every platform
+		f.Close()
+		quarantineFailed(src, filePath, err)
 		return
-	} else if errors.Is(err, storage.ErrObjectNotExist) { // KEY CHANGE: Using errors.Is for robust error comparison
-		// Case 2: File does NOT exist in GCS. This is the desired state for a new upload.
-		// Proceed to the upload logic below. No log needed here, as we're proceeding.
-	} else {
-		// Case 3: Some other error occurred while checking existence (e.g., permissions, network issue).
-		// Log the error and skip the upload for now.
-		log.Printf("Error checking existence of %s in GCS bucket %s: %v. Skipping upload.", objectName, bucketName, err)
+	}
+	clearFailures(filePath)
+	if outcome == auditQuarantined || outcome == auditSkipped {
+		journal.done(filePath)
+		message, args := conflictMessage(filePath, objectName, target, outcome)
+		notifyCode(notifyFailure, errCodeConflict, message, args...)
+		recordAudit(auditRecord{Event: outcome, File: filePath, Bucket: target.Bucket, Object: objectName, Pipeline: target.Pipeline, Size: stableInfo.Size(), Local: cfg.OnConflict})
 		return
 	}
+	message, messageArgs := msgUploaded, []any{"file", filePath, "object", objectName, "bucket", target.Bucket}
+	if conflicted {
+		message, messageArgs = conflictMessage(filePath, objectName, target, outcome)
+		objectName = target.Object
+	}
+	journal.setState(filePath, journalUploaded, nil)
+	health.uploaded()
 
-	// --- UPLOAD LOGIC STARTS HERE (only if file doesn't exist in GCS) ---
-	wc := obj.NewWriter(ctx)
-	if _, err = io.Copy(wc, f); err != nil {
-		log.Printf("Error uploading %s to %s/%s: %v", filePath, bucketName, objectName, err)
-		// It's crucial to close the writer even if io.Copy fails
-		if cerr := wc.Close(); cerr != nil {
-			log.Printf("Error closing writer after failed upload for %s: %v", objectName, cerr)
+	if outcome != auditUploaded && outcome != auditOverwritten {
+		// File already exists in GCS. Log, notify, apply --on-success, then return.
+		if outcome == auditExisted {
+			logger.Info("File already exists in GCS, skipping upload", "on_success", cfg.OnSuccess)
 		}
+		done, err := finishLocalFile(src, filePath, stableInfo, target)
+		if err != nil {
+			reportFailure(logger, filePath, "Error handling local file already on GCS", err, "on_success", cfg.OnSuccess)
+			return
+		}
+		journal.done(filePath)
+		logger.Info("Local file handled after confirming GCS existence", "local", done)
+		notify(notifyExists, msgFileExisted, "object", objectName, "bucket", target.Bucket, "local", done)
+		recordAudit(auditRecord{Event: outcome, File: filePath, Bucket: target.Bucket, Object: objectName, Pipeline: target.Pipeline, Size: stableInfo.Size(), Local: cfg.OnSuccess}.withObject(object))
 		return
 	}
 
-	if err := wc.Close(); err != nil {
-		log.Printf("Error closing writer for %s: %v", objectName, err)
-		return
+	if target.Gzip && object != nil {
+		logger = logger.With("compressed_bytes", object.Size)
 	}
+	logger.Info("Uploaded file", durationMS(start))
+	uploadedBytes.Add(stableInfo.Size())
+	recordAudit(auditRecord{Event: outcome, File: filePath, Bucket: target.Bucket, Object: objectName, Pipeline: target.Pipeline, Size: stableInfo.Size(), Local: cfg.OnSuccess}.withObject(object))
 
-	log.Printf("Successfully uploaded %s to gs://%s/%s", filePath, bucketName, objectName)
+	notify(notifySuccess, message, messageArgs...)
 
-	sendNotification("File Uploaded", fmt.Sprintf("Successfully uploaded '%s' to GCS bucket '%s'.", objectName, bucketName))
+	// The local file is still in place, so generate its preview before --on-success runs
+	if wantsPreview(filePath) {
+		uploadPreview(ctx, filePath, target)
+	}
 
-	if err := os.Remove(filePath); err != nil {
-		log.Printf("Error deleting file %s after upload: %v", filePath, err)
+	done, err := finishLocalFile(src, filePath, stableInfo, target)
+	if err != nil {
+		reportFailure(logger, filePath, "Error handling local file after upload", err, "on_success", cfg.OnSuccess)
 	} else {
-		log.Printf("Successfully deleted local file: %s", filePath)
+		journal.done(filePath)
+		logger.Info("Local file handled", "local", done)
 	}
 }
 
-// waitForFileStability checks if a file's size remains stable over a duration.
-func waitForFileStability(filePath string, duration, interval time.Duration) error {
-	lastSize := int64(-1)
-	stableStartTime := time.Now()
+// uploadFile makes one attempt at uploading f to target and verifies the object's checksums
+// against the local file. It returns the outcome as an audit event: auditUploaded, or
+// auditExisted if an identical object is already in the bucket, or auditCopied/auditDuplicate
+// if --dedupe found the content under another name, together with the attributes of the
+// object under the file's name where known. The returned error says whether the attempt may
+// be retried (see isRetryable); the local file is never touched here.
+func uploadFile(ctx context.Context, f *os.File, target uploadTarget) (outcome string, object *storage.ObjectAttrs, err error) {
+	client, err := clients.get(target.Credentials)
+	if err != nil {
+		return "", nil, fmt.Errorf("creating Google Cloud Storage client: %w", err)
+	}
+	defer func() { clients.report(client, err) }()
 
-	for {
-		fileInfo, err := os.Stat(filePath)
+	info, err := f.Stat()
+	if err != nil {
+		return "", nil, fmt.Errorf("reading file: %w", err)
+	}
+	// Parts are cut at file offsets, which a compressed stream doesn't have
+	composite := cfg.CompositeThreshold > 0 && info.Size() >= int64(cfg.CompositeThreshold) && !target.Gzip
+
+	// Objects are only ever created, never overwritten (If-GenerationMatch: 0), so instances
+	// watching the same share can't race each other into writing an object twice: the one
+	// that loses gets a precondition failure and compares its file with the winner's object.
+	// An existence check beforehand is only made where it is free (--dest-index), where it
+	// tells an existing object from a duplicate (--dedupe), or where the precondition would
+	// only fail after all the data was sent (composite uploads check it when composing).
+	obj := encrypted(client.Bucket(target.Bucket).Object(target.Object))
+	if target.Replace == 0 && (destIndexFor(target) != nil || cfg.Dedupe != dedupeOff || composite) {
+		existing, err := statObject(ctx, client, target)
 		if err != nil {
-			return fmt.Errorf("could not stat file during stability check: %v", err)
+			// Some error occurred while checking existence (e.g., permissions, network issue)
+			return "", nil, fmt.Errorf("checking existence in GCS: %w", err)
+		} else if existing != nil {
+			outcome, err := matchTarget(f, target, existing)
+			return outcome, existing, err
 		}
+	}
 
-		currentSize := fileInfo.Size()
-
-		if lastSize == -1 {
-			lastSize = currentSize
-		} else if currentSize != lastSize {
-			// Size changed, reset stability timer
-			lastSize = currentSize
-			stableStartTime = time.Now()
+	if cfg.Dedupe != dedupeOff && target.Replace == 0 {
+		outcome, err := dedupeFile(ctx, client, f, target)
+		if isPreconditionFailed(err) {
+			return matchCreated(ctx, obj, f, target)
+		} else if err != nil || outcome != "" {
+			return outcome, nil, err
 		}
+	}
 
-		if time.Since(stableStartTime) >= duration {
-			return nil // File size has been stable for the required duration
+	// A previous attempt may have read part of the file
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", nil, fmt.Errorf("rewinding file: %w", err)
+	}
+
+	objectWrites.wait(target.Bucket, target.Object)
+	dest := obj.If(storage.Conditions{DoesNotExist: true})
+	if target.Replace != 0 {
+		// Only the object the file was compared with is replaced, not one written since
+		dest = obj.If(storage.Conditions{GenerationMatch: target.Replace})
+	}
+	var attrs *storage.ObjectAttrs
+	var sums *checksums
+	if composite {
+		attrs, sums, err = uploadComposite(ctx, client, dest, f, info.Size(), objectAttrs(f, target))
+	} else {
+		attrs, sums, err = uploadStream(ctx, dest, f, info.Size(), target.Hashed, target.Gzip, objectAttrs(f, target))
+	}
+	if isPreconditionFailed(err) {
+		return matchCreated(ctx, obj, f, target)
+	} else if err != nil {
+		return "", nil, err
+	}
+
+	if err = sums.verify(attrs); err != nil {
+		// Remove the corrupt object, or the next attempt would find it and take the file as uploaded
+		cond := storage.Conditions{GenerationMatch: attrs.Generation}
+		if derr := obj.If(cond).Delete(ctx); derr != nil {
+			return "", nil, fmt.Errorf("%v; removing the corrupt object also failed: %v", err, derr)
 		}
+		return "", nil, err
+	}
+	if !hasDigests(attrs, sums) {
+		// A streamed upload only knows the --digest digests at its end
+		updated, err := recordDigests(ctx, obj, attrs, sums)
+		if err != nil {
+			// Removed like a corrupt object: the next attempt would take it as uploaded, without digests
+			err = fmt.Errorf("recording digests: %w", err)
+			cond := storage.Conditions{GenerationMatch: attrs.Generation}
+			if derr := obj.If(cond).Delete(ctx); derr != nil {
+				return "", nil, fmt.Errorf("%v; removing the object also failed: %v", err, derr)
+			}
+			return "", nil, err
+		}
+		attrs = updated
+	}
+	recordObject(target, attrs)
+	slog.Debug("Verified checksums", "bucket", target.Bucket, "object", target.Object, "crc32c", fmt.Sprintf("%08x", attrs.CRC32C))
+	return auditUploaded, attrs, nil
+}
 
-		time.Sleep(interval) // Wait for the next check
+// objectAttrs returns the attributes of the object f is uploaded to: headers, storage class and metadata.
+func objectAttrs(f *os.File, target uploadTarget) storage.ObjectAttrs {
+	attrs := storage.ObjectAttrs{
+		Name:               target.Object,
+		ContentType:        target.ContentType,
+		StorageClass:       target.StorageClass,
+		CacheControl:       target.CacheControl,
+		ContentDisposition: target.ContentDisposition,
+		ContentLanguage:    target.ContentLanguage,
+		KMSKeyName:         cfg.KMSKey,
+		PredefinedACL:      target.PredefinedACL,
+	}
+	if gzipEncoded(f.Name()) || (target.Gzip && !cfg.GzipObjects) {
+		attrs.ContentEncoding = "gzip"
+	}
+	metadata := make(map[string]string)
+	if cfg.CaptureProvenance {
+		maps.Copy(metadata, fileProvenance(f.Name()))
+	}
+	if cfg.CaptureAttribution {
+		maps.Copy(metadata, fileAttribution(f.Name()))
+	}
+	if target.CameraModel != "" {
+		metadata[metaCameraModel] = target.CameraModel
+	}
+	if cfg.SniffSchema {
+		maps.Copy(metadata, fileSchema(f.Name()))
+	}
+	if target.Hashed != nil {
+		maps.Copy(metadata, target.Hashed.sums.digestMetadata())
+	}
+	// Configured metadata (--metadata) wins over the automatically captured entries
+	maps.Copy(metadata, target.Metadata)
+	if len(metadata) > 0 {
+		attrs.Metadata = metadata
+	}
+	// A modification time is already recorded by GCS; only a time from the name or EXIF data is news
+	if target.TimeFrom != timeFromMtime {
+		attrs.CustomTime = target.Time
 	}
+	return attrs
 }
 
-// sendNotification sends a macOS native notification if running on Darwin.
-func sendNotification(title, message string) {
-	if runtime.GOOS == "darwin" {
-		cmd := exec.Command("osascript",
-			"-e", fmt.Sprintf(`display notification "%s" with title "%s" subtitle "%s"`, message, title, bundleIdent))
-		err := cmd.Run()
-		if err != nil {
-			log.Printf("Error sending macOS notification: %v", err)
+// uploadStream writes f to dest in a single (resumable) upload, gzip-compressed if compress is
+// set, and returns the attributes of the new object together with the checksums of the data
+// that was sent. A file hashed before (hashed is not nil) isn't hashed again; its checksums
+// are sent along for GCS to check.
+func uploadStream(ctx context.Context, dest *storage.ObjectHandle, f *os.File, size int64, hashed *hashedFile, compress bool, attrs storage.ObjectAttrs) (*storage.ObjectAttrs, *checksums, error) {
+	// Failed chunks of a resumable upload are retried, rather than restarting the whole file;
+	// the retries are safe since the object is verified against the local checksums afterwards
+	wc := dest.Retryer(storage.WithPolicy(storage.RetryAlways)).NewWriter(ctx)
+	wc.ObjectAttrs = attrs
+	wc.ChunkSize = int(cfg.ChunkSize)
+	wc.ChunkRetryDeadline = cfg.ChunkRetryDeadline
+	// The size of a compressed upload is only known at its end
+	if cfg.ProgressThreshold > 0 && size >= int64(cfg.ProgressThreshold) && !compress {
+		progress := trackProgress(f.Name(), size)
+		defer progress.done()
+		wc.ProgressFunc = progress.update
+	}
+	// Checksum the data while streaming it, to compare with what GCS stored
+	r, done := fileReader(f)
+	defer done()
+	if compress {
+		zr := compressedReader(r)
+		defer zr.Close()
+		r = zr
+	}
+	sums := newChecksums()
+	data := io.TeeReader(r, sums)
+	if hashed != nil {
+		sums, data = hashed.sums, r
+		wc.CRC32C, wc.SendCRC32C = sums.crc32c.Sum32(), true
+		wc.MD5 = sums.md5.Sum(nil)
+	}
+	if _, err := io.Copy(wc, data); err != nil {
+		// It's crucial to close the writer even if io.Copy fails
+		if cerr := wc.Close(); cerr != nil {
+			slog.Error("Error closing writer after failed upload", "object", attrs.Name, "error", cerr)
 		}
+		return nil, nil, err
+	}
+	if err := wc.Close(); err != nil {
+		return nil, nil, fmt.Errorf("closing writer: %w", err)
 	}
+	return wc.Attrs(), sums, nil
 }
 
-// storeServiceAccountKeyInKeychain stores the service account KEY JSON (as bytes) in macOS Keychain.
-func storeServiceAccountKeyInKeychain(keyJSON []byte) error {
-	// Prepare the item with new data
-	newItem := keychain.NewGenericPassword(keychainSAKeyService, keychainSAKeyAccount, "", keyJSON, "")
-	newItem.SetSynchronizable(keychain.SynchronizableNo)
-	newItem.SetAccessible(keychain.AccessibleWhenUnlocked)
-
-	err := keychain.AddItem(newItem) // Try adding first
-	if err == keychain.ErrorDuplicateItem {
-		// If it's a duplicate, prepare a query for the existing item
-		queryItem := keychain.NewItem()
-		queryItem.SetSecClass(keychain.SecClassGenericPassword)
-		queryItem.SetService(keychainSAKeyService)
-		queryItem.SetAccount(keychainSAKeyAccount)
-
-		// Update the existing item with the data from newItem
-		err = keychain.UpdateItem(queryItem, newItem)
-	}
-	return err
+// matchCreated compares f with the object of target after writing it failed because the
+// object already exists: another instance, or an earlier attempt whose response was lost,
+// created it first.
+func matchCreated(ctx context.Context, obj *storage.ObjectHandle, f *os.File, target uploadTarget) (string, *storage.ObjectAttrs, error) {
+	existing, err := obj.Attrs(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("checking existence in GCS: %w", err)
+	}
+	recordObject(target, existing)
+	outcome, err := matchTarget(f, target, existing)
+	return outcome, existing, err
 }
 
-// getServiceAccountKeyFromKeychain retrieves the service account KEY JSON (as bytes) from macOS Keychain.
-func getServiceAccountKeyFromKeychain() ([]byte, error) {
-	query := keychain.NewItem()
-	query.SetSecClass(keychain.SecClassGenericPassword)
-	query.SetService(keychainSAKeyService)
-	query.SetAccount(keychainSAKeyAccount)
-	query.SetMatchLimit(keychain.MatchLimitOne)
-	query.SetReturnData(true)
+// matchTarget is matchExisting, with the checksums of target.Hashed if the file was hashed already.
+func matchTarget(f *os.File, target uploadTarget, existing *storage.ObjectAttrs) (string, error) {
+	if target.Hashed != nil {
+		return matchExistingSums(target.Hashed.sums, existing)
+	}
+	return matchExisting(f, target, existing)
+}
 
-	results, err := keychain.QueryItem(query)
+// matchExisting compares f, as uploaded for target, with the object already at its
+// destination. Only an object with the same content counts as the file being uploaded.
+func matchExisting(f *os.File, target uploadTarget, existing *storage.ObjectAttrs) (string, error) {
+	sums, err := uploadChecksums(f, target)
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("reading file: %w", err)
 	}
-	if len(results) == 0 {
-		return nil, fmt.Errorf("service account key not found in Keychain for service '%s', account '%s'", keychainSAKeyService, keychainSAKeyAccount)
+	return matchExistingSums(sums, existing)
+}
+
+// matchExistingSums is matchExisting for data whose checksums are already known.
+func matchExistingSums(sums *checksums, existing *storage.ObjectAttrs) (string, error) {
+	if err := sums.verify(existing); err != nil {
+		return "", &conflictError{generation: existing.Generation, mismatch: err}
 	}
+	return auditExisted, nil
+}
 
-	return results[0].Data, nil
+// observeFile logs and notifies about the upload that would be performed for filePath in --observe mode.
+func observeFile(src *watchSource, filePath string, target uploadTarget) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		slog.Error("[OBSERVE] Error getting file info", "file", filePath, "error", err)
+		return
+	}
+	logger := slog.With("file", filePath, "bucket", target.Bucket, "object", target.Object)
+	logger.Info("[OBSERVE] Would upload file", "bytes", info.Size(), "modified", info.ModTime().Format(time.RFC3339),
+		"file_time", target.Time.Format(time.RFC3339), "time_from", target.TimeFrom, "pipeline", target.Pipeline, "on_success", cfg.OnSuccess)
+	if cfg.Dedupe != dedupeOff {
+		logger.Info("[OBSERVE] Would look for identical content under the destination prefix first", "prefix", target.ListPrefix, "dedupe", cfg.Dedupe)
+	}
+	if class := storageClassFor(src.relativePath(filePath), info.Size()); class != "" {
+		logger.Info("[OBSERVE] Would use storage class", "storage_class", class)
+	}
+	for key, value := range target.Metadata {
+		logger.Info("[OBSERVE] Would record metadata", "key", key, "value", value)
+	}
+	if target.ContentType != "" {
+		logger.Info("[OBSERVE] Would set Content-Type", "content_type", target.ContentType)
+	}
+	if wantsPreview(filePath) {
+		logger.Info("[OBSERVE] Would upload a preview", "preview", previewObject(target.Object))
+	}
+	if cfg.SniffSchema {
+		for key, value := range fileSchema(filePath) {
+			logger.Info("[OBSERVE] Would record metadata", "key", key, "value", value)
+		}
+	}
+	if target.CameraModel != "" {
+		logger.Info("[OBSERVE] Would record metadata", "key", metaCameraModel, "value", target.CameraModel)
+	}
+	if cfg.CaptureProvenance {
+		for key, value := range fileProvenance(filePath) {
+			logger.Info("[OBSERVE] Would record metadata", "key", key, "value", value)
+		}
+	}
+	if cfg.CaptureAttribution {
+		for key, value := range fileAttribution(filePath) {
+			logger.Info("[OBSERVE] Would record metadata", "key", key, "value", value)
+		}
+	}
+	notify(notifyObserved, msgFileObserved, "object", target.Object, "bucket", target.Bucket)
 }
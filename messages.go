@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Message IDs of the notifications, the keys of the message catalog.
+const (
+	msgUploaded            = "uploaded"
+	msgUploadedOverwritten = "uploaded_overwritten"
+	msgUploadedRenamed     = "uploaded_renamed"
+	msgUploadFailed        = "upload_failed"
+	msgFileExisted         = "file_existed"
+	msgFileObserved        = "file_observed"
+	msgConflictSkipped     = "conflict_skipped"
+	msgConflictQuarantined = "conflict_quarantined"
+	msgFileQuarantined     = "file_quarantined"
+	msgStillFailing        = "still_failing"
+	msgBundleUploaded      = "bundle_uploaded"
+	msgBundleFailed        = "bundle_failed"
+	msgPartSetUploaded     = "part_set_uploaded"
+	msgPartSetExisted      = "part_set_existed"
+	msgPartSetFailed       = "part_set_failed"
+	msgAuthBroken          = "auth_broken"
+	msgAuthRestored        = "auth_restored"
+	msgKeyRotationDue      = "key_rotation_due"
+	msgDeletionsPaused     = "deletions_paused"
+	msgFileOnHold          = "file_on_hold"
+	msgFilesOnHold         = "files_on_hold"
+	msgObjectDrifted       = "object_drifted"
+	msgObjectsDrifted      = "objects_drifted"
+	msgNameCollision       = "name_collision"
+	msgObjectCollision     = "object_collision"
+	msgNameCollisions      = "name_collisions"
+)
+
+// messageTemplate is the title and text of a notification, with {parameter} placeholders.
+type messageTemplate struct {
+	Title string `yaml:"title"`
+	Text  string `yaml:"text"`
+}
+
+// messageCatalog holds the English notifications. --message-catalog replaces entries of it.
+var messageCatalog = map[string]messageTemplate{
+	msgUploaded:            {"File Uploaded", "Successfully uploaded '{object}' to GCS bucket '{bucket}'."},
+	msgUploadedOverwritten: {"File Uploaded", "Successfully uploaded '{object}' to GCS bucket '{bucket}'. It replaced a different '{object}' (on-conflict: {on_conflict})."},
+	msgUploadedRenamed:     {"File Uploaded", "Successfully uploaded '{object}' to GCS bucket '{bucket}'. A different '{conflict}' already existed, so it was uploaded as '{object}' (on-conflict: {on_conflict})."},
+	msgUploadFailed:        {"Upload Failed", "Could not upload '{file}' to GCS bucket '{bucket}': {error}"},
+	msgFileExisted:         {"File Existed", "File '{object}' already existed in GCS bucket '{bucket}'. Local file {local}."},
+	msgFileObserved:        {"File Observed", "Would upload '{object}' to GCS bucket '{bucket}'."},
+	msgConflictSkipped:     {"Upload Skipped", "'{file}' was not uploaded: GCS bucket '{bucket}' already has a different '{object}' (on-conflict: {on_conflict}). The file was left in place."},
+	msgConflictQuarantined: {"Upload Skipped", "'{file}' was not uploaded: GCS bucket '{bucket}' already has a different '{object}' (on-conflict: {on_conflict}). The file was moved to {quarantine}."},
+	msgFileQuarantined:     {"File Quarantined", "'{file}' failed {failures} times in a row and was moved to {quarantine}: {error}"},
+	msgStillFailing:        {"Still Failing", "'{file}' failed {failures} more times ({code}) since {since}: {error}"},
+	msgBundleUploaded:      {"Files Uploaded", "Successfully uploaded {count} files to GCS bucket '{bucket}' as the bundle '{object}'."},
+	msgBundleFailed:        {"Upload Failed", "Could not upload a bundle of {count} files to GCS bucket '{bucket}': {error}"},
+	msgPartSetUploaded:     {"File Uploaded", "Successfully uploaded the {count} parts of '{object}' to GCS bucket '{bucket}'."},
+	msgPartSetExisted:      {"File Existed", "File '{object}' already existed in GCS bucket '{bucket}'."},
+	msgPartSetFailed:       {"Upload Failed", "Could not upload the {count} parts of '{file}' to GCS bucket '{bucket}': {error}"},
+	msgAuthBroken:          {"Authentication Broken", "Uploads to GCS are failing because the credentials no longer work. See the log for how to fix it."},
+	msgAuthRestored:        {"Authentication Restored", "Uploads to GCS are authenticating again."},
+	msgKeyRotationDue:      {"Key Rotation Due", "The service account key of {account} is {days} days old. Rotate it."},
+	msgDeletionsPaused:     {"Deletions Paused", "More than {max} local files were removed within a minute. Uploads continue, but files are kept until you run 'gcs-folder-uploader resume-deletions'."},
+	msgFileOnHold:          {"File On Hold", "'{file}' has been on hold for more than {max_age} and is not uploaded until it is moved out of the hold folder."},
+	msgFilesOnHold:         {"Files On Hold", "{count} files have been on hold for more than {max_age}, including '{file}'. They are not uploaded until they are moved out of the hold folder."},
+	msgObjectDrifted:       {"Object Drifted", "{object} no longer matches what was uploaded."},
+	msgObjectsDrifted:      {"Objects Drifted", "{count} objects no longer match what was uploaded, including {object}."},
+	msgNameCollision:       {"Name Collision", "Several files would be uploaded to {object}: {files}. --on-conflict {on_conflict} decides what happens on upload."},
+	msgObjectCollision:     {"Name Collision", "'{file}' would be uploaded to {object}, which exists with other content. --on-conflict {on_conflict} decides what happens on upload."},
+	msgNameCollisions:      {"Name Collisions", "{count} objects would receive more than one file's content, including {object}. --on-conflict {on_conflict} decides what happens on upload; see the log."},
+}
+
+// messages is the catalog notifications are rendered from: messageCatalog with the entries
+// of --message-catalog, loaded at startup.
+var messages = messageCatalog
+
+// messageParamRegexp matches a {parameter} of a message template.
+var messageParamRegexp = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// renderMessage renders the message id of the catalog with args, which alternate parameter
+// names and values as for slog. It returns the title, the text and the parameters as strings.
+func renderMessage(id string, args ...any) (string, string, map[string]string) {
+	params := make(map[string]string, len(args)/2)
+	for i := 0; i+1 < len(args); i += 2 {
+		params[fmt.Sprint(args[i])] = fmt.Sprint(args[i+1])
+	}
+	render := func(tmpl string) string {
+		return messageParamRegexp.ReplaceAllStringFunc(tmpl, func(m string) string {
+			if value, ok := params[m[1:len(m)-1]]; ok {
+				return value
+			}
+			return m
+		})
+	}
+	tmpl := messages[id]
+	return render(tmpl.Title), render(tmpl.Text), params
+}
+
+// messageParams returns the parameters a message template uses.
+func messageParams(tmpl messageTemplate) map[string]bool {
+	params := make(map[string]bool)
+	for _, m := range messageParamRegexp.FindAllStringSubmatch(tmpl.Title+tmpl.Text, -1) {
+		params[m[1]] = true
+	}
+	return params
+}
+
+// loadMessageCatalog reads a YAML file of message IDs mapped to a title and text, e.g. in
+// another language, and returns messageCatalog with its entries. A translation may use the
+// parameters of the English message, in any order; a missing title or text stays English.
+func loadMessageCatalog(path string) (map[string]messageTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]messageTemplate
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&entries); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	catalog := maps.Clone(messageCatalog)
+	for id, entry := range entries {
+		english, ok := messageCatalog[id]
+		if !ok {
+			return nil, fmt.Errorf("unknown message %q (see the messages subcommand)", id)
+		}
+		known := messageParams(english)
+		for param := range messageParams(entry) {
+			if !known[param] {
+				return nil, fmt.Errorf("message %s: unknown parameter {%s}", id, param)
+			}
+		}
+		if entry.Title == "" {
+			entry.Title = english.Title
+		}
+		if entry.Text == "" {
+			entry.Text = english.Text
+		}
+		catalog[id] = entry
+	}
+	return catalog, nil
+}
+
+// validateMessageCatalog checks the --message-catalog file.
+func validateMessageCatalog(c *Config) error {
+	if c.MessageCatalog == "" {
+		return nil
+	}
+	if _, err := loadMessageCatalog(c.MessageCatalog); err != nil {
+		return fmt.Errorf("message-catalog: %v", err)
+	}
+	return nil
+}
+
+// printMessageCatalog implements the messages subcommand: it prints the English catalog as
+// YAML, to start a --message-catalog from.
+func printMessageCatalog() error {
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(messageCatalog); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,16 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// networkFileSystems are the statfs type names of network file systems.
+var networkFileSystems = map[string]bool{"nfs": true, "smbfs": true, "afpfs": true, "webdav": true}
+
+// networkFileSystem returns the type of the file system dir is on if it is a network one.
+func networkFileSystem(dir string) (string, bool) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return "", false
+	}
+	name := unix.ByteSliceToString(st.Fstypename[:])
+	return name, networkFileSystems[name]
+}
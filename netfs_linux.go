@@ -0,0 +1,21 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// networkFileSystems names the statfs magic numbers of network file systems.
+var networkFileSystems = map[uint32]string{
+	unix.NFS_SUPER_MAGIC:  "nfs",
+	unix.CIFS_SUPER_MAGIC: "cifs",
+	unix.SMB2_SUPER_MAGIC: "smb2",
+	unix.SMB_SUPER_MAGIC:  "smb",
+}
+
+// networkFileSystem returns the type of the file system dir is on if it is a network one.
+func networkFileSystem(dir string) (string, bool) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return "", false
+	}
+	name, ok := networkFileSystems[uint32(st.Type)]
+	return name, ok
+}
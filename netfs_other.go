@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+// networkFileSystem reports no network file systems: they are only detected on Linux,
+// macOS and Windows.
+func networkFileSystem(dir string) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,20 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+// networkFileSystem returns "remote" if dir is on a network drive or share.
+func networkFileSystem(dir string) (string, bool) {
+	name, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return "", false
+	}
+	// The root of the volume dir is on, which may be a share or a folder it is mounted in
+	root := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumePathName(name, &root[0], uint32(len(root))); err != nil {
+		return "", false
+	}
+	if windows.GetDriveType(&root[0]) != windows.DRIVE_REMOTE {
+		return "", false
+	}
+	return "remote", true
+}
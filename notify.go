@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Notification event types, which --notify selects per sink.
+const (
+	notifySuccess  = "success"  // A file was uploaded
+	notifyExists   = "exists"   // A file was already in GCS
+	notifyFailure  = "failure"  // A file could not be uploaded
+	notifyObserved = "observed" // Observer mode found a file it would upload
+	notifyAlert    = "alert"    // Authentication broke or recovered, a key is due for rotation, files are held too long
+	notifyAll      = "all"
+)
+
+var notifyEvents = []string{notifySuccess, notifyExists, notifyFailure, notifyObserved, notifyAlert}
+
+// Notification sinks.
+const (
+	sinkDesktop = "desktop" // macOS Notification Center, notify-send on Linux, a toast on Windows
+	sinkSlack   = "slack"   // Slack incoming webhook (--slack-webhook)
+	sinkEmail   = "email"   // SMTP (--smtp-*)
+	sinkCommand = "command" // Runs --notify-command
+)
+
+// notification is one message sent to the notification sinks.
+type notification struct {
+	Event   string
+	Code    string // Error code of failures and alerts (see errorCode), or ""
+	ID      string // Message ID in the message catalog
+	Params  map[string]string
+	Title   string
+	Message string
+}
+
+// Notifier delivers notifications to one sink.
+type Notifier interface {
+	Notify(n notification) error
+}
+
+// notifyFlag maps a sink to the comma-separated events it receives. As a flag it is
+// repeatable and takes SINK or SINK=EVENTS; config files use a plain mapping.
+type notifyFlag map[string]string
+
+func (f *notifyFlag) String() string {
+	var parts []string
+	for sink, events := range *f {
+		parts = append(parts, sink+"="+events)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (f *notifyFlag) Set(value string) error {
+	sink, events, ok := strings.Cut(value, "=")
+	if !ok {
+		events = notifyAll
+	}
+	if *f == nil {
+		*f = make(notifyFlag)
+	}
+	(*f)[sink] = events
+	return nil
+}
+
+// notifySinks returns the configured sinks. Without any, macOS shows every event in the
+// Notification Center, except in hardened mode, which never runs external commands; other
+// platforms, often headless, stay silent.
+func (c *Config) notifySinks() notifyFlag {
+	if len(c.Notify) > 0 || c.Hardened || runtime.GOOS != "darwin" {
+		return c.Notify
+	}
+	return notifyFlag{sinkDesktop: notifyAll}
+}
+
+// validateNotify checks the --notify sinks, their events and the settings each sink needs.
+func validateNotify(c *Config) error {
+	for sink, events := range c.Notify {
+		for _, event := range strings.Split(events, ",") {
+			if event != notifyAll && !slices.Contains(notifyEvents, event) {
+				return fmt.Errorf("notify %s: unknown event '%s' (expected %s or %s)", sink, event, strings.Join(notifyEvents, ", "), notifyAll)
+			}
+		}
+		switch sink {
+		case sinkDesktop:
+		case sinkSlack:
+			if u, err := url.Parse(c.SlackWebhook); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return fmt.Errorf("notify %s needs slack-webhook to be an http(s) URL, got '%s'", sink, c.SlackWebhook)
+			}
+		case sinkEmail:
+			if _, _, err := net.SplitHostPort(c.SMTPServer); err != nil {
+				return fmt.Errorf("notify %s needs smtp-server as HOST:PORT, got '%s'", sink, c.SMTPServer)
+			}
+			if c.SMTPFrom == "" || len(c.SMTPTo) == 0 {
+				return fmt.Errorf("notify %s needs smtp-from and smtp-to", sink)
+			}
+		case sinkCommand:
+			if c.NotifyCommand == "" {
+				return fmt.Errorf("notify %s needs a notify-command", sink)
+			}
+		default:
+			return fmt.Errorf("unknown notification sink '%s' (expected %s, %s, %s or %s)", sink, sinkDesktop, sinkSlack, sinkEmail, sinkCommand)
+		}
+	}
+	return nil
+}
+
+// notifierRoute is a sink and the events it receives (nil for all of them).
+type notifierRoute struct {
+	sink     string
+	notifier Notifier
+	events   map[string]bool
+}
+
+// notifiers are the sinks set up by setupNotifiers.
+var notifiers []notifierRoute
+
+// setupNotifiers creates the sinks configured with --notify and loads --message-catalog.
+func setupNotifiers(c *Config) {
+	messages = messageCatalog
+	if c.MessageCatalog != "" {
+		catalog, err := loadMessageCatalog(c.MessageCatalog)
+		if err != nil {
+			slog.Error("Error loading message catalog, notifications are in English", "path", c.MessageCatalog, "error", err)
+		} else {
+			messages = catalog
+		}
+	}
+	notifiers = nil
+	for sink, events := range c.notifySinks() {
+		route := notifierRoute{sink: sink}
+		switch sink {
+		case sinkDesktop:
+			route.notifier = desktopNotifier{}
+		case sinkSlack:
+			route.notifier = slackNotifier{webhook: c.SlackWebhook}
+		case sinkEmail:
+			route.notifier = emailNotifier{server: c.SMTPServer, from: c.SMTPFrom, to: c.SMTPTo, username: c.SMTPUsername}
+		case sinkCommand:
+			route.notifier = commandNotifier{path: c.NotifyCommand}
+		}
+		if events != notifyAll && !strings.Contains(","+events+",", ","+notifyAll+",") {
+			route.events = make(map[string]bool)
+			for _, event := range strings.Split(events, ",") {
+				route.events[event] = true
+			}
+		}
+		notifiers = append(notifiers, route)
+	}
+}
+
+// notify sends the message id of the message catalog, rendered with args (alternating
+// parameter names and values), as a notification of event to every sink configured for it,
+// in the background.
+func notify(event, id string, args ...any) {
+	notifyCode(event, "", id, args...)
+}
+
+// notifyCode is notify for failures and alerts with an error code.
+func notifyCode(event, code, id string, args ...any) {
+	title, message, params := renderMessage(id, args...)
+	n := notification{Event: event, Code: code, ID: id, Params: params, Title: cleanNotifyText(title), Message: cleanNotifyText(message)}
+	for _, route := range notifiers {
+		if route.events != nil && !route.events[event] {
+			continue
+		}
+		go func() {
+			if err := route.notifier.Notify(n); err != nil {
+				slog.Error("Error sending notification", "sink", route.sink, "event", event, "error", err)
+			}
+		}()
+	}
+}
+
+// desktopNotifier shows notifications on the desktop of the platform.
+type desktopNotifier struct{}
+
+func (desktopNotifier) Notify(n notification) error {
+	cmd := desktopCommand(runtime.GOOS, n)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// desktopCommand returns the command showing n on the desktop of goos.
+func desktopCommand(goos string, n notification) *exec.Cmd {
+	switch goos {
+	case "darwin":
+		// The texts are arguments of the script rather than part of it, so quotes in file
+		// names can't break out of a string literal
+		return exec.Command("osascript", "-e", macNotifyScript, n.Message, n.Title, bundleIdent)
+	case "windows":
+		// The texts go through the environment, which needs no quoting in the script
+		cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", windowsToastScript)
+		cmd.Env = append(os.Environ(), "NOTIFY_TITLE="+n.Title, "NOTIFY_MESSAGE="+n.Message)
+		return cmd
+	default:
+		// The body may be rendered as markup, and a title starting with '-' must not be an option
+		return exec.Command("notify-send", "--app-name=gcs-folder-uploader", "--", n.Title, escapeMarkup(n.Message))
+	}
+}
+
+// macNotifyScript shows its arguments, the message, title and subtitle, as a notification.
+const macNotifyScript = `on run argv
+display notification (item 1 of argv) with title (item 2 of argv) subtitle (item 3 of argv)
+end run`
+
+// windowsToastScript shows $env:NOTIFY_TITLE and $env:NOTIFY_MESSAGE as a Windows toast,
+// under the app ID of PowerShell, which is registered on every Windows installation.
+const windowsToastScript = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$xml = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $xml.GetElementsByTagName('text')
+$text.Item(0).AppendChild($xml.CreateTextNode($env:NOTIFY_TITLE)) > $null
+$text.Item(1).AppendChild($xml.CreateTextNode($env:NOTIFY_MESSAGE)) > $null
+$appID = '{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe'
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($appID).Show([Windows.UI.Notifications.ToastNotification]::new($xml))`
+
+// slackNotifier posts notifications to a Slack incoming webhook.
+type slackNotifier struct {
+	webhook string
+}
+
+func (s slackNotifier) Notify(n notification) error {
+	host, _ := os.Hostname()
+	body, err := json.Marshal(map[string]string{"text": slackText(n, host)})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(s.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("slack webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// slackText returns the Slack message text of n sent from host.
+func slackText(n notification, host string) string {
+	// Slack reads <...> as links and mentions (<!channel>), which file names must not trigger
+	text := fmt.Sprintf("*%s* (%s)\n%s", escapeMarkup(n.Title), host, escapeMarkup(n.Message))
+	if n.Code != "" {
+		text += fmt.Sprintf("\nError code: `%s`", n.Code)
+	}
+	return text
+}
+
+// emailNotifier sends notifications as plain text mail over SMTP. The password, if the
+// server needs one, comes from the GCS_UPLOADER_SMTP_PASSWORD environment variable, so it
+// doesn't show up in the process list or the config file.
+type emailNotifier struct {
+	server   string
+	from     string
+	to       []string
+	username string
+}
+
+func (e emailNotifier) Notify(n notification) error {
+	host, _ := os.Hostname()
+	var auth smtp.Auth
+	if e.username != "" {
+		serverHost, _, _ := net.SplitHostPort(e.server)
+		auth = smtp.PlainAuth("", e.username, os.Getenv("GCS_UPLOADER_SMTP_PASSWORD"), serverHost)
+	}
+	return smtp.SendMail(e.server, auth, e.from, e.to, e.message(n, host, time.Now()))
+}
+
+// message returns the mail of n sent from host at t.
+func (e emailNotifier) message(n notification, host string, t time.Time) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.to, ", "))
+	// Encoded, so non-ASCII file names survive and line breaks can't add headers
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", fmt.Sprintf("[gcs-folder-uploader] %s (%s)", n.Title, host)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", t.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nEvent: %s\r\nHost: %s\r\n", n.Message, n.Event, host)
+	if n.Code != "" {
+		fmt.Fprintf(&msg, "Error code: %s\r\n", n.Code)
+	}
+	return msg.Bytes()
+}
+
+// cleanNotifyText makes text from file names safe to show: invalid UTF-8 is replaced and
+// control characters other than line breaks and tabs are dropped.
+func cleanNotifyText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(s, "\uFFFD"))
+}
+
+// markupEscaper escapes the characters that are markup for Slack and notification servers.
+var markupEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// escapeMarkup returns s with &, < and > escaped.
+func escapeMarkup(s string) string {
+	return markupEscaper.Replace(s)
+}
+
+// commandNotifier runs a program for every notification, with the event, title and message
+// in the GCS_UPLOADER_EVENT, GCS_UPLOADER_TITLE and GCS_UPLOADER_MESSAGE environment variables,
+// and the error code, if any, in GCS_UPLOADER_ERROR_CODE. GCS_UPLOADER_MESSAGE_ID and
+// GCS_UPLOADER_PARAMS (a JSON object) hold the message ID and parameters, for programs that
+// word the notification themselves.
+type commandNotifier struct {
+	path string
+}
+
+func (c commandNotifier) Notify(n notification) error {
+	params, err := json.Marshal(n.Params)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(c.path)
+	cmd.Env = append(os.Environ(), "GCS_UPLOADER_EVENT="+n.Event, "GCS_UPLOADER_TITLE="+n.Title, "GCS_UPLOADER_MESSAGE="+n.Message, "GCS_UPLOADER_ERROR_CODE="+n.Code,
+		"GCS_UPLOADER_MESSAGE_ID="+n.ID, "GCS_UPLOADER_PARAMS="+string(params))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", c.path, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
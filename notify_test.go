@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/mail"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDesktopCommandDarwin(t *testing.T) {
+	tests := []struct {
+		name           string
+		title, message string
+	}{
+		{"double quotes", `File "Uploaded"`, `Uploaded 'a" & do shell script "rm -rf ~" & "'.txt`},
+		{"backslashes", `C:\temp\`, `\" & quit & "\`},
+		{"newline", "title", "line one\nline two"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := desktopCommand("darwin", notification{Title: tt.title, Message: tt.message})
+			want := []string{"osascript", "-e", macNotifyScript, tt.message, tt.title, bundleIdent}
+			if !slices.Equal(cmd.Args, want) {
+				t.Errorf("args = %q, want %q", cmd.Args, want)
+			}
+		})
+	}
+}
+
+func TestDesktopCommandWindows(t *testing.T) {
+	tests := []struct {
+		name           string
+		title, message string
+	}{
+		{"subexpression", "$(Remove-Item C:\\ -Recurse)", "Uploaded '$(Stop-Computer)'"},
+		{"backtick", "`whoami`", "a`\"; Stop-Computer; \"`b"},
+		{"quotes", `it's "quoted"`, `'); Stop-Computer; ('`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := desktopCommand("windows", notification{Title: tt.title, Message: tt.message})
+			want := []string{"powershell", "-NoProfile", "-NonInteractive", "-Command", windowsToastScript}
+			if !slices.Equal(cmd.Args, want) {
+				t.Errorf("args = %q, want %q", cmd.Args, want)
+			}
+			if !slices.Contains(cmd.Env, "NOTIFY_TITLE="+tt.title) || !slices.Contains(cmd.Env, "NOTIFY_MESSAGE="+tt.message) {
+				t.Errorf("title and message not passed verbatim in the environment")
+			}
+		})
+	}
+}
+
+func TestDesktopCommandLinux(t *testing.T) {
+	tests := []struct {
+		name           string
+		title, message string
+		wantMessage    string
+	}{
+		{"leading dash", "-u critical", "--help", "--help"},
+		{"pango markup", "Uploaded", `<b>a</b> & <span foreground="red">b</span>`, `&lt;b&gt;a&lt;/b&gt; &amp; &lt;span foreground="red"&gt;b&lt;/span&gt;`},
+		{"entity", "Uploaded", "&amp;", "&amp;amp;"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := desktopCommand("linux", notification{Title: tt.title, Message: tt.message})
+			want := []string{"notify-send", "--app-name=gcs-folder-uploader", "--", tt.title, tt.wantMessage}
+			if !slices.Equal(cmd.Args, want) {
+				t.Errorf("args = %q, want %q", cmd.Args, want)
+			}
+		})
+	}
+}
+
+func TestSlackText(t *testing.T) {
+	tests := []struct {
+		name  string
+		n     notification
+		want  string
+		avoid []string
+	}{
+		{"mention", notification{Title: "Uploaded", Message: "<!channel> <!here|here> <@U123>"},
+			"*Uploaded* (host)\n&lt;!channel&gt; &lt;!here|here&gt; &lt;@U123&gt;", []string{"<!channel>", "<!here", "<@"}},
+		{"link", notification{Title: "<https://evil.example|click>", Message: "a<b"},
+			"*&lt;https://evil.example|click&gt;* (host)\na&lt;b", []string{"<https"}},
+		{"ampersand", notification{Title: "A & B", Message: "&lt;"},
+			"*A &amp; B* (host)\n&amp;lt;", nil},
+		{"code", notification{Title: "Upload Failed", Message: "m", Code: "auth"},
+			"*Upload Failed* (host)\nm\nError code: `auth`", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := slackText(tt.n, "host")
+			if got != tt.want {
+				t.Errorf("slackText = %q, want %q", got, tt.want)
+			}
+			for _, s := range tt.avoid {
+				if strings.Contains(got, s) {
+					t.Errorf("slackText = %q contains %q", got, s)
+				}
+			}
+		})
+	}
+}
+
+func TestEmailSubject(t *testing.T) {
+	e := emailNotifier{from: "uploader@example.com", to: []string{"ops@example.com"}}
+	tests := []struct {
+		name  string
+		title string
+	}{
+		{"crlf", "Uploaded\r\nBcc: victim@example.com"},
+		{"lf", "Uploaded\nBcc: victim@example.com\n\nforged body"},
+		{"cr", "Uploaded\rX-Injected: yes"},
+		{"non-ascii", "Hochgeladen: Größe.txt"},
+		{"plain", "File Uploaded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := e.message(notification{Event: notifySuccess, Title: tt.title, Message: "body"}, "host", time.Unix(0, 0))
+			msg, err := mail.ReadMessage(bytes.NewReader(raw))
+			if err != nil {
+				t.Fatalf("reading mail: %v", err)
+			}
+			want := []string{"Content-Type", "Date", "From", "Subject", "To"}
+			var got []string
+			for key := range msg.Header {
+				got = append(got, key)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, want) {
+				t.Errorf("headers = %q, want %q", got, want)
+			}
+			subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+			if err != nil {
+				t.Fatalf("decoding subject: %v", err)
+			}
+			if want := "[gcs-folder-uploader] " + tt.title + " (host)"; subject != want {
+				t.Errorf("subject = %q, want %q", subject, want)
+			}
+			if body, _ := io.ReadAll(msg.Body); !bytes.HasPrefix(body, []byte("body\r\n")) {
+				t.Errorf("body = %q, want it to start with the message", body)
+			}
+		})
+	}
+}
+
+func TestCleanNotifyText(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"a\r\nb", "a\nb"},
+		{"tab\tand\x1b[31mescape", "tab\tand[31mescape"},
+		{"bell\a", "bell"},
+		{"bad\xffutf8", "bad\uFFFDutf8"},
+		{"\u202eright-to-left", "\u202eright-to-left"},
+	}
+	for _, tt := range tests {
+		if got := cleanNotifyText(tt.in); got != tt.want {
+			t.Errorf("cleanNotifyText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
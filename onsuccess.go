@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// What happens to a local file once it is safely in GCS (--on-success).
+const (
+	onSuccessDelete = "delete" // Remove the local file
+	onSuccessMove   = "move"   // Move it below --archive-dir, keeping its path relative to the source
+	onSuccessKeep   = "keep"   // Leave it in place and record it in the ledger so it isn't uploaded again
+)
+
+// validateOnSuccess checks the --on-success and --archive-dir settings against the sources.
+func validateOnSuccess(c *Config, sources []SourceConfig) error {
+	switch c.OnSuccess {
+	case onSuccessDelete, onSuccessKeep:
+		return nil
+	case onSuccessMove:
+	default:
+		return fmt.Errorf("on-success must be %q, %q or %q, got %q", onSuccessDelete, onSuccessMove, onSuccessKeep, c.OnSuccess)
+	}
+	if c.ArchiveDir == "" {
+		return errors.New("on-success=move needs an archive-dir")
+	}
+	archive := filepath.Clean(c.ArchiveDir)
+	for _, sc := range sources {
+		// An archive inside a watched folder would have its files uploaded again
+		if isWithin(archive, sc.Path) {
+			return fmt.Errorf("archive-dir '%s' must not be inside source '%s'", c.ArchiveDir, sc.Path)
+		}
+	}
+	return nil
+}
+
+// finishLocalFile applies --on-success to filePath after it was uploaded (or found
+// already uploaded) and returns a past-tense description of what was done.
+func finishLocalFile(src *watchSource, filePath string, info os.FileInfo, target uploadTarget) (string, error) {
+	if p := protectedBy(filePath); p != "" {
+		return "", fmt.Errorf("'%s' is under protected path '%s'", filePath, p)
+	}
+	if cfg.OnSuccess != onSuccessKeep && !deletions.allow(filePath, info, target) {
+		return "held until deletions are resumed", nil
+	}
+	return applyOnSuccess(src, filePath, info, target)
+}
+
+// applyOnSuccess deletes, moves or keeps filePath as --on-success says. info is the file
+// as it was uploaded: a file written to since then is left in place and queued again, as
+// its new content isn't in GCS.
+func applyOnSuccess(src *watchSource, filePath string, info os.FileInfo, target uploadTarget) (string, error) {
+	if cfg.OnSuccess != onSuccessKeep && changedSince(filePath, info) {
+		processFileWrapper(src, filePath)
+		return "left in place, as it changed since its upload; queued again", nil
+	}
+	switch cfg.OnSuccess {
+	case onSuccessMove:
+		dest, err := archiveFile(filePath, filepath.Join(cfg.ArchiveDir, filepath.FromSlash(src.relativePath(filePath))))
+		if err != nil {
+			return "", err
+		}
+		finishCompanions(src, filePath)
+		return "moved to " + dest, nil
+	case onSuccessKeep:
+		if err := ledger.record(filePath, info, target); err != nil {
+			return "", fmt.Errorf("recording in the ledger: %v", err)
+		}
+		return "kept", nil
+	default:
+		if err := os.Remove(filePath); err != nil {
+			return "", err
+		}
+		finishCompanions(src, filePath)
+		return "deleted", nil
+	}
+}
+
+// changedSince reports whether filePath is no longer the file described by info: its size
+// or modification time differ, or it was replaced by something else than a file. It is
+// stat'ed like the upload opened it, following a symlink.
+func changedSince(filePath string, info os.FileInfo) bool {
+	current, err := os.Stat(filePath)
+	if err != nil {
+		return !errors.Is(err, os.ErrNotExist) // A vanished file leaves nothing to lose
+	}
+	return !current.Mode().IsRegular() || current.Size() != info.Size() || !current.ModTime().Equal(info.ModTime())
+}
+
+// archiveFile moves filePath to dest, creating parent directories and picking a free
+// name ("report-1.pdf") rather than overwriting an earlier archived file. It returns
+// the path the file was moved to.
+func archiveFile(filePath, dest string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return "", err
+	}
+	ext := filepath.Ext(dest)
+	base := strings.TrimSuffix(dest, ext)
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(dest); errors.Is(err, os.ErrNotExist) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		dest = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+
+	err := os.Rename(filePath, dest)
+	if errors.Is(err, syscall.EXDEV) {
+		// The archive is on another volume: copy, then remove the original
+		err = copyFile(filePath, dest)
+		if err == nil {
+			err = os.Remove(filePath)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// copyFile copies src to a new file dst, keeping its permissions and modification time.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// openHandlesCommand is empty: the handles check reads /proc.
+const openHandlesCommand = ""
+
+// openHandlesSupported reports why open file handles can't be checked, if they can't.
+func openHandlesSupported() error {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		return errors.New("/proc is not mounted")
+	}
+	return nil
+}
+
+// openForWriting reports whether another process has filePath open for writing, from the
+// file descriptors in /proc. Processes of other users are only visible to root.
+func openForWriting(filePath string) (bool, error) {
+	// The links in /proc point to the real path
+	filePath, err := filepath.EvalSymlinks(filePath)
+	if err != nil {
+		return false, err
+	}
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return false, err
+	}
+	self := strconv.Itoa(os.Getpid())
+	for _, proc := range procs {
+		if _, err := strconv.Atoi(proc.Name()); err != nil || proc.Name() == self {
+			continue
+		}
+		fdDir := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue // Exited, or another user's
+		}
+		for _, fd := range fds {
+			if target, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err != nil || target != filePath {
+				continue
+			}
+			if fdWritable(filepath.Join("/proc", proc.Name(), "fdinfo", fd.Name())) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// fdWritable reports whether the file descriptor described by the fdinfo file was opened
+// for writing (O_WRONLY or O_RDWR).
+func fdWritable(fdinfo string) bool {
+	f, err := os.Open(fdinfo)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "flags:"); ok {
+			flags, err := strconv.ParseUint(strings.TrimSpace(value), 8, 64)
+			return err == nil && flags&uint64(os.O_WRONLY|os.O_RDWR) != 0
+		}
+	}
+	return false
+}
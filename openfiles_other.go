@@ -0,0 +1,42 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// openHandlesCommand is the external command the handles check runs (see validateHardened).
+const openHandlesCommand = "lsof"
+
+// openHandlesSupported reports why open file handles can't be checked, if they can't.
+func openHandlesSupported() error {
+	if _, err := exec.LookPath(openHandlesCommand); err != nil {
+		return errors.New("lsof is not installed")
+	}
+	return nil
+}
+
+// openForWriting reports whether another process has filePath open for writing, asking
+// lsof for the access mode of every open descriptor of the file.
+func openForWriting(filePath string) (bool, error) {
+	out, err := exec.Command(openHandlesCommand, "-F", "a", "--", filePath).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(out) == 0 {
+		return false, nil // lsof exits with 1 when no process has the file open
+	} else if err != nil {
+		return false, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// "a" fields hold the access mode: r(ead), w(rite) or u (read and write)
+		if mode, ok := strings.CutPrefix(scanner.Text(), "a"); ok && (mode == "w" || mode == "u") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// openHandlesCommand is empty: the handles check opens the file.
+const openHandlesCommand = ""
+
+// openHandlesSupported reports why open file handles can't be checked, if they can't.
+func openHandlesSupported() error {
+	return nil
+}
+
+// errorSharingViolation is ERROR_SHARING_VIOLATION, which the syscall package doesn't name.
+const errorSharingViolation syscall.Errno = 32
+
+// openForWriting reports whether another process has filePath open for writing: opening it
+// without sharing write access then fails with a sharing violation.
+func openForWriting(filePath string) (bool, error) {
+	name, err := syscall.UTF16PtrFromString(filePath)
+	if err != nil {
+		return false, err
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_DELETE, nil, syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if errors.Is(err, errorSharingViolation) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	syscall.CloseHandle(h)
+	return false, nil
+}
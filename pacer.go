@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// objectPacer spaces out writes to the same object, as GCS allows about one write per
+// second to an object and answers faster updates with 429 errors. Writers to different
+// objects never wait for each other.
+type objectPacer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     map[string]time.Time // Earliest time of the next write, per bucket/object
+}
+
+// objectWrites paces all object writes of the process.
+var objectWrites = newObjectPacer(ObjectWriteInterval)
+
+func newObjectPacer(interval time.Duration) *objectPacer {
+	return &objectPacer{interval: interval, next: make(map[string]time.Time)}
+}
+
+// wait blocks until a write to object in bucket is allowed and reserves that slot, so
+// concurrent writers to the same object take turns.
+func (p *objectPacer) wait(bucket, object string) {
+	key := bucket + "/" + object
+	p.mu.Lock()
+	now := time.Now()
+	// Forget slots that have passed, so the map only holds recently written objects
+	for k, t := range p.next {
+		if !t.After(now) {
+			delete(p.next, k)
+		}
+	}
+	slot := now
+	if t, ok := p.next[key]; ok && t.After(now) {
+		slot = t
+	}
+	p.next[key] = slot.Add(p.interval)
+	p.mu.Unlock()
+
+	time.Sleep(time.Until(slot))
+}
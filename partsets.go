@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/uuid"
+)
+
+// partFileRegexp matches the parts producers split big files into, "bigfile.part0001",
+// "bigfile.part0002", ..., capturing the name of the whole file and the part number.
+var partFileRegexp = regexp.MustCompile(`^(.+)\.part(\d+)$`)
+
+// maxComposeSources is the most objects GCS composes in one request; maxComposeComponents
+// the most an object may be composed of in total.
+const (
+	maxComposeSources    = 32
+	maxComposeComponents = 1024
+)
+
+// partSets tracks the part sets seen by processSingleFile (--part-sets) until they are
+// complete: numbered without gaps from 0 or 1, and with no part changed for
+// --part-set-settle. Keys are the paths of the whole files, which don't exist locally.
+var partSets = struct {
+	mu      sync.Mutex
+	pending map[string]*pendingPartSet
+}{pending: make(map[string]*pendingPartSet)}
+
+// pendingPartSet is a part set waiting to be complete.
+type pendingPartSet struct {
+	src    *watchSource
+	warned bool // Its incompleteness has been logged
+}
+
+// observePart records filePath as part of a set, if it is one, and reports whether it is.
+// Parts are never uploaded by themselves.
+func observePart(src *watchSource, filePath string) bool {
+	m := partFileRegexp.FindStringSubmatch(filepath.Base(filePath))
+	if m == nil {
+		return false
+	}
+	setPath := filepath.Join(filepath.Dir(filePath), m[1])
+	partSets.mu.Lock()
+	defer partSets.mu.Unlock()
+	if _, ok := partSets.pending[setPath]; !ok {
+		slog.Debug("Waiting for the part set to be complete", "file", setPath, "part", filePath)
+		partSets.pending[setPath] = &pendingPartSet{src: src}
+	}
+	return true
+}
+
+// collectParts returns the parts of the file setPath in order, with their total size and
+// the modification time of the newest, or an error saying why the set is incomplete.
+func collectParts(setPath string) (parts []string, size int64, newest time.Time, err error) {
+	entries, err := os.ReadDir(filepath.Dir(setPath))
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	numbers := make(map[string]int)
+	for _, e := range entries {
+		m := partFileRegexp.FindStringSubmatch(e.Name())
+		if m == nil || m[1] != filepath.Base(setPath) || !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, 0, time.Time{}, err
+		}
+		n, _ := strconv.Atoi(m[2])
+		partPath := filepath.Join(filepath.Dir(setPath), e.Name())
+		numbers[partPath] = n
+		parts = append(parts, partPath)
+		size += info.Size()
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	if len(parts) == 0 {
+		return nil, 0, time.Time{}, os.ErrNotExist
+	}
+	if len(parts) > maxComposeComponents {
+		return nil, 0, time.Time{}, fmt.Errorf("%d parts, more than the %d GCS can compose", len(parts), maxComposeComponents)
+	}
+	sort.Slice(parts, func(i, j int) bool { return numbers[parts[i]] < numbers[parts[j]] })
+	first := numbers[parts[0]]
+	if first > 1 {
+		return nil, 0, time.Time{}, fmt.Errorf("the first part is number %d", first)
+	}
+	for i, p := range parts {
+		if numbers[p] != first+i {
+			return nil, 0, time.Time{}, fmt.Errorf("part %d is missing", first+i)
+		}
+	}
+	return parts, size, newest, nil
+}
+
+// submitPartSets queues the part sets that are complete. With final set, as the last check
+// of --once, the sets that are not are logged, since they are only uploaded by a later run.
+func submitPartSets(final bool) {
+	partSets.mu.Lock()
+	defer partSets.mu.Unlock()
+	for setPath, set := range partSets.pending {
+		parts, _, newest, err := collectParts(setPath)
+		switch {
+		case os.IsNotExist(err):
+			delete(partSets.pending, setPath) // The parts are gone
+		case err != nil:
+			if final || (!set.warned && time.Since(newest) >= cfg.PartSetSettle) {
+				slog.Warn("Part set is incomplete, waiting for the missing parts", "file", setPath, "error", err)
+				set.warned = true
+			}
+		case time.Since(newest) < cfg.PartSetSettle:
+			if final {
+				slog.Warn("Part set is still being written, leaving it for the next run", "file", setPath, "parts", len(parts), "settle", cfg.PartSetSettle)
+			}
+		default:
+			delete(partSets.pending, setPath)
+			uploads.submitParts(set.src, setPath)
+		}
+	}
+}
+
+// watchPartSets queues part sets once they are complete.
+func watchPartSets() {
+	for range time.Tick(PartSetCheckInterval) {
+		submitPartSets(false)
+	}
+}
+
+// partSetInfo describes the whole file of a part set to resolveTarget: the newest part,
+// with the size of all parts together.
+type partSetInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i partSetInfo) Name() string { return partFileRegexp.FindStringSubmatch(i.FileInfo.Name())[1] }
+func (i partSetInfo) Size() int64  { return i.size }
+
+// processPartSet uploads the parts of the file setPath as one object, composed in GCS, and
+// applies --on-success to all parts once the composed object has been verified.
+func processPartSet(src *watchSource, setPath string) {
+	logger := slog.With("file", setPath)
+	// Collected again, as parts may have changed while the set was queued
+	parts, size, _, err := collectParts(setPath)
+	if os.IsNotExist(err) {
+		logger.Debug("Part set no longer exists, skipping processing")
+		return
+	} else if err != nil {
+		reportFailure(logger, setPath, "Part set is no longer complete, skipping upload", err)
+		return
+	}
+	last, err := os.Stat(parts[len(parts)-1])
+	if err != nil {
+		reportFailure(logger, setPath, "Error getting file info", err)
+		return
+	}
+	target := resolveTarget(src, setPath, partSetInfo{FileInfo: last, size: size})
+	logger = logger.With("bucket", target.Bucket, "object", target.Object, "parts", len(parts), "bytes", size)
+	if cfg.Observe {
+		logger.Info("[OBSERVE] Would compose part set into one object")
+		return
+	}
+	logger.Info("Attempting to upload part set")
+
+	files := make([]*os.File, len(parts))
+	for i, p := range parts {
+		if files[i], err = os.Open(p); err != nil {
+			reportFailure(logger, setPath, "Error opening part", err, "part", p)
+			return
+		}
+		defer files[i].Close()
+	}
+	target.StorageClass = storageClassFor(src.relativePath(setPath), size)
+
+	start := time.Now()
+	var outcome string
+	err = withRetries(fmt.Sprintf("uploading part set %s", setPath), func() error {
+		return withUploadTimeout(rootCtx, func(ctx context.Context) (err error) {
+			outcome, err = uploadPartSet(ctx, files, target)
+			return err
+		})
+	})
+	if rootCtx.Err() != nil {
+		logger.Warn("Upload stopped by shutdown, leaving the parts for the next start", "error", err)
+		return
+	}
+	if err != nil {
+		if reportFailure(logger, setPath, "Error uploading part set, skipping upload", err, durationMS(start)) {
+			notifyCode(notifyFailure, errorCode(err), msgPartSetFailed, "count", len(parts), "file", setPath, "bucket", target.Bucket, "error", err)
+		}
+		return
+	}
+	health.uploaded()
+	if outcome == auditExisted {
+		logger.Info("Part set already exists in GCS, skipping upload", "on_success", cfg.OnSuccess)
+		notify(notifyExists, msgPartSetExisted, "object", target.Object, "bucket", target.Bucket)
+	} else {
+		logger.Info("Uploaded part set", durationMS(start))
+		uploadedBytes.Add(size)
+		notify(notifySuccess, msgPartSetUploaded, "count", len(parts), "object", target.Object, "bucket", target.Bucket)
+	}
+	recordAudit(auditRecord{Event: outcome, File: setPath, Bucket: target.Bucket, Object: target.Object, Pipeline: target.Pipeline, Size: size, Local: cfg.OnSuccess})
+
+	// Only now that the whole file is safely in GCS are any of its parts touched
+	for i, p := range parts {
+		info, err := files[i].Stat()
+		if err != nil {
+			reportFailure(logger, setPath, "Error getting file info", err, "part", p)
+			continue
+		}
+		done, err := finishLocalFile(src, p, info, target)
+		if err != nil {
+			reportFailure(logger, setPath, "Error handling part after upload", err, "part", p, "on_success", cfg.OnSuccess)
+			continue
+		}
+		logger.Debug("Part handled", "part", p, "local", done)
+	}
+	logger.Info("Local parts handled", "on_success", cfg.OnSuccess)
+}
+
+// uploadPartSet makes one attempt at uploading files, the parts of one file in order, as
+// temporary objects in parallel, composing them into the object of target and deleting the
+// temporary objects. GCS checks the CRC32C of the composed object against the local parts
+// read one after the other. It returns auditUploaded, or auditExisted if an identical
+// object is already in the bucket.
+func uploadPartSet(ctx context.Context, files []*os.File, target uploadTarget) (outcome string, err error) {
+	client, err := clients.get(target.Credentials)
+	if err != nil {
+		return "", fmt.Errorf("creating Google Cloud Storage client: %w", err)
+	}
+	defer func() { clients.report(client, err) }()
+
+	sums := newChecksums()
+	sizes := make([]int64, len(files))
+	for i, f := range files {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", fmt.Errorf("reading part: %w", err)
+		}
+		if sizes[i], err = io.Copy(sums, f); err != nil {
+			return "", fmt.Errorf("reading part: %w", err)
+		}
+	}
+	// Composing only checks its precondition after all parts were sent
+	existing, err := statObject(ctx, client, target)
+	if err != nil {
+		return "", fmt.Errorf("checking existence in GCS: %w", err)
+	} else if existing != nil {
+		return matchExistingSums(sums, existing)
+	}
+
+	bucket := client.Bucket(target.Bucket)
+	id := uuid.NewString()
+	var temps []*storage.ObjectHandle
+	tempObject := func() *storage.ObjectHandle {
+		obj := bucket.Object(fmt.Sprintf("%s%s%s-%04d", target.Object, compositePartMarker, id, len(temps)))
+		temps = append(temps, obj)
+		return obj
+	}
+	defer func() { deleteParts(temps) }()
+
+	sources := make([]*storage.ObjectHandle, len(files))
+	for i := range files {
+		sources[i] = tempObject()
+	}
+	errs := make([]error, len(files))
+	limit := make(chan struct{}, cfg.CompositeParts)
+	var wg sync.WaitGroup
+	for i, f := range files {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-limit }()
+			errs[i] = uploadPart(ctx, sources[i], io.NewSectionReader(f, 0, sizes[i]))
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return "", fmt.Errorf("uploading part %s: %w", files[i].Name(), err)
+		}
+	}
+
+	// More sources than one compose takes are composed in tiers
+	for len(sources) > maxComposeSources {
+		var next []*storage.ObjectHandle
+		for i := 0; i < len(sources); i += maxComposeSources {
+			group := sources[i:min(i+maxComposeSources, len(sources))]
+			if len(group) == 1 {
+				next = append(next, group[0])
+				continue
+			}
+			intermediate := tempObject()
+			composer := encrypted(intermediate).ComposerFrom(group...)
+			composer.StorageClass = "STANDARD"
+			composer.KMSKeyName = cfg.KMSKey
+			if _, err := composer.Run(ctx); err != nil {
+				return "", fmt.Errorf("composing parts: %w", err)
+			}
+			next = append(next, intermediate)
+		}
+		sources = next
+	}
+
+	objectWrites.wait(target.Bucket, target.Object)
+	obj := encrypted(bucket.Object(target.Object))
+	composer := obj.If(storage.Conditions{DoesNotExist: true}).ComposerFrom(sources...)
+	// The attributes go by the first part, except for the encoding, which goes by the whole name
+	composer.ObjectAttrs = objectAttrs(files[0], target)
+	composer.Metadata = withDigests(composer.Metadata, sums)
+	if gzipEncoded(target.Object) {
+		composer.ContentEncoding = "gzip"
+	}
+	// GCS rejects the compose if the result doesn't match the local parts
+	composer.CRC32C = sums.crc32c.Sum32()
+	composer.SendCRC32C = true
+	composed, err := composer.Run(ctx)
+	if isPreconditionFailed(err) {
+		if existing, err = obj.Attrs(ctx); err != nil {
+			return "", fmt.Errorf("checking existence in GCS: %w", err)
+		}
+		recordObject(target, existing)
+		return matchExistingSums(sums, existing)
+	} else if err != nil {
+		return "", fmt.Errorf("composing %d parts: %w", len(files), err)
+	}
+	if err := sums.verify(composed); err != nil {
+		// Remove the corrupt object, or the next attempt would find it and take the set as uploaded
+		if derr := obj.If(storage.Conditions{GenerationMatch: composed.Generation}).Delete(ctx); derr != nil {
+			return "", fmt.Errorf("%w; removing the corrupt object also failed: %v", err, derr)
+		}
+		return "", err
+	}
+	recordObject(target, composed)
+	return auditUploaded, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// What to do with cloud placeholder files (--cloud-placeholders).
+const (
+	placeholderWait     = "wait"     // Wait for the sync client to download the content
+	placeholderDownload = "download" // Ask the sync client to download the content, then wait
+	placeholderSkip     = "skip"     // Skip the file with a warning
+)
+
+// iCloudStubSuffix marks the stub iCloud Drive leaves in place of an evicted file on older
+// macOS releases: "report.pdf" becomes ".report.pdf.icloud", a small plist with no content.
+const iCloudStubSuffix = ".icloud"
+
+// iCloudStubTarget returns the path of the file an iCloud Drive stub stands for,
+// and whether filePath is such a stub at all.
+func iCloudStubTarget(filePath string) (string, bool) {
+	base := filepath.Base(filePath)
+	if !strings.HasPrefix(base, ".") || !strings.HasSuffix(base, iCloudStubSuffix) {
+		return "", false
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(base, "."), iCloudStubSuffix)
+	if name == "" {
+		return "", false
+	}
+	return filepath.Join(filepath.Dir(filePath), name), true
+}
+
+// prepareCloudFile applies the --cloud-placeholders policy to filePath and reports
+// whether its content is on disk and the upload should go ahead.
+// iCloud stubs are never uploaded: once downloaded, the real file shows up as its own event.
+func prepareCloudFile(filePath string) bool {
+	if target, ok := iCloudStubTarget(filePath); ok {
+		if cfg.CloudPlaceholders != placeholderDownload {
+			slog.Warn("Skipping evicted iCloud Drive file. Use --cloud-placeholders=download to fetch it.", "file", filePath, "stub_for", target)
+			return false
+		}
+		if err := requestDownload(target); err != nil {
+			slog.Error("Error requesting download of evicted iCloud Drive file, skipping upload", "file", target, "error", err)
+			return false
+		}
+		slog.Info("Requested download of evicted iCloud Drive file; it will be uploaded once it arrives", "file", target)
+		return false
+	}
+
+	dataless, err := isDataless(filePath)
+	if err != nil {
+		slog.Error("Error checking placeholder status, skipping upload", "file", filePath, "error", err)
+		return false
+	}
+	if !dataless {
+		return true
+	}
+	switch cfg.CloudPlaceholders {
+	case placeholderSkip:
+		slog.Warn("Skipping cloud placeholder whose content is not downloaded", "file", filePath)
+		return false
+	case placeholderDownload:
+		if err := requestDownload(filePath); err != nil {
+			slog.Error("Error requesting download of cloud placeholder, skipping upload", "file", filePath, "error", err)
+			return false
+		}
+	}
+
+	if err := waitForMaterialization(filePath, cfg.MaterializeTimeout, MaterializeCheckInterval); err != nil {
+		slog.Error("Error waiting for cloud placeholder to be materialized, skipping upload", "file", filePath, "error", err)
+		return false
+	}
+	return true
+}
+
+// validatePlaceholderPolicy checks a --cloud-placeholders value.
+func validatePlaceholderPolicy(policy string) error {
+	switch policy {
+	case placeholderWait, placeholderDownload, placeholderSkip:
+		return nil
+	}
+	return fmt.Errorf("cloud-placeholders must be %q, %q or %q, got %q", placeholderWait, placeholderDownload, placeholderSkip, policy)
+}
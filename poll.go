@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// fileStamp is what polling compares to notice that a file changed.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// pollers holds the polling loop of every source that is polled (--poll-interval), so
+// a source falling back to polling at runtime isn't polled twice.
+var pollers = struct {
+	sync.Mutex
+	started map[*watchSource]bool
+	stop    chan struct{}
+}{started: make(map[*watchSource]bool), stop: make(chan struct{})}
+
+// startPolling scans src every interval and hands new and changed files to the debouncer,
+// for file systems where fsnotify misses events (NFS, SMB) or doesn't work at all.
+// It does nothing if src is polled already.
+func startPolling(src *watchSource, interval time.Duration) {
+	pollers.Lock()
+	defer pollers.Unlock()
+	if pollers.started[src] {
+		return
+	}
+	pollers.started[src] = true
+	slog.Info("Polling folder for changes", "path", src.Path, "interval", interval, "destination", src.destination())
+	go pollSource(src, interval)
+}
+
+// isPolled reports whether src is polled.
+func isPolled(src *watchSource) bool {
+	pollers.Lock()
+	defer pollers.Unlock()
+	return pollers.started[src]
+}
+
+// stopPolling ends all polling loops.
+func stopPolling() {
+	pollers.Lock()
+	defer pollers.Unlock()
+	select {
+	case <-pollers.stop:
+	default:
+		close(pollers.stop)
+	}
+}
+
+// pollSource is the polling loop of src. The first pass only records the files present,
+// since the initial scan has queued them already.
+func pollSource(src *watchSource, interval time.Duration) {
+	health.setPolling(src, true)
+	defer health.setPolling(src, false)
+	seen := snapshotSource(src)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pollers.stop:
+			return
+		case <-ticker.C:
+		}
+		current := snapshotSource(src)
+		for filePath, stamp := range current {
+			if old, ok := seen[filePath]; ok && old == stamp {
+				continue
+			}
+			if reason := src.skipReason(filePath); reason != "" {
+				slog.Debug("Ignoring change", "file", filePath, "reason", reason)
+				continue
+			}
+			slog.Debug("Detected change by polling", "file", filePath)
+			processFileWrapper(src, filePath)
+		}
+		seen = current
+	}
+}
+
+// snapshotSource returns the size and modification time of every file in src.
+func snapshotSource(src *watchSource) map[string]fileStamp {
+	files := make(map[string]fileStamp)
+	err := forEachFile(src.Path, func(filePath string) {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return // Removed since it was listed
+		}
+		files[filePath] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+	})
+	if err != nil {
+		slog.Error("Error polling folder", "path", src.Path, "error", err)
+	}
+	return files
+}
+
+// pollIntervalOrDefault is the interval used when fsnotify turns out not to work for a source.
+func pollIntervalOrDefault() time.Duration {
+	if cfg.PollInterval > 0 {
+		return cfg.PollInterval
+	}
+	return DefaultPollInterval
+}
+
+// isWatchUnsupported reports whether a watcher error means the file system doesn't
+// support change notifications, so the source has to be polled instead.
+func isWatchUnsupported(err error) bool {
+	return errors.Is(err, errors.ErrUnsupported)
+}
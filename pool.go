@@ -0,0 +1,416 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// uploadJob is a file waiting to be processed by the worker pool.
+type uploadJob struct {
+	src      *watchSource
+	filePath string
+	partSet  bool          // filePath is the file a part set adds up to (see processPartSet)
+	prepared *uploadTarget // Checked and hashed by the hashing pool, ready to upload
+	bundle   *fileBundle   // A closed bundle to upload; filePath identifies it (see processBundle)
+
+	bytes     int64            // Size for the byte budget, as of when the job was queued
+	skipped   int              // Times passed over for jobs that fit the byte budget
+	admission *budgetAdmission // Part of the byte budget held while the job is processed
+}
+
+// workerPool processes queued files with a fixed number of workers, so a burst of
+// thousands of files never opens more than --concurrency files and GCS streams at once.
+// The queue itself is unbounded and never blocks the watchers; a file that is already
+// queued is not queued a second time.
+//
+// Each source has its own queue, and the workers take from them by smooth weighted
+// round-robin (--source-weight), so a deep backlog of a bulk folder never holds back the
+// files of a low-volume one: those wait for at most a few jobs, not the whole backlog.
+// With a byte budget, jobs are only taken once their size fits into it (see byteBudget).
+type workerPool struct {
+	name    string // For the logs
+	process func(job uploadJob)
+	weights map[string]int // Source path to its relative share of the workers; unlisted sources weigh 1
+	budget  *byteBudget    // --max-inflight-bytes; nil for none
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queues  map[string]*sourceQueue
+	order   []string // Sources in the order they first queued a job, for a stable choice between equals
+	size    int      // Jobs queued across all sources
+	queued  map[string]bool
+	workers int // Workers started
+	active  int // Jobs being processed
+	limit   int // Jobs processed at once at most, below the number of workers (see adaptConcurrency); 0 for no limit
+	closed  bool
+	wg      sync.WaitGroup
+
+	reserved string // Job passed over too often, taken before any other once it fits the budget
+}
+
+// sourceQueue is the queue of one source, with its credit in the round-robin.
+type sourceQueue struct {
+	jobs    []uploadJob
+	weight  int
+	current int
+}
+
+// uploads is the process-wide worker pool, started in main.
+var uploads *workerPool
+
+// hashers is the pool that checks files, waits for them to be stable and hashes them before
+// passing them on to uploads (--hash-workers). It is nil when files are hashed while they
+// are uploaded, by the upload workers.
+var hashers *workerPool
+
+// newWorkerPool starts workers goroutines calling process for the submitted files. weights
+// maps a source to its relative share of the workers while several sources have files queued.
+// budget, if not nil, caps the total size of the files being processed.
+func newWorkerPool(name string, workers int, weights map[string]int, budget *byteBudget, process func(job uploadJob)) *workerPool {
+	cleaned := make(map[string]int, len(weights))
+	for source, w := range weights {
+		cleaned[filepath.Clean(source)] = w
+	}
+	p := &workerPool{name: name, process: process, weights: cleaned, budget: budget, queues: make(map[string]*sourceQueue), queued: make(map[string]bool)}
+	p.cond = sync.NewCond(&p.mu)
+	p.grow(workers)
+	return p
+}
+
+// grow starts workers until the pool has at least workers of them. Workers are never
+// stopped; to use fewer, set a limit.
+func (p *workerPool) grow(workers int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.workers < workers {
+		p.workers++
+		p.wg.Add(1)
+		go p.worker(p.workers)
+	}
+}
+
+// processJob is the work of the upload pool.
+func processJob(job uploadJob) {
+	switch {
+	case job.partSet:
+		processPartSet(job.src, job.filePath)
+	case job.bundle != nil:
+		processBundle(job.bundle)
+	case job.prepared != nil:
+		uploadPrepared(job.src, job.filePath, *job.prepared)
+	default:
+		processSingleFile(job)
+	}
+}
+
+// submitFile queues filePath from src for processing, by the hashing pool first if there is one.
+func submitFile(src *watchSource, filePath string) {
+	if hashers != nil {
+		hashers.submit(src, filePath)
+		return
+	}
+	uploads.submit(src, filePath)
+}
+
+// drainPools blocks until the hashing pool, if any, and then the upload pool are idle.
+func drainPools() {
+	if hashers != nil {
+		hashers.drain()
+	}
+	uploads.drain()
+}
+
+// submit queues filePath from src for processing.
+func (p *workerPool) submit(src *watchSource, filePath string) {
+	p.enqueue(uploadJob{src: src, filePath: filePath})
+}
+
+// submitParts queues the part set of the file setPath from src for processing.
+func (p *workerPool) submitParts(src *watchSource, setPath string) {
+	p.enqueue(uploadJob{src: src, filePath: setPath, partSet: true})
+}
+
+// submitBundle queues the closed bundle b for upload.
+func (p *workerPool) submitBundle(b *fileBundle) {
+	p.enqueue(uploadJob{src: b.src, filePath: "bundle:" + b.id, bundle: b})
+}
+
+func (p *workerPool) enqueue(job uploadJob) {
+	if p.budget != nil {
+		job.bytes = jobBytes(job)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.queued[job.filePath] {
+		return
+	}
+	p.queued[job.filePath] = true
+	source := jobSource(job)
+	q, ok := p.queues[source]
+	if !ok {
+		q = &sourceQueue{weight: 1}
+		if w, ok := p.weights[source]; ok && w > 0 {
+			q.weight = w
+		}
+		p.queues[source] = q
+		p.order = append(p.order, source)
+	}
+	q.jobs = append(q.jobs, job)
+	p.size++
+	slog.Debug("Queued file", "pool", p.name, "file", job.filePath, "queue_depth", p.size)
+	p.cond.Broadcast() // drain waits on the same condition as the workers
+}
+
+// depth returns the number of files waiting for a worker.
+func (p *workerPool) depth() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// jobSource returns the source a job is queued under.
+func jobSource(job uploadJob) string {
+	if job.src == nil {
+		return ""
+	}
+	return filepath.Clean(job.src.Path)
+}
+
+// jobBytes returns the size of job for the byte budget, as far as it is known when it is queued.
+func jobBytes(job uploadJob) int64 {
+	switch {
+	case job.bundle != nil:
+		return job.bundle.size
+	case job.prepared != nil && job.prepared.Hashed != nil:
+		return job.prepared.Hashed.size
+	case job.partSet:
+		if _, size, _, err := collectParts(job.filePath); err == nil {
+			return size
+		}
+		return 0
+	}
+	info, err := os.Stat(job.filePath)
+	if err != nil {
+		return 0 // Reported by the worker
+	}
+	return info.Size()
+}
+
+// pick removes the next job from the source queues by smooth weighted round-robin: every
+// source with jobs gains its weight in credit, the one with the most is served and pays
+// back the total, so over any stretch each busy source gets its weighted share of the
+// jobs, spread out rather than in runs. With a byte budget, a source is served with its
+// first job that fits, and sources with none are passed over; ok is false if no job fits.
+// It must be called with p.mu held and p.size > 0.
+func (p *workerPool) pick() (job uploadJob, ok bool) {
+	var queued map[string]bool
+	if p.budget != nil {
+		queued = make(map[string]bool, len(p.order))
+		for _, source := range p.order {
+			if len(p.queues[source].jobs) > 0 {
+				queued[source] = true
+			}
+		}
+		if p.reserved != "" {
+			return p.pickReserved(queued)
+		}
+	}
+
+	var best *sourceQueue
+	var bestSource string
+	bestIndex := -1
+	var passed []*uploadJob // Jobs checked before the budget and found too large
+	total := 0
+	for _, source := range p.order {
+		q := p.queues[source]
+		if len(q.jobs) == 0 {
+			continue
+		}
+		total += q.weight
+		index := 0
+		if p.budget != nil {
+			index = -1
+			for i := range min(len(q.jobs), byteBudgetLookahead) {
+				if p.budget.fits(source, q.jobs[i].bytes, queued) {
+					index = i
+					break
+				}
+				passed = append(passed, &q.jobs[i])
+			}
+			if index < 0 {
+				continue
+			}
+		}
+		if best == nil || q.current+q.weight > best.current+best.weight {
+			best, bestSource, bestIndex = q, source, index
+		}
+	}
+	if best == nil {
+		return uploadJob{}, false
+	}
+	for _, source := range p.order {
+		if q := p.queues[source]; len(q.jobs) > 0 {
+			q.current += q.weight
+		}
+	}
+	best.current -= total
+	for _, j := range passed {
+		if j.skipped++; j.skipped >= byteBudgetMaxSkips && p.reserved == "" {
+			p.reserved = j.filePath
+			slog.Debug("File waiting for the in-flight byte budget reserves it", "pool", p.name, "file", j.filePath, "bytes", j.bytes)
+		}
+	}
+	return p.take(best, bestSource, bestIndex), true
+}
+
+// pickReserved removes the job holding the byte budget reservation once it fits. It must be
+// called with p.mu held.
+func (p *workerPool) pickReserved(queued map[string]bool) (uploadJob, bool) {
+	for _, source := range p.order {
+		q := p.queues[source]
+		for i, job := range q.jobs {
+			if job.filePath != p.reserved {
+				continue
+			}
+			if !p.budget.fits(source, job.bytes, queued) {
+				return uploadJob{}, false
+			}
+			p.reserved = ""
+			return p.take(q, source, i), true
+		}
+	}
+	p.reserved = "" // No longer queued
+	return p.pick()
+}
+
+// take removes the job at index from the queue q of source, admitting it to the byte budget.
+// It must be called with p.mu held.
+func (p *workerPool) take(q *sourceQueue, source string, index int) uploadJob {
+	job := q.jobs[index]
+	copy(q.jobs[index:], q.jobs[index+1:])
+	q.jobs[len(q.jobs)-1] = uploadJob{} // Let the popped job be garbage collected
+	q.jobs = q.jobs[:len(q.jobs)-1]
+	if len(q.jobs) == 0 {
+		q.current = 0 // An idle source doesn't bank credit for its next burst
+	}
+	p.size--
+	if p.budget != nil {
+		job.admission = p.budget.admit(source, job.bytes)
+	}
+	return job
+}
+
+// next blocks until a job is available and removes it from the queue. ok is false once the pool is closed.
+func (p *workerPool) next() (job uploadJob, depth int, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.closed {
+		if p.size > 0 && (p.limit == 0 || p.active < p.limit) {
+			if job, ok := p.pick(); ok {
+				delete(p.queued, job.filePath)
+				p.active++
+				return job, p.size, true
+			}
+		}
+		p.cond.Wait() // Also woken when a job finishes and returns its bytes to the budget
+	}
+	return uploadJob{}, 0, false
+}
+
+func (p *workerPool) worker(id int) {
+	defer p.wg.Done()
+	for {
+		job, depth, ok := p.next()
+		if !ok {
+			return
+		}
+		slog.Debug("Processing file", "pool", p.name, "worker", id, "file", job.filePath, "queue_depth", depth)
+		p.process(job)
+
+		p.mu.Lock()
+		p.active--
+		if job.admission != nil {
+			p.budget.release(job.admission)
+		}
+		p.mu.Unlock()
+		p.cond.Broadcast()
+	}
+}
+
+// setLimit sets how many jobs may be processed at once; 0 lets every worker run.
+func (p *workerPool) setLimit(n int) {
+	p.mu.Lock()
+	p.limit = n
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// drain blocks until the queue is empty and no file is being processed.
+func (p *workerPool) drain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for (p.size > 0 || p.active > 0) && !p.closed {
+		p.cond.Wait()
+	}
+}
+
+// reportDepth logs the queue depth every interval while files are waiting.
+func (p *workerPool) reportDepth(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if depth := p.depth(); depth > 0 {
+			slog.Info("Files waiting for a worker", "pool", p.name, "queue_depth", depth)
+		}
+	}
+}
+
+// close stops the workers once their current file is done. Queued files are dropped.
+func (p *workerPool) close() {
+	p.stop()
+}
+
+// stop stops the workers once their current file is done, like close, and returns the
+// files that were still queued.
+func (p *workerPool) stop() []uploadJob {
+	p.mu.Lock()
+	p.closed = true
+	var queue []uploadJob
+	for _, source := range p.order {
+		queue = append(queue, p.queues[source].jobs...)
+	}
+	clear(p.queues)
+	p.order = nil
+	p.size = 0
+	clear(p.queued)
+	p.reserved = ""
+	p.mu.Unlock()
+	p.cond.Broadcast()
+	return queue
+}
+
+// wait blocks until the workers of a stopped pool have finished their current file, or
+// timeout has passed. It reports whether they all finished.
+func (p *workerPool) wait(timeout time.Duration) bool {
+	finished := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// busy returns the number of files being processed.
+func (p *workerPool) busy() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active
+}
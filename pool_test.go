@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testSource(path string) *watchSource {
+	return &watchSource{SourceConfig: SourceConfig{Path: path}}
+}
+
+// runPool queues jobs while the pool's single worker is held on a first job, then releases
+// it and returns the sources of the jobs in the order the worker took them.
+func runPool(t *testing.T, weights map[string]int, queue func(p *workerPool)) []string {
+	t.Helper()
+	var (
+		mu      sync.Mutex
+		order   []string
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	p := newWorkerPool("test", 1, weights, nil, func(job uploadJob) {
+		if job.filePath == "hold" {
+			close(started)
+			<-release
+			return
+		}
+		mu.Lock()
+		order = append(order, job.src.Path)
+		mu.Unlock()
+	})
+	defer p.close()
+	p.submit(testSource("/hold"), "hold")
+	<-started
+	queue(p)
+	close(release)
+	p.drain()
+	mu.Lock()
+	defer mu.Unlock()
+	return order
+}
+
+func TestWorkerPoolServesLowVolumeSource(t *testing.T) {
+	bulk := testSource("/data/bulk")
+	telemetry := testSource("/data/telemetry")
+	order := runPool(t, nil, func(p *workerPool) {
+		for i := range 1000 {
+			p.submit(bulk, fmt.Sprintf("/data/bulk/%d", i))
+		}
+		for i := range 3 {
+			p.submit(telemetry, fmt.Sprintf("/data/telemetry/%d", i))
+		}
+	})
+	if len(order) != 1003 {
+		t.Fatalf("processed %d jobs, want 1003", len(order))
+	}
+	last := 0
+	for i, source := range order {
+		if source == telemetry.Path {
+			last = i
+		}
+	}
+	// Served alternately with the bulk backlog: within the first 6 jobs, not after 1000
+	if last >= 6 {
+		t.Errorf("last telemetry job was job %d of %d, want it served alongside the bulk backlog", last+1, len(order))
+	}
+}
+
+func TestWorkerPoolWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]int
+		want    int // Jobs of /a among the first 40
+	}{
+		{"equal", nil, 20},
+		{"weighted", map[string]int{"/a": 3}, 30},
+		{"unclean path", map[string]int{"/a/": 3}, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testSource("/a")
+			b := testSource("/b")
+			order := runPool(t, tt.weights, func(p *workerPool) {
+				for i := range 100 {
+					p.submit(a, fmt.Sprintf("/a/%d", i))
+					p.submit(b, fmt.Sprintf("/b/%d", i))
+				}
+			})
+			got := 0
+			for _, source := range order[:40] {
+				if source == a.Path {
+					got++
+				}
+			}
+			if got != tt.want {
+				t.Errorf("/a got %d of the first 40 jobs, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolStopReturnsQueuedJobs(t *testing.T) {
+	p := newWorkerPool("test", 0, nil, nil, func(uploadJob) {})
+	p.submit(testSource("/a"), "/a/1")
+	p.submit(testSource("/b"), "/b/1")
+	p.submit(testSource("/a"), "/a/1") // Already queued
+	p.submit(testSource("/a"), "/a/2")
+	if d := p.depth(); d != 3 {
+		t.Fatalf("depth = %d, want 3", d)
+	}
+	if jobs := p.stop(); len(jobs) != 3 {
+		t.Errorf("stop returned %d jobs, want 3", len(jobs))
+	}
+	if d := p.depth(); d != 0 {
+		t.Errorf("depth after stop = %d, want 0", d)
+	}
+}
+
+// runBudgetPool runs a pool of two workers with a byte budget of 100. One worker is held on
+// a file of 60 bytes, while a file of large bytes and then small files of 10 bytes are
+// queued. The held worker is released once the first before small files are done; runBudgetPool
+// returns the names of the queued files in the order they were processed.
+func runBudgetPool(t *testing.T, large int64, small, before int) []string {
+	t.Helper()
+	dir := t.TempDir()
+	file := func(name string, size int64) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, size), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	hold := file("hold", 60)
+	var (
+		mu      sync.Mutex
+		order   []string
+		started = make(chan struct{})
+		release = make(chan struct{})
+		done    = make(chan struct{})
+	)
+	p := newWorkerPool("test", 2, nil, newByteBudget(100, nil), func(job uploadJob) {
+		if job.filePath == hold {
+			close(started)
+			<-release
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, filepath.Base(job.filePath))
+		if len(order) == before {
+			close(done)
+		}
+	})
+	defer p.close()
+	src := testSource(dir)
+	p.submit(src, hold)
+	<-started
+	p.submit(src, file("large", large))
+	for i := range small {
+		p.submit(src, file(fmt.Sprintf("small%d", i), 10))
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("small files not processed while the budget was partly in use")
+	}
+	close(release)
+	p.drain()
+	mu.Lock()
+	defer mu.Unlock()
+	return order
+}
+
+func TestWorkerPoolBudgetTakesFilesThatFit(t *testing.T) {
+	order := runBudgetPool(t, 80, 3, 3)
+	want := []string{"small0", "small1", "small2", "large"}
+	if !slices.Equal(order, want) {
+		t.Errorf("order = %q, want %q", order, want)
+	}
+}
+
+func TestWorkerPoolBudgetReservation(t *testing.T) {
+	order := runBudgetPool(t, 95, 40, byteBudgetMaxSkips)
+	if len(order) != 41 {
+		t.Fatalf("processed %d files, want 41", len(order))
+	}
+	if i := slices.Index(order, "large"); i != byteBudgetMaxSkips {
+		t.Errorf("large file was file %d, want it right after the %d small files that passed it", i+1, byteBudgetMaxSkips)
+	}
+}
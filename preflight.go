@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// preflightDestination is a bucket written with a credential profile.
+type preflightDestination struct {
+	credentials, bucket string
+}
+
+// preflightDestinations returns the buckets the sources upload to, with their credentials,
+// including the canary bucket of --canary-percent.
+func preflightDestinations(sources []*watchSource) []preflightDestination {
+	var dests []preflightDestination
+	add := func(d preflightDestination) {
+		if !slices.Contains(dests, d) {
+			dests = append(dests, d)
+		}
+	}
+	for _, src := range sources {
+		add(preflightDestination{src.Credentials, src.Bucket})
+		if cfg.CanaryPercent > 0 {
+			add(preflightDestination{src.Credentials, canaryBucketOrDefault(src)})
+		}
+	}
+	return dests
+}
+
+// requiredPermissions returns the IAM permissions on the destination buckets that the
+// configured features need.
+func requiredPermissions() []string {
+	perms := []string{"storage.objects.get"} // Every upload is verified against its object
+	if cfg.VerifyOnly {
+		return perms
+	}
+	perms = append(perms, "storage.objects.create")
+	if cfg.Dedupe != dedupeOff || cfg.DestIndex || cfg.CollisionCheck > 0 {
+		perms = append(perms, "storage.objects.list")
+	}
+	// Composite uploads and part sets remove their parts; overwriting an object replaces it
+	if cfg.CompositeThreshold > 0 || cfg.PartSets || cfg.OnConflict == conflictOverwrite || cfg.OnConflict == conflictVersion {
+		perms = append(perms, "storage.objects.delete")
+	}
+	if len(cfg.Digests) > 0 {
+		perms = append(perms, "storage.objects.update") // Streamed uploads record their digests afterwards
+	}
+	if cfg.PredefinedACL != "" || len(cfg.ACLRules) > 0 {
+		perms = append(perms, "storage.objects.setIamPolicy")
+	}
+	return perms
+}
+
+// runPreflight checks that every destination bucket exists and that its credentials
+// authenticate, impersonation included, and hold the permissions the uploads need, so a
+// broken setup fails at startup rather than on the first upload. GCS being unreachable
+// doesn't fail it: the uploads wait in the offline retry queue until it is back.
+func runPreflight(sources []*watchSource) error {
+	perms := requiredPermissions()
+	var failed []string
+	for _, d := range preflightDestinations(sources) {
+		logger := slog.With("credentials", profileName(d.credentials), "bucket", d.bucket)
+		err := checkDestination(d, perms)
+		switch {
+		case err == nil:
+			logger.Info("Preflight check passed", "permissions", perms)
+		case isUnreachable(err):
+			logger.Warn("Preflight check skipped, GCS is unreachable; uploads are queued until it is back", "error", err)
+		default:
+			logger.Error("Preflight check failed", "error", err)
+			failed = append(failed, fmt.Sprintf("gs://%s: %v", d.bucket, err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// checkDestination tests the permissions of d's credentials on its bucket. Testing
+// permissions needs none itself, so it works for accounts that may only write objects.
+func checkDestination(d preflightDestination, perms []string) (err error) {
+	client, err := clients.get(d.credentials)
+	if err != nil {
+		return fmt.Errorf("creating Google Cloud Storage client: %w", err)
+	}
+	defer func() { clients.report(client, err) }()
+	ctx, cancel := context.WithTimeout(rootCtx, 30*time.Second)
+	defer cancel()
+	granted, err := client.Bucket(d.bucket).IAM().TestPermissions(ctx, perms)
+	var apiErr *googleapi.Error
+	switch {
+	case isAuthError(err):
+		creds, _ := credentialsFor(d.credentials)
+		return fmt.Errorf("authentication failed: %w. %s", err, authRemediation(creds, err))
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+		return errors.New("bucket does not exist")
+	case err != nil:
+		return err
+	}
+	var missing []string
+	for _, p := range perms {
+		if !slices.Contains(granted, p) {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("credentials lack %s on the bucket", strings.Join(missing, ", "))
+	}
+	return nil
+}
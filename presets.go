@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// presets maps a --preset name to the settings it stands for.
+var presets = map[string]func(c *Config){
+	// Ship rotated logs, never the one being written: app.log.1 and *.gz, served as
+	// (transparently decompressed) text and named host/YYYY/MM/DD/file.
+	"logs": func(c *Config) {
+		c.Include = stringSliceFlag{"*.log.[0-9]*", "*.gz"}
+		c.ContentType = "text/plain"
+		c.GzipEncoding = true
+		c.HostPrefix = true
+		c.DatePrefix = "2006/01/02"
+	},
+}
+
+// presetNames returns the available presets, sorted.
+func presetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyPreset fills in the settings of c.Preset wherever c still has the default value,
+// so anything set in the config file or on the command line wins over the preset.
+func (c *Config) applyPreset(defaults Config) error {
+	if c.Preset == "" {
+		return nil
+	}
+	apply, ok := presets[c.Preset]
+	if !ok {
+		return fmt.Errorf("unknown preset %q (available: %s)", c.Preset, strings.Join(presetNames(), ", "))
+	}
+	preset := defaults
+	apply(&preset)
+
+	dst := reflect.ValueOf(c).Elem()
+	def := reflect.ValueOf(defaults)
+	src := reflect.ValueOf(preset)
+	for i := 0; i < dst.NumField(); i++ {
+		if reflect.DeepEqual(dst.Field(i).Interface(), def.Field(i).Interface()) {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// PreviewWidth is the width in pixels of generated preview images.
+const PreviewWidth = 480
+
+// previewExtensions lists the image and video formats previews are generated for.
+var previewExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".heic": true, ".tif": true, ".tiff": true,
+	".mp4": true, ".mov": true, ".m4v": true, ".avi": true, ".mkv": true, ".webm": true,
+}
+
+// ffmpegPath is the ffmpeg binary used for previews, found on PATH at startup.
+// Empty when --previews is off or ffmpeg is not installed.
+var ffmpegPath string
+
+// wantsPreview reports whether a preview should be generated for filePath.
+func wantsPreview(filePath string) bool {
+	return cfg.Previews && ffmpegPath != "" && previewExtensions[strings.ToLower(filepath.Ext(filePath))]
+}
+
+// previewObject returns the object name of the preview of the object named objectName.
+func previewObject(objectName string) string {
+	return path.Join(cfg.PreviewPrefix, objectName) + ".jpg"
+}
+
+// uploadPreview renders a JPEG preview of filePath with ffmpeg and uploads it next to
+// target under --preview-prefix. Failures are logged; they never affect the main upload.
+func uploadPreview(ctx context.Context, filePath string, target uploadTarget) {
+	tmp, err := os.CreateTemp("", "gcs-uploader-preview-*.jpg")
+	if err != nil {
+		slog.Error("Error creating preview file", "file", filePath, "error", err)
+		return
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	// The thumbnail filter picks a representative frame of a video; an image is its own frame
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-nostdin", "-loglevel", "error", "-y",
+		"-i", filePath, "-vf", fmt.Sprintf("thumbnail,scale=%d:-2", PreviewWidth), "-frames:v", "1", tmp.Name())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		slog.Error("Error generating preview", "file", filePath, "error", err, "output", strings.TrimSpace(string(out)))
+		return
+	}
+
+	objectName := previewObject(target.Object)
+	err = withRetries(fmt.Sprintf("uploading preview of %s", filePath), func() (err error) {
+		client, err := clients.get(target.Credentials)
+		if err != nil {
+			return fmt.Errorf("creating Google Cloud Storage client: %w", err)
+		}
+		defer func() { clients.report(client, err) }()
+		f, err := os.Open(tmp.Name())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return uploadPreviewFile(ctx, encrypted(client.Bucket(target.Bucket).Object(objectName)), f, target)
+	})
+	if err != nil {
+		slog.Error("Error uploading preview", "file", filePath, "bucket", target.Bucket, "object", objectName, "error", err)
+		return
+	}
+	slog.Info("Uploaded preview", "file", filePath, "bucket", target.Bucket, "object", objectName)
+}
+
+// uploadPreviewFile writes a preview image to obj, pointing back to the object of target it
+// previews and with the same access.
+func uploadPreviewFile(ctx context.Context, obj *storage.ObjectHandle, f *os.File, target uploadTarget) error {
+	objectWrites.wait(obj.BucketName(), obj.ObjectName())
+	wc := obj.NewWriter(ctx)
+	wc.ContentType = "image/jpeg"
+	wc.KMSKeyName = cfg.KMSKey
+	wc.Metadata = map[string]string{"preview-of": target.Object}
+	wc.PredefinedACL = target.PredefinedACL
+	if _, err := f.WriteTo(wc); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
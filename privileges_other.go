@@ -0,0 +1,132 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to username (--run-as). The state directory,
+// including the control socket, was set up as root and is handed over to the user so
+// the uploader can keep writing it.
+func dropPrivileges(username string, dir *stateDir) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid uid %q", u.Uid)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid gid %q", u.Gid)
+	}
+	if os.Geteuid() == uid {
+		return nil // Already running as that user
+	}
+	if os.Geteuid() != 0 {
+		return errors.New("only root can switch to another user")
+	}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return fmt.Errorf("looking up groups: %v", err)
+	}
+	groups := make([]int, 0, len(groupIDs))
+	for _, g := range groupIDs {
+		if id, err := strconv.Atoi(g); err == nil {
+			groups = append(groups, id)
+		}
+	}
+
+	if err := chownStateDir(dir, uid, gid); err != nil {
+		return fmt.Errorf("handing over the state directory: %v", err)
+	}
+	// Groups first: once the uid changes, the process may no longer change them
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setting groups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setting gid: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setting uid: %v", err)
+	}
+	return nil
+}
+
+// chownStateDir gives the state directory and every file in it to uid and gid.
+func chownStateDir(dir *stateDir, uid, gid int) error {
+	if dir.readOnly {
+		return nil // Left to the uploader that owns it
+	}
+	entries, err := os.ReadDir(dir.path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.Lchown(dir.file(entry.Name()), uid, gid); err != nil {
+			return err
+		}
+	}
+	return os.Lchown(dir.path, uid, gid)
+}
+
+// checkRootSources refuses to run as root on a source folder that other users can write
+// to, or, with --recursive, a folder below it: a file or symlink planted there would be
+// read, uploaded and deleted with root's privileges. --run-as or --allow-root lift the
+// check. Folders appearing later are checked as they are watched (see refusedAsRoot).
+func checkRootSources(sources []*watchSource) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	for _, src := range sources {
+		info, err := os.Stat(src.Path)
+		if err != nil {
+			continue // Reported when the folder is watched
+		}
+		if writableByOthers(info) {
+			return fmt.Errorf("refusing to run as root on source '%s', which other users can write to. Use --run-as USER, or --allow-root to run as root anyway", src.Path)
+		}
+		if !cfg.Recursive {
+			continue
+		}
+		err = filepath.WalkDir(src.Path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil // Unreadable entries are reported by the scan
+			}
+			if info, err := d.Info(); err == nil && writableByOthers(info) {
+				return fmt.Errorf("refusing to run as root on source '%s': its folder '%s' can be written to by other users. Use --run-as USER, or --allow-root to run as root anyway", src.Path, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refusedAsRoot reports whether the folder dir must be left alone because the uploader runs
+// as root, without --run-as or --allow-root, and other users can write to it.
+func refusedAsRoot(dir string) bool {
+	if os.Geteuid() != 0 || cfg.AllowRoot {
+		return false
+	}
+	info, err := os.Stat(dir)
+	return err == nil && writableByOthers(info)
+}
+
+// writableByOthers reports whether users other than root can write to the folder of info:
+// it belongs to another user, or its group or everyone may write to it.
+func writableByOthers(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return (ok && st.Uid != 0) || info.Mode().Perm()&0o022 != 0
+}
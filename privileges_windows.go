@@ -0,0 +1,19 @@
+package main
+
+import "errors"
+
+// dropPrivileges switches the process to another user (--run-as). Windows services
+// choose their account when they are installed instead.
+func dropPrivileges(username string, dir *stateDir) error {
+	return errors.New("--run-as is not supported on Windows; configure the service account instead")
+}
+
+// checkRootSources is a no-op on Windows, which has no root user.
+func checkRootSources(sources []*watchSource) error {
+	return nil
+}
+
+// refusedAsRoot is always false on Windows, which has no root user.
+func refusedAsRoot(dir string) bool {
+	return false
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// uploadProgress is the progress of one upload of at least --progress-threshold, logged
+// every --progress-interval and served on /metrics while the upload runs.
+type uploadProgress struct {
+	file   string
+	size   int64
+	start  time.Time
+	sent   atomic.Int64
+	logged time.Time // Last progress log, only touched by update
+}
+
+// uploadsInProgress holds the large uploads being sent.
+var uploadsInProgress = struct {
+	mu      sync.Mutex
+	uploads map[*uploadProgress]bool
+}{uploads: make(map[*uploadProgress]bool)}
+
+// trackProgress starts tracking the upload of filePath, of size bytes. Call done once it
+// is finished.
+func trackProgress(filePath string, size int64) *uploadProgress {
+	now := time.Now()
+	p := &uploadProgress{file: filePath, size: size, start: now, logged: now}
+	uploadsInProgress.mu.Lock()
+	uploadsInProgress.uploads[p] = true
+	uploadsInProgress.mu.Unlock()
+	return p
+}
+
+// done stops tracking the upload.
+func (p *uploadProgress) done() {
+	uploadsInProgress.mu.Lock()
+	delete(uploadsInProgress.uploads, p)
+	uploadsInProgress.mu.Unlock()
+}
+
+// update is the writer ProgressFunc: it records that sent bytes were sent and logs the
+// progress once --progress-interval has passed since it was last logged.
+func (p *uploadProgress) update(sent int64) {
+	p.sent.Store(sent)
+	if sent >= p.size || time.Since(p.logged) < cfg.ProgressInterval {
+		return
+	}
+	p.logged = time.Now()
+	rate, eta := p.estimate(sent)
+	slog.Info("Upload progress", "file", p.file, "percent", sent*100/p.size, "bytes", sent, "size", p.size,
+		"throughput", formatByteSize(int64(rate))+"/s", "eta", eta)
+}
+
+// estimate returns the average throughput in bytes per second since the upload started and
+// the time left at that rate.
+func (p *uploadProgress) estimate(sent int64) (rate float64, eta time.Duration) {
+	elapsed := time.Since(p.start).Seconds()
+	if elapsed <= 0 || sent == 0 {
+		return 0, 0
+	}
+	rate = float64(sent) / elapsed
+	return rate, time.Duration(float64(p.size-sent) / rate * float64(time.Second)).Round(time.Second)
+}
+
+// writeProgressMetrics writes the uploads in progress in the Prometheus text format, one
+// series per file.
+func writeProgressMetrics(w io.Writer) {
+	uploadsInProgress.mu.Lock()
+	uploads := make([]*uploadProgress, 0, len(uploadsInProgress.uploads))
+	for p := range uploadsInProgress.uploads {
+		uploads = append(uploads, p)
+	}
+	uploadsInProgress.mu.Unlock()
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].file < uploads[j].file })
+
+	metrics := []struct {
+		name, help string
+		value      func(p *uploadProgress, sent int64) float64
+	}{
+		{"gcs_uploader_upload_sent_bytes", "Bytes of a large upload in progress sent so far.",
+			func(p *uploadProgress, sent int64) float64 { return float64(sent) }},
+		{"gcs_uploader_upload_size_bytes", "Size of the file of a large upload in progress.",
+			func(p *uploadProgress, sent int64) float64 { return float64(p.size) }},
+		{"gcs_uploader_upload_throughput_bytes_per_second", "Average throughput of a large upload in progress.",
+			func(p *uploadProgress, sent int64) float64 { rate, _ := p.estimate(sent); return rate }},
+		{"gcs_uploader_upload_eta_seconds", "Estimated time left of a large upload in progress.",
+			func(p *uploadProgress, sent int64) float64 { _, eta := p.estimate(sent); return eta.Seconds() }},
+	}
+	sent := make([]int64, len(uploads))
+	for i, p := range uploads {
+		sent[i] = p.sent.Load()
+	}
+	fmt.Fprintf(w, "# HELP gcs_uploader_uploads_in_progress Large uploads being sent.\n# TYPE gcs_uploader_uploads_in_progress gauge\ngcs_uploader_uploads_in_progress %d\n", len(uploads))
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+		for i, p := range uploads {
+			fmt.Fprintf(w, "%s{file=\"%s\"} %g\n", m.name, metricLabelEscaper.Replace(p.file), m.value(p, sent[i]))
+		}
+	}
+}
+
+// metricLabelEscaper escapes a Prometheus label value.
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// broadRoots are folders that hold far more than anyone means to upload and delete: a
+// source may be inside them, but not one of them or a folder above them.
+func broadRoots() []string {
+	roots := []string{"/", "/Users", "/home", "/var", "/private", "/Volumes"}
+	if runtime.GOOS == "windows" {
+		drive := os.Getenv("SystemDrive") + `\`
+		roots = []string{drive, filepath.Join(drive, "Users")}
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		roots = append(roots, home)
+	}
+	return roots
+}
+
+// systemFolders hold the operating system and installed applications: no source may be
+// in or above them.
+func systemFolders() []string {
+	if runtime.GOOS == "windows" {
+		return []string{os.Getenv("SystemRoot"), os.Getenv("ProgramFiles"), os.Getenv("ProgramFiles(x86)"), os.Getenv("ProgramData")}
+	}
+	return []string{"/System", "/Library", "/Applications", "/bin", "/sbin", "/usr", "/etc", "/private/etc", "/boot", "/dev", "/proc", "/sys"}
+}
+
+// checkDangerousSource returns an error if path is a broad root or a system folder, which
+// only --i-know-what-i-am-doing allows watching.
+func checkDangerousSource(path string) error {
+	// Compare the real path, e.g. /tmp is /private/tmp on macOS
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	for _, root := range broadRoots() {
+		if pathWithin(root, path) {
+			return fmt.Errorf("source '%s' would upload and delete everything in '%s'; pick a folder below it, or pass --i-know-what-i-am-doing", path, root)
+		}
+	}
+	for _, dir := range systemFolders() {
+		if dir != "" && (pathWithin(path, dir) || pathWithin(dir, path)) {
+			return fmt.Errorf("source '%s' is a system folder ('%s'); pass --i-know-what-i-am-doing if you really mean it", path, dir)
+		}
+	}
+	return nil
+}
+
+// validateProtected refuses dangerous sources (unless --i-know-what-i-am-doing is set) and
+// checks the --protect paths.
+func validateProtected(c *Config, sources []SourceConfig) error {
+	for _, p := range c.ProtectedPaths {
+		if !filepath.IsAbs(p) {
+			return fmt.Errorf("protected path '%s' must be absolute", p)
+		}
+	}
+	if c.AllowDangerous {
+		return nil
+	}
+	for _, sc := range sources {
+		if err := checkDangerousSource(sc.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// protectedBy returns the --protect path filePath is at or below, or "" if it isn't protected.
+func protectedBy(filePath string) string {
+	for _, p := range cfg.ProtectedPaths {
+		if pathWithin(filePath, filepath.Clean(p)) {
+			return p
+		}
+	}
+	return ""
+}
+
+// pathWithin is isWithin for paths of the host's file system, which compares names without
+// regard to case on macOS and Windows, as their file systems do by default.
+func pathWithin(child, dir string) bool {
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		child, dir = strings.ToLower(child), strings.ToLower(dir)
+	}
+	return isWithin(filepath.Clean(child), filepath.Clean(dir))
+}
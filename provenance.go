@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Provenance extended attributes macOS sets on downloaded files.
+const (
+	xattrWhereFroms = "com.apple.metadata:kMDItemWhereFroms" // Binary plist: [download URL, referring page]
+	xattrQuarantine = "com.apple.quarantine"                 // "flags;hex timestamp;agent;event UUID"
+)
+
+// Object metadata keys the provenance is stored under.
+const (
+	metaWhereFrom         = "where-from"
+	metaWhereFromReferrer = "where-from-referrer"
+	metaQuarantineAgent   = "quarantine-agent"
+	metaQuarantineTime    = "quarantine-time"
+)
+
+// provenanceMetadata returns object metadata describing where filePath was downloaded from,
+// read from its macOS provenance attributes. Missing or unreadable attributes are left out.
+func provenanceMetadata(filePath string) (map[string]string, error) {
+	meta := make(map[string]string)
+	var errs []error
+
+	if data, err := readXattr(filePath, xattrWhereFroms); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %v", xattrWhereFroms, err))
+	} else if data != nil {
+		urls, err := decodePlistStrings(data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", xattrWhereFroms, err))
+		}
+		if len(urls) > 0 && urls[0] != "" {
+			meta[metaWhereFrom] = urls[0]
+		}
+		if len(urls) > 1 && urls[1] != "" {
+			meta[metaWhereFromReferrer] = urls[1]
+		}
+	}
+
+	if data, err := readXattr(filePath, xattrQuarantine); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %v", xattrQuarantine, err))
+	} else if data != nil {
+		fields := strings.Split(string(data), ";")
+		if len(fields) > 1 {
+			if secs, err := strconv.ParseInt(fields[1], 16, 64); err == nil {
+				meta[metaQuarantineTime] = time.Unix(secs, 0).UTC().Format(time.RFC3339)
+			}
+		}
+		if len(fields) > 2 && fields[2] != "" {
+			meta[metaQuarantineAgent] = fields[2]
+		}
+	}
+	return meta, errors.Join(errs...)
+}
+
+// fileProvenance returns the provenance metadata of filePath for an upload, logging
+// attributes that could not be read rather than failing the upload over them.
+func fileProvenance(filePath string) map[string]string {
+	meta, err := provenanceMetadata(filePath)
+	if err != nil {
+		slog.Error("Error reading provenance attributes", "file", filePath, "error", err)
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	slog.Debug("Captured provenance", "file", filePath, "provenance", meta)
+	return meta
+}
+
+// decodePlistStrings decodes a binary property list ("bplist00") whose top object is
+// a string or an array of strings, which is how macOS stores kMDItemWhereFroms.
+func decodePlistStrings(data []byte) ([]string, error) {
+	if len(data) < 8+32 || string(data[:8]) != "bplist00" {
+		return nil, errors.New("not a binary property list")
+	}
+	trailer := data[len(data)-32:]
+	offsetSize := int(trailer[6])
+	refSize := int(trailer[7])
+	numObjects := binary.BigEndian.Uint64(trailer[8:16])
+	topObject := binary.BigEndian.Uint64(trailer[16:24])
+	tableOffset := binary.BigEndian.Uint64(trailer[24:32])
+	if offsetSize < 1 || offsetSize > 8 || refSize < 1 || refSize > 8 || topObject >= numObjects ||
+		tableOffset > uint64(len(data)) || numObjects > (uint64(len(data))-tableOffset)/uint64(offsetSize) {
+		return nil, errors.New("malformed property list trailer")
+	}
+
+	offsetOf := func(ref uint64) (int, error) {
+		if ref >= numObjects {
+			return 0, fmt.Errorf("object reference %d out of range", ref)
+		}
+		start := int(tableOffset) + int(ref)*offsetSize
+		off := readBigEndian(data[start : start+offsetSize])
+		if off >= tableOffset {
+			return 0, fmt.Errorf("object offset %d out of range", off)
+		}
+		return int(off), nil
+	}
+
+	top, err := offsetOf(topObject)
+	if err != nil {
+		return nil, err
+	}
+	if data[top]>>4 != 0xA { // Not an array: a single string
+		s, err := decodePlistString(data, top, int(tableOffset))
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+
+	count, pos, err := plistCount(data, top, int(tableOffset))
+	if err != nil {
+		return nil, err
+	}
+	if count > (int(tableOffset)-pos)/refSize {
+		return nil, errors.New("array runs past the object table")
+	}
+	var out []string
+	for i := 0; i < count; i++ {
+		off, err := offsetOf(readBigEndian(data[pos+i*refSize : pos+(i+1)*refSize]))
+		if err != nil {
+			return out, err
+		}
+		s, err := decodePlistString(data, off, int(tableOffset))
+		if err != nil {
+			return out, err
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// decodePlistString decodes the ASCII (0x5n) or UTF-16 (0x6n) string object at off.
+func decodePlistString(data []byte, off, end int) (string, error) {
+	kind := data[off] >> 4
+	count, pos, err := plistCount(data, off, end)
+	if err != nil {
+		return "", err
+	}
+	switch kind {
+	case 0x5:
+		if count > end-pos {
+			return "", errors.New("string runs past the object table")
+		}
+		return string(data[pos : pos+count]), nil
+	case 0x6:
+		if count > (end-pos)/2 {
+			return "", errors.New("string runs past the object table")
+		}
+		units := make([]uint16, count)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(data[pos+2*i:])
+		}
+		return string(utf16.Decode(units)), nil
+	default:
+		return "", fmt.Errorf("unexpected object type 0x%x, expected a string", kind)
+	}
+}
+
+// plistCount returns the length stored in the marker of the object at off, and the position
+// of its payload. Lengths of 15 and more are stored as a following integer object.
+func plistCount(data []byte, off, end int) (int, int, error) {
+	count := int(data[off] & 0x0F)
+	pos := off + 1
+	if count != 0x0F {
+		return count, pos, nil
+	}
+	if pos >= end || data[pos]>>4 != 0x1 {
+		return 0, 0, errors.New("malformed object length")
+	}
+	size := 1 << (data[pos] & 0x0F)
+	pos++
+	if size > 8 || size > end-pos {
+		return 0, 0, errors.New("malformed object length")
+	}
+	n := readBigEndian(data[pos : pos+size])
+	if n > uint64(end) {
+		return 0, 0, errors.New("object length out of range")
+	}
+	return int(n), pos + size, nil
+}
+
+// readBigEndian decodes an unsigned big-endian integer of 1 to 8 bytes.
+func readBigEndian(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
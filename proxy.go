@@ -0,0 +1,70 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// proxySchemes are the proxy URL schemes the HTTP transport supports.
+var proxySchemes = map[string]bool{"http": true, "https": true, "socks5": true}
+
+// parseProxyURL parses --proxy. A user name in the URL authenticates to the proxy with
+// basic auth; the password is taken from the URL or, to keep it out of the config and the
+// process list, from GCS_UPLOADER_PROXY_PASSWORD.
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || !proxySchemes[u.Scheme] || u.Host == "" {
+		return nil, fmt.Errorf("proxy must be an http, https or socks5 URL, got '%s'", s)
+	}
+	if u.User != nil {
+		if _, set := u.User.Password(); !set {
+			if password := os.Getenv("GCS_UPLOADER_PROXY_PASSWORD"); password != "" {
+				u.User = url.UserPassword(u.User.Username(), password)
+			}
+		}
+	}
+	return u, nil
+}
+
+// setupProxy sends the HTTP requests of the uploader through --proxy. The requests to
+// Cloud Storage, to the token endpoints of every authentication strategy and to webhooks
+// all use transports cloned from http.DefaultTransport, so it is replaced by one with the
+// proxy. Hosts in NO_PROXY still connect directly. Without --proxy, HTTPS_PROXY, HTTP_PROXY
+// and NO_PROXY from the environment apply as usual.
+func setupProxy(c *Config) {
+	if c.Proxy == "" {
+		if p := cmp.Or(os.Getenv("HTTPS_PROXY"), os.Getenv("https_proxy")); p != "" {
+			slog.Info("Using the proxy from the environment", "proxy", redactProxy(p), "no_proxy", cmp.Or(os.Getenv("NO_PROXY"), os.Getenv("no_proxy")))
+		}
+		return
+	}
+	u, err := parseProxyURL(c.Proxy)
+	if err != nil {
+		fatal("Invalid proxy", "error", err) // Checked by validate
+	}
+	proxyConfig := &httpproxy.Config{
+		HTTPProxy:  u.String(),
+		HTTPSProxy: u.String(),
+		NoProxy:    cmp.Or(os.Getenv("NO_PROXY"), os.Getenv("no_proxy")),
+	}
+	proxyFunc := proxyConfig.ProxyFunc()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) { return proxyFunc(req.URL) }
+	http.DefaultTransport = transport
+	slog.Info("Using a proxy", "proxy", u.Redacted(), "no_proxy", proxyConfig.NoProxy)
+}
+
+// redactProxy returns the proxy URL s with its password masked, for logging.
+func redactProxy(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	return u.Redacted()
+}
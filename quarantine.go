@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// failureStreaks counts the failures of each file in a row, for --quarantine-after.
+var failureStreaks = struct {
+	mu    sync.Mutex
+	files map[string]*failureStreak
+}{files: make(map[string]*failureStreak)}
+
+type failureStreak struct {
+	failures int
+	first    time.Time
+}
+
+// failureReport is the sidecar written next to a file quarantined by --quarantine-after.
+type failureReport struct {
+	File          string    `json:"file"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+	ErrorCode     string    `json:"error_code"`
+	Error         string    `json:"error"`
+	Failures      int       `json:"failures"`
+	FirstFailure  time.Time `json:"first_failure"`
+}
+
+// quarantinable reports whether err is about the file itself. Credentials that don't work,
+// an unreachable or rate limited GCS and a bucket the uploader has no access to make every
+// file fail, so they never quarantine one; neither does a file that is gone.
+func quarantinable(err error) bool {
+	switch errorCode(err) {
+	case errCodeAuth, errCodeNetwork, errCodeQuota, errCodeNotFoundLocal:
+		return false
+	case errCodePermission:
+		return errors.Is(err, fs.ErrPermission) // Not readable locally, rather than IAM
+	}
+	return true
+}
+
+// quarantineFailed counts a failure of filePath from src and, once it failed
+// --quarantine-after times in a row, moves it below --quarantine-dir with a sidecar
+// <name>.error.json describing the failure, so it stops being retried.
+func quarantineFailed(src *watchSource, filePath string, err error) {
+	if cfg.QuarantineAfter == 0 || !quarantinable(err) {
+		return
+	}
+	failureStreaks.mu.Lock()
+	f := failureStreaks.files[filePath]
+	if f == nil {
+		f = &failureStreak{first: time.Now()}
+		failureStreaks.files[filePath] = f
+	}
+	f.failures++
+	failed := *f
+	failureStreaks.mu.Unlock()
+	if failed.failures < cfg.QuarantineAfter {
+		return
+	}
+
+	logger := slog.With("file", filePath, "failures", failed.failures)
+	dest, moveErr := archiveFile(filePath, filepath.Join(cfg.QuarantineDir, filepath.FromSlash(src.relativePath(filePath))))
+	if moveErr != nil {
+		logger.Error("Error moving repeatedly failing file to quarantine", "error", moveErr)
+		return
+	}
+	clearFailures(filePath)
+	journal.done(filePath)
+	report := failureReport{
+		File:          filePath,
+		QuarantinedAt: time.Now().UTC(),
+		ErrorCode:     errorCode(err),
+		Error:         err.Error(),
+		Failures:      failed.failures,
+		FirstFailure:  failed.first.UTC(),
+	}
+	data, _ := json.MarshalIndent(report, "", "  ")
+	if err := os.WriteFile(dest+".error.json", append(data, '\n'), 0o644); err != nil {
+		logger.Error("Error writing failure report next to quarantined file", "quarantine", dest, "error", err)
+	}
+	logger.Warn("File failed repeatedly, moved it to quarantine", "quarantine", dest, "error_code", report.ErrorCode, "error", err)
+	notifyCode(notifyFailure, report.ErrorCode, msgFileQuarantined, "file", filePath, "failures", failed.failures, "quarantine", dest, "error", err)
+	recordAudit(auditRecord{Event: auditGaveUp, File: filePath, Local: conflictQuarantine})
+}
+
+// clearFailures forgets the failures of filePath, once it was uploaded.
+func clearFailures(filePath string) {
+	failureStreaks.mu.Lock()
+	delete(failureStreaks.files, filePath)
+	failureStreaks.mu.Unlock()
+}
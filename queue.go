@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// queuedFile is a file waiting in the retry queue for GCS to become reachable again.
+type queuedFile struct {
+	Path        string    `json:"path"`
+	Credentials string    `json:"credentials,omitempty"`
+	Bucket      string    `json:"bucket"`
+	Queued      time.Time `json:"queued"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// queueContents is the content of the queue file.
+type queueContents struct {
+	Files []queuedFile `json:"files,omitempty"`
+}
+
+// offlineQueue holds the files whose upload failed because GCS could not be reached,
+// in the order they failed. While it is not empty the uploader is offline: new files are
+// queued behind the others instead of each one running through its retries. A probe
+// checks every --reconnect-interval whether GCS answers again and, once it does, the
+// queue is flushed to the workers in order.
+//
+// The queue is persisted in the state directory, so queued files survive a restart.
+type offlineQueue struct {
+	mu     sync.Mutex
+	dir    *stateDir
+	files  []queuedFile
+	queued map[string]bool
+}
+
+// retryQueue is the offline retry queue of the state directory, loaded at startup.
+var retryQueue *offlineQueue
+
+// loadOfflineQueue reads the queue file of dir.
+func loadOfflineQueue(dir *stateDir) (*offlineQueue, error) {
+	var contents queueContents
+	if err := dir.readJSON(stateQueueFile, &contents); err != nil {
+		return nil, err
+	}
+	q := &offlineQueue{dir: dir, files: contents.Files, queued: make(map[string]bool)}
+	for _, f := range q.files {
+		q.queued[f.Path] = true
+	}
+	return q, nil
+}
+
+// save persists the queue. It must be called with q.mu held.
+func (q *offlineQueue) save() {
+	if err := q.dir.writeJSON(stateQueueFile, queueContents{Files: q.files}); err != nil {
+		slog.Error("Error saving the offline retry queue", "error", err)
+	}
+}
+
+// offline reports whether files are waiting for GCS to become reachable.
+func (q *offlineQueue) offline() bool {
+	return q.len() > 0
+}
+
+// len returns the number of queued files.
+func (q *offlineQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.files)
+}
+
+// add appends filePath to the queue, unless it is queued already. failure is the error
+// that made the upload fail, or nil if the file was queued because the uploader is offline.
+func (q *offlineQueue) add(filePath string, target uploadTarget, failure error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.queued[filePath] {
+		return
+	}
+	entry := queuedFile{Path: filePath, Credentials: target.Credentials, Bucket: target.Bucket, Queued: time.Now().UTC()}
+	if failure != nil {
+		entry.Error = failure.Error()
+	}
+	q.files = append(q.files, entry)
+	q.queued[filePath] = true
+	q.save()
+	slog.Info("Queued file until GCS is reachable again", "file", filePath, "bucket", target.Bucket, "queued", len(q.files))
+}
+
+// flush empties the queue and submits its files to the workers in order. Files that are
+// gone or no longer belong to a source are dropped.
+func (q *offlineQueue) flush() {
+	q.mu.Lock()
+	files := q.files
+	q.files = nil
+	q.queued = make(map[string]bool)
+	q.save()
+	q.mu.Unlock()
+
+	for _, f := range files {
+		src := sourceOf(sources, f.Path)
+		if src == nil {
+			slog.Warn("Dropping queued file that is no longer in a watched folder", "file", f.Path)
+			continue
+		}
+		submitFile(src, f.Path)
+	}
+}
+
+// probe checks every interval whether GCS can be reached while files are queued,
+// and flushes the queue once it can. It runs for the lifetime of the process.
+func (q *offlineQueue) probe(interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		q.mu.Lock()
+		var first queuedFile
+		if len(q.files) > 0 {
+			first = q.files[0]
+		}
+		q.mu.Unlock()
+		if first.Bucket == "" {
+			continue
+		}
+		if err := probeGCS(rootCtx, first.Credentials, first.Bucket); err != nil {
+			slog.Debug("GCS is still unreachable", "error", err)
+			continue
+		}
+		slog.Info("GCS is reachable again, resuming queued uploads", "queued", q.len())
+		q.flush()
+	}
+}
+
+// probeGCS makes one cheap request to GCS. Any answer, even a refusal such as 403 for an
+// account without bucket-level permissions, proves it is reachable; only the errors that
+// would make an upload fail transiently count as unreachable.
+func probeGCS(ctx context.Context, credentials, bucket string) error {
+	client, err := clients.get(credentials)
+	if err != nil {
+		return fmt.Errorf("creating Google Cloud Storage client: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	_, err = client.Bucket(bucket).Attrs(ctx)
+	var apiErr *googleapi.Error
+	clients.report(client, err)
+	if err == nil || (errors.As(err, &apiErr) && apiErr.Code < http.StatusInternalServerError && apiErr.Code != http.StatusTooManyRequests) {
+		return nil
+	}
+	return err
+}
+
+// isUnreachable reports whether a failed upload is worth queueing until GCS is reachable:
+// any transient failure (see isRetryable) that retrying did not overcome, except a checksum
+// mismatch, which says nothing about connectivity.
+func isUnreachable(err error) bool {
+	return isRetryable(err) && !errors.Is(err, errChecksumMismatch)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log/slog"
+	"reflect"
+	"slices"
+)
+
+// reloadableSettings are the Config fields a SIGHUP reloads from the config file: the
+// filters, the notification settings, the number of parallel uploads and logging. Every
+// other setting shapes the watchers, the state or the clients, and needs a restart.
+var reloadableSettings = []string{
+	"Include", "Exclude", "WatchSubpaths", "MinFileAge", "MinSize", "MaxSize", "Producers",
+	"Notify", "SlackWebhook", "SMTPServer", "SMTPFrom", "SMTPTo", "SMTPUsername", "NotifyCommand", "MessageCatalog",
+	"Concurrency",
+	"Verbose", "LogFormat", "LogLevel",
+}
+
+// configReloader re-reads --config on SIGHUP, merged with the command line as at startup.
+type configReloader struct {
+	path     string
+	cmdline  Config          // The settings from the command line alone
+	defaults Config          // The flag defaults
+	setFlags map[string]bool // The flags set on the command line, which win over the file
+	started  Config          // The configuration the uploader started with
+}
+
+// reload loads the config file again and applies the reloadable settings that changed.
+// A config file that doesn't load or validate is rejected as a whole, keeping the current
+// settings. Changes to other settings are logged as waiting for a restart.
+func (r *configReloader) reload() {
+	slog.Info("Reloading configuration", "path", r.path)
+	file, err := loadConfigFile(r.path, r.defaults)
+	if err != nil {
+		slog.Error("Error loading config file, keeping the current configuration", "path", r.path, "error", err)
+		return
+	}
+	next := r.cmdline
+	next.overrideWith(file, r.setFlags)
+	if err := next.applyPreset(r.defaults); err != nil {
+		slog.Error("Invalid configuration, keeping the current one", "path", r.path, "error", err)
+		return
+	}
+	if err := next.validate(); err != nil {
+		slog.Error("Invalid configuration, keeping the current one", "path", r.path, "error", err)
+		return
+	}
+	include, _ := compilePathFilters(next.Include) // Checked by validate
+	exclude, _ := compilePathFilters(next.Exclude)
+
+	updated := *cfg
+	dst := reflect.ValueOf(&updated).Elem()
+	current := reflect.ValueOf(*cfg)
+	src := reflect.ValueOf(next)
+	started := reflect.ValueOf(r.started)
+	var changed, needRestart []string
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		name := field.Tag.Get("flag")
+		if name == "" {
+			name = field.Tag.Get("yaml")
+		}
+		if !slices.Contains(reloadableSettings, field.Name) {
+			if !reflect.DeepEqual(src.Field(i).Interface(), started.Field(i).Interface()) {
+				needRestart = append(needRestart, name)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(src.Field(i).Interface(), current.Field(i).Interface()) {
+			dst.Field(i).Set(src.Field(i))
+			changed = append(changed, name)
+		}
+	}
+	if len(needRestart) > 0 {
+		slog.Warn("Some changed settings only take effect after a restart", "settings", needRestart)
+	}
+	if len(changed) == 0 {
+		slog.Info("Configuration reloaded, no reloadable setting changed")
+		return
+	}
+
+	cfg = &updated
+	includeFilters, excludeFilters = include, exclude
+	setupLogging(cfg)
+	setupNotifiers(cfg)
+	if uploads != nil {
+		uploads.grow(cfg.Concurrency)
+		if !cfg.AdaptiveConcurrency {
+			uploads.setLimit(cfg.Concurrency)
+		}
+	}
+	slog.Info("Configuration reloaded", "changed", changed)
+}
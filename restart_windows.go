@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// restartProcess starts the same executable with the same arguments. Windows can't
+// replace a running process, so the caller exits once the new one has started.
+func restartProcess() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Start()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// isRetryable reports whether a failed GCS operation is worth another attempt: rate limiting (429),
+// server errors (5xx), timeouts and network failures. Auth errors are retried as well, since the
+// shared client is rebuilt with fresh credentials before the next attempt, and so are
+// checksum mismatches, whose corrupt object has been removed, and attempts that ran past
+// --upload-timeout.
+func isRetryable(err error) bool {
+	return storage.ShouldRetry(err) || isAuthError(err) || errors.Is(err, errChecksumMismatch) || errors.Is(err, errUploadTimeout)
+}
+
+// errUploadTimeout is the error of an upload attempt cut off by --upload-timeout.
+var errUploadTimeout = errors.New("upload timed out")
+
+// withUploadTimeout makes one upload attempt fn with a context that is cancelled once
+// --upload-timeout has passed, which aborts the writer of a stalled upload. An attempt cut
+// off that way fails with errUploadTimeout.
+func withUploadTimeout(ctx context.Context, fn func(ctx context.Context) error) error {
+	if cfg.UploadTimeout == 0 {
+		return fn(ctx)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, cfg.UploadTimeout)
+	defer cancel()
+	err := fn(attemptCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %v: %v", errUploadTimeout, cfg.UploadTimeout, err)
+	}
+	return err
+}
+
+// backoffDelay returns how long to wait before retry number attempt (0-based): base doubled
+// per attempt and capped at RetryMaxDelay, with jitter so that files that failed together
+// don't all retry at the same moment.
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	delay := RetryMaxDelay
+	if attempt < 32 && base<<attempt > 0 && base<<attempt < RetryMaxDelay {
+		delay = base << attempt
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// Retry policy keywords of --retry-policy.
+const (
+	retryNever   = "never"
+	retryForever = "forever"
+)
+
+// retryPolicy says how failures of one error class are retried.
+type retryPolicy struct {
+	MaxRetries int           // -1 retries forever
+	Cooldown   time.Duration // Minimum wait before each retry
+}
+
+// retryPolicyFlag maps an error code (see errorCode) to its retry policy: "never",
+// "forever" or a number of retries, optionally followed by ",cooldown=DURATION". As a flag
+// it is repeatable and takes CODE=POLICY; config files use a plain mapping.
+type retryPolicyFlag map[string]string
+
+func (f *retryPolicyFlag) String() string {
+	var parts []string
+	for code, policy := range *f {
+		parts = append(parts, code+"="+policy)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+func (f *retryPolicyFlag) Set(value string) error {
+	code, policy, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected CODE=POLICY, got '%s'", value)
+	}
+	if *f == nil {
+		*f = make(retryPolicyFlag)
+	}
+	(*f)[strings.ToUpper(code)] = policy
+	return nil
+}
+
+// parseRetryPolicy parses one policy of --retry-policy.
+func parseRetryPolicy(s string) (retryPolicy, error) {
+	count, options, _ := strings.Cut(s, ",")
+	var p retryPolicy
+	switch count {
+	case retryNever:
+	case retryForever:
+		p.MaxRetries = -1
+	default:
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("expected %s, %s or a number of retries, got '%s'", retryNever, retryForever, count)
+		}
+		p.MaxRetries = n
+	}
+	if options != "" {
+		value, ok := strings.CutPrefix(options, "cooldown=")
+		d, err := time.ParseDuration(value)
+		if !ok || err != nil || d < 0 {
+			return p, fmt.Errorf("expected cooldown=DURATION after the number of retries, got '%s'", options)
+		}
+		p.Cooldown = d
+	}
+	return p, nil
+}
+
+// validateRetryPolicies checks the error codes and policies of --retry-policy.
+func validateRetryPolicies(c *Config) error {
+	for code, policy := range c.RetryPolicies {
+		if !slices.Contains(errorCodes, code) {
+			return fmt.Errorf("retry-policy: unknown error code '%s' (expected one of %s)", code, strings.Join(errorCodes, ", "))
+		}
+		if _, err := parseRetryPolicy(policy); err != nil {
+			return fmt.Errorf("retry-policy %s: %v", code, err)
+		}
+	}
+	return nil
+}
+
+// retryPolicyFor returns how err is retried: by the --retry-policy of its error code, or
+// else up to --max-retries times if it is transient (see isRetryable) and not at all if not.
+func retryPolicyFor(err error) retryPolicy {
+	if s, ok := cfg.RetryPolicies[errorCode(err)]; ok {
+		if p, err := parseRetryPolicy(s); err == nil {
+			return p
+		}
+	}
+	if isRetryable(err) {
+		return retryPolicy{MaxRetries: cfg.MaxRetries}
+	}
+	return retryPolicy{}
+}
+
+// withRetries runs fn until it succeeds or the retry policy of its error (see
+// retryPolicyFor) gives up, sleeping with exponential backoff, or at least the policy's
+// cool-down, in between. what describes the operation for logging. Once rootCtx is
+// cancelled, the last error is returned without further attempts.
+func withRetries(what string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || rootCtx.Err() != nil {
+			return err
+		}
+		policy := retryPolicyFor(err)
+		if policy.MaxRetries >= 0 && attempt >= policy.MaxRetries {
+			return err
+		}
+		transientErrors.Add(1)
+		delay := max(backoffDelay(cfg.RetryBaseDelay, attempt), policy.Cooldown)
+		attempts := any(policy.MaxRetries + 1)
+		if policy.MaxRetries < 0 {
+			attempts = retryForever
+		}
+		slog.Warn("Transient error, retrying", "operation", what, "attempt", attempt+1, "attempts", attempts, "delay", delay.Round(time.Millisecond), "error_code", errorCode(err), "error", err)
+		select {
+		case <-time.After(delay):
+		case <-rootCtx.Done():
+			return err
+		}
+	}
+}
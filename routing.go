@@ -0,0 +1,129 @@
+package main
+
+import (
+	"hash/fnv"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Pipeline names recorded for every routed file.
+const (
+	pipelineStable = "stable"
+	pipelineCanary = "canary"
+)
+
+// hostName is this machine's host name, used by --host-prefix.
+var hostName string
+
+// uploadTarget is the destination resolved for a local file.
+type uploadTarget struct {
+	Pipeline    string // pipelineStable or pipelineCanary
+	Credentials string // Credential profile of the source, "" for the default one
+	Bucket      string
+	Object      string
+	Time        time.Time // File time, used for customTime and --date-prefix
+	TimeFrom    string    // Where Time comes from: timeFromEXIF, timeFromName or timeFromMtime
+
+	CameraModel string // From the photo's EXIF data (--use-exif)
+	ContentType string // Detected or configured Content-Type; empty lets GCS decide
+	Gzip        bool   // Compressed while uploading (--gzip)
+
+	StorageClass  string      // Empty for the bucket's default storage class
+	PredefinedACL string      // --predefined-acl or --acl-rule; empty for the bucket's default object ACL
+	ListPrefix    string      // Destination prefix of the source, listed by --dedupe and --dest-index
+	Replace       int64       // Generation of a conflicting object to overwrite (--on-conflict), or 0 to only create one
+	Hashed        *hashedFile // Checksums from the hashing pool (--hash-workers); nil hashes while uploading
+
+	// Rendered --cache-control, --content-disposition, --content-language and --metadata
+	CacheControl       string
+	ContentDisposition string
+	ContentLanguage    string
+	Metadata           map[string]string
+}
+
+// resolveTarget decides which pipeline handles filePath from src and computes its bucket and object name.
+func resolveTarget(src *watchSource, filePath string, info os.FileInfo) uploadTarget {
+	objectName := info.Name()
+	if cfg.PreservePath {
+		objectName = src.relativePath(filePath)
+	}
+	t, from := fileTime(filePath, info)
+	photo, isPhoto := photoInfo(filePath)
+	if isPhoto && !photo.CaptureTime.IsZero() {
+		t, from = photo.CaptureTime, timeFromEXIF
+	}
+	vars := objectVars{source: src.Path, relPath: src.relativePath(filePath), time: t, modTime: info.ModTime(), size: info.Size(), camera: photo.CameraModel}
+	if cfg.ObjectPrefix != "" {
+		objectName = renderObjectName(cfg.ObjectPrefix, vars, objectName)
+	}
+	if cfg.DatePrefix != "" {
+		objectName = path.Join(t.Format(cfg.DatePrefix), objectName)
+	}
+	if cfg.HostPrefix {
+		objectName = path.Join(hostName, objectName)
+	}
+	objectName = path.Join(src.Prefix, objectName)
+	// Part sets are composed from their parts as they are, so they are never compressed
+	_, partSet := info.(partSetInfo)
+	compressed := !partSet && compressesFile(src, filePath)
+	contentType := contentTypeFor(src, filePath)
+	if compressed && cfg.GzipObjects {
+		objectName += ".gz"
+		contentType = gzipContentType
+	}
+
+	target := uploadTarget{Pipeline: pipelineStable, Credentials: src.Credentials, Bucket: src.Bucket, Object: objectName, Time: t, TimeFrom: from, CameraModel: photo.CameraModel, ContentType: contentType, Gzip: compressed}
+	listPrefix := src.Prefix
+	target.PredefinedACL = aclFor(src.relativePath(filePath))
+	target.CacheControl = renderTemplate(cfg.CacheControl, vars)
+	target.ContentDisposition = renderTemplate(cfg.ContentDisposition, vars)
+	target.ContentLanguage = renderTemplate(cfg.ContentLanguage, vars)
+	if len(cfg.Metadata) > 0 {
+		target.Metadata = make(map[string]string, len(cfg.Metadata))
+		for key, value := range cfg.Metadata {
+			target.Metadata[key] = renderTemplate(value, vars)
+		}
+	}
+	if isCanaryFile(src, filePath) {
+		target.Pipeline = pipelineCanary
+		target.Bucket = canaryBucketOrDefault(src)
+		target.Object = path.Join(cfg.CanaryPrefix, objectName)
+		listPrefix = path.Join(cfg.CanaryPrefix, src.Prefix)
+	}
+	// Lifecycle rules match on the start of the name, so the TTL segment goes first
+	if prefix := ttlPrefixFor(src.relativePath(filePath)); prefix != "" {
+		target.Object = prefix + target.Object
+		listPrefix = prefix + listPrefix
+	}
+	target.ListPrefix = listingPrefix(strings.TrimSuffix(listPrefix, "/"))
+	return target
+}
+
+// isCanaryFile reports whether filePath falls into the --canary-percent share of files.
+// The choice is a hash of the path relative to the source, so a file always takes the same pipeline.
+func isCanaryFile(src *watchSource, filePath string) bool {
+	if cfg.CanaryPercent <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(src.relativePath(filePath)))
+	return int(h.Sum32()%100) < cfg.CanaryPercent
+}
+
+// canaryBucketOrDefault returns the canary bucket, falling back to the source's own bucket.
+func canaryBucketOrDefault(src *watchSource) string {
+	if cfg.CanaryBucket != "" {
+		return cfg.CanaryBucket
+	}
+	return src.Bucket
+}
+
+// listingPrefix turns a destination prefix into an object name prefix to list.
+func listingPrefix(prefix string) string {
+	if prefix == "" || prefix == "." {
+		return ""
+	}
+	return prefix + "/"
+}
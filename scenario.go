@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// scenario is an end-to-end test of the uploader with a configuration, run by `test`: the
+// uploader watches a temporary source folder and uploads to an in-memory fake of GCS, while
+// files are dropped into the folder; then the bucket and the folder are checked.
+type scenario struct {
+	Name    string           `yaml:"name"`
+	Config  string           `yaml:"config"`  // Config file of the uploader, relative to the scenario file
+	Args    []string         `yaml:"args"`    // Further flags of the uploader; ${TEST_DIR} is the temporary folder
+	Objects []scenarioObject `yaml:"objects"` // Objects in the bucket before the uploader starts
+	Setup   []scenarioStep   `yaml:"setup"`   // File changes before the uploader starts
+	Steps   []scenarioStep   `yaml:"steps"`   // File changes once the uploader watches the folder
+	Expect  scenarioExpect   `yaml:"expect"`
+	Timeout time.Duration    `yaml:"timeout"` // How long the expectations may take to be met
+	Settle  time.Duration    `yaml:"settle"`  // How long they must then keep holding
+}
+
+// scenarioStep is one change to the source folder. Paths are relative to it.
+type scenarioStep struct {
+	Write   string        `yaml:"write"` // Create or overwrite a file with Content, or Size bytes
+	Content string        `yaml:"content"`
+	Size    byteSize      `yaml:"size"`
+	Partial time.Duration `yaml:"partial"` // Write the first half, pause this long, then the rest
+	Rename  string        `yaml:"rename"`  // Move a file or folder to To
+	To      string        `yaml:"to"`
+	Mkdir   string        `yaml:"mkdir"`
+	Remove  string        `yaml:"remove"`
+	Sleep   time.Duration `yaml:"sleep"`
+}
+
+// scenarioObject is an object placed in the bucket before the start, or expected in it at
+// the end. Unset fields of an expected object, including the bucket, match anything.
+type scenarioObject struct {
+	Bucket      string            `yaml:"bucket"`
+	Name        string            `yaml:"name"`
+	Content     *string           `yaml:"content"`
+	Size        *byteSize         `yaml:"size"`
+	ContentType string            `yaml:"content_type"`
+	Metadata    map[string]string `yaml:"metadata"`
+}
+
+// scenarioExpect is the state a scenario must end in.
+type scenarioExpect struct {
+	Objects       []scenarioObject `yaml:"objects"`        // Objects that must be in the bucket
+	AbsentObjects []string         `yaml:"absent_objects"` // Object names no bucket may hold
+	Exact         bool             `yaml:"exact"`          // No other objects may have been created
+	Files         []string         `yaml:"files"`          // Local files that must still exist
+	Gone          []string         `yaml:"gone"`           // Local files that must be gone
+	ExitCode      *int             `yaml:"exit_code"`      // Exit status of the uploader, e.g. with --once
+}
+
+// Defaults of a scenario's timing. The settle time outlasts the default debounce delay, so
+// a file that shouldn't be uploaded has had its chance.
+const (
+	scenarioTimeout = time.Minute
+	scenarioSettle  = 5 * time.Second
+)
+
+// runTestCommand implements `test [-v] [-keep] SCENARIO...`: it runs each scenario file and
+// fails if any of them does.
+func runTestCommand(args []string) error {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	verbose := fs.Bool("v", false, "Show the output of the uploader.")
+	keep := fs.Bool("keep", false, "Keep the temporary folders of the scenarios.")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("usage: test [-v] [-keep] SCENARIO.yaml...")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("finding the uploader executable: %v", err)
+	}
+	failed := 0
+	for _, path := range fs.Args() {
+		start := time.Now()
+		s, err := loadScenario(path)
+		var problems []string
+		var output string
+		if err == nil {
+			problems, output, err = s.run(exe, filepath.Dir(path), *verbose, *keep)
+		}
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		name := path
+		if s != nil && s.Name != "" {
+			name = s.Name
+		}
+		if len(problems) == 0 {
+			fmt.Printf("PASS  %s (%.1fs)\n", name, time.Since(start).Seconds())
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL  %s (%.1fs)\n", name, time.Since(start).Seconds())
+		for _, p := range problems {
+			fmt.Printf("      %s\n", p)
+		}
+		if output != "" && !*verbose {
+			fmt.Printf("      --- uploader output ---\n%s", output)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d scenarios failed", failed, fs.NArg())
+	}
+	return nil
+}
+
+// loadScenario reads and checks a scenario file.
+func loadScenario(path string) (*scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &scenario{Timeout: scenarioTimeout, Settle: scenarioSettle}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(s); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("reading scenario %s: %v", path, err)
+	}
+	for _, o := range s.Objects {
+		if o.Bucket == "" || o.Name == "" {
+			return nil, fmt.Errorf("scenario %s: objects need a bucket and a name", path)
+		}
+	}
+	for _, step := range append(s.Setup, s.Steps...) {
+		if step.Rename != "" && step.To == "" {
+			return nil, fmt.Errorf("scenario %s: rename %s needs a 'to'", path, step.Rename)
+		}
+	}
+	if s.Config != "" {
+		if !filepath.IsAbs(s.Config) {
+			s.Config = filepath.Join(filepath.Dir(path), s.Config)
+		}
+		c, err := loadConfigFile(s.Config, Config{})
+		if err != nil {
+			return nil, fmt.Errorf("loading config file '%s': %v", s.Config, err)
+		}
+		if len(c.Sources) > 0 {
+			return nil, fmt.Errorf("config file '%s': scenarios replace the source folder, 'sources' is not supported", s.Config)
+		}
+	}
+	return s, nil
+}
+
+// run runs the scenario with the uploader at exe. It returns the expectations that were not
+// met and, if any, the output of the uploader.
+func (s *scenario) run(exe, scenarioDir string, verbose, keep bool) ([]string, string, error) {
+	dir, err := os.MkdirTemp("", "gcs-uploader-test-*")
+	if err != nil {
+		return nil, "", err
+	}
+	if keep {
+		fmt.Printf("      Temporary folder: %s\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+	src := filepath.Join(dir, "src")
+	if err := os.Mkdir(src, 0o755); err != nil {
+		return nil, "", err
+	}
+
+	gcs := newFakeGCS()
+	before := make(map[string]bool)
+	for _, o := range s.Objects {
+		var data []byte
+		if o.Content != nil {
+			data = []byte(*o.Content)
+		} else if o.Size != nil {
+			data = scenarioData(o.Name, int64(*o.Size))
+		}
+		attrs := make(map[string]any)
+		if o.ContentType != "" {
+			attrs["contentType"] = o.ContentType
+		}
+		if len(o.Metadata) > 0 {
+			metadata := make(map[string]any)
+			for key, value := range o.Metadata {
+				metadata[key] = value
+			}
+			attrs["metadata"] = metadata
+		}
+		gcs.put(o.Bucket, o.Name, data, attrs)
+		before[o.Bucket+"/"+o.Name] = true
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", err
+	}
+	server := &http.Server{Handler: gcs}
+	go server.Serve(listener)
+	defer server.Close()
+
+	for _, step := range s.Setup {
+		if err := step.apply(src); err != nil {
+			return nil, "", err
+		}
+	}
+
+	args := []string{"--source", src, "--state-dir", filepath.Join(dir, "state")}
+	if s.Config != "" {
+		args = append(args, "--config", s.Config)
+	}
+	for _, arg := range s.Args {
+		args = append(args, os.Expand(arg, func(name string) string {
+			if name == "TEST_DIR" {
+				return dir
+			}
+			return "${" + name + "}"
+		}))
+	}
+	out := &scenarioOutput{ready: make(chan struct{})}
+	if verbose {
+		out.echo = os.Stdout
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Dir = scenarioDir
+	cmd.Env = append(os.Environ(), "STORAGE_EMULATOR_HOST="+listener.Addr().String())
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Start(); err != nil {
+		return nil, "", fmt.Errorf("starting the uploader: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	var exitErr error
+	running := true
+
+	// Files are only dropped once the source folder is watched, or the uploader has exited
+	select {
+	case <-out.ready:
+	case exitErr = <-exited:
+		running = false
+	case <-time.After(s.Timeout):
+		cmd.Process.Kill()
+		<-exited
+		return []string{"uploader didn't start watching the source folder within " + s.Timeout.String()}, out.String(), nil
+	}
+	for _, step := range s.Steps {
+		if err := step.apply(src); err != nil {
+			if running {
+				cmd.Process.Kill()
+				<-exited
+			}
+			return nil, out.String(), err
+		}
+	}
+
+	// The expectations must be met within the timeout and then keep holding while it settles
+	deadline := time.Now().Add(s.Timeout)
+	var problems []string
+	var heldSince time.Time
+	for {
+		if running {
+			select {
+			case exitErr = <-exited:
+				running = false
+			default:
+			}
+		}
+		problems = s.Expect.unmet(gcs, before, src)
+		if len(problems) > 0 {
+			heldSince = time.Time{}
+			if time.Now().After(deadline) {
+				break
+			}
+		} else if heldSince.IsZero() {
+			heldSince = time.Now()
+		} else if time.Since(heldSince) >= s.Settle || !running {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if running {
+		// A clean shutdown, as on SIGTERM from a service manager; signals aren't supported on Windows
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			cmd.Process.Kill()
+		}
+		select {
+		case exitErr = <-exited:
+		case <-time.After(time.Minute):
+			cmd.Process.Kill()
+			exitErr = <-exited
+		}
+	}
+	if want := s.Expect.ExitCode; want != nil {
+		if code := cmd.ProcessState.ExitCode(); code != *want {
+			problems = append(problems, fmt.Sprintf("uploader exited with status %d, want %d", code, *want))
+		}
+	} else if exitErr != nil && len(problems) > 0 {
+		problems = append(problems, fmt.Sprintf("uploader exited: %v", exitErr))
+	}
+	if len(problems) == 0 {
+		return nil, "", nil
+	}
+	return problems, out.String(), nil
+}
+
+// apply makes the change of the step in the source folder src.
+func (step scenarioStep) apply(src string) error {
+	path := func(p string) string { return filepath.Join(src, filepath.FromSlash(p)) }
+	switch {
+	case step.Write != "":
+		data := []byte(step.Content)
+		if step.Content == "" && step.Size > 0 {
+			data = scenarioData(step.Write, int64(step.Size))
+		}
+		if err := os.MkdirAll(filepath.Dir(path(step.Write)), 0o755); err != nil {
+			return err
+		}
+		f, err := os.Create(path(step.Write))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if step.Partial > 0 {
+			half := len(data) / 2
+			if _, err := f.Write(data[:half]); err != nil {
+				return err
+			}
+			f.Sync()
+			time.Sleep(step.Partial)
+			data = data[half:]
+		}
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+		return f.Close()
+	case step.Rename != "":
+		if err := os.MkdirAll(filepath.Dir(path(step.To)), 0o755); err != nil {
+			return err
+		}
+		return os.Rename(path(step.Rename), path(step.To))
+	case step.Mkdir != "":
+		return os.MkdirAll(path(step.Mkdir), 0o755)
+	case step.Remove != "":
+		return os.RemoveAll(path(step.Remove))
+	case step.Sleep > 0:
+		time.Sleep(step.Sleep)
+		return nil
+	}
+	return errors.New("step without an action (write, rename, mkdir, remove or sleep)")
+}
+
+// unmet returns the expectations that don't hold. before holds the objects that were in
+// the bucket before the start, which --exact allows.
+func (e *scenarioExpect) unmet(gcs *fakeGCS, before map[string]bool, src string) []string {
+	var problems []string
+	objects := gcs.list()
+	expected := make(map[string]bool)
+	for _, want := range e.Objects {
+		var mismatch string
+		found := false
+		for _, o := range objects {
+			if o.name != want.Name || (want.Bucket != "" && o.bucket != want.Bucket) {
+				continue
+			}
+			expected[o.bucket+"/"+o.name] = true // A mismatch is reported as such, not as unexpected
+			if mismatch = want.mismatch(o); mismatch == "" {
+				found = true
+				break
+			}
+		}
+		switch {
+		case found:
+		case mismatch != "":
+			problems = append(problems, fmt.Sprintf("object %s: %s", want.Name, mismatch))
+		default:
+			problems = append(problems, fmt.Sprintf("object %s: missing", want.Name))
+		}
+	}
+	for _, o := range objects {
+		key := o.bucket + "/" + o.name
+		for _, name := range e.AbsentObjects {
+			if o.name == name {
+				problems = append(problems, fmt.Sprintf("object gs://%s: should not exist", key))
+			}
+		}
+		if e.Exact && !expected[key] && !before[key] {
+			problems = append(problems, fmt.Sprintf("object gs://%s: not expected", key))
+		}
+	}
+	for _, name := range e.Files {
+		if _, err := os.Lstat(filepath.Join(src, filepath.FromSlash(name))); err != nil {
+			problems = append(problems, fmt.Sprintf("file %s: should still exist", name))
+		}
+	}
+	for _, name := range e.Gone {
+		if _, err := os.Lstat(filepath.Join(src, filepath.FromSlash(name))); err == nil {
+			problems = append(problems, fmt.Sprintf("file %s: should be gone", name))
+		}
+	}
+	return problems
+}
+
+// mismatch describes how o differs from the expected object, or returns "" if it matches.
+func (want scenarioObject) mismatch(o fakeObject) string {
+	switch {
+	case want.Content != nil && string(o.data) != *want.Content:
+		return fmt.Sprintf("content is %q, want %q", truncate(string(o.data), 40), truncate(*want.Content, 40))
+	case want.Size != nil && int64(len(o.data)) != int64(*want.Size):
+		return fmt.Sprintf("size is %d, want %d", len(o.data), *want.Size)
+	case want.ContentType != "" && o.attrs["contentType"] != want.ContentType:
+		return fmt.Sprintf("content type is %v, want %s", o.attrs["contentType"], want.ContentType)
+	}
+	metadata, _ := o.attrs["metadata"].(map[string]any)
+	for key, value := range want.Metadata {
+		if metadata[key] != value {
+			return fmt.Sprintf("metadata %s is %v, want %s", key, metadata[key], value)
+		}
+	}
+	return ""
+}
+
+// scenarioData returns size bytes of pseudo-random data, always the same for a name, so
+// files of the same size don't deduplicate.
+func scenarioData(name string, size int64) []byte {
+	data := make([]byte, size)
+	rand.NewChaCha8(sha256.Sum256([]byte(name))).Read(data)
+	return data
+}
+
+// truncate shortens s to at most n bytes for display.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// scenarioOutput collects the output of the uploader of a scenario and closes ready once
+// the uploader watches the source folder.
+type scenarioOutput struct {
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	echo  io.Writer
+	ready chan struct{}
+	seen  bool // Whether ready is closed
+}
+
+func (o *scenarioOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.buf.Write(p)
+	if o.echo != nil {
+		o.echo.Write(p)
+	}
+	if !o.seen && (bytes.Contains(o.buf.Bytes(), []byte("Monitoring folder for file system events")) || bytes.Contains(o.buf.Bytes(), []byte("Polling folder for changes"))) {
+		o.seen = true
+		close(o.ready)
+	}
+	return len(p), nil
+}
+
+func (o *scenarioOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.String()
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Object metadata keys for the schema of data files (--sniff-schema).
+const (
+	metaSchemaFormat      = "schema-format"        // csv, tsv or parquet
+	metaSchemaColumns     = "schema-columns"       // Number of columns
+	metaSchemaHeader      = "schema-header"        // Column names, comma-separated
+	metaSchemaRows        = "schema-rows"          // Exact row count (Parquet, or a CSV read in full)
+	metaSchemaRowEstimate = "schema-rows-estimate" // Row count extrapolated from the start of a CSV file
+)
+
+// Sniffing limits: how much of a CSV file is sampled, how large a Parquet footer may be,
+// and how long the header list may grow (GCS caps custom metadata at 8 KiB per object).
+const (
+	schemaSampleSize      = 64 << 10
+	schemaMaxFooterSize   = 16 << 20
+	schemaMaxHeaderLength = 2048
+)
+
+// fileSchema returns the schema metadata of a CSV, TSV or Parquet file, or nil for other
+// files. Files that can't be sniffed are logged and uploaded without schema metadata.
+func fileSchema(filePath string) map[string]string {
+	var meta map[string]string
+	var err error
+	switch ext := strings.ToLower(filepath.Ext(filePath)); ext {
+	case ".csv":
+		meta, err = sniffCSV(filePath, ',', "csv")
+	case ".tsv":
+		meta, err = sniffCSV(filePath, '\t', "tsv")
+	case ".parquet":
+		meta, err = sniffParquet(filePath)
+	default:
+		return nil
+	}
+	if err != nil {
+		slog.Error("Error sniffing the schema", "file", filePath, "error", err)
+		return nil
+	}
+	return meta
+}
+
+// sniffCSV reads the start of a delimited text file to find its column count, its header
+// row if the first row looks like one, and an estimate of its row count.
+func sniffCSV(filePath string, delimiter rune, format string) (map[string]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sample, err := io.ReadAll(io.LimitReader(f, schemaSampleSize))
+	if err != nil {
+		return nil, err
+	}
+
+	r := csv.NewReader(bytes.NewReader(sample))
+	r.Comma = delimiter
+	r.LazyQuotes = true
+	r.FieldsPerRecord = -1
+	first, err := r.Read()
+	if errors.Is(err, io.EOF) {
+		return map[string]string{metaSchemaFormat: format, metaSchemaColumns: "0", metaSchemaRows: "0"}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	meta := map[string]string{
+		metaSchemaFormat:  format,
+		metaSchemaColumns: strconv.Itoa(len(first)),
+	}
+
+	lines := bytes.Count(sample, []byte{'\n'})
+	if len(sample) > 0 && sample[len(sample)-1] != '\n' && int64(len(sample)) == info.Size() {
+		lines++ // Last line without a trailing newline
+	}
+	if looksLikeHeader(first) {
+		meta[metaSchemaHeader] = truncateHeader(first)
+		lines--
+	}
+	if int64(len(sample)) == info.Size() {
+		meta[metaSchemaRows] = strconv.Itoa(lines)
+	} else if len(sample) > 0 {
+		meta[metaSchemaRowEstimate] = strconv.FormatInt(int64(lines)*info.Size()/int64(len(sample)), 10)
+	}
+	return meta, nil
+}
+
+// looksLikeHeader reports whether a first row holds column names rather than data:
+// every field is non-empty and none of them is a number.
+func looksLikeHeader(row []string) bool {
+	for _, field := range row {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			return false
+		}
+		if _, err := strconv.ParseFloat(field, 64); err == nil {
+			return false
+		}
+	}
+	return len(row) > 0
+}
+
+// truncateHeader joins column names with commas, cut to schemaMaxHeaderLength.
+func truncateHeader(names []string) string {
+	header := strings.Join(names, ",")
+	if len(header) > schemaMaxHeaderLength {
+		header = header[:schemaMaxHeaderLength-3] + "..."
+	}
+	return header
+}
+
+// sniffParquet reads the column names and row count from a Parquet file's footer.
+func sniffParquet(filePath string) (map[string]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// File layout: "PAR1" ... FileMetaData, 4-byte little-endian metadata length, "PAR1"
+	if info.Size() < 12 {
+		return nil, errors.New("file too small for Parquet")
+	}
+	tail := make([]byte, 8)
+	if _, err := f.ReadAt(tail, info.Size()-8); err != nil {
+		return nil, err
+	}
+	if string(tail[4:]) != "PAR1" {
+		return nil, errors.New("missing Parquet magic number")
+	}
+	size := int64(binary.LittleEndian.Uint32(tail))
+	if size > schemaMaxFooterSize || size > info.Size()-12 {
+		return nil, fmt.Errorf("invalid Parquet footer size %d", size)
+	}
+	footer := make([]byte, size)
+	if _, err := f.ReadAt(footer, info.Size()-8-size); err != nil {
+		return nil, err
+	}
+
+	columns, rows, err := parseParquetFooter(footer)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		metaSchemaFormat:  "parquet",
+		metaSchemaColumns: strconv.Itoa(len(columns)),
+		metaSchemaHeader:  truncateHeader(columns),
+		metaSchemaRows:    strconv.FormatInt(rows, 10),
+	}, nil
+}
+
+// parseParquetFooter decodes the Thrift (compact protocol) FileMetaData of a Parquet file
+// far enough to return its leaf column names and row count.
+func parseParquetFooter(data []byte) (columns []string, rows int64, err error) {
+	r := &thriftReader{data: data}
+	type schemaElement struct {
+		name     string
+		children int32
+		hasKids  bool
+	}
+	var schema []schemaElement
+
+	// FileMetaData: 2 = list<SchemaElement> schema, 3 = i64 num_rows
+	err = r.readStruct(func(id int16, typ byte) error {
+		switch {
+		case id == 2 && typ == thriftList:
+			n, elemType, err := r.readListHeader()
+			if err != nil {
+				return err
+			}
+			if elemType != thriftStruct {
+				return errors.New("unexpected schema element type")
+			}
+			for i := 0; i < n; i++ {
+				var el schemaElement
+				// SchemaElement: 4 = string name, 5 = i32 num_children
+				err := r.readStruct(func(id int16, typ byte) error {
+					switch {
+					case id == 4 && typ == thriftBinary:
+						b, err := r.readBinary()
+						el.name = string(b)
+						return err
+					case id == 5 && typ == thriftI32:
+						v, err := r.readVarint()
+						el.children, el.hasKids = int32(zigzag(v)), true
+						return err
+					}
+					return r.skip(typ)
+				})
+				if err != nil {
+					return err
+				}
+				schema = append(schema, el)
+			}
+			return nil
+		case id == 3 && typ == thriftI64:
+			v, err := r.readVarint()
+			rows = zigzag(v)
+			return err
+		}
+		return r.skip(typ)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	// The first element is the root; leaves are the elements without children
+	for i, el := range schema {
+		if i > 0 && (!el.hasKids || el.children == 0) {
+			columns = append(columns, el.name)
+		}
+	}
+	return columns, rows, nil
+}
+
+// Thrift compact protocol field types.
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftByte   = 3
+	thriftI16    = 4
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftDouble = 7
+	thriftBinary = 8
+	thriftList   = 9
+	thriftSet    = 10
+	thriftMap    = 11
+	thriftStruct = 12
+)
+
+// thriftReader decodes the subset of the Thrift compact protocol Parquet footers use.
+type thriftReader struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+var errThriftTruncated = errors.New("truncated Parquet metadata")
+
+func (r *thriftReader) readByte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, errThriftTruncated
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *thriftReader) readVarint() (uint64, error) {
+	var v uint64
+	for shift := 0; shift < 64; shift += 7 {
+		b, err := r.readByte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint64(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, errors.New("varint too long")
+}
+
+func zigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) readBinary() ([]byte, error) {
+	n, err := r.readVarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.data)-r.pos) {
+		return nil, errThriftTruncated
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+func (r *thriftReader) readListHeader() (int, byte, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	n := uint64(b >> 4)
+	if n == 15 {
+		if n, err = r.readVarint(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if n > uint64(len(r.data)-r.pos) { // Every element takes at least one byte
+		return 0, 0, errThriftTruncated
+	}
+	return int(n), b & 0x0F, nil
+}
+
+// readStruct calls field for each field of a struct until its stop marker. field must
+// consume the field's value, with skip if it isn't interested in it.
+func (r *thriftReader) readStruct(field func(id int16, typ byte) error) error {
+	r.depth++
+	defer func() { r.depth-- }()
+	if r.depth > 64 {
+		return errors.New("Parquet metadata nested too deeply")
+	}
+	var last int16
+	for {
+		b, err := r.readByte()
+		if err != nil {
+			return err
+		}
+		if b == 0 {
+			return nil
+		}
+		id := last + int16(b>>4)
+		if b>>4 == 0 {
+			v, err := r.readVarint()
+			if err != nil {
+				return err
+			}
+			id = int16(zigzag(v))
+		}
+		if err := field(id, b&0x0F); err != nil {
+			return err
+		}
+		last = id
+	}
+}
+
+// skip consumes a value of type typ.
+func (r *thriftReader) skip(typ byte) error {
+	r.depth++
+	defer func() { r.depth-- }()
+	if r.depth > 64 {
+		return errors.New("Parquet metadata nested too deeply")
+	}
+	switch typ {
+	case thriftTrue, thriftFalse:
+		return nil // The value is part of the field header
+	case thriftByte:
+		_, err := r.readByte()
+		return err
+	case thriftI16, thriftI32, thriftI64:
+		_, err := r.readVarint()
+		return err
+	case thriftDouble:
+		if len(r.data)-r.pos < 8 {
+			return errThriftTruncated
+		}
+		r.pos += 8
+		return nil
+	case thriftBinary:
+		_, err := r.readBinary()
+		return err
+	case thriftList, thriftSet:
+		n, elemType, err := r.readListHeader()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := r.skipElement(elemType); err != nil {
+				return err
+			}
+		}
+		return nil
+	case thriftMap:
+		n, err := r.readVarint()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		types, err := r.readByte()
+		if err != nil {
+			return err
+		}
+		if n > uint64(len(r.data)-r.pos) {
+			return errThriftTruncated
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := r.skipElement(types >> 4); err != nil {
+				return err
+			}
+			if err := r.skipElement(types & 0x0F); err != nil {
+				return err
+			}
+		}
+		return nil
+	case thriftStruct:
+		return r.readStruct(func(id int16, typ byte) error { return r.skip(typ) })
+	}
+	return fmt.Errorf("unknown Thrift type %d", typ)
+}
+
+// skipElement consumes a collection element of type typ. Unlike struct fields,
+// booleans in collections take a byte each.
+func (r *thriftReader) skipElement(typ byte) error {
+	if typ == thriftTrue || typ == thriftFalse {
+		_, err := r.readByte()
+		return err
+	}
+	return r.skip(typ)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// rootCtx is the context of the GCS requests of the upload pipeline. It is cancelled when
+// the shutdown timeout runs out, which aborts the uploads still in progress and their retries.
+var rootCtx, cancelRoot = context.WithCancel(context.Background())
+
+// shutdown stops the uploader on SIGINT or SIGTERM. It takes no new files, lets the files
+// being hashed or uploaded finish within --shutdown-timeout, and records the files that were
+// still waiting in the journal. An upload cut off by the timeout is cancelled and left in
+// the journal as well; either way, the next start picks the files up again.
+func shutdown(watchers []*fsnotify.Watcher) {
+	deadline := time.Now().Add(cfg.ShutdownTimeout)
+	for _, watcher := range watchers {
+		watcher.Close()
+	}
+	stopPolling()
+	waiting := cancelPendingEvents()
+
+	// Hashed files move on to the upload pool, so it is stopped last
+	finished := true
+	for _, p := range []*workerPool{hashers, uploads} {
+		if p == nil {
+			continue
+		}
+		for _, job := range p.stop() {
+			waiting = append(waiting, job.filePath)
+		}
+		if busy := p.busy(); busy > 0 {
+			slog.Info("Waiting for files in progress to finish", "pool", p.name, "files", busy, "timeout", time.Until(deadline).Round(time.Second))
+		}
+		if !p.wait(time.Until(deadline)) {
+			slog.Warn("Shutdown timeout reached, stopping files in progress", "pool", p.name, "files", p.busy())
+			cancelRoot()
+			finished = false
+		}
+	}
+	recordWaiting(waiting)
+	if finished {
+		slog.Info("Files in progress finished. Exiting.")
+	}
+}
+
+// recordWaiting records the files that were waiting to be processed in the journal, in a
+// single write. Part sets have no file of their own and are left to the initial scan, which
+// finds their parts.
+func recordWaiting(files []string) {
+	if cfg.Observe || len(files) == 0 {
+		return
+	}
+	waiting := make(map[string]os.FileInfo)
+	for _, filePath := range files {
+		if _, ok := waiting[filePath]; ok {
+			continue
+		}
+		info, err := os.Stat(filePath)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		waiting[filePath] = info
+	}
+	journal.queued(waiting)
+	slog.Info("Recorded files still waiting for upload in the journal", "files", len(waiting))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SourceConfig maps one watched folder to its upload destination.
+type SourceConfig struct {
+	Path   string `yaml:"path" toml:"path"`
+	Bucket string `yaml:"bucket" toml:"bucket"` // Defaults to the top-level bucket
+	Prefix string `yaml:"prefix" toml:"prefix"` // Object name prefix, e.g. "ingest/host1"
+
+	Credentials string `yaml:"credentials" toml:"credentials"` // Credential profile; defaults to the top-level credentials
+}
+
+// watchSource is a validated SourceConfig as used by the running pipeline.
+type watchSource struct {
+	SourceConfig
+}
+
+// sourceListFlag collects repeated --source values, each either PATH or PATH=gs://BUCKET[/PREFIX].
+// In config files `source` accepts a single string or a list of them.
+type sourceListFlag []string
+
+func (s *sourceListFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *sourceListFlag) Set(value string) error {
+	if _, err := parseSourceSpec(value); err != nil {
+		return err
+	}
+	*s = append(*s, value)
+	return nil
+}
+
+func (s *sourceListFlag) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*s = sourceListFlag{value.Value}
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
+
+func (s *sourceListFlag) UnmarshalTOML(data any) error {
+	switch v := data.(type) {
+	case string:
+		*s = sourceListFlag{v}
+	case []any:
+		*s = nil
+		for _, item := range v {
+			str, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("source entries must be strings, got %T", item)
+			}
+			*s = append(*s, str)
+		}
+	default:
+		return fmt.Errorf("source must be a string or a list of strings, got %T", data)
+	}
+	return nil
+}
+
+// parseSourceSpec parses PATH or PATH=gs://BUCKET[/PREFIX].
+func parseSourceSpec(spec string) (SourceConfig, error) {
+	i := strings.Index(spec, "=gs://")
+	if i == -1 {
+		return SourceConfig{Path: spec}, nil
+	}
+	sc := SourceConfig{Path: spec[:i]}
+	sc.Bucket, sc.Prefix, _ = strings.Cut(spec[i+len("=gs://"):], "/")
+	if sc.Path == "" || sc.Bucket == "" {
+		return sc, fmt.Errorf("invalid source %q (expected PATH or PATH=gs://BUCKET[/PREFIX])", spec)
+	}
+	return sc, nil
+}
+
+// sourceConfigs returns every configured source (from --source and the `sources` section),
+// with the top-level bucket filled in where a source doesn't name its own.
+func (c *Config) sourceConfigs() ([]SourceConfig, error) {
+	var all []SourceConfig
+	for _, spec := range c.Source {
+		sc, err := parseSourceSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, sc)
+	}
+	all = append(all, c.Sources...)
+	for i := range all {
+		if all[i].Bucket == "" {
+			all[i].Bucket = c.Bucket
+		}
+		all[i].Path = filepath.Clean(all[i].Path)
+		all[i].Prefix = strings.Trim(all[i].Prefix, "/")
+	}
+	return all, nil
+}
+
+// validateSources checks that sources are usable and don't overlap, since a file
+// watched by two pipelines would be uploaded (and deleted) twice.
+func validateSources(sources []SourceConfig) error {
+	if len(sources) == 0 {
+		return fmt.Errorf("--source parameter is required. Please specify the folder to monitor")
+	}
+	for i, a := range sources {
+		if a.Bucket == "" {
+			return fmt.Errorf("no bucket for source '%s'. Use --bucket or PATH=gs://BUCKET", a.Path)
+		}
+		for _, b := range sources[i+1:] {
+			if isWithin(a.Path, b.Path) || isWithin(b.Path, a.Path) {
+				return fmt.Errorf("sources '%s' and '%s' overlap", a.Path, b.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// isWithin reports whether child is dir itself or located below it.
+func isWithin(child, dir string) bool {
+	rel, err := filepath.Rel(dir, child)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// relativePath returns filePath relative to the source folder, using forward slashes.
+func (s *watchSource) relativePath(filePath string) string {
+	rel, err := filepath.Rel(s.Path, filePath)
+	if err != nil {
+		return filepath.ToSlash(filepath.Base(filePath))
+	}
+	return filepath.ToSlash(rel)
+}
+
+// destination renders the source's bucket and prefix as a gs:// URL for logging.
+func (s *watchSource) destination() string {
+	if s.Prefix == "" {
+		return "gs://" + s.Bucket + "/"
+	}
+	return "gs://" + s.Bucket + "/" + s.Prefix + "/"
+}
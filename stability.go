@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Stability checks --stability-check can combine.
+const (
+	stabilitySize    = "size"    // The file's size hasn't changed
+	stabilityHandles = "handles" // No other process has the file open for writing
+)
+
+// A stabilityCheck reports whether a file is still being written. One is created for each
+// file that waits for stability and asked every --stability-interval, with the file's
+// current info.
+type stabilityCheck func(filePath string, info os.FileInfo) (busy bool, err error)
+
+// stabilityChecks create the checks of --stability-check, by name.
+var stabilityChecks = map[string]func() stabilityCheck{
+	stabilitySize: func() stabilityCheck {
+		last := int64(-1)
+		return func(_ string, info os.FileInfo) (bool, error) {
+			changed := last != -1 && info.Size() != last
+			last = info.Size()
+			return changed, nil
+		}
+	},
+	stabilityHandles: func() stabilityCheck {
+		return func(filePath string, _ os.FileInfo) (bool, error) {
+			return openForWriting(filePath)
+		}
+	},
+}
+
+// validateStabilityChecks checks the comma-separated names of --stability-check and the
+// debounce and stability durations.
+func validateStabilityChecks(c *Config) error {
+	if c.Debounce < 0 {
+		return errors.New("debounce must not be negative")
+	}
+	if c.StabilityDuration < 0 {
+		return errors.New("stability-duration must not be negative")
+	}
+	if c.StabilityInterval <= 0 {
+		return fmt.Errorf("stability-interval must be positive, got %s", c.StabilityInterval)
+	}
+	names := strings.Split(c.StabilityCheck, ",")
+	for _, name := range names {
+		if stabilityChecks[name] == nil {
+			known := slices.Sorted(maps.Keys(stabilityChecks))
+			return fmt.Errorf("stability-check: unknown check '%s', expected a comma-separated list of %s", name, strings.Join(known, ", "))
+		}
+	}
+	if slices.Contains(names, stabilityHandles) {
+		if err := openHandlesSupported(); err != nil {
+			return fmt.Errorf("stability-check=%s: %v", stabilityHandles, err)
+		}
+	}
+	return nil
+}
+
+// waitForFileStability waits until none of the --stability-check checks has found the
+// file busy for duration.
+func waitForFileStability(filePath string, duration, interval time.Duration) error {
+	var checks []stabilityCheck
+	for _, name := range strings.Split(cfg.StabilityCheck, ",") {
+		checks = append(checks, stabilityChecks[name]())
+	}
+	stableStartTime := time.Now()
+
+	for {
+		fileInfo, err := os.Stat(filePath)
+		if err != nil {
+			return fmt.Errorf("could not stat file during stability check: %v", err)
+		}
+		for _, check := range checks {
+			busy, err := check(filePath, fileInfo)
+			if err != nil {
+				return fmt.Errorf("stability check: %w", err)
+			}
+			if busy {
+				// Still being written, reset stability timer
+				stableStartTime = time.Now()
+			}
+		}
+
+		if time.Since(stableStartTime) >= duration {
+			return nil // No check found the file busy for the required duration
+		}
+
+		time.Sleep(interval) // Wait for the next check
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// State directory layout. Every file lives directly under the state directory, except
+// those of a `state import` on its way into place.
+const (
+	stateSchemaFile    = "schema.json"    // Schema version of the directory contents
+	stateLedgerFile    = "ledger.jsonl"   // Uploaded-file ledger used for deduplication, appended to and compacted at startup
+	stateJournalFile   = "journal.jsonl"  // Upload journal, a log of state changes compacted at startup
+	stateQueueFile     = "queue.json"     // Durable retry queue
+	stateAuditFile     = "audit.jsonl"    // Append-only audit history, one JSON record per line
+	stateBookmarksFile = "bookmarks.json" // Security-scoped bookmarks of the source folders (macOS App Sandbox)
+	stateBaselineFile  = "baseline.json"  // Files present before --new-files-only took effect, per source folder
+	stateHeldFile      = "held.jsonl"     // Uploaded files whose removal waits for resume-deletions
+	stateControlSocket = "control.sock"   // Unix socket of the running uploader (not part of the schema)
+	stateLockFile      = "lock"           // Locked by the process using the directory (not part of the schema)
+	stateImportTmpDir  = "import.tmp"     // Files of a `state import` being staged (not part of the schema)
+	stateImportDir     = "import"         // Files of a staged `state import` being moved into place (not part of the schema)
+	stateImportFiles   = "files.json"     // In stateImportDir: names of the files the import holds
+
+	stateJournalFileV3 = "journal.json" // Upload journal up to schema 3, rewritten whole on every change
+	stateLedgerFileV4  = "ledger.json"  // Ledger up to schema 4, rewritten whole on every change
+)
+
+// currentStateSchema is the schema version this build reads and writes.
+// Bump it together with a new entry in stateMigrations.
+const currentStateSchema = 6
+
+// stateMigrations[i] upgrades a state directory from schema version i to i+1.
+var stateMigrations = []func(dir string) error{
+	// 0 -> 1: initial layout
+	func(dir string) error {
+		for _, name := range []string{stateLedgerFileV4, stateJournalFileV3, stateQueueFile} {
+			if err := writeFileAtomicIfMissing(filepath.Join(dir, name), []byte("{}\n")); err != nil {
+				return err
+			}
+		}
+		return writeFileAtomicIfMissing(filepath.Join(dir, stateAuditFile), nil)
+	},
+	// 1 -> 2: macOS security-scoped bookmarks of the source folders
+	func(dir string) error {
+		return writeFileAtomicIfMissing(filepath.Join(dir, stateBookmarksFile), []byte("{}\n"))
+	},
+	// 2 -> 3: baselines of --new-files-only
+	func(dir string) error {
+		return writeFileAtomicIfMissing(filepath.Join(dir, stateBaselineFile), []byte("{}\n"))
+	},
+	// 3 -> 4: the upload journal becomes an append-only log
+	migrateJournalLog,
+	// 4 -> 5: the ledger becomes an append-only log as well
+	migrateLedgerLog,
+	// 5 -> 6: files held by --max-deletions-per-minute
+	func(dir string) error {
+		return writeFileAtomicIfMissing(filepath.Join(dir, stateHeldFile), nil)
+	},
+}
+
+// stateSchema is the content of schema.json.
+type stateSchema struct {
+	Version int `json:"version"`
+}
+
+// errStateReadOnly is returned by the writes to a state directory opened read-only.
+var errStateReadOnly = errors.New("state directory is open read-only")
+
+// stateDir is an opened, migrated state directory.
+type stateDir struct {
+	path     string
+	lock     *os.File // Exclusive lock on stateLockFile, held for the life of the process
+	readOnly bool     // Opened by openStateDirReadOnly: writes fail with errStateReadOnly
+
+	appendMutex sync.Mutex // Serializes appends to JSON-lines files
+}
+
+// defaultStateDir returns the per-user data directory for the uploader's persistent state.
+func defaultStateDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return filepath.Join(home, "Library", "Application Support", "gcs-uploader"), nil
+	case "windows":
+		if dir := os.Getenv("LocalAppData"); dir != "" {
+			return filepath.Join(dir, "gcs-uploader"), nil
+		}
+		return filepath.Join(home, "AppData", "Local", "gcs-uploader"), nil
+	default:
+		if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+			return filepath.Join(dir, "gcs-uploader"), nil
+		}
+		return filepath.Join(home, ".local", "share", "gcs-uploader"), nil
+	}
+}
+
+// openStateDir creates the state directory if needed and migrates it to currentStateSchema.
+func openStateDir(path string) (*stateDir, error) {
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create state directory: %v", err)
+	}
+	lock, err := lockStateDir(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &stateDir{path: path, lock: lock}
+	if err := s.recoverImport(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	if err := s.migrate(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// recoverImport cleans up after a `state import` that was interrupted: files it was still
+// staging are dropped, leaving the old state as it was, and a staged import is moved into
+// place. The caller holds the lock of s.
+func (s *stateDir) recoverImport() error {
+	if err := os.RemoveAll(s.file(stateImportTmpDir)); err != nil {
+		return fmt.Errorf("could not remove an unfinished state import: %v", err)
+	}
+	if _, err := os.Stat(s.file(stateImportDir)); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	slog.Warn("Finishing an interrupted state import", "path", s.path)
+	if err := s.applyImport(); err != nil {
+		return fmt.Errorf("finishing an interrupted state import: %v", err)
+	}
+	return nil
+}
+
+// applyImport moves the files staged in stateImportDir into place, replacing the state files
+// and removing those the import doesn't hold, with schema.json last. Every step can be
+// repeated, so an interrupted move is finished by running it again. The caller holds the
+// lock of s.
+func (s *stateDir) applyImport() error {
+	var names []string
+	if err := s.readJSON(filepath.Join(stateImportDir, stateImportFiles), &names); err != nil {
+		return fmt.Errorf("could not read the files of the import: %v", err)
+	}
+	imported := make(map[string]bool, len(names))
+	for _, name := range names {
+		imported[name] = true
+	}
+	for _, name := range append(append([]string{stateHeldFile}, stateTransferFiles...), stateSchemaFile) {
+		var err error
+		if imported[name] {
+			err = os.Rename(s.file(filepath.Join(stateImportDir, name)), s.file(name))
+		} else {
+			err = os.Remove(s.file(name))
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) { // Moved or removed before an interruption
+			return err
+		}
+	}
+	if err := syncDir(s.path); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.file(stateImportDir))
+}
+
+// migrate brings the state directory up to currentStateSchema. The caller holds its lock.
+func (s *stateDir) migrate() error {
+	var schema stateSchema
+	if err := s.readJSON(stateSchemaFile, &schema); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not read state schema: %v", err)
+	}
+	if schema.Version > currentStateSchema {
+		return fmt.Errorf("state directory '%s' has schema version %d, newer than this build supports (%d)", s.path, schema.Version, currentStateSchema)
+	}
+	for schema.Version < currentStateSchema {
+		if err := stateMigrations[schema.Version](s.path); err != nil {
+			return fmt.Errorf("migrating state schema from version %d: %v", schema.Version, err)
+		}
+		schema.Version++
+		// Record each step so an interrupted upgrade resumes from the last completed migration
+		if err := s.writeJSON(stateSchemaFile, schema); err != nil {
+			return fmt.Errorf("could not record state schema version %d: %v", schema.Version, err)
+		}
+		slog.Info("Migrated state directory", "path", s.path, "schema_version", schema.Version)
+	}
+	return nil
+}
+
+// openStateDirReadOnly opens the state directory at path for the modes that only read it
+// (explain, --observe and --verify-only), so they can run next to the uploader holding
+// its lock: it neither takes the lock nor migrates. A missing directory is created first,
+// as no uploader can be using it yet.
+func openStateDirReadOnly(path string) (*stateDir, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		s, err := openStateDir(path)
+		if err != nil {
+			return nil, err
+		}
+		s.lock.Close()
+	}
+	s, version, err := readStateDir(path)
+	if err != nil {
+		return nil, err
+	}
+	if version < currentStateSchema {
+		return nil, fmt.Errorf("state directory '%s' has schema version %d; run the uploader once in upload mode to migrate it to %d", path, version, currentStateSchema)
+	}
+	s.readOnly = true
+	return s, nil
+}
+
+// lockStateDir takes the exclusive lock of the state directory at path, so that no two
+// processes read and write it at once. It fails right away if another process holds it.
+func lockStateDir(path string) (*os.File, error) {
+	name := filepath.Join(path, stateLockFile)
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open state lock: %v", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("state directory '%s' is in use by another process, such as a running uploader (%v); stop it or use another --state-dir", path, err)
+	}
+	return f, nil
+}
+
+// readStateDir opens the existing state directory at path without creating or migrating
+// anything, for commands that only read it, and returns its schema version.
+func readStateDir(path string) (*stateDir, int, error) {
+	if info, err := os.Stat(path); err != nil {
+		return nil, 0, fmt.Errorf("could not open state directory: %v", err)
+	} else if !info.IsDir() {
+		return nil, 0, fmt.Errorf("state directory '%s' is not a directory", path)
+	}
+	s := &stateDir{path: path}
+	if _, err := os.Stat(s.file(stateImportDir)); err == nil {
+		return nil, 0, fmt.Errorf("state directory '%s' holds an interrupted state import; run the uploader in upload mode once to finish it", path)
+	}
+	var schema stateSchema
+	if err := s.readJSON(stateSchemaFile, &schema); errors.Is(err, os.ErrNotExist) {
+		return nil, 0, fmt.Errorf("'%s' is not a state directory: it has no %s", path, stateSchemaFile)
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("could not read state schema: %v", err)
+	}
+	if schema.Version > currentStateSchema {
+		return nil, 0, fmt.Errorf("state directory '%s' has schema version %d, newer than this build supports (%d)", path, schema.Version, currentStateSchema)
+	}
+	return s, schema.Version, nil
+}
+
+// file returns the full path of a file inside the state directory.
+func (s *stateDir) file(name string) string {
+	return filepath.Join(s.path, name)
+}
+
+// readJSON decodes the named state file into v.
+func (s *stateDir) readJSON(name string, v any) error {
+	data, err := os.ReadFile(s.file(name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSON atomically replaces the named state file with the JSON encoding of v.
+func (s *stateDir) writeJSON(name string, v any) error {
+	if s.readOnly {
+		return errStateReadOnly
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.file(name), append(data, '\n'))
+}
+
+// appendJSONLine appends the JSON encoding of v as one line to the named state file and syncs it.
+func (s *stateDir) appendJSONLine(name string, v any) error {
+	return s.appendJSONLines(name, []any{v})
+}
+
+// appendJSONLines appends the JSON encoding of each record as a line to the named state
+// file in a single write, and syncs it.
+func (s *stateDir) appendJSONLines(name string, records []any) error {
+	if s.readOnly {
+		return errStateReadOnly
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	s.appendMutex.Lock()
+	defer s.appendMutex.Unlock()
+
+	f, err := os.OpenFile(s.file(name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readJSONLines calls fn with every line of the named JSON-lines state file. A last line
+// cut short by a crash while it was appended is skipped.
+func (s *stateDir) readJSONLines(name string, fn func(line []byte) error) error {
+	data, err := os.ReadFile(s.file(name))
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if err := fn(line); err != nil {
+			if i == len(lines)-1 {
+				slog.Warn("Ignoring incomplete last line of state file", "file", s.file(name), "error", err)
+				return nil
+			}
+			return fmt.Errorf("line %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// writeJSONLines atomically replaces the named state file with the JSON encoding of each
+// record on a line of its own.
+func (s *stateDir) writeJSONLines(name string, records []any) error {
+	if s.readOnly {
+		return errStateReadOnly
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(s.file(name), buf.Bytes())
+}
+
+// writeFileAtomic writes data to a temporary file, syncs it and renames it over path,
+// so readers (and a crash at any point) see either the old or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once the rename succeeded
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// writeFileAtomicIfMissing creates path with data unless it already exists.
+func writeFileAtomicIfMissing(path string, data []byte) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// syncDir flushes directory metadata (such as a rename) to disk where the platform supports it.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateExportFormat identifies files produced by `state export`.
+const stateExportFormat = "gcs-uploader-state"
+
+// stateExportFiles lists the state files carried over by `state export` / `state import`.
+// Bookmarks are left out: they only resolve for the app and machine that created them.
+var stateExportFiles = []string{stateLedgerFile, stateJournalFile, stateQueueFile, stateAuditFile, stateBaselineFile}
+
+// stateTransferFiles are the files export and import carry over: stateExportFiles, and those
+// of older schemas, which the migrations convert after an import.
+var stateTransferFiles = append([]string{stateJournalFileV3, stateLedgerFileV4}, stateExportFiles...)
+
+// stateExport is the portable representation of a state directory.
+type stateExport struct {
+	Format        string            `json:"format"`
+	SchemaVersion int               `json:"schema_version"`
+	ExportedAt    time.Time         `json:"exported_at"`
+	Hostname      string            `json:"hostname,omitempty"`
+	Files         map[string]string `json:"files"`
+}
+
+// runStateCommand implements `state export FILE` and `state import FILE`.
+func runStateCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: state export|import [--state-dir DIR] [--force] FILE")
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("state "+action, flag.ExitOnError)
+	dir := fs.String("state-dir", "", "Directory for persistent state (defaults to the platform data directory).")
+	force := fs.Bool("force", false, "import: replace existing state instead of refusing.")
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: state %s [--state-dir DIR] [--force] FILE", action)
+	}
+	file := fs.Arg(0)
+
+	if *dir == "" {
+		var err error
+		if *dir, err = defaultStateDir(); err != nil {
+			return fmt.Errorf("could not determine default state directory: %v", err)
+		}
+	}
+
+	switch action {
+	case "export":
+		return exportState(*dir, file)
+	case "import":
+		return importState(*dir, file, *force)
+	default:
+		return fmt.Errorf("unknown state command %q (expected export or import)", action)
+	}
+}
+
+// exportState writes every state file of dir into a single JSON document at file. dir is
+// only read: it is neither created nor migrated, so the export has the schema it was left in.
+func exportState(dir, file string) error {
+	s, version, err := readStateDir(dir)
+	if err != nil {
+		return err
+	}
+	export := stateExport{
+		Format:        stateExportFormat,
+		SchemaVersion: version,
+		ExportedAt:    time.Now().UTC(),
+		Files:         make(map[string]string),
+	}
+	export.Hostname, _ = os.Hostname()
+	for _, name := range stateTransferFiles {
+		data, err := os.ReadFile(s.file(name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("could not read %s: %v", name, err)
+		}
+		export.Files[name] = string(data)
+	}
+
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(file, append(data, '\n')); err != nil {
+		return fmt.Errorf("could not write export file: %v", err)
+	}
+	log.Printf("Exported state from '%s' (schema version %d) to '%s'.", dir, version, file)
+	return nil
+}
+
+// importState restores the state files from an export into dir and migrates them to the
+// current schema, holding the lock of dir throughout. The files are staged first and only
+// then moved into place (see stateDir.applyImport), so a crash leaves either the old state
+// or a staged import that the next start finishes.
+func importState(dir, file string, force bool) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("could not read export file: %v", err)
+	}
+	var export stateExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return fmt.Errorf("could not parse export file: %v", err)
+	}
+	if export.Format != stateExportFormat {
+		return fmt.Errorf("'%s' is not a state export (format %q)", file, export.Format)
+	}
+	if export.SchemaVersion > currentStateSchema {
+		return fmt.Errorf("export has schema version %d, newer than this build supports (%d)", export.SchemaVersion, currentStateSchema)
+	}
+
+	s := &stateDir{path: dir}
+	if _, err := os.Stat(s.file(stateSchemaFile)); err == nil && !force {
+		return fmt.Errorf("state directory '%s' already exists; use --force to replace it", dir)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("could not create state directory: %v", err)
+	}
+	lock, err := lockStateDir(dir)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	s.lock = lock
+	if err := s.recoverImport(); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(s.file(stateImportTmpDir), 0o700); err != nil {
+		return fmt.Errorf("could not stage the import: %v", err)
+	}
+	staged := []string{stateSchemaFile}
+	if err := s.writeJSON(filepath.Join(stateImportTmpDir, stateSchemaFile), stateSchema{Version: export.SchemaVersion}); err != nil {
+		return err
+	}
+	for _, name := range stateTransferFiles {
+		content, ok := export.Files[name]
+		if !ok {
+			continue
+		}
+		if err := writeFileAtomic(s.file(filepath.Join(stateImportTmpDir, name)), []byte(content)); err != nil {
+			return fmt.Errorf("could not write %s: %v", name, err)
+		}
+		staged = append(staged, name)
+	}
+	if err := s.writeJSON(filepath.Join(stateImportTmpDir, stateImportFiles), staged); err != nil {
+		return err
+	}
+	// From here on the import is complete on disk, and an interrupted move is finished at the next start
+	if err := os.Rename(s.file(stateImportTmpDir), s.file(stateImportDir)); err != nil {
+		return fmt.Errorf("could not stage the import: %v", err)
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	if err := s.applyImport(); err != nil {
+		return fmt.Errorf("could not move the imported files into place: %v", err)
+	}
+	// Still under the same lock, let the normal migrations bring it up to date
+	if err := s.migrate(); err != nil {
+		return err
+	}
+	log.Printf("Imported state exported from '%s' at %s into '%s'.", export.Hostname, export.ExportedAt.Format(time.RFC3339), dir)
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// storageClasses lists the GCS storage classes objects can be uploaded with.
+var storageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE"}
+
+// parseStorageClass normalizes a storage class name and checks that it exists.
+func parseStorageClass(class string) (string, error) {
+	upper := strings.ToUpper(strings.TrimSpace(class))
+	for _, c := range storageClasses {
+		if upper == c {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("unknown storage class %q (expected one of %s)", class, strings.Join(storageClasses, ", "))
+}
+
+// sizeRule uploads files of at least minSize bytes with storage class class.
+type sizeRule struct {
+	minSize int64
+	class   string
+}
+
+// sizeRulesFlag holds storage class tiers by file size. As a flag it is repeatable and
+// takes SIZE=CLASS (e.g., 1GB=NEARLINE); config files use a mapping of size to class.
+// Kept sorted by decreasing size, so the first rule a file reaches applies.
+type sizeRulesFlag []sizeRule
+
+func (r *sizeRulesFlag) String() string {
+	var parts []string
+	for _, rule := range *r {
+		parts = append(parts, formatByteSize(rule.minSize)+"="+rule.class)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r *sizeRulesFlag) Set(value string) error {
+	size, class, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("%q is not in SIZE=CLASS form", value)
+	}
+	return r.add(size, class)
+}
+
+func (r *sizeRulesFlag) add(size, class string) error {
+	n, err := parseByteSize(size)
+	if err != nil {
+		return err
+	}
+	c, err := parseStorageClass(class)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, sizeRule{minSize: n, class: c})
+	sort.SliceStable(*r, func(i, j int) bool { return (*r)[i].minSize > (*r)[j].minSize })
+	return nil
+}
+
+func (r *sizeRulesFlag) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: expected a mapping of size: storage class", node.Line)
+	}
+	*r = nil
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if err := r.add(node.Content[i].Value, node.Content[i+1].Value); err != nil {
+			return fmt.Errorf("line %d: %v", node.Content[i].Line, err)
+		}
+	}
+	return nil
+}
+
+func (r *sizeRulesFlag) UnmarshalTOML(data any) error {
+	m, ok := data.(map[string]any)
+	if !ok {
+		return fmt.Errorf("expected a table of size = storage class, got %T", data)
+	}
+	*r = nil
+	for size, v := range m {
+		class, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("storage class for %q must be a string, got %T", size, v)
+		}
+		if err := r.add(size, class); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup returns the storage class for a file of size bytes, if a tier applies.
+func (r sizeRulesFlag) lookup(size int64) (string, bool) {
+	for _, rule := range r {
+		if size >= rule.minSize {
+			return rule.class, true
+		}
+	}
+	return "", false
+}
+
+// storageClassFor returns the storage class a file is uploaded with, given its path
+// relative to the source folder and its size: the first matching --storage-class-rule,
+// then the --storage-class-by-size tiers, then --storage-class. "" means the bucket's default.
+func storageClassFor(rel string, size int64) string {
+	if class, ok := cfg.StorageClassRules.lookup(rel); ok {
+		return class
+	}
+	if class, ok := cfg.StorageClassBySize.lookup(size); ok {
+		return class
+	}
+	return cfg.StorageClass
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --telemetry modes.
+const (
+	telemetryOff = "off"
+	telemetryOn  = "on"
+)
+
+// processStart is when the uploader started, for the uptime in telemetry reports.
+var processStart = time.Now()
+
+// telemetryReport is what --telemetry on sends: anonymous aggregates that say which
+// features are used and which errors happen, never file names, paths, buckets, hosts or
+// any other configured value.
+type telemetryReport struct {
+	Version   string           `json:"version"`
+	OS        string           `json:"os"`
+	Arch      string           `json:"arch"`
+	GoVersion string           `json:"go_version"`
+	Sources   int              `json:"sources"`        // Number of source folders
+	Features  []string         `json:"features"`       // Settings changed from their defaults, by name only
+	Uptime    int64            `json:"uptime_seconds"` // Since the start
+	Files     map[string]int64 `json:"files"`          // Files by audit event since the start, e.g. uploaded
+	Errors    map[string]int64 `json:"errors"`         // Failed files by error code since the start
+}
+
+// telemetryEvents counts the audit events since the start, for telemetry reports.
+var telemetryEvents = struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}{counts: make(map[string]int64)}
+
+// countTelemetryEvent counts one audit event.
+func countTelemetryEvent(event string) {
+	telemetryEvents.mu.Lock()
+	defer telemetryEvents.mu.Unlock()
+	telemetryEvents.counts[event]++
+}
+
+// newTelemetryReport returns the report for the configuration c, whose defaults are defaults,
+// with the counts since the start.
+func newTelemetryReport(c *Config, defaults Config) telemetryReport {
+	sources, _ := c.sourceConfigs() // Checked by validate
+	telemetryEvents.mu.Lock()
+	files := maps.Clone(telemetryEvents.counts)
+	telemetryEvents.mu.Unlock()
+	return telemetryReport{
+		Version:   version,
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		GoVersion: runtime.Version(),
+		Sources:   len(sources),
+		Features:  changedSettings(c, defaults),
+		Uptime:    int64(time.Since(processStart).Seconds()),
+		Files:     files,
+		Errors:    failureCounts(),
+	}
+}
+
+// changedSettings returns the names of the settings of c that differ from defaults, sorted:
+// the flag name, or the config file key of settings without a flag. The telemetry settings
+// themselves are left out.
+func changedSettings(c *Config, defaults Config) []string {
+	cur := reflect.ValueOf(*c)
+	def := reflect.ValueOf(defaults)
+	features := []string{}
+	for i := 0; i < cur.NumField(); i++ {
+		field := cur.Type().Field(i)
+		name := field.Tag.Get("flag")
+		if name == "" {
+			name, _, _ = strings.Cut(field.Tag.Get("yaml"), ",")
+		}
+		if name == "" || strings.HasPrefix(name, "telemetry") {
+			continue
+		}
+		if !reflect.DeepEqual(cur.Field(i).Interface(), def.Field(i).Interface()) {
+			features = append(features, name)
+		}
+	}
+	slices.Sort(features)
+	return features
+}
+
+// telemetryURL returns where reports are sent: --telemetry-url or the built-in endpoint.
+func telemetryURL(c *Config) string {
+	if c.TelemetryURL != "" {
+		return c.TelemetryURL
+	}
+	return telemetryEndpoint
+}
+
+// validateTelemetry checks --telemetry and where its reports go.
+func validateTelemetry(c *Config) error {
+	switch c.Telemetry {
+	case telemetryOff:
+		return nil
+	case telemetryOn:
+	default:
+		return fmt.Errorf("telemetry must be 'off' or 'on', got %q", c.Telemetry)
+	}
+	if telemetryURL(c) == "" {
+		return errors.New("this build has no telemetry endpoint; --telemetry on needs --telemetry-url")
+	}
+	if !strings.HasPrefix(telemetryURL(c), "https://") && !strings.HasPrefix(telemetryURL(c), "http://") {
+		return fmt.Errorf("telemetry-url must be an http(s) URL, got %q", c.TelemetryURL)
+	}
+	if c.TelemetryInterval <= 0 {
+		return errors.New("telemetry-interval must be positive")
+	}
+	return nil
+}
+
+// startTelemetry sends a report every --telemetry-interval with --telemetry on. Failures are
+// only logged at debug level: telemetry never gets in the way of uploading.
+func startTelemetry(defaults Config) {
+	if cfg.Telemetry != telemetryOn {
+		return
+	}
+	slog.Info("Sending anonymous usage statistics (--telemetry on); see them with 'telemetry show'", "url", telemetryURL(cfg), "interval", cfg.TelemetryInterval)
+	go func() {
+		ticker := time.NewTicker(cfg.TelemetryInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := sendTelemetry(telemetryURL(cfg), newTelemetryReport(cfg, defaults)); err != nil {
+				slog.Debug("Error sending telemetry report", "error", err)
+			}
+		}
+	}()
+}
+
+// sendTelemetry posts report as JSON to url.
+func sendTelemetry(url string, report telemetryReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("telemetry endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// runTelemetryShow implements `telemetry show [flags]`: it prints the report the uploader
+// would send with the same flags, with the counts of a fresh start, and where it would go.
+func runTelemetryShow(c *Config, defaults Config) {
+	data, err := json.MarshalIndent(newTelemetryReport(c, defaults), "", "  ")
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if c.Telemetry == telemetryOn {
+		fmt.Fprintf(os.Stderr, "Telemetry is on. Every %s, a report like this is sent to %s:\n", c.TelemetryInterval, telemetryURL(c))
+	} else {
+		fmt.Fprintln(os.Stderr, "Telemetry is off, nothing is sent. With --telemetry on, this report would be sent:")
+	}
+	fmt.Println(string(data))
+}
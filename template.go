@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// templateVarRegexp matches a {variable} in a template (--object-prefix, --metadata, ...).
+var templateVarRegexp = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// objectVars is what a per-file template is rendered from.
+type objectVars struct {
+	source  string    // Source folder
+	relPath string    // Path relative to the source folder, with forward slashes
+	time    time.Time // File time (see fileTime)
+	modTime time.Time
+	size    int64
+	camera  string // Camera model from the EXIF data (--use-exif); empty if there is none
+}
+
+// templateVars maps each variable a template may use to its value.
+var templateVars = map[string]func(v objectVars) string{
+	"date":     func(v objectVars) string { return v.time.Format("2006-01-02") },
+	"year":     func(v objectVars) string { return v.time.Format("2006") },
+	"month":    func(v objectVars) string { return v.time.Format("01") },
+	"day":      func(v objectVars) string { return v.time.Format("02") },
+	"hour":     func(v objectVars) string { return v.time.Format("15") },
+	"hostname": func(v objectVars) string { return hostName },
+	"uuid":     func(v objectVars) string { return fileUUID(v).String() },
+	"source":   func(v objectVars) string { return filepath.Base(v.source) },
+	"relpath":  func(v objectVars) string { return v.relPath },
+	"reldir":   func(v objectVars) string { return path.Dir(v.relPath) },
+	"name":     func(v objectVars) string { return path.Base(v.relPath) },
+	"ext":      func(v objectVars) string { return strings.TrimPrefix(path.Ext(v.relPath), ".") },
+	"mtime":    func(v objectVars) string { return v.modTime.UTC().Format(time.RFC3339) },
+	"size":     func(v objectVars) string { return strconv.FormatInt(v.size, 10) },
+	"camera":   func(v objectVars) string { return cameraName(v.camera) },
+}
+
+// cameraName returns the {camera} of a file: its camera model as a single path segment, or
+// "unknown" for files that aren't photos or don't record one.
+func cameraName(model string) string {
+	if model == "" {
+		return "unknown"
+	}
+	return strings.ReplaceAll(model, "/", "-")
+}
+
+// fileUUIDNamespace is the namespace of the name-based UUIDs of fileUUID.
+var fileUUIDNamespace = uuid.MustParse("cd228131-1542-45cd-ae53-43f70c4e548d")
+
+// fileUUID returns the {uuid} of a file: derived from the host, its path, size and
+// modification time rather than random, so the retries of a file and the previews of
+// explain and the collision check agree on its name, while a changed file gets a new one.
+func fileUUID(v objectVars) uuid.UUID {
+	name := fmt.Sprintf("%s\x00%s\x00%d\x00%d", hostName, filepath.Join(v.source, v.relPath), v.size, v.modTime.UnixNano())
+	return uuid.NewSHA1(fileUUIDNamespace, []byte(name))
+}
+
+// validateTemplate checks that a template only uses known variables.
+func validateTemplate(tmpl string) error {
+	for _, m := range templateVarRegexp.FindAllStringSubmatch(tmpl, -1) {
+		if _, ok := templateVars[m[1]]; !ok {
+			return fmt.Errorf("unknown variable {%s}", m[1])
+		}
+	}
+	return nil
+}
+
+// templateNamesFile reports whether a template places the file's own name, path or extension
+// itself, in which case it is the whole object name rather than a prefix.
+func templateNamesFile(tmpl string) bool {
+	return strings.Contains(tmpl, "{name}") || strings.Contains(tmpl, "{relpath}") || strings.Contains(tmpl, "{ext}")
+}
+
+// renderObjectName applies the --object-prefix template to objectName, the name the file
+// would get without it.
+func renderObjectName(tmpl string, vars objectVars, objectName string) string {
+	rendered := renderTemplate(tmpl, vars)
+	if templateNamesFile(tmpl) {
+		return path.Clean(rendered)
+	}
+	return path.Join(rendered, objectName)
+}
+
+// renderTemplate replaces the variables of tmpl with their values for a file.
+func renderTemplate(tmpl string, vars objectVars) string {
+	return templateVarRegexp.ReplaceAllStringFunc(tmpl, func(m string) string {
+		return templateVars[m[1:len(m)-1]](vars)
+	})
+}
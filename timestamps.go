@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Sources of a file's time, in order of precedence.
+const (
+	timeFromEXIF  = "exif"  // Capture time of a photo (--use-exif)
+	timeFromName  = "name"  // Timestamp in the file name (--filename-time-pattern)
+	timeFromMtime = "mtime" // Modification time
+)
+
+// filenameTimeRegexp is the compiled --filename-time-pattern, or nil when not configured.
+var filenameTimeRegexp *regexp.Regexp
+
+// compileFilenameTimePattern compiles a --filename-time-pattern and checks that it
+// extracts at most one piece of the name (the first capture group, or the whole match).
+func compileFilenameTimePattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if re.NumSubexp() > 1 {
+		return nil, fmt.Errorf("pattern has %d capture groups, expected at most one", re.NumSubexp())
+	}
+	return re, nil
+}
+
+// filenameTime parses the timestamp embedded in the base name of filePath, such as
+// 20240131_123456 in IMG_20240131_123456.jpg, in the local time zone.
+func filenameTime(filePath string) (time.Time, bool) {
+	if filenameTimeRegexp == nil {
+		return time.Time{}, false
+	}
+	m := filenameTimeRegexp.FindStringSubmatch(filepath.Base(filePath))
+	if m == nil {
+		return time.Time{}, false
+	}
+	value := m[len(m)-1]
+	t, err := time.ParseInLocation(cfg.FilenameTimeLayout, value, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// fileTime returns when the file's content was created and where that came from: the
+// timestamp in its name if --filename-time-pattern matches, otherwise its modification time.
+func fileTime(filePath string, info os.FileInfo) (time.Time, string) {
+	if t, ok := filenameTime(filePath); ok {
+		return t, timeFromName
+	}
+	return info.ModTime(), timeFromMtime
+}
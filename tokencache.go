@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// keychainTokenService is the keystore service cached access tokens are stored under, one
+// item per credential profile (see --cache-tokens).
+const keychainTokenService = "gcp-file-sync-access-token"
+
+// cachedADCTypes are the Application Default Credentials file types whose tokens are worth
+// caching: each new token costs a call to the STS or IAM credentials API.
+var cachedADCTypes = map[string]bool{
+	"external_account":                 true, // Workload or workforce identity federation
+	"external_account_authorized_user": true, // Workforce identity federation via gcloud
+	"impersonated_service_account":     true,
+}
+
+// tokenCacheAccount returns the keystore account the token of creds is cached under. It
+// names what the token was issued for, so a changed profile never picks up a stale token.
+func tokenCacheAccount(profile string, creds resolvedCredentials) string {
+	if creds.Strategy == authImpersonation {
+		return profileName(profile) + "/" + creds.ImpersonateSA
+	}
+	return profileName(profile) + "/" + creds.Strategy
+}
+
+// cachingTokenSource gets tokens from base and stores each new one in the keystore.
+type cachingTokenSource struct {
+	base    oauth2.TokenSource
+	account string
+}
+
+func (s *cachingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.base.Token()
+	if err != nil {
+		return nil, err
+	}
+	if err := storeCachedToken(s.account, token); err != nil {
+		slog.Warn("Error caching access token in the keystore", "keystore", keystore.Name(), "keychain_account", s.account, "error", err)
+	}
+	return token, nil
+}
+
+// withTokenCache wraps base so that it starts from the token cached under account, if it is
+// still valid, and caches the tokens it gets from then on. Rapid restarts then reuse one
+// token instead of each asking the IAM credentials or STS API for a new one.
+func withTokenCache(base oauth2.TokenSource, account string) oauth2.TokenSource {
+	cached, err := loadCachedToken(account)
+	if err == nil && cached.Valid() {
+		slog.Debug("Using cached access token", "keychain_account", account, "expiry", cached.Expiry.Format(time.RFC3339))
+	} else {
+		cached = nil
+	}
+	return oauth2.ReuseTokenSource(cached, &cachingTokenSource{base: base, account: account})
+}
+
+// cacheableADCTokenSource returns the token source of Application Default Credentials if they
+// are federated or impersonated, or nil for other credentials, which keep the default setup.
+func cacheableADCTokenSource(ctx context.Context) oauth2.TokenSource {
+	creds, err := google.FindDefaultCredentials(ctx, storage.ScopeFullControl)
+	if err != nil || creds.JSON == nil {
+		return nil // E.g. the metadata server, whose tokens are free
+	}
+	var file struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(creds.JSON, &file) != nil || !cachedADCTypes[file.Type] {
+		return nil
+	}
+	return creds.TokenSource
+}
+
+// storeCachedToken saves token in the keystore under account.
+func storeCachedToken(account string, token *oauth2.Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return keystore.Set(keychainTokenService, account, data)
+}
+
+// loadCachedToken reads the token cached under account.
+func loadCachedToken(account string) (*oauth2.Token, error) {
+	data, err := keystore.Get(keychainTokenService, account)
+	if err != nil {
+		return nil, err
+	}
+	var token oauth2.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// forgetCachedToken removes the token cached for a credential profile, after the API
+// rejected it, so the next client asks for a new one.
+func forgetCachedToken(profile string) {
+	creds, err := credentialsFor(profile)
+	if err != nil {
+		return
+	}
+	keystore.Delete(keychainTokenService, tokenCacheAccount(profile, creds))
+}
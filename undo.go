@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// runUndo implements `undo [flags] PATH...`: it downloads files that were uploaded and then
+// deleted or moved within --undo-window back to their original paths. A PATH is a file or
+// a folder, which restores every file uploaded from below it, e.g. a whole folder dropped
+// by mistake. The flags are those of the uploader, so the sources and their credentials are
+// the same. Restored files are recorded in the ledger so they aren't uploaded again.
+func runUndo(paths []string) error {
+	if len(paths) == 0 {
+		return errors.New("usage: undo [flags] PATH... (files or folders to restore)")
+	}
+	// A running uploader would upload and delete the restored files right away
+	if conn, err := net.Dial("unix", appState.file(stateControlSocket)); err == nil {
+		conn.Close()
+		return errors.New("an uploader is running with this state directory; stop it first (gcs-folder-uploader stop)")
+	}
+	for i, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		paths[i] = abs
+	}
+
+	records, err := undoableRecords(paths, time.Now().Add(-cfg.UndoWindow))
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no files uploaded and removed from %v in the last %s (--undo-window)", paths, cfg.UndoWindow)
+	}
+	var restored, failed int
+	for _, rec := range records {
+		logger := slog.With("file", rec.File, "bucket", rec.Bucket, "object", rec.Object)
+		if _, err := os.Lstat(rec.File); err == nil {
+			logger.Info("File is already back in place, skipping")
+			continue
+		}
+		if rec.Event == auditDuplicate {
+			logger.Error("File can't be restored: --dedupe=skip uploaded nothing under its name")
+			failed++
+			continue
+		}
+		if err := restoreFile(context.Background(), rec); err != nil {
+			logger.Error("Error restoring file", "error", err)
+			failed++
+			continue
+		}
+		logger.Info("Restored file", "uploaded", rec.Time.Local().Format(time.RFC3339))
+		restored++
+	}
+	slog.Info("Undo finished", "restored", restored, "failed", failed)
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be restored", failed)
+	}
+	return nil
+}
+
+// undoableRecords returns the latest audit record since the given time of each file at or
+// below paths whose local copy was deleted or moved, sorted by file.
+func undoableRecords(paths []string, since time.Time) ([]auditRecord, error) {
+	f, err := os.Open(appState.file(stateAuditFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	latest := make(map[string]auditRecord)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("reading audit history: %v", err)
+		}
+		if rec.Time.Before(since) {
+			continue
+		}
+		for _, p := range paths {
+			if pathWithin(rec.File, p) {
+				latest[rec.File] = rec
+				break
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading audit history: %v", err)
+	}
+	var records []auditRecord
+	for _, rec := range latest {
+		// A quarantined file never made it to GCS, the object under its name is another one
+		if rec.Local != onSuccessKeep && rec.Event != auditQuarantined && rec.Event != auditSkipped && rec.Event != auditGaveUp {
+			records = append(records, rec)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].File < records[j].File })
+	return records, nil
+}
+
+// restoreFile downloads the object of rec to a temporary file next to rec.File and renames
+// it into place, then records it in the ledger.
+func restoreFile(ctx context.Context, rec auditRecord) (err error) {
+	profile := ""
+	if src := sourceOf(sources, rec.File); src != nil {
+		profile = src.Credentials
+	}
+	client, err := clients.get(profile)
+	if err != nil {
+		return fmt.Errorf("creating Google Cloud Storage client: %w", err)
+	}
+	defer func() { clients.report(client, err) }()
+
+	// The generation that was uploaded, not whatever replaced it since
+	obj := client.Bucket(rec.Bucket).Object(rec.Object)
+	if rec.Generation != 0 {
+		obj = obj.Generation(rec.Generation)
+	}
+	r, err := encrypted(obj).NewReader(ctx)
+	if rec.Generation != 0 && errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("gs://%s/%s#%d, the uploaded generation, no longer exists: the object was replaced or deleted and the bucket keeps no noncurrent versions", rec.Bucket, rec.Object, rec.Generation)
+	}
+	if err != nil {
+		return fmt.Errorf("reading gs://%s/%s: %w", rec.Bucket, rec.Object, err)
+	}
+	defer r.Close()
+	if err := os.MkdirAll(filepath.Dir(rec.File), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(rec.File), "."+filepath.Base(rec.File)+".undo-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once the rename succeeded
+	var data io.Reader = r
+	if rec.Event == auditBundled {
+		src := sourceOf(sources, rec.File)
+		if src == nil {
+			tmp.Close()
+			return fmt.Errorf("%s is in none of the source folders, so its path in the bundle is unknown", rec.File)
+		}
+		if data, err = bundleEntry(r, rec.Object, src.relativePath(rec.File)); err != nil {
+			tmp.Close()
+			return fmt.Errorf("extracting from gs://%s/%s: %w", rec.Bucket, rec.Object, err)
+		}
+	} else if strings.HasSuffix(rec.Object, ".gz") && !strings.HasSuffix(rec.File, ".gz") {
+		// Compressed by --gzip-objects; Content-Encoding: gzip objects arrive decompressed
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("decompressing gs://%s/%s: %w", rec.Bucket, rec.Object, err)
+		}
+		data = zr
+	}
+	if _, err := io.Copy(tmp, data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("downloading gs://%s/%s: %w", rec.Bucket, rec.Object, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), rec.File); err != nil {
+		return err
+	}
+	info, err := os.Stat(rec.File)
+	if err != nil {
+		return err
+	}
+	return ledger.recordRestored(rec.File, info, uploadTarget{Bucket: rec.Bucket, Object: rec.Object})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"cloud.google.com/go/storage"
+)
+
+// errChecksumMismatch marks an upload whose object in GCS doesn't match the local file.
+// The corrupt object is removed before the error is returned, so the upload can be retried.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksums computes the CRC32C and MD5 of the data written to it, as GCS does for an object,
+// and the --digest digests.
+type checksums struct {
+	crc32c  hash.Hash32
+	md5     hash.Hash
+	digests map[string]hash.Hash // By --digest name
+	size    int64                // Bytes written
+}
+
+func newChecksums() *checksums {
+	c := &checksums{crc32c: crc32.New(crc32cTable), md5: md5.New()}
+	for _, name := range cfg.Digests {
+		if c.digests == nil {
+			c.digests = make(map[string]hash.Hash)
+		}
+		c.digests[name] = digestAlgorithms[name]()
+	}
+	return c
+}
+
+func (c *checksums) Write(p []byte) (int, error) {
+	c.crc32c.Write(p)
+	c.md5.Write(p)
+	for _, h := range c.digests {
+		h.Write(p)
+	}
+	c.size += int64(len(p))
+	return len(p), nil
+}
+
+// verify compares the checksums with the ones GCS reports for an object. MD5 is only
+// compared when GCS has one; composite objects carry just a CRC32C.
+func (c *checksums) verify(attrs *storage.ObjectAttrs) error {
+	if local := c.crc32c.Sum32(); attrs.CRC32C != local {
+		return fmt.Errorf("%w: CRC32C is %08x in GCS but %08x locally", errChecksumMismatch, attrs.CRC32C, local)
+	}
+	if local := c.md5.Sum(nil); len(attrs.MD5) > 0 && !bytes.Equal(attrs.MD5, local) {
+		return fmt.Errorf("%w: MD5 is %x in GCS but %x locally", errChecksumMismatch, attrs.MD5, local)
+	}
+	return nil
+}
+
+// fileChecksums reads f from the start and returns its checksums.
+func fileChecksums(f *os.File) (*checksums, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r, done := fileReader(f)
+	defer done()
+	sums := newChecksums()
+	if _, err := io.Copy(sums, r); err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
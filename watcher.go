@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// forEachFile calls fn for every regular file in root, descending into subdirectories when --recursive is set.
+func forEachFile(root string, fn func(filePath string)) error {
+	if !cfg.Recursive {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				fn(filepath.Join(root, entry.Name()))
+			}
+		}
+		return nil
+	}
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Keep walking the rest of the tree if a single entry can't be read
+			slog.Error("Error accessing path during scan", "path", p, "error", err)
+			if d != nil && d.IsDir() && p != root {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			fn(p)
+		} else if p != root && refusedAsRoot(p) {
+			slog.Error("Skipping folder other users can write to while running as root; use --run-as USER or --allow-root", "path", p)
+			return fs.SkipDir
+		}
+		return nil
+	})
+}
+
+// watchTree adds root to the watcher and, when --recursive is set, every directory below it.
+// A directory on a network file system has src polled as well (see pollIfNetworked).
+func watchTree(src *watchSource, watcher *fsnotify.Watcher, root string) error {
+	if !cfg.Recursive {
+		if err := watcher.Add(root); err != nil {
+			return err
+		}
+		pollIfNetworked(src, root)
+		return nil
+	}
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			slog.Error("Error accessing path while adding watches", "path", p, "error", err)
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if refusedAsRoot(p) {
+			if p == root {
+				return fmt.Errorf("refusing to watch '%s' as root: other users can write to it. Use --run-as USER or --allow-root", p)
+			}
+			slog.Error("Not watching folder other users can write to while running as root; use --run-as USER or --allow-root", "path", p)
+			return fs.SkipDir
+		}
+		if err := watcher.Add(p); err != nil {
+			if p == root {
+				return err
+			}
+			slog.Error("Error adding folder to watcher", "path", p, "error", err)
+			return nil
+		}
+		if p != root {
+			slog.Debug("Watching subdirectory", "path", p)
+		}
+		pollIfNetworked(src, p)
+		return nil
+	})
+}
+
+// pollIfNetworked starts polling src if dir is on a network file system (NFS, SMB), where
+// changes made by other hosts raise no file system events. It does nothing if src is
+// polled already.
+func pollIfNetworked(src *watchSource, dir string) {
+	if isPolled(src) {
+		return
+	}
+	if fsType, ok := networkFileSystem(dir); ok {
+		slog.Info("Folder is on a network file system, which misses the changes of other hosts; polling the source as well", "path", dir, "file_system", fsType)
+		startPolling(src, pollIntervalOrDefault())
+	}
+}
+
+// handleNewDirectory starts watching a directory created under the source folder in recursive mode
+// and queues any files that landed in it before the watch was in place.
+func handleNewDirectory(src *watchSource, watcher *fsnotify.Watcher, dir string) {
+	if err := watchTree(src, watcher, dir); err != nil {
+		slog.Error("Error watching new directory", "path", dir, "error", err)
+		return
+	}
+	err := forEachFile(dir, func(filePath string) {
+		if reason := src.skipReason(filePath); reason != "" {
+			slog.Debug("Skipping file in new directory", "file", filePath, "reason", reason)
+			return
+		}
+		go processFileWrapper(src, filePath)
+	})
+	if err != nil {
+		slog.Error("Error scanning new directory", "path", dir, "error", err)
+	}
+}
+
+// listExisting returns the files already present in src at startup, adding them to backlog.
+func listExisting(src *watchSource, backlog *backlogSummary) []string {
+	slog.Info("Performing initial scan of source folder for existing files", "path", src.Path)
+	var files []string
+	err := forEachFile(src.Path, func(filePath string) {
+		if reason := src.skipReason(filePath); reason != "" {
+			slog.Debug("Skipping file during initial scan", "file", filePath, "reason", reason)
+			return
+		}
+		slog.Debug("Found existing file during initial scan", "file", filePath)
+		files = append(files, filePath)
+		if info, err := os.Stat(filePath); err == nil {
+			backlog.add(info.Size())
+		}
+	})
+	if err != nil {
+		slog.Error("Error during initial scan", "path", src.Path, "error", err)
+	}
+	return files
+}
+
+// queueExisting queues the files listExisting found in src.
+func queueExisting(src *watchSource, files []string) {
+	for _, filePath := range files {
+		// Queue existing files directly without debouncing, as they should be stable
+		// Note: These files will bypass the debouncer. If they are actively being written
+		// when the app starts, they might be uploaded prematurely.
+		submitFile(src, filePath)
+	}
+	slog.Info("Initial scan complete", "path", src.Path, "files", len(files))
+}
+
+// startWatcher creates the fsnotify watcher pipeline for src and handles its events in a goroutine.
+func startWatcher(src *watchSource) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	// Add the source folder (and its subdirectories in recursive mode) to the watcher
+	if err := watchTree(src, watcher, src.Path); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	slog.Info("Monitoring folder for file system events", "path", src.Path, "destination", src.destination())
+
+	health.setWatching(src, true)
+	go func() {
+		defer health.setWatching(src, false)
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				slog.Debug("Raw fsnotify event", "op", event.Op.String(), "path", event.Name)
+				// We care about creation, writes, and chmod (often indicates end of write)
+				// RENAME/REMOVE for tracking if file disappears before processing
+				if cfg.Recursive && event.Op&fsnotify.Create != 0 {
+					if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+						slog.Debug("Detected new directory", "path", event.Name)
+						go handleNewDirectory(src, watcher, event.Name)
+						continue
+					}
+				}
+				if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Chmod) != 0 {
+					if reason := src.skipReason(event.Name); reason != "" {
+						slog.Debug("Ignoring event", "file", event.Name, "reason", reason)
+						continue
+					}
+					slog.Debug("Detected event", "op", event.Op.String(), "file", event.Name)
+					// Use the wrapper to debounce and process the file
+					go processFileWrapper(src, event.Name)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("Watcher error", "path", src.Path, "error", err)
+				health.watchError(src, err)
+				if isWatchUnsupported(err) {
+					startPolling(src, pollIntervalOrDefault())
+				}
+			}
+		}
+	}()
+	return watcher, nil
+}
+
+// waitForMaterialization waits until a cloud placeholder (e.g. a Google Drive for desktop
+// file still being downloaded) has its content on disk, polling every interval up to timeout.
+func waitForMaterialization(filePath string, timeout, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	logged := false
+	for {
+		dataless, err := isDataless(filePath)
+		if err != nil {
+			return fmt.Errorf("could not check placeholder status: %v", err)
+		}
+		if !dataless {
+			if logged {
+				slog.Info("Placeholder is now materialized locally", "file", filePath)
+			}
+			return nil
+		}
+		if !logged {
+			slog.Info("File is a cloud placeholder (dataless); waiting for its content to be downloaded", "file", filePath)
+			logged = true
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("file was still a cloud placeholder after %s", timeout)
+		}
+		time.Sleep(interval)
+	}
+}
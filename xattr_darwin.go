@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattr returns the value of the extended attribute name on filePath, or nil if it is not set.
+func readXattr(filePath, name string) ([]byte, error) {
+	size, err := unix.Getxattr(filePath, name, nil)
+	if errors.Is(err, unix.ENOATTR) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	n, err := unix.Getxattr(filePath, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}